@@ -0,0 +1,170 @@
+package distclient
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/pkg/retrier"
+	"code.cloudfoundry.org/lager"
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// maxBlobResumes is how many times in a row a blob download is resumed
+// without any data being read, or a resume is attempted, before giving up.
+const maxBlobResumes = 5
+
+// resumeBackoff is the delay between attempts to resume, so that they span a
+// brief outage rather than all failing at once.
+var resumeBackoff = retrier.Backoff{
+	InitialDelay: 200 * time.Millisecond,
+	MaxDelay:     5 * time.Second,
+	Jitter:       0.5,
+	MaxWait:      time.Minute,
+}
+
+// resumableBlobReader reads a blob, and if the connection drops part way
+// through carries on from where it left off with a Range request, as long as
+// the registry advertised that it accepts them. The bytes read are exactly
+// those of the blob whatever the number of resumes, so the digest of the
+// whole stream can be verified by the consumer as usual.
+type resumableBlobReader struct {
+	ctx    context.Context
+	logger lager.Logger
+	client *http.Client
+	url    string
+	digest digest.Digest
+
+	body      io.ReadCloser
+	offset    int64
+	resumable bool
+	failures  int
+}
+
+func (r *conn) GetBlobReader(ctx context.Context, logger lager.Logger, d digest.Digest) (io.Reader, error) {
+	blob := &resumableBlobReader{
+		ctx:    ctx,
+		logger: logger.Session("blob-reader", lager.Data{"digest": d}),
+		client: r.httpClient,
+		url:    fmt.Sprintf("%s/v2/%s/blobs/%s", r.endpoint, r.repo, d),
+		digest: d,
+	}
+
+	if err := blob.open(); err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+func (b *resumableBlobReader) Read(p []byte) (int, error) {
+	for {
+		if b.body == nil {
+			if err := b.resume(); err != nil {
+				b.logger.Error("giving-up", err, lager.Data{"offset": b.offset})
+				return 0, err
+			}
+		}
+
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if n > 0 {
+			b.failures = 0
+		}
+
+		if err == nil || err == io.EOF || !b.resumable {
+			return n, err
+		}
+
+		b.body.Close()
+		b.body = nil
+
+		b.failures++
+		if b.failures > maxBlobResumes {
+			b.logger.Error("giving-up", err, lager.Data{"offset": b.offset})
+			return n, err
+		}
+
+		b.logger.Info("resuming", lager.Data{"offset": b.offset, "error": err.Error()})
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume reopens the blob from the offset read so far, backing off between
+// attempts and failing fast on errors which will certainly happen again.
+func (b *resumableBlobReader) resume() error {
+	if b.ctx.Err() != nil {
+		return b.ctx.Err()
+	}
+
+	return resumeBackoff.Retry(b.ctx, maxBlobResumes, classifyResume, func(attempt int) error {
+		return b.open()
+	})
+}
+
+// classifyResume retries failures to resume other than those which will
+// certainly happen again, waiting as long as a throttling registry asks.
+func classifyResume(err error) (bool, time.Duration) {
+	if Classify(err) == Permanent {
+		return false, 0
+	}
+
+	return true, RetryAfter(err)
+}
+
+func (b *resumableBlobReader) Close() error {
+	if b.body == nil {
+		return nil
+	}
+
+	return b.body.Close()
+}
+
+func (b *resumableBlobReader) open() error {
+	req, err := http.NewRequest("GET", b.url, nil)
+	if err != nil {
+		return err
+	}
+
+	if b.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	}
+	req.Cancel = b.ctx.Done()
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && b.offset > 0:
+		// a proxy which ignores or misaligns the range would corrupt the blob
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != b.offset {
+			resp.Body.Close()
+			return fmt.Errorf("distclient: resumed blob %s at %q rather than at %d", b.digest, resp.Header.Get("Content-Range"), b.offset)
+		}
+	case resp.StatusCode == http.StatusOK:
+		if b.offset == 0 {
+			b.resumable = resp.Header.Get("Accept-Ranges") == "bytes"
+			break
+		}
+
+		// the range was ignored, so skip what has already been read
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, b.offset); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return newStatusError(resp, "blob "+b.digest.String())
+	}
+
+	b.body = resp.Body
+	return nil
+}
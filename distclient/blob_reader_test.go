@@ -0,0 +1,166 @@
+package distclient_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/docker/distribution/digest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Reading blobs", func() {
+	var (
+		logger   *lagertest.TestLogger
+		registry *fakeRegistry
+		conn     distclient.Conn
+		blob     []byte
+		d        digest.Digest
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		registry = newFakeRegistry()
+
+		blob = []byte("a-blob-which-is-long-enough-to-be-cut-in-to-several-pieces")
+		d = registry.AddBlob(blob)
+
+		var err error
+		conn, err = distclient.NewDialer([]string{registry.Host()}).Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	rangeRequests := func() (ranges []string) {
+		for _, req := range registry.Requests() {
+			if r := req.Header.Get("Range"); r != "" {
+				ranges = append(ranges, r)
+			}
+		}
+
+		return ranges
+	}
+
+	Context("when the connection drops part way through", func() {
+		BeforeEach(func() {
+			registry.CutBlobsAfter(10)
+		})
+
+		It("resumes from where it left off until the whole blob is read", func() {
+			r, err := conn.GetBlobReader(context.Background(), logger, d)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.ReadAll(r)).To(Equal(blob))
+			Expect(rangeRequests()).To(ContainElement("bytes=10-"))
+			Expect(rangeRequests()).To(ContainElement("bytes=20-"))
+		})
+
+		It("reads exactly the bytes of the blob, so its digest still matches", func() {
+			r, err := conn.GetBlobReader(context.Background(), logger, d)
+			Expect(err).NotTo(HaveOccurred())
+
+			verifier, err := digest.NewDigestVerifier(d)
+			Expect(err).NotTo(HaveOccurred())
+
+			b, err := ioutil.ReadAll(r)
+			Expect(err).NotTo(HaveOccurred())
+			verifier.Write(b)
+			Expect(verifier.Verified()).To(BeTrue())
+		})
+
+		Context("and the registry is briefly unavailable", func() {
+			BeforeEach(func() {
+				registry.FailResumesFor(http.StatusServiceUnavailable, 200*time.Millisecond)
+			})
+
+			It("backs off between resumes until it is back", func() {
+				r, err := conn.GetBlobReader(context.Background(), logger, d)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.ReadAll(r)).To(Equal(blob))
+			})
+		})
+
+		Context("and resuming fails in a way which will not change", func() {
+			BeforeEach(func() {
+				registry.FailResumesFor(http.StatusNotFound, time.Minute)
+			})
+
+			It("gives up without trying again", func() {
+				r, err := conn.GetBlobReader(context.Background(), logger, d)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = ioutil.ReadAll(r)
+				Expect(err).To(HaveOccurred())
+				Expect(rangeRequests()).To(HaveLen(1))
+			})
+		})
+
+		Context("and the registry answers from the wrong offset", func() {
+			BeforeEach(func() {
+				registry.MisalignRanges()
+			})
+
+			It("returns an error rather than corrupting the blob", func() {
+				r, err := conn.GetBlobReader(context.Background(), logger, d)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = ioutil.ReadAll(r)
+				Expect(err).To(MatchError(ContainSubstring("rather than at 10")))
+			})
+		})
+
+		Context("and the context has been cancelled", func() {
+			It("does not resume", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+
+				r, err := conn.GetBlobReader(ctx, logger, d)
+				Expect(err).NotTo(HaveOccurred())
+				cancel()
+
+				_, err = ioutil.ReadAll(r)
+				Expect(err).To(HaveOccurred())
+				Expect(rangeRequests()).To(BeEmpty())
+			})
+		})
+
+		Context("and the registry does not accept range requests", func() {
+			BeforeEach(func() {
+				registry.DisableRanges()
+			})
+
+			It("returns an error", func() {
+				r, err := conn.GetBlobReader(context.Background(), logger, d)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = ioutil.ReadAll(r)
+				Expect(err).To(HaveOccurred())
+				Expect(rangeRequests()).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when dialing with a cancelled context", func() {
+		It("returns an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := distclient.NewDialer([]string{registry.Host()}).Dial(ctx, logger, registry.Host(), "some/repo", distclient.Credentials{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the blob does not exist", func() {
+		It("returns an error", func() {
+			_, err := conn.GetBlobReader(context.Background(), logger, sha256Digest([]byte("missing")))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,81 @@
+package distclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultCertsDir is where docker looks for per-registry certificates.
+const DefaultCertsDir = "/etc/docker/certs.d"
+
+// registryTLSConfig builds the TLS configuration for host from the
+// <certsDir>/<host> directory, laid out the same way as docker's certs.d:
+//
+//	*.crt           CA certificates trusted in addition to the system roots
+//	<name>.cert     a client certificate, presented along with <name>.key
+//
+// If there is no directory for the host the default configuration is
+// returned.
+func registryTLSConfig(certsDir, host string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if certsDir == "" {
+		return config, nil
+	}
+
+	hostDir := filepath.Join(certsDir, host)
+	entries, err := ioutil.ReadDir(hostDir)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("distclient: read certs dir %s: %s", hostDir, err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(hostDir, entry.Name())
+
+		switch filepath.Ext(entry.Name()) {
+		case ".crt":
+			if config.RootCAs == nil {
+				config.RootCAs = systemCertPool()
+			}
+
+			pem, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("distclient: read CA certificate %s: %s", path, err)
+			}
+
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("distclient: no certificates found in %s", path)
+			}
+		case ".cert":
+			keyPath := strings.TrimSuffix(path, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(path, keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("distclient: load client certificate %s: %s", path, err)
+			}
+
+			config.Certificates = append(config.Certificates, cert)
+		case ".key":
+			certPath := strings.TrimSuffix(path, ".key") + ".cert"
+			if _, err := os.Stat(certPath); err != nil {
+				return nil, fmt.Errorf("distclient: client key %s has no matching certificate %s", path, certPath)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+func systemCertPool() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return x509.NewCertPool()
+	}
+
+	return pool
+}
@@ -0,0 +1,142 @@
+package distclient_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Registry certificates", func() {
+	var (
+		logger    *lagertest.TestLogger
+		registry  *fakeRegistry
+		tlsConfig *tls.Config
+		certsDir  string
+		hostDir   string
+	)
+
+	dial := func() error {
+		dialer := distclient.NewDialer(nil)
+		dialer.CertsDir = certsDir
+
+		_, err := dialer.Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+		return err
+	}
+
+	writeFile := func(name string, contents []byte) {
+		Expect(ioutil.WriteFile(filepath.Join(hostDir, name), contents, 0600)).To(Succeed())
+	}
+
+	trustRegistry := func() {
+		writeFile("ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw}))
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		tlsConfig = &tls.Config{}
+
+		var err error
+		certsDir, err = ioutil.TempDir("", "certs.d")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		registry = newFakeTLSRegistry(tlsConfig)
+
+		hostDir = filepath.Join(certsDir, registry.Host())
+		Expect(os.MkdirAll(hostDir, 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		registry.Close()
+		Expect(os.RemoveAll(certsDir)).To(Succeed())
+	})
+
+	It("does not trust a registry signed by an unknown CA", func() {
+		Expect(dial()).To(HaveOccurred())
+	})
+
+	It("trusts the CA certificates in the registry's certs directory", func() {
+		trustRegistry()
+		Expect(dial()).To(Succeed())
+	})
+
+	Context("when the registry requires a client certificate", func() {
+		var certPEM, keyPEM []byte
+
+		BeforeEach(func() {
+			var clientCert *x509.Certificate
+			clientCert, certPEM, keyPEM = generateClientCert()
+
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(clientCert)
+
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConfig.ClientCAs = clientCAs
+		})
+
+		JustBeforeEach(func() {
+			trustRegistry()
+		})
+
+		It("fails without one", func() {
+			Expect(dial()).To(HaveOccurred())
+		})
+
+		It("presents the client certificate and key from the registry's certs directory", func() {
+			writeFile("client.cert", certPEM)
+			writeFile("client.key", keyPEM)
+
+			Expect(dial()).To(Succeed())
+		})
+
+		Context("when a key has no matching certificate", func() {
+			It("returns an error", func() {
+				writeFile("client.key", keyPEM)
+
+				err := dial()
+				Expect(err).To(MatchError(ContainSubstring("no matching certificate")))
+			})
+		})
+	})
+})
+
+func generateClientCert() (*x509.Certificate, []byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "garden-shed-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return cert, certPEM, keyPEM
+}
@@ -1,13 +1,14 @@
 package distclient
 
 import (
-	"crypto/tls"
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
-	"net"
+	"io/ioutil"
 	"net/http"
-	"net/url"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/docker/docker/image"
 
@@ -16,19 +17,22 @@ import (
 	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest"
 	"github.com/docker/distribution/registry/client"
-	"github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/distribution/registry/client/transport"
 	"golang.org/x/net/context"
 )
 
 //go:generate counterfeiter -o fake_distclient/fake_conn.go . Conn
 type Conn interface {
-	GetManifest(logger lager.Logger, tag string) (*Manifest, error)
-	GetBlobReader(logger lager.Logger, d digest.Digest) (io.Reader, error)
+	GetManifest(ctx context.Context, logger lager.Logger, ref string, platform Platform) (*Manifest, error)
+	GetBlobReader(ctx context.Context, logger lager.Logger, d digest.Digest) (io.Reader, error)
+	StatBlob(ctx context.Context, logger lager.Logger, d digest.Digest) error
 }
 
 type conn struct {
-	client distribution.Repository
+	client     distribution.Repository
+	httpClient *http.Client
+	endpoint   string
+	repo       string
 }
 
 type Manifest struct {
@@ -40,155 +44,235 @@ type Layer struct {
 	StrongID       digest.Digest
 	ParentStrongID digest.Digest
 	Image          image.Image
+	Healthcheck    *Healthcheck
 }
 
 type dialer struct {
 	InsecureRegistryList InsecureRegistryList
+
+	// CredentialStore is used to find credentials for a host when a dial
+	// does not provide any.
+	CredentialStore CredentialStore
+
+	// CertsDir holds a directory per registry host of CA and client
+	// certificates, see registryTLSConfig.
+	CertsDir string
+
+	mu    sync.Mutex
+	hosts map[string]*hostTransport
+	stats DialStats
 }
 
 func NewDialer(insecureRegistries []string) *dialer {
-	return &dialer{InsecureRegistryList(insecureRegistries)}
+	return &dialer{
+		InsecureRegistryList: InsecureRegistryList(insecureRegistries),
+		CredentialStore:      NewDockerConfigStore(DefaultDockerConfigPath()),
+		CertsDir:             DefaultCertsDir,
+	}
 }
 
-func (d dialer) Dial(logger lager.Logger, host, repo string) (Conn, error) {
-	host, transport, err := newTransport(logger, d.InsecureRegistryList, host, repo)
+func (d *dialer) Dial(ctx context.Context, logger lager.Logger, host, repo string, creds Credentials) (Conn, error) {
+	if creds.Empty() && d.CredentialStore != nil {
+		var err error
+		if creds, err = d.CredentialStore.Credentials(ctx, logger, host); err != nil {
+			// carry on anonymously, public images are still pullable
+			logger.Error("failed-to-look-up-credentials", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	ht, err := d.hostTransport(logger, host)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, pingCached, err := ht.ping(ctx, logger, host, d.InsecureRegistryList.AllowInsecure(host))
 	if err != nil {
 		logger.Error("failed-to-construct-transport", err)
 		return nil, err
 	}
 
-	repoClient, err := client.NewRepository(context.TODO(), repo, host, transport)
+	authorizer, authReused := ht.authorizer(repo, creds)
+	d.record(func(stats *DialStats) {
+		if pingCached {
+			stats.PingsCached++
+		} else {
+			stats.Pings++
+		}
+
+		if authReused {
+			stats.AuthorizersReused++
+		}
+	})
+
+	rt := transport.NewTransport(ht.base, authorizer)
+	repoClient, err := client.NewRepository(ctx, repo, endpoint, rt)
 	if err != nil {
 		logger.Error("failed-to-construct-repository", err)
 		return nil, err
 	}
 
-	return &conn{client: repoClient}, nil
+	return &conn{
+		client:     repoClient,
+		httpClient: &http.Client{Transport: rt},
+		endpoint:   endpoint,
+		repo:       repo,
+	}, nil
 }
 
-func (r *conn) GetManifest(logger lager.Logger, tag string) (*Manifest, error) {
-	manifestService, err := r.client.Manifests(context.TODO())
+// GetManifest fetches the manifest for ref, which is either a tag or a
+// manifest digest. Manifests fetched by digest are verified against it.
+func (r *conn) GetManifest(ctx context.Context, logger lager.Logger, ref string, platform Platform) (*Manifest, error) {
+	body, mediaType, err := r.fetchManifest(ctx, logger, ref)
 	if err != nil {
-		logger.Error("failed-to-construct-manifest-service", err)
+		logger.Error("failed-to-get-by-ref", err)
 		return nil, err
 	}
 
-	layer, err := manifestService.GetByTag(tag)
-	if err != nil {
-		logger.Error("failed-to-get-by-tag", err)
-		return nil, err
+	if d, err := digest.ParseDigest(ref); err == nil {
+		if _, err := readVerified(bytes.NewReader(digestedContent(body, mediaType)), d); err != nil {
+			logger.Error("failed-to-verify-manifest", err, lager.Data{"digest": d})
+			return nil, err
+		}
+	}
+
+	if isIndex(mediaType) {
+		if body, mediaType, err = r.fetchPlatformManifest(ctx, logger, body, platform); err != nil {
+			logger.Error("failed-to-get-platform-manifest", err, lager.Data{"platform": platform.String()})
+			return nil, err
+		}
+	}
+
+	var layers []Layer
+	switch mediaType {
+	case MediaTypeManifestV2, MediaTypeOCIManifest:
+		layers, err = r.toSchema2Layers(ctx, logger, body)
+	default:
+		layers, err = schema1Layers(body)
 	}
 
-	layers, err := toLayers(layer.FSLayers, layer.History)
 	if err != nil {
-		logger.Error("failed-to-get-v1-compat-layers", err)
+		logger.Error("failed-to-get-layers", err, lager.Data{"mediaType": mediaType})
 		return nil, err
 	}
 
 	return &Manifest{Layers: layers}, nil
 }
 
-func (r *conn) GetBlobReader(logger lager.Logger, digest digest.Digest) (io.Reader, error) {
-	blobStore := r.client.Blobs(context.TODO())
-	return blobStore.Open(context.TODO(), digest)
-}
+func (r *conn) fetchManifest(ctx context.Context, logger lager.Logger, ref string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v2/%s/manifests/%s", r.endpoint, r.repo, ref), nil)
+	if err != nil {
+		return nil, "", err
+	}
 
-func toLayers(fsl []manifest.FSLayer, history []manifest.History) (r []Layer, err error) {
-	var parent digest.Digest
-	for i := len(fsl) - 1; i >= 0; i-- {
-		var img image.Image
-		err := json.Unmarshal([]byte(history[i].V1Compatibility), &img)
-		if err != nil {
-			return nil, err
-		}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	req.Cancel = ctx.Done()
 
-		config, err := image.MakeImageConfig([]byte(history[i].V1Compatibility), fsl[i].BlobSum, parent)
-		id, err := image.StrongID(config)
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
 
-		r = append(r, Layer{
-			BlobSum:        fsl[i].BlobSum,
-			Image:          img,
-			StrongID:       id,
-			ParentStrongID: parent,
-		})
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", newStatusError(resp, "manifest "+ref)
+	}
 
-		parent = id
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return
+	mediaType := manifestMediaType(resp.Header.Get("Content-Type"), body)
+	logger.Debug("got-manifest", lager.Data{"mediaType": mediaType})
+
+	return body, mediaType, nil
 }
 
-func newTransport(logger lager.Logger, insecureRegistries InsecureRegistryList, host, repo string) (string, http.RoundTripper, error) {
-	scheme := "https://"
-	baseTransport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).Dial,
-		DisableKeepAlives: true,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: insecureRegistries.AllowInsecure(host),
-		},
+func (r *conn) fetchPlatformManifest(ctx context.Context, logger lager.Logger, index []byte, platform Platform) ([]byte, string, error) {
+	desc, err := selectManifest(index, platform)
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, mediaType, err := r.fetchManifest(ctx, logger, desc.Digest.String())
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := readVerified(bytes.NewReader(body), desc.Digest); err != nil {
+		return nil, "", err
 	}
 
-	authTransport := transport.NewTransport(baseTransport)
+	if isIndex(mediaType) {
+		return nil, "", fmt.Errorf("manifest %s for platform %s is itself an index", desc.Digest, platform)
+	}
+
+	return body, mediaType, nil
+}
 
-	pingClient := &http.Client{
-		Transport: authTransport,
-		Timeout:   15 * time.Second,
+func (r *conn) toSchema2Layers(ctx context.Context, logger lager.Logger, body []byte) ([]Layer, error) {
+	var m schema2Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequest("GET", scheme+host+"/v2", nil)
+	config, err := r.getConfig(ctx, logger, m.Config.Digest)
 	if err != nil {
-		logger.Error("failed-to-create-ping-request", err)
-		return "", nil, err
+		return nil, err
 	}
 
-	challengeManager := auth.NewSimpleChallengeManager()
+	return schema2Layers(m, config)
+}
 
-	resp, err := pingClient.Do(req)
+func (r *conn) getConfig(ctx context.Context, logger lager.Logger, d digest.Digest) ([]byte, error) {
+	blob, err := r.client.Blobs(ctx).Open(ctx, d)
 	if err != nil {
-		logger.Error("failed-to-ping-registry", err)
+		logger.Error("failed-to-open-config", err, lager.Data{"digest": d})
+		return nil, err
+	}
+	defer blob.Close()
 
-		if !insecureRegistries.AllowInsecure(host) {
-			return "", nil, err
-		}
+	return readVerified(blob, d)
+}
 
-		scheme = "http://"
-		req, err = http.NewRequest("GET", scheme+host+"/v2", nil)
-		if err != nil {
-			logger.Error("failed-to-create-http-ping-request", err)
-			return "", nil, err
-		}
+// StatBlob checks the blob exists in the repository, and that the connection
+// is authorized to read it.
+func (r *conn) StatBlob(ctx context.Context, logger lager.Logger, digest digest.Digest) error {
+	_, err := r.client.Blobs(ctx).Stat(ctx, digest)
+	return err
+}
 
-		resp, err = pingClient.Do(req)
+func toLayers(fsl []manifest.FSLayer, history []manifest.History) (r []Layer, err error) {
+	var parent digest.Digest
+	for i := len(fsl) - 1; i >= 0; i-- {
+		var img image.Image
+		err := json.Unmarshal([]byte(history[i].V1Compatibility), &img)
 		if err != nil {
-			return "", nil, err
+			return nil, err
 		}
-	} else {
-		defer resp.Body.Close()
 
-		if err := challengeManager.AddResponse(resp); err != nil {
-			logger.Error("failed-to-add-response-to-challenge-manager", err)
-			return "", nil, err
+		healthcheck, err := parseHealthcheck([]byte(history[i].V1Compatibility))
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	credentialStore := dumbCredentialStore{"", ""}
-	tokenHandler := auth.NewTokenHandler(authTransport, credentialStore, repo, "pull")
-	basicHandler := auth.NewBasicHandler(credentialStore)
-	authorizer := auth.NewAuthorizer(challengeManager, tokenHandler, basicHandler)
+		config, err := image.MakeImageConfig([]byte(history[i].V1Compatibility), fsl[i].BlobSum, parent)
+		id, err := image.StrongID(config)
 
-	return scheme + host, transport.NewTransport(baseTransport, authorizer), nil
-}
+		r = append(r, Layer{
+			BlobSum:        fsl[i].BlobSum,
+			Image:          img,
+			Healthcheck:    healthcheck,
+			StrongID:       id,
+			ParentStrongID: parent,
+		})
 
-type dumbCredentialStore struct {
-	username string
-	password string
-}
+		parent = id
+	}
 
-func (dcs dumbCredentialStore) Basic(*url.URL) (string, string) {
-	return dcs.username, dcs.password
+	return
 }
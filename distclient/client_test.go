@@ -14,6 +14,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
+	"golang.org/x/net/context"
 )
 
 // busybox version to try to pull, should be a tag so it doesn't change
@@ -57,12 +58,12 @@ var _ = Describe("distclient", func() {
 		d := distclient.NewDialer([]string{})
 
 		var err error
-		conn, err = d.Dial(logger, "registry-1.docker.io", "library/busybox")
+		conn, err = d.Dial(context.Background(), logger, "registry-1.docker.io", "library/busybox", distclient.Credentials{})
 		Expect(err).NotTo(HaveOccurred())
 	})
 
 	It("can pull a manifest from dockerhub", func() {
-		layer, err := conn.GetManifest(logger, busyBoxVersion)
+		layer, err := conn.GetManifest(context.Background(), logger, busyBoxVersion, distclient.DefaultPlatform())
 		Expect(err).NotTo(HaveOccurred())
 
 		Expect(layer.Layers[0].BlobSum).To(Equal(busyBoxLayers[0].BlobSum))
@@ -79,7 +80,7 @@ var _ = Describe("distclient", func() {
 	})
 
 	It("returns bottom layer to top layer (reverse of docker api, order they should be applied to the graph)", func() {
-		layer, err := conn.GetManifest(logger, busyBoxVersion)
+		layer, err := conn.GetManifest(context.Background(), logger, busyBoxVersion, distclient.DefaultPlatform())
 		Expect(err).NotTo(HaveOccurred())
 
 		Expect(layer.Layers[0].ParentStrongID).To(BeEquivalentTo(""))
@@ -90,7 +91,7 @@ var _ = Describe("distclient", func() {
 			tmp := tmpDir()
 			defer os.RemoveAll(tmp)
 
-			r, err := conn.GetBlobReader(logger, layer.BlobSum)
+			r, err := conn.GetBlobReader(context.Background(), logger, layer.BlobSum)
 			Expect(err).NotTo(HaveOccurred())
 
 			cmd := exec.Command("tar", "zxf", "-", "-C", tmp)
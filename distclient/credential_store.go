@@ -0,0 +1,224 @@
+package distclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
+)
+
+//go:generate counterfeiter -o fake_distclient/fake_credential_store.go . CredentialStore
+type CredentialStore interface {
+	Credentials(ctx context.Context, logger lager.Logger, host string) (Credentials, error)
+}
+
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+type DockerAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// DockerConfigStore looks up credentials the same way the docker cli does: a
+// per-registry credential helper from credHelpers wins, then the default
+// credsStore helper, then the auths entries of the config file itself.
+type DockerConfigStore struct {
+	// ConfigPath is the path to a docker config.json, it is re-read on every
+	// lookup so that changes take effect without a restart. A missing file
+	// means there are no credentials.
+	ConfigPath string
+
+	// HelperDir, when set, is where docker-credential-* helpers are looked up
+	// instead of $PATH.
+	HelperDir string
+}
+
+// DefaultDockerConfigPath is $DOCKER_CONFIG/config.json, falling back to
+// ~/.docker/config.json.
+func DefaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+func NewDockerConfigStore(configPath string) *DockerConfigStore {
+	return &DockerConfigStore{ConfigPath: configPath}
+}
+
+func (s *DockerConfigStore) Credentials(ctx context.Context, logger lager.Logger, host string) (Credentials, error) {
+	logger = logger.Session("docker-config-credentials", lager.Data{"host": host})
+
+	config, err := s.readConfig()
+	if err != nil {
+		logger.Error("failed-to-read-config", err, lager.Data{"path": s.ConfigPath})
+		return Credentials{}, err
+	}
+
+	host = normalizeRegistryHost(host)
+
+	helper := config.CredsStore
+	for h, name := range config.CredHelpers {
+		if normalizeRegistryHost(h) == host {
+			helper = name
+		}
+	}
+
+	if helper != "" {
+		creds, found, err := s.execHelper(ctx, helper, host)
+		if err != nil {
+			logger.Error("credential-helper-failed", err, lager.Data{"helper": helper})
+			return Credentials{}, err
+		}
+
+		if found {
+			logger.Debug("found-in-credential-helper", lager.Data{"helper": helper})
+			return creds, nil
+		}
+	}
+
+	for h, auth := range config.Auths {
+		if normalizeRegistryHost(h) == host {
+			logger.Debug("found-in-config")
+			return auth.credentials()
+		}
+	}
+
+	return Credentials{}, nil
+}
+
+func (s *DockerConfigStore) readConfig() (DockerConfig, error) {
+	var config DockerConfig
+
+	b, err := ioutil.ReadFile(s.ConfigPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("distclient: parse docker config %s: %s", s.ConfigPath, err)
+	}
+
+	return config, nil
+}
+
+// helperTimeout is how long a credential helper may take, so that one which
+// hangs, for example waiting on a locked keychain, does not hang the fetch.
+const helperTimeout = 30 * time.Second
+
+// helperNotFound is printed by docker-credential-* helpers when they have no
+// credentials for the requested server
+const helperNotFound = "credentials not found in native keychain"
+
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+func (s *DockerConfigStore) execHelper(ctx context.Context, helper, host string) (Credentials, bool, error) {
+	path := "docker-credential-" + helper
+	if s.HelperDir != "" {
+		path = filepath.Join(s.HelperDir, path)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+
+	stdout := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, path, "get")
+	cmd.Stdin = strings.NewReader(helperServerURL(host))
+	cmd.Stdout = stdout
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return Credentials{}, false, fmt.Errorf("distclient: run credential helper %s: %s", helper, ctx.Err())
+		}
+
+		if strings.Contains(stdout.String(), helperNotFound) {
+			return Credentials{}, false, nil
+		}
+
+		return Credentials{}, false, fmt.Errorf("distclient: run credential helper %s: %s", helper, err)
+	}
+
+	var resp helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return Credentials{}, false, fmt.Errorf("distclient: parse output of credential helper %s: %s", helper, err)
+	}
+
+	// helpers return identity tokens with a username of <token>
+	if resp.Username == "<token>" {
+		return Credentials{IdentityToken: resp.Secret}, true, nil
+	}
+
+	return Credentials{Username: resp.Username, Password: resp.Secret}, true, nil
+}
+
+func (a DockerAuth) credentials() (Credentials, error) {
+	creds := Credentials{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+	}
+
+	if a.Auth == "" {
+		return creds, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("distclient: decode auth: %s", err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return Credentials{}, fmt.Errorf("distclient: auth is not of the form username:password")
+	}
+
+	creds.Username, creds.Password = parts[0], parts[1]
+	return creds, nil
+}
+
+// helperServerURL is the server URL the docker cli would ask a credential
+// helper for.
+func helperServerURL(host string) string {
+	if host == "index.docker.io" {
+		return "https://index.docker.io/v1/"
+	}
+
+	return host
+}
+
+// normalizeRegistryHost strips any scheme and path from a config key, and
+// treats all the names of the docker hub as the same host.
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "docker.io":
+		return "index.docker.io"
+	}
+
+	return host
+}
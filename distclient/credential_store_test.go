@@ -0,0 +1,288 @@
+package distclient_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/garden-shed/distclient/fake_distclient"
+	"code.cloudfoundry.org/lager/lagertest"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DockerConfigStore", func() {
+	var (
+		logger    *lagertest.TestLogger
+		configDir string
+		helperDir string
+		store     *distclient.DockerConfigStore
+	)
+
+	writeConfig := func(config distclient.DockerConfig) {
+		Expect(ioutil.WriteFile(filepath.Join(configDir, "config.json"), mustMarshal(config), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		var err error
+		configDir, err = ioutil.TempDir("", "docker-config")
+		Expect(err).NotTo(HaveOccurred())
+
+		helperDir, err = ioutil.TempDir("", "credential-helpers")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Symlink(fakeCredentialHelperBin, filepath.Join(helperDir, "docker-credential-fake"))).To(Succeed())
+
+		os.Setenv("FAKE_CREDENTIAL_HELPER_CREDS", `{
+			"helper-registry.example.com": {"Username": "helper-user", "Secret": "helper-secret"},
+			"token-registry.example.com": {"Username": "<token>", "Secret": "some-identity-token"},
+			"https://index.docker.io/v1/": {"Username": "hub-user", "Secret": "hub-secret"}
+		}`)
+
+		store = distclient.NewDockerConfigStore(filepath.Join(configDir, "config.json"))
+		store.HelperDir = helperDir
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("FAKE_CREDENTIAL_HELPER_CREDS")
+		os.Unsetenv("FAKE_CREDENTIAL_HELPER_FAIL")
+		os.Unsetenv("FAKE_CREDENTIAL_HELPER_SLEEP")
+		Expect(os.RemoveAll(configDir)).To(Succeed())
+		Expect(os.RemoveAll(helperDir)).To(Succeed())
+	})
+
+	Context("when the config file does not exist", func() {
+		It("returns no credentials", func() {
+			creds, err := store.Credentials(context.Background(), logger, "registry.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds.Empty()).To(BeTrue())
+		})
+	})
+
+	Context("when the config file is not valid JSON", func() {
+		It("returns an error", func() {
+			Expect(ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte("{"), 0600)).To(Succeed())
+
+			_, err := store.Credentials(context.Background(), logger, "registry.example.com")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("auths entries", func() {
+		BeforeEach(func() {
+			writeConfig(distclient.DockerConfig{
+				Auths: map[string]distclient.DockerAuth{
+					"registry.example.com":          {Auth: base64.StdEncoding.EncodeToString([]byte("some-user:some:password"))},
+					"https://other.example.com/v2/": {Auth: base64.StdEncoding.EncodeToString([]byte("other-user:other-password"))},
+					"token.example.com":             {IdentityToken: "some-identity-token"},
+					"https://index.docker.io/v1/":   {Auth: base64.StdEncoding.EncodeToString([]byte("hub-user:hub-password"))},
+					"bad.example.com":               {Auth: "not base64!"},
+					"no-colon.example.com":          {Auth: base64.StdEncoding.EncodeToString([]byte("just-a-user"))},
+				},
+			})
+		})
+
+		It("decodes the base64 auth for the host", func() {
+			creds, err := store.Credentials(context.Background(), logger, "registry.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds).To(Equal(distclient.Credentials{Username: "some-user", Password: "some:password"}))
+		})
+
+		It("matches keys which have a scheme and path", func() {
+			creds, err := store.Credentials(context.Background(), logger, "other.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds.Username).To(Equal("other-user"))
+		})
+
+		It("returns identity tokens", func() {
+			creds, err := store.Credentials(context.Background(), logger, "token.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds).To(Equal(distclient.Credentials{IdentityToken: "some-identity-token"}))
+		})
+
+		It("treats registry-1.docker.io as the docker hub index", func() {
+			creds, err := store.Credentials(context.Background(), logger, "registry-1.docker.io")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds.Username).To(Equal("hub-user"))
+		})
+
+		It("returns no credentials for unknown hosts", func() {
+			creds, err := store.Credentials(context.Background(), logger, "unknown.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds.Empty()).To(BeTrue())
+		})
+
+		It("returns an error when the auth is not valid base64", func() {
+			_, err := store.Credentials(context.Background(), logger, "bad.example.com")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the auth is not username:password", func() {
+			_, err := store.Credentials(context.Background(), logger, "no-colon.example.com")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("does not log the credentials", func() {
+			_, err := store.Credentials(context.Background(), logger, "registry.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(logger.Buffer().Contents())).NotTo(ContainSubstring("some:password"))
+		})
+	})
+
+	Describe("credential helpers", func() {
+		Context("when a helper is configured for the host", func() {
+			BeforeEach(func() {
+				writeConfig(distclient.DockerConfig{
+					CredHelpers: map[string]string{"helper-registry.example.com": "fake"},
+				})
+			})
+
+			It("asks the helper", func() {
+				creds, err := store.Credentials(context.Background(), logger, "helper-registry.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(creds).To(Equal(distclient.Credentials{Username: "helper-user", Password: "helper-secret"}))
+			})
+
+			It("does not ask the helper about other hosts", func() {
+				os.Setenv("FAKE_CREDENTIAL_HELPER_FAIL", "true")
+
+				creds, err := store.Credentials(context.Background(), logger, "registry.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(creds.Empty()).To(BeTrue())
+			})
+
+			Context("when the helper hangs", func() {
+				BeforeEach(func() {
+					os.Setenv("FAKE_CREDENTIAL_HELPER_SLEEP", "1m")
+				})
+
+				It("gives up when the context is done", func() {
+					ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+					defer cancel()
+
+					start := time.Now()
+					_, err := store.Credentials(ctx, logger, "helper-registry.example.com")
+					Expect(err).To(MatchError(ContainSubstring("deadline exceeded")))
+					Expect(time.Since(start)).To(BeNumerically("<", 30*time.Second))
+				})
+			})
+
+			Context("when the helper fails", func() {
+				It("returns an error", func() {
+					os.Setenv("FAKE_CREDENTIAL_HELPER_FAIL", "true")
+
+					_, err := store.Credentials(context.Background(), logger, "helper-registry.example.com")
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Context("when a default credsStore is configured", func() {
+			BeforeEach(func() {
+				writeConfig(distclient.DockerConfig{
+					CredsStore: "fake",
+					Auths: map[string]distclient.DockerAuth{
+						"fallback.example.com": {Username: "fallback-user", Password: "fallback-password"},
+					},
+				})
+			})
+
+			It("asks the helper for any host", func() {
+				creds, err := store.Credentials(context.Background(), logger, "helper-registry.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(creds.Username).To(Equal("helper-user"))
+			})
+
+			It("asks the helper for the docker hub using the index server URL", func() {
+				creds, err := store.Credentials(context.Background(), logger, "registry-1.docker.io")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(creds.Username).To(Equal("hub-user"))
+			})
+
+			It("converts <token> usernames in to identity tokens", func() {
+				creds, err := store.Credentials(context.Background(), logger, "token-registry.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(creds).To(Equal(distclient.Credentials{IdentityToken: "some-identity-token"}))
+			})
+
+			It("falls back to the auths entries when the helper has no credentials", func() {
+				creds, err := store.Credentials(context.Background(), logger, "fallback.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(creds.Username).To(Equal("fallback-user"))
+			})
+		})
+	})
+})
+
+var _ = Describe("Dialing with a credential store", func() {
+	var (
+		logger    *lagertest.TestLogger
+		registry  *fakeRegistry
+		fakeStore *fake_distclient.FakeCredentialStore
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		registry = newFakeRegistry()
+		registry.RequireBasicAuth("store-user", "store-password")
+		registry.AddManifest("some-tag", distclient.MediaTypeManifestV1, mustMarshal(map[string]interface{}{
+			"schemaVersion": 1,
+			"fsLayers":      []map[string]interface{}{{"blobSum": registry.AddBlob([]byte("layer"))}},
+			"history":       []map[string]interface{}{{"v1Compatibility": `{"id":"abc"}`}},
+		}))
+
+		fakeStore = new(fake_distclient.FakeCredentialStore)
+		fakeStore.CredentialsReturns(distclient.Credentials{Username: "store-user", Password: "store-password"}, nil)
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	dial := func(creds distclient.Credentials) (distclient.Conn, error) {
+		d := distclient.NewDialer([]string{registry.Host()})
+		d.CredentialStore = fakeStore
+		return d.Dial(context.Background(), logger, registry.Host(), "some/repo", creds)
+	}
+
+	It("looks up credentials for the host when none are given", func() {
+		conn, err := dial(distclient.Credentials{})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(fakeStore.CredentialsCallCount()).To(Equal(1))
+		_, _, host := fakeStore.CredentialsArgsForCall(0)
+		Expect(host).To(Equal(registry.Host()))
+	})
+
+	It("prefers the credentials given with the request", func() {
+		_, err := dial(distclient.Credentials{Username: "store-user", Password: "store-password"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(fakeStore.CredentialsCallCount()).To(Equal(0))
+	})
+
+	Context("when the store fails", func() {
+		BeforeEach(func() {
+			registry.RequireBasicAuth("", "")
+			fakeStore.CredentialsReturns(distclient.Credentials{}, errors.New("store-exploded"))
+		})
+
+		It("carries on anonymously", func() {
+			conn, err := dial(distclient.Credentials{})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
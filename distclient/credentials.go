@@ -0,0 +1,35 @@
+package distclient
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+// Credentials are used to authenticate against private registries, either
+// directly with basic auth or to obtain a bearer token from the registry's
+// token server. An IdentityToken, when present, is exchanged for a bearer
+// token in place of the username and password.
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+func (c Credentials) Empty() bool {
+	return c.Username == "" && c.Password == "" && c.IdentityToken == ""
+}
+
+// Basic implements auth.CredentialStore
+func (c Credentials) Basic(*url.URL) (string, string) {
+	return c.Username, c.Password
+}
+
+// MarshalJSON redacts the credentials, so that they can never end up in log
+// data by accident.
+func (c Credentials) MarshalJSON() ([]byte, error) {
+	if c.Empty() {
+		return json.Marshal("")
+	}
+
+	return json.Marshal("[redacted]")
+}
@@ -0,0 +1,100 @@
+package distclient_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/onsi/gomega/gbytes"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Private registries", func() {
+	var (
+		logger   *lagertest.TestLogger
+		registry *fakeRegistry
+		creds    distclient.Credentials
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		registry = newFakeRegistry()
+		registry.AddManifest("some-tag", distclient.MediaTypeManifestV1, mustMarshal(map[string]interface{}{
+			"schemaVersion": 1,
+			"fsLayers":      []map[string]interface{}{{"blobSum": registry.AddBlob([]byte("layer"))}},
+			"history":       []map[string]interface{}{{"v1Compatibility": `{"id":"abc"}`}},
+		}))
+
+		creds = distclient.Credentials{Username: "some-user", Password: "some-password"}
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	getManifest := func(creds distclient.Credentials) error {
+		conn, err := distclient.NewDialer([]string{registry.Host()}).Dial(context.Background(), logger, registry.Host(), "some/repo", creds)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+		return err
+	}
+
+	Context("when the registry requires basic auth", func() {
+		BeforeEach(func() {
+			registry.RequireBasicAuth("some-user", "some-password")
+		})
+
+		It("authenticates with the given credentials", func() {
+			Expect(getManifest(creds)).To(Succeed())
+		})
+
+		It("fails without credentials", func() {
+			Expect(getManifest(distclient.Credentials{})).NotTo(Succeed())
+		})
+
+		It("fails with the wrong credentials", func() {
+			Expect(getManifest(distclient.Credentials{Username: "some-user", Password: "wrong"})).NotTo(Succeed())
+		})
+	})
+
+	Context("when the registry requires a bearer token", func() {
+		BeforeEach(func() {
+			registry.RequireBearerAuth("some-user", "some-password")
+		})
+
+		It("exchanges the credentials for a token", func() {
+			Expect(getManifest(creds)).To(Succeed())
+		})
+
+		It("fails without credentials", func() {
+			Expect(getManifest(distclient.Credentials{})).NotTo(Succeed())
+		})
+	})
+
+	It("never logs the credentials", func() {
+		registry.RequireBasicAuth("some-user", "some-password")
+		Expect(getManifest(creds)).To(Succeed())
+		Expect(getManifest(distclient.Credentials{})).NotTo(Succeed())
+
+		Expect(logger).NotTo(gbytes.Say("some-password"))
+	})
+
+	Describe("marshalling to JSON", func() {
+		It("redacts the credentials", func() {
+			logger.Info("with-creds", lager.Data{"creds": creds})
+
+			b, err := json.Marshal(creds)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).NotTo(ContainSubstring("some-password"))
+			Expect(string(b)).NotTo(ContainSubstring("some-user"))
+			Expect(logger.Buffer()).NotTo(gbytes.Say("some-password"))
+		})
+	})
+})
@@ -3,11 +3,27 @@ package distclient_test
 import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
 
 	"testing"
 )
 
+var fakeCredentialHelperBin string
+
 func TestDistclient(t *testing.T) {
 	RegisterFailHandler(Fail)
+
+	SynchronizedBeforeSuite(func() []byte {
+		bin, err := gexec.Build("code.cloudfoundry.org/garden-shed/distclient/fake_credential_helper")
+		Expect(err).NotTo(HaveOccurred())
+		return []byte(bin)
+	}, func(bin []byte) {
+		fakeCredentialHelperBin = string(bin)
+	})
+
+	SynchronizedAfterSuite(func() {}, func() {
+		gexec.CleanupBuildArtifacts()
+	})
+
 	RunSpecs(t, "Distclient Suite")
 }
@@ -0,0 +1,335 @@
+package distclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// archiveConn is a Conn which reads images from a `docker save` tarball.
+// The archive is indexed once when it is opened, after which the layer tars
+// are read straight out of it, so it is never extracted.
+//
+// Layer blobs are identified by their diff IDs, which are the digests of the
+// uncompressed layer tars, so the layers get the same IDs as those of the
+// same image pulled from a registry. Layer tars which are gzipped in the
+// archive, as some tools save them, are decompressed as they are read.
+type archiveConn struct {
+	path      string
+	entries   map[string]archiveEntry
+	manifests []archiveManifest
+
+	// repositories maps repository and tag to the ID of the top layer, as
+	// recorded by older versions of docker
+	repositories map[string]map[string]string
+
+	mu    sync.Mutex
+	blobs map[digest.Digest]archiveEntry
+}
+
+type archiveEntry struct {
+	offset  int64
+	size    int64
+	gzipped bool
+}
+
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// OpenDockerArchive returns a Conn for the `docker save` tarball at path.
+func OpenDockerArchive(path string) (Conn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("distclient: open docker archive: %s", err)
+	}
+	defer f.Close()
+
+	entries, err := indexArchive(f)
+	if err != nil {
+		return nil, fmt.Errorf("distclient: read docker archive %s: %s", path, err)
+	}
+
+	a := &archiveConn{
+		path:    path,
+		entries: entries,
+		blobs:   make(map[digest.Digest]archiveEntry),
+	}
+
+	if _, ok := entries["manifest.json"]; !ok {
+		return nil, fmt.Errorf("distclient: %s has no manifest.json, it may have been saved by docker older than 1.10", path)
+	}
+
+	if err := a.readJSON(f, "manifest.json", &a.manifests); err != nil {
+		return nil, err
+	}
+
+	if _, ok := entries["repositories"]; ok {
+		if err := a.readJSON(f, "repositories", &a.repositories); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// indexArchive finds the offset and size of every file in the tar.
+func indexArchive(f *os.File) (map[string]archiveEntry, error) {
+	entries := make(map[string]archiveEntry)
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// the tar reader does not buffer, so the file is positioned at the
+		// start of the entry's contents
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[path.Clean(hdr.Name)] = archiveEntry{offset: offset, size: hdr.Size}
+	}
+}
+
+func (a *archiveConn) GetManifest(ctx context.Context, logger lager.Logger, ref string, platform Platform) (*Manifest, error) {
+	m, err := a.resolve(ref)
+	if err != nil {
+		logger.Error("failed-to-resolve-ref", err, lager.Data{"ref": ref})
+		return nil, err
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("distclient: open docker archive: %s", err)
+	}
+	defer f.Close()
+
+	configEntry, err := a.entry(m.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := readEntry(f, configEntry, configDigest(m.Config))
+	if err != nil {
+		logger.Error("failed-to-read-config", err, lager.Data{"config": m.Config})
+		return nil, err
+	}
+
+	var c imageConfig
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil, fmt.Errorf("distclient: parse image config %s: %s", m.Config, err)
+	}
+
+	if len(c.RootFS.DiffIDs) != len(m.Layers) {
+		return nil, fmt.Errorf("distclient: image config has %d diff_ids but archive has %d layers", len(c.RootFS.DiffIDs), len(m.Layers))
+	}
+
+	// the layers are served uncompressed, so their digests are the diff IDs
+	sm := schema2Manifest{SchemaVersion: 2, MediaType: MediaTypeManifestV2}
+	for i, name := range m.Layers {
+		layer, err := a.entry(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if layer.gzipped, err = isGzipped(f, layer); err != nil {
+			return nil, fmt.Errorf("distclient: read layer %s: %s", name, err)
+		}
+
+		a.mu.Lock()
+		a.blobs[c.RootFS.DiffIDs[i]] = layer
+		a.mu.Unlock()
+
+		sm.Layers = append(sm.Layers, Descriptor{Digest: c.RootFS.DiffIDs[i], Size: layer.size})
+	}
+
+	layers, err := schema2Layers(sm, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manifest{Layers: layers}, nil
+}
+
+// GetBlobReader returns the layer tar with diff ID d. Only layers of images
+// whose manifest has already been got can be read.
+func (a *archiveConn) GetBlobReader(ctx context.Context, logger lager.Logger, d digest.Digest) (io.Reader, error) {
+	a.mu.Lock()
+	entry, ok := a.blobs[d]
+	a.mu.Unlock()
+
+	if !ok {
+		return nil, distribution.ErrBlobUnknown
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("distclient: open docker archive: %s", err)
+	}
+
+	var r io.Reader = io.NewSectionReader(f, entry.offset, entry.size)
+	if entry.gzipped {
+		if r, err = gzip.NewReader(r); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("distclient: decompress layer %s: %s", d, err)
+		}
+	}
+
+	return &sectionReadCloser{
+		Reader: r,
+		Closer: f,
+	}, nil
+}
+
+func (a *archiveConn) StatBlob(ctx context.Context, logger lager.Logger, d digest.Digest) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.blobs[d]; !ok {
+		return distribution.ErrBlobUnknown
+	}
+
+	return nil
+}
+
+// resolve finds the image for ref, which is a repository and tag as given to
+// `docker save`. An empty ref means the only image in the archive.
+func (a *archiveConn) resolve(ref string) (archiveManifest, error) {
+	if ref == "" {
+		if len(a.manifests) != 1 {
+			return archiveManifest{}, fmt.Errorf("distclient: %s holds %d images, a tag must be given", a.path, len(a.manifests))
+		}
+
+		return a.manifests[0], nil
+	}
+
+	repo, tag := ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repo, tag = ref[:i], ref[i+1:]
+	}
+
+	for _, m := range a.manifests {
+		for _, repoTag := range m.RepoTags {
+			if repoTag == repo+":"+tag {
+				return m, nil
+			}
+		}
+	}
+
+	// images saved by ID have no RepoTags, but may still be tagged in the
+	// repositories file by the ID of their top layer
+	if id, ok := a.repositories[repo][tag]; ok {
+		for _, m := range a.manifests {
+			if len(m.Layers) > 0 && path.Dir(path.Clean(m.Layers[len(m.Layers)-1])) == id {
+				return m, nil
+			}
+		}
+	}
+
+	return archiveManifest{}, fmt.Errorf("distclient: no image tagged %s:%s in %s", repo, tag, a.path)
+}
+
+func (a *archiveConn) entry(name string) (archiveEntry, error) {
+	entry, ok := a.entries[path.Clean(name)]
+	if !ok {
+		return archiveEntry{}, fmt.Errorf("distclient: %s not found in %s", name, a.path)
+	}
+
+	return entry, nil
+}
+
+func (a *archiveConn) readJSON(f *os.File, name string, v interface{}) error {
+	entry, err := a.entry(name)
+	if err != nil {
+		return err
+	}
+
+	b, err := readEntry(f, entry, "")
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("distclient: parse %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// readEntry reads a whole file out of the archive, verifying it if its
+// digest is known.
+func readEntry(f *os.File, entry archiveEntry, d digest.Digest) ([]byte, error) {
+	r := io.NewSectionReader(f, entry.offset, entry.size)
+	if d == "" {
+		return ioutil.ReadAll(r)
+	}
+
+	return readVerified(r, d)
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzipped is whether the file in the archive starts with the gzip magic
+// number, which a tar, starting with the name of its first entry, does not.
+func isGzipped(f *os.File, entry archiveEntry) (bool, error) {
+	if entry.size < int64(len(gzipMagic)) {
+		return false, nil
+	}
+
+	magic := make([]byte, len(gzipMagic))
+	if _, err := f.ReadAt(magic, entry.offset); err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(magic, gzipMagic), nil
+}
+
+// configDigest works out the digest of an image config from its name, which
+// is <hex>.json in archives saved by docker before 25 and blobs/sha256/<hex>
+// in those saved since.
+func configDigest(name string) digest.Digest {
+	hex := strings.TrimSuffix(path.Base(name), ".json")
+	algorithm := "sha256"
+	if dir := path.Dir(path.Clean(name)); path.Base(path.Dir(dir)) == "blobs" {
+		algorithm = path.Base(dir)
+	}
+
+	d := digest.Digest(algorithm + ":" + hex)
+	if d.Validate() != nil {
+		return ""
+	}
+
+	return d
+}
+
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,180 @@
+package distclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
+)
+
+// ErrorClass says whether a failed registry request is worth trying again.
+type ErrorClass int
+
+const (
+	// Transient errors, such as dropped connections or server errors, may
+	// succeed if retried after a short while.
+	Transient ErrorClass = iota
+
+	// Permanent errors, such as unknown manifests or failed authorization,
+	// will fail the same way however often they are retried.
+	Permanent
+
+	// Throttled errors mean the registry is rate limiting requests, and may
+	// say how long to wait before retrying with a Retry-After header.
+	Throttled
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Permanent:
+		return "permanent"
+	case Throttled:
+		return "throttled"
+	default:
+		return "transient"
+	}
+}
+
+// StatusError is returned when a registry responds with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	What       string
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response, what string) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		What:       what,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("distclient: unexpected status fetching %s: %s", e.What, e.Status)
+}
+
+// WrapError adds context to the message of err, keeping its class.
+func WrapError(err error, format string, args ...interface{}) error {
+	return &wrappedError{
+		message: fmt.Sprintf(format, args...),
+		cause:   err,
+	}
+}
+
+type wrappedError struct {
+	message string
+	cause   error
+}
+
+func (e *wrappedError) Error() string {
+	return e.message + ": " + e.cause.Error()
+}
+
+func (e *wrappedError) Cause() error {
+	return e.cause
+}
+
+// Classify returns the class of an error returned by a Conn. Besides our own
+// StatusErrors, this understands the errors of the distribution client,
+// which are returned for blob requests and failed token exchanges. Errors
+// which did not come from a registry response, such as network errors, are
+// transient.
+func Classify(err error) ErrorClass {
+	switch err := cause(err).(type) {
+	case *StatusError:
+		return classifyStatus(err.StatusCode, err.RetryAfter)
+	case errcode.Errors:
+		if len(err) > 0 {
+			return Classify(err[0])
+		}
+	case errcode.Error:
+		return classifyStatus(err.Code.Descriptor().HTTPStatusCode, 0)
+	case errcode.ErrorCode:
+		return classifyStatus(err.Descriptor().HTTPStatusCode, 0)
+	case *client.UnexpectedHTTPResponseError:
+		// the distribution client only parses the bodies of 4xx responses,
+		// which is how a 401 or 403 without an error body comes back
+		return Permanent
+	}
+
+	if cause(err) == distribution.ErrBlobUnknown {
+		return Permanent
+	}
+
+	return Transient
+}
+
+func classifyStatus(statusCode int, retryAfter time.Duration) ErrorClass {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return Throttled
+	case statusCode == http.StatusServiceUnavailable && retryAfter > 0:
+		return Throttled
+	case statusCode == http.StatusRequestTimeout, statusCode >= 500:
+		return Transient
+	case statusCode >= 400:
+		return Permanent
+	}
+
+	return Transient
+}
+
+// RetryAfter returns how long the registry asked to be left alone for when
+// it returned err, or zero if it did not say.
+func RetryAfter(err error) time.Duration {
+	if err, ok := cause(err).(*StatusError); ok {
+		return err.RetryAfter
+	}
+
+	return 0
+}
+
+func cause(err error) error {
+	for {
+		// failures of the authorizer, such as a refused token exchange, come
+		// back from http.Client wrapped in a url.Error
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+			continue
+		}
+
+		wrapped, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return err
+		}
+
+		err = wrapped.Cause()
+	}
+}
+
+// parseRetryAfter understands both forms of the Retry-After header: a number
+// of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+
+	return 0
+}
@@ -0,0 +1,135 @@
+package distclient_test
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/docker/distribution/digest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Classifying errors", func() {
+	var (
+		logger   *lagertest.TestLogger
+		registry *fakeRegistry
+	)
+
+	getManifest := func() error {
+		conn, err := distclient.NewDialer([]string{registry.Host()}).Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+		return err
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		registry = newFakeRegistry()
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	It("treats an unknown manifest as permanent", func() {
+		err := getManifest()
+		Expect(err).To(HaveOccurred())
+		Expect(distclient.Classify(err)).To(Equal(distclient.Permanent))
+	})
+
+	It("treats server errors as transient", func() {
+		registry.FailManifests(http.StatusBadGateway, "")
+
+		err := getManifest()
+		Expect(err).To(HaveOccurred())
+		Expect(distclient.Classify(err)).To(Equal(distclient.Transient))
+	})
+
+	Context("when the registry is rate limiting", func() {
+		It("is throttled, for as many seconds as the registry asks", func() {
+			registry.FailManifests(http.StatusTooManyRequests, "30")
+
+			err := getManifest()
+			Expect(distclient.Classify(err)).To(Equal(distclient.Throttled))
+			Expect(distclient.RetryAfter(err)).To(Equal(30 * time.Second))
+		})
+
+		It("understands a Retry-After date", func() {
+			registry.FailManifests(http.StatusTooManyRequests, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+
+			err := getManifest()
+			Expect(distclient.RetryAfter(err)).To(BeNumerically("~", time.Hour, 2*time.Second))
+		})
+
+		It("is throttled when unavailable with a Retry-After", func() {
+			registry.FailManifests(http.StatusServiceUnavailable, "5")
+
+			Expect(distclient.Classify(getManifest())).To(Equal(distclient.Throttled))
+		})
+	})
+
+	Describe("blob requests, which go through the distribution client", func() {
+		var blob digest.Digest
+
+		statBlob := func(creds distclient.Credentials) error {
+			conn, err := distclient.NewDialer([]string{registry.Host()}).Dial(context.Background(), logger, registry.Host(), "some/repo", creds)
+			Expect(err).NotTo(HaveOccurred())
+
+			return conn.StatBlob(context.Background(), logger, blob)
+		}
+
+		BeforeEach(func() {
+			blob = registry.AddBlob([]byte("some-blob"))
+		})
+
+		It("treats an unknown blob as permanent", func() {
+			blob = sha256Digest([]byte("not-there"))
+
+			err := statBlob(distclient.Credentials{})
+			Expect(err).To(HaveOccurred())
+			Expect(distclient.Classify(err)).To(Equal(distclient.Permanent))
+		})
+
+		It("treats unauthorized requests as permanent", func() {
+			registry.RequireBasicAuth("some-user", "some-password")
+
+			err := statBlob(distclient.Credentials{Username: "some-user", Password: "wrong"})
+			Expect(err).To(HaveOccurred())
+			Expect(distclient.Classify(err)).To(Equal(distclient.Permanent))
+		})
+
+		It("treats forbidden requests as permanent", func() {
+			registry.ForbidBlobs()
+
+			err := statBlob(distclient.Credentials{})
+			Expect(err).To(HaveOccurred())
+			Expect(distclient.Classify(err)).To(Equal(distclient.Permanent))
+		})
+
+		It("treats a refused token exchange as permanent", func() {
+			registry.RequireBearerAuth("some-user", "some-password")
+
+			err := statBlob(distclient.Credentials{Username: "some-user", Password: "wrong"})
+			Expect(err).To(HaveOccurred())
+			Expect(distclient.Classify(err)).To(Equal(distclient.Permanent))
+		})
+	})
+
+	It("treats errors which did not come from the registry as transient", func() {
+		Expect(distclient.Classify(errors.New("connection reset"))).To(Equal(distclient.Transient))
+		Expect(distclient.RetryAfter(errors.New("connection reset"))).To(BeZero())
+	})
+
+	It("keeps the class of wrapped errors", func() {
+		err := distclient.WrapError(&distclient.StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}, "get manifest for %s", "some/repo")
+
+		Expect(err.Error()).To(HavePrefix("get manifest for some/repo: "))
+		Expect(distclient.Classify(err)).To(Equal(distclient.Throttled))
+		Expect(distclient.RetryAfter(err)).To(Equal(time.Second))
+	})
+})
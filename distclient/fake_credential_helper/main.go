@@ -0,0 +1,63 @@
+// fake_credential_helper behaves like a docker-credential-* helper, serving
+// credentials from the JSON object (server URL to {"Username", "Secret"}) in
+// $FAKE_CREDENTIAL_HELPER_CREDS, after sleeping for
+// $FAKE_CREDENTIAL_HELPER_SLEEP if it is set.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+type creds struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+func main() {
+	if len(os.Args) != 2 || os.Args[1] != "get" {
+		fmt.Fprintln(os.Stderr, "usage: fake_credential_helper get")
+		os.Exit(2)
+	}
+
+	if sleep := os.Getenv("FAKE_CREDENTIAL_HELPER_SLEEP"); sleep != "" {
+		d, err := time.ParseDuration(sleep)
+		if err != nil {
+			panic(err)
+		}
+
+		time.Sleep(d)
+	}
+
+	if os.Getenv("FAKE_CREDENTIAL_HELPER_FAIL") != "" {
+		fmt.Println("something went terribly wrong")
+		os.Exit(1)
+	}
+
+	in, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		panic(err)
+	}
+	serverURL := strings.TrimSpace(string(in))
+
+	all := map[string]creds{}
+	if err := json.Unmarshal([]byte(os.Getenv("FAKE_CREDENTIAL_HELPER_CREDS")), &all); err != nil {
+		panic(err)
+	}
+
+	c, ok := all[serverURL]
+	if !ok {
+		fmt.Println("credentials not found in native keychain")
+		os.Exit(1)
+	}
+
+	c.ServerURL = serverURL
+	if err := json.NewEncoder(os.Stdout).Encode(c); err != nil {
+		panic(err)
+	}
+}
@@ -8,22 +8,26 @@ import (
 	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/lager"
 	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
 )
 
 type FakeConn struct {
-	GetManifestStub        func(logger lager.Logger, tag string) (*distclient.Manifest, error)
+	GetManifestStub        func(ctx context.Context, logger lager.Logger, ref string, platform distclient.Platform) (*distclient.Manifest, error)
 	getManifestMutex       sync.RWMutex
 	getManifestArgsForCall []struct {
-		logger lager.Logger
-		tag    string
+		ctx      context.Context
+		logger   lager.Logger
+		ref      string
+		platform distclient.Platform
 	}
 	getManifestReturns struct {
 		result1 *distclient.Manifest
 		result2 error
 	}
-	GetBlobReaderStub        func(logger lager.Logger, d digest.Digest) (io.Reader, error)
+	GetBlobReaderStub        func(ctx context.Context, logger lager.Logger, d digest.Digest) (io.Reader, error)
 	getBlobReaderMutex       sync.RWMutex
 	getBlobReaderArgsForCall []struct {
+		ctx    context.Context
 		logger lager.Logger
 		d      digest.Digest
 	}
@@ -31,20 +35,32 @@ type FakeConn struct {
 		result1 io.Reader
 		result2 error
 	}
+	StatBlobStub        func(ctx context.Context, logger lager.Logger, d digest.Digest) error
+	statBlobMutex       sync.RWMutex
+	statBlobArgsForCall []struct {
+		ctx    context.Context
+		logger lager.Logger
+		d      digest.Digest
+	}
+	statBlobReturns struct {
+		result1 error
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeConn) GetManifest(logger lager.Logger, tag string) (*distclient.Manifest, error) {
+func (fake *FakeConn) GetManifest(ctx context.Context, logger lager.Logger, ref string, platform distclient.Platform) (*distclient.Manifest, error) {
 	fake.getManifestMutex.Lock()
 	fake.getManifestArgsForCall = append(fake.getManifestArgsForCall, struct {
-		logger lager.Logger
-		tag    string
-	}{logger, tag})
-	fake.recordInvocation("GetManifest", []interface{}{logger, tag})
+		ctx      context.Context
+		logger   lager.Logger
+		ref      string
+		platform distclient.Platform
+	}{ctx, logger, ref, platform})
+	fake.recordInvocation("GetManifest", []interface{}{ctx, logger, ref, platform})
 	fake.getManifestMutex.Unlock()
 	if fake.GetManifestStub != nil {
-		return fake.GetManifestStub(logger, tag)
+		return fake.GetManifestStub(ctx, logger, ref, platform)
 	}
 	return fake.getManifestReturns.result1, fake.getManifestReturns.result2
 }
@@ -55,10 +71,10 @@ func (fake *FakeConn) GetManifestCallCount() int {
 	return len(fake.getManifestArgsForCall)
 }
 
-func (fake *FakeConn) GetManifestArgsForCall(i int) (lager.Logger, string) {
+func (fake *FakeConn) GetManifestArgsForCall(i int) (context.Context, lager.Logger, string, distclient.Platform) {
 	fake.getManifestMutex.RLock()
 	defer fake.getManifestMutex.RUnlock()
-	return fake.getManifestArgsForCall[i].logger, fake.getManifestArgsForCall[i].tag
+	return fake.getManifestArgsForCall[i].ctx, fake.getManifestArgsForCall[i].logger, fake.getManifestArgsForCall[i].ref, fake.getManifestArgsForCall[i].platform
 }
 
 func (fake *FakeConn) GetManifestReturns(result1 *distclient.Manifest, result2 error) {
@@ -69,16 +85,17 @@ func (fake *FakeConn) GetManifestReturns(result1 *distclient.Manifest, result2 e
 	}{result1, result2}
 }
 
-func (fake *FakeConn) GetBlobReader(logger lager.Logger, d digest.Digest) (io.Reader, error) {
+func (fake *FakeConn) GetBlobReader(ctx context.Context, logger lager.Logger, d digest.Digest) (io.Reader, error) {
 	fake.getBlobReaderMutex.Lock()
 	fake.getBlobReaderArgsForCall = append(fake.getBlobReaderArgsForCall, struct {
+		ctx    context.Context
 		logger lager.Logger
 		d      digest.Digest
-	}{logger, d})
-	fake.recordInvocation("GetBlobReader", []interface{}{logger, d})
+	}{ctx, logger, d})
+	fake.recordInvocation("GetBlobReader", []interface{}{ctx, logger, d})
 	fake.getBlobReaderMutex.Unlock()
 	if fake.GetBlobReaderStub != nil {
-		return fake.GetBlobReaderStub(logger, d)
+		return fake.GetBlobReaderStub(ctx, logger, d)
 	}
 	return fake.getBlobReaderReturns.result1, fake.getBlobReaderReturns.result2
 }
@@ -89,10 +106,10 @@ func (fake *FakeConn) GetBlobReaderCallCount() int {
 	return len(fake.getBlobReaderArgsForCall)
 }
 
-func (fake *FakeConn) GetBlobReaderArgsForCall(i int) (lager.Logger, digest.Digest) {
+func (fake *FakeConn) GetBlobReaderArgsForCall(i int) (context.Context, lager.Logger, digest.Digest) {
 	fake.getBlobReaderMutex.RLock()
 	defer fake.getBlobReaderMutex.RUnlock()
-	return fake.getBlobReaderArgsForCall[i].logger, fake.getBlobReaderArgsForCall[i].d
+	return fake.getBlobReaderArgsForCall[i].ctx, fake.getBlobReaderArgsForCall[i].logger, fake.getBlobReaderArgsForCall[i].d
 }
 
 func (fake *FakeConn) GetBlobReaderReturns(result1 io.Reader, result2 error) {
@@ -103,6 +120,40 @@ func (fake *FakeConn) GetBlobReaderReturns(result1 io.Reader, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeConn) StatBlob(ctx context.Context, logger lager.Logger, d digest.Digest) error {
+	fake.statBlobMutex.Lock()
+	fake.statBlobArgsForCall = append(fake.statBlobArgsForCall, struct {
+		ctx    context.Context
+		logger lager.Logger
+		d      digest.Digest
+	}{ctx, logger, d})
+	fake.recordInvocation("StatBlob", []interface{}{ctx, logger, d})
+	fake.statBlobMutex.Unlock()
+	if fake.StatBlobStub != nil {
+		return fake.StatBlobStub(ctx, logger, d)
+	}
+	return fake.statBlobReturns.result1
+}
+
+func (fake *FakeConn) StatBlobCallCount() int {
+	fake.statBlobMutex.RLock()
+	defer fake.statBlobMutex.RUnlock()
+	return len(fake.statBlobArgsForCall)
+}
+
+func (fake *FakeConn) StatBlobArgsForCall(i int) (context.Context, lager.Logger, digest.Digest) {
+	fake.statBlobMutex.RLock()
+	defer fake.statBlobMutex.RUnlock()
+	return fake.statBlobArgsForCall[i].ctx, fake.statBlobArgsForCall[i].logger, fake.statBlobArgsForCall[i].d
+}
+
+func (fake *FakeConn) StatBlobReturns(result1 error) {
+	fake.StatBlobStub = nil
+	fake.statBlobReturns = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeConn) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
@@ -110,6 +161,8 @@ func (fake *FakeConn) Invocations() map[string][][]interface{} {
 	defer fake.getManifestMutex.RUnlock()
 	fake.getBlobReaderMutex.RLock()
 	defer fake.getBlobReaderMutex.RUnlock()
+	fake.statBlobMutex.RLock()
+	defer fake.statBlobMutex.RUnlock()
 	return fake.invocations
 }
 
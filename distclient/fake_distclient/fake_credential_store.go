@@ -0,0 +1,83 @@
+// This file was generated by counterfeiter
+package fake_distclient
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
+)
+
+type FakeCredentialStore struct {
+	CredentialsStub        func(ctx context.Context, logger lager.Logger, host string) (distclient.Credentials, error)
+	credentialsMutex       sync.RWMutex
+	credentialsArgsForCall []struct {
+		ctx    context.Context
+		logger lager.Logger
+		host   string
+	}
+	credentialsReturns struct {
+		result1 distclient.Credentials
+		result2 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeCredentialStore) Credentials(ctx context.Context, logger lager.Logger, host string) (distclient.Credentials, error) {
+	fake.credentialsMutex.Lock()
+	fake.credentialsArgsForCall = append(fake.credentialsArgsForCall, struct {
+		ctx    context.Context
+		logger lager.Logger
+		host   string
+	}{ctx, logger, host})
+	fake.recordInvocation("Credentials", []interface{}{ctx, logger, host})
+	fake.credentialsMutex.Unlock()
+	if fake.CredentialsStub != nil {
+		return fake.CredentialsStub(ctx, logger, host)
+	}
+	return fake.credentialsReturns.result1, fake.credentialsReturns.result2
+}
+
+func (fake *FakeCredentialStore) CredentialsCallCount() int {
+	fake.credentialsMutex.RLock()
+	defer fake.credentialsMutex.RUnlock()
+	return len(fake.credentialsArgsForCall)
+}
+
+func (fake *FakeCredentialStore) CredentialsArgsForCall(i int) (context.Context, lager.Logger, string) {
+	fake.credentialsMutex.RLock()
+	defer fake.credentialsMutex.RUnlock()
+	return fake.credentialsArgsForCall[i].ctx, fake.credentialsArgsForCall[i].logger, fake.credentialsArgsForCall[i].host
+}
+
+func (fake *FakeCredentialStore) CredentialsReturns(result1 distclient.Credentials, result2 error) {
+	fake.CredentialsStub = nil
+	fake.credentialsReturns = struct {
+		result1 distclient.Credentials
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeCredentialStore) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.credentialsMutex.RLock()
+	defer fake.credentialsMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeCredentialStore) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ distclient.CredentialStore = new(FakeCredentialStore)
@@ -0,0 +1,376 @@
+package distclient_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+type fakeManifest struct {
+	mediaType string
+	body      []byte
+}
+
+// fakeRegistry is a minimal stand-in for a v2 registry which serves
+// manifests by reference and blobs by digest.
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string]fakeManifest
+	blobs     map[digest.Digest][]byte
+	requests  []*http.Request
+
+	// when set, requests must authenticate with these credentials, either
+	// directly or by exchanging them for a bearer token
+	username, password string
+	bearer             bool
+
+	// blob responses advertise and honour Range requests unless noRanges is
+	// set, and when cutBlobsAfter is set the connection is dropped after that
+	// many bytes of every blob response
+	noRanges      bool
+	cutBlobsAfter int
+
+	// when set, Range requests fail with outageStatus for this long after a
+	// blob response is cut, as if the registry were briefly unavailable, and
+	// when misalignRanges is set they are answered from the wrong offset
+	outage         time.Duration
+	outageStatus   int
+	outageEnds     time.Time
+	misalignRanges bool
+
+	// when set, every manifest request fails with this status
+	manifestStatus     int
+	manifestRetryAfter string
+
+	// when set, every blob request is refused with a 403
+	forbidBlobs bool
+
+	// when set, pings are not answered until it is closed
+	pingsHeld chan struct{}
+}
+
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{
+		manifests: make(map[string]fakeManifest),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+
+	r.Server = httptest.NewServer(r)
+	return r
+}
+
+// newFakeTLSRegistry serves https using httptest's certificate, with any
+// client certificate requirements given in config.
+func newFakeTLSRegistry(config *tls.Config) *fakeRegistry {
+	r := &fakeRegistry{
+		manifests: make(map[string]fakeManifest),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+
+	r.Server = httptest.NewUnstartedServer(r)
+	r.Server.TLS = config
+	r.Server.StartTLS()
+	return r
+}
+
+func (r *fakeRegistry) Host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.Server.URL, "http://"), "https://")
+}
+
+func (r *fakeRegistry) AddManifest(ref, mediaType string, body []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.manifests[ref] = fakeManifest{mediaType: mediaType, body: body}
+}
+
+func (r *fakeRegistry) AddBlob(b []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d := sha256Digest(b)
+	r.blobs[d] = b
+	return d
+}
+
+// RequireBasicAuth makes the registry challenge for basic auth.
+func (r *fakeRegistry) RequireBasicAuth(username, password string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.username, r.password = username, password
+}
+
+// RequireBearerAuth makes the registry challenge for a bearer token, which
+// is issued by its /token endpoint in exchange for the given credentials.
+func (r *fakeRegistry) RequireBearerAuth(username, password string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.username, r.password = username, password
+	r.bearer = true
+}
+
+// CutBlobsAfter makes the registry drop the connection after sending n bytes
+// of any blob.
+func (r *fakeRegistry) CutBlobsAfter(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cutBlobsAfter = n
+}
+
+// FailResumesFor makes Range requests fail with status for d after each cut
+// blob.
+func (r *fakeRegistry) FailResumesFor(status int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.outageStatus, r.outage = status, d
+}
+
+// MisalignRanges makes Range requests be answered from one byte later than
+// asked for, as a broken proxy might.
+func (r *fakeRegistry) MisalignRanges() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.misalignRanges = true
+}
+
+func (r *fakeRegistry) DisableRanges() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.noRanges = true
+}
+
+// FailManifests makes every manifest request fail with status, sending
+// retryAfter as the Retry-After header if it is not empty.
+func (r *fakeRegistry) FailManifests(status int, retryAfter string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.manifestStatus, r.manifestRetryAfter = status, retryAfter
+}
+
+// ForbidBlobs makes every blob request fail with a 403, as registries do
+// when the credentials may see the repository but not pull from it.
+func (r *fakeRegistry) ForbidBlobs() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.forbidBlobs = true
+}
+
+// HoldPings stops the registry answering pings until the returned func is
+// called.
+func (r *fakeRegistry) HoldPings() func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	held := make(chan struct{})
+	r.pingsHeld = held
+	return func() { close(held) }
+}
+
+func (r *fakeRegistry) Requests() []*http.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.requests
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req)
+	pingsHeld := r.pingsHeld
+	r.mu.Unlock()
+
+	if pingsHeld != nil && (req.URL.Path == "/v2" || req.URL.Path == "/v2/") {
+		<-pingsHeld
+	}
+
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+
+	if !r.authorized(req) {
+		r.challenge(w)
+		return
+	}
+
+	if req.URL.Path == "/v2" || req.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if i := strings.Index(req.URL.Path, "/manifests/"); i >= 0 {
+		r.serveManifest(w, req, req.URL.Path[i+len("/manifests/"):])
+		return
+	}
+
+	if i := strings.Index(req.URL.Path, "/blobs/"); i >= 0 {
+		r.serveBlob(w, req, digest.Digest(req.URL.Path[i+len("/blobs/"):]))
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+const fakeToken = "some-token"
+
+func (r *fakeRegistry) authorized(req *http.Request) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.username == "" {
+		return true
+	}
+
+	if r.bearer {
+		return req.Header.Get("Authorization") == "Bearer "+fakeToken
+	}
+
+	username, password, ok := req.BasicAuth()
+	return ok && username == r.username && password == r.password
+}
+
+func (r *fakeRegistry) challenge(w http.ResponseWriter) {
+	r.mu.Lock()
+	bearer := r.bearer
+	r.mu.Unlock()
+
+	if bearer {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, r.Server.URL))
+	} else {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake-registry"`)
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	expectedUsername, expectedPassword := r.username, r.password
+	r.mu.Unlock()
+
+	username, password, ok := req.BasicAuth()
+	if !ok || username != expectedUsername || password != expectedPassword {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"token":%q}`, fakeToken)
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, ref string) {
+	r.mu.Lock()
+	m, ok := r.manifests[ref]
+	status, retryAfter := r.manifestStatus, r.manifestRetryAfter
+	r.mu.Unlock()
+
+	if status != 0 {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+
+		w.WriteHeader(status)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Docker-Content-Digest", sha256Digest(m.body).String())
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(m.body)))
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method != "HEAD" {
+		w.Write(m.body)
+	}
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, d digest.Digest) {
+	r.mu.Lock()
+	b, ok := r.blobs[d]
+	noRanges, cutAfter, forbidden := r.noRanges, r.cutBlobsAfter, r.forbidBlobs
+	outageEnds, outageStatus, misalign := r.outageEnds, r.outageStatus, r.misalignRanges
+	r.mu.Unlock()
+
+	if forbidden {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if req.Header.Get("Range") != "" && time.Now().Before(outageEnds) {
+		w.WriteHeader(outageStatus)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := http.StatusOK
+	if !noRanges {
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		var start int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); err == nil {
+			if misalign {
+				start++
+			}
+
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(b)-1, len(b)))
+			status = http.StatusPartialContent
+			b = b[start:]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.WriteHeader(status)
+
+	if req.Method == "HEAD" {
+		return
+	}
+
+	if cutAfter > 0 && len(b) > cutAfter {
+		r.mu.Lock()
+		r.outageEnds = time.Now().Add(r.outage)
+		r.mu.Unlock()
+
+		w.Write(b[:cutAfter])
+		w.(http.Flusher).Flush()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+
+		return
+	}
+
+	w.Write(b)
+}
+
+func sha256Digest(b []byte) digest.Digest {
+	return digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256(b)))
+}
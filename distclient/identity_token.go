@@ -0,0 +1,104 @@
+package distclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTokenExpiry = 60 * time.Second
+
+// identityTokenHandler is a bearer token auth.AuthenticationHandler which
+// exchanges an identity (refresh) token for an access token using the OAuth2
+// flow supported by docker token servers.
+type identityTokenHandler struct {
+	transport     http.RoundTripper
+	identityToken string
+	scope         string
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (h *identityTokenHandler) Scheme() string {
+	return "bearer"
+}
+
+func (h *identityTokenHandler) AuthorizeRequest(req *http.Request, params map[string]string) error {
+	// the exchange is cancelled along with the request it authorizes
+	token, err := h.getToken(req.Cancel, params)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (h *identityTokenHandler) getToken(cancel <-chan struct{}, params map[string]string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.token != "" && time.Now().Before(h.expiresAt) {
+		return h.token, nil
+	}
+
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("distclient: token auth challenge has no realm")
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {h.identityToken},
+		"service":       {params["service"]},
+		"scope":         {h.scope},
+		"client_id":     {"garden-shed"},
+	}
+
+	req, err := http.NewRequest("POST", realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Cancel = cancel
+
+	client := &http.Client{Transport: h.transport, Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("distclient: exchange identity token: %s", resp.Status)
+	}
+
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+
+	if tr.AccessToken == "" {
+		return "", fmt.Errorf("distclient: token server returned no access token")
+	}
+
+	expiry := defaultTokenExpiry
+	if tr.ExpiresIn > 0 {
+		expiry = time.Duration(tr.ExpiresIn) * time.Second
+	}
+
+	h.token = tr.AccessToken
+	h.expiresAt = time.Now().Add(expiry)
+
+	return h.token, nil
+}
@@ -0,0 +1,237 @@
+package distclient
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/docker/image"
+)
+
+const (
+	MediaTypeManifestV1       = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeSignedManifestV1 = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeManifestV2       = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeImageConfig      = "application/vnd.docker.container.image.v1+json"
+
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+)
+
+// manifestMediaTypes are sent in the Accept header of manifest requests, most
+// preferred first, so that registries only serve schema1 when they have
+// nothing better.
+var manifestMediaTypes = []string{
+	MediaTypeOCIIndex,
+	MediaTypeManifestList,
+	MediaTypeOCIManifest,
+	MediaTypeManifestV2,
+	MediaTypeSignedManifestV1,
+	MediaTypeManifestV1,
+}
+
+var ErrDigestMismatch = errors.New("digest verification failed")
+
+type Descriptor struct {
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	Digest    digest.Digest `json:"digest"`
+}
+
+type schema2Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type imageRootFS struct {
+	Type    string          `json:"type"`
+	DiffIDs []digest.Digest `json:"diff_ids"`
+}
+
+type imageConfig struct {
+	image.Image
+	RootFS imageRootFS `json:"rootfs"`
+}
+
+// Healthcheck is the HEALTHCHECK of an image config, which image.Image
+// predates.
+type Healthcheck struct {
+	Test        []string      `json:"Test"`
+	Interval    time.Duration `json:"Interval"`
+	Timeout     time.Duration `json:"Timeout"`
+	StartPeriod time.Duration `json:"StartPeriod"`
+	Retries     int           `json:"Retries"`
+}
+
+func parseHealthcheck(config []byte) (*Healthcheck, error) {
+	var c struct {
+		Config *struct {
+			Healthcheck *Healthcheck `json:"Healthcheck"`
+		} `json:"config"`
+	}
+
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil, err
+	}
+
+	if c.Config == nil {
+		return nil, nil
+	}
+
+	return c.Config.Healthcheck, nil
+}
+
+// manifestMediaType works out the media type of a manifest, falling back to
+// the schemaVersion/mediaType fields of the body for registries that serve
+// manifests as application/json.
+func manifestMediaType(contentType string, body []byte) string {
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	for _, mt := range manifestMediaTypes {
+		if contentType == mt {
+			return mt
+		}
+	}
+
+	var versioned struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}
+
+	if err := json.Unmarshal(body, &versioned); err != nil || versioned.SchemaVersion != 2 {
+		return MediaTypeManifestV1
+	}
+
+	// the mediaType field is optional in OCI manifests and indexes
+	switch {
+	case versioned.MediaType != "":
+		return versioned.MediaType
+	case versioned.Manifests != nil:
+		return MediaTypeOCIIndex
+	default:
+		return MediaTypeOCIManifest
+	}
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeManifestList
+}
+
+// digestedContent is the part of a manifest its digest is taken over. The
+// digest of a signed schema1 manifest is that of its payload, the manifest
+// without its signatures, and for every other manifest it is the whole body.
+func digestedContent(body []byte, mediaType string) []byte {
+	if mediaType != MediaTypeSignedManifestV1 && mediaType != MediaTypeManifestV1 {
+		return body
+	}
+
+	var sm manifest.SignedManifest
+	if err := json.Unmarshal(body, &sm); err != nil {
+		return body
+	}
+
+	// unsigned manifests have no payload to speak of
+	payload, err := sm.Payload()
+	if err != nil {
+		return body
+	}
+
+	return payload
+}
+
+func schema1Layers(body []byte) ([]Layer, error) {
+	var m manifest.Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+
+	if len(m.FSLayers) != len(m.History) {
+		return nil, fmt.Errorf("schema1 manifest has %d layers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+
+	return toLayers(m.FSLayers, m.History)
+}
+
+// schema2Layers converts a schema2 or OCI manifest and its image config in to
+// layers, bottom-most first. Layers are identified by their chain ID, so the ID of a
+// layer depends on the uncompressed content of it and all of its parents. The
+// image config is attached to the top-most layer only.
+func schema2Layers(m schema2Manifest, configBytes []byte) ([]Layer, error) {
+	var config imageConfig
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, err
+	}
+
+	if len(config.RootFS.DiffIDs) != len(m.Layers) {
+		return nil, fmt.Errorf("image config has %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(m.Layers))
+	}
+
+	var layers []Layer
+	var parent digest.Digest
+	for i, l := range m.Layers {
+		id := chainID(parent, config.RootFS.DiffIDs[i])
+
+		img := image.Image{Size: l.Size}
+		var healthcheck *Healthcheck
+		if i == len(m.Layers)-1 {
+			img = config.Image
+			img.Size = l.Size
+
+			var err error
+			if healthcheck, err = parseHealthcheck(configBytes); err != nil {
+				return nil, err
+			}
+		}
+
+		layers = append(layers, Layer{
+			BlobSum:        l.Digest,
+			StrongID:       id,
+			ParentStrongID: parent,
+			Image:          img,
+			Healthcheck:    healthcheck,
+		})
+
+		parent = id
+	}
+
+	return layers, nil
+}
+
+func chainID(parent, diffID digest.Digest) digest.Digest {
+	if parent == "" {
+		return diffID
+	}
+
+	return digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(parent+" "+diffID))))
+}
+
+// readVerified reads all of r, and returns an error if the content does not
+// match the expected digest.
+func readVerified(r io.Reader, d digest.Digest) ([]byte, error) {
+	verifier, err := digest.NewDigestVerifier(d)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(io.TeeReader(r, verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifier.Verified() {
+		return nil, ErrDigestMismatch
+	}
+
+	return b, nil
+}
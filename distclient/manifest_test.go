@@ -0,0 +1,377 @@
+package distclient_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/libtrust"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Manifests", func() {
+	var (
+		logger   lager.Logger
+		registry *fakeRegistry
+		conn     distclient.Conn
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		registry = newFakeRegistry()
+
+		d := distclient.NewDialer([]string{registry.Host()})
+
+		var err error
+		conn, err = d.Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	Describe("schema2 manifests", func() {
+		var (
+			bottomBlob, topBlob digest.Digest
+			configBytes         []byte
+		)
+
+		BeforeEach(func() {
+			bottomBlob = registry.AddBlob([]byte("bottom-layer"))
+			topBlob = registry.AddBlob([]byte("top-layer"))
+
+			configBytes = mustMarshal(map[string]interface{}{
+				"architecture": "amd64",
+				"os":           "linux",
+				"config": map[string]interface{}{
+					"Env":     []string{"PATH=/bin", "FOO=bar"},
+					"Volumes": map[string]struct{}{"/data": struct{}{}},
+					"Healthcheck": map[string]interface{}{
+						"Test":     []string{"CMD", "true"},
+						"Interval": int64(30 * time.Second),
+						"Retries":  3,
+					},
+				},
+				"rootfs": map[string]interface{}{
+					"type":     "layers",
+					"diff_ids": []string{"sha256:aaaa", "sha256:bbbb"},
+				},
+			})
+		})
+
+		JustBeforeEach(func() {
+			configDigest := registry.AddBlob(configBytes)
+
+			registry.AddManifest("some-tag", distclient.MediaTypeManifestV2, mustMarshal(map[string]interface{}{
+				"schemaVersion": 2,
+				"mediaType":     distclient.MediaTypeManifestV2,
+				"config": map[string]interface{}{
+					"mediaType": distclient.MediaTypeImageConfig,
+					"size":      len(configBytes),
+					"digest":    configDigest,
+				},
+				"layers": []map[string]interface{}{
+					{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 12, "digest": bottomBlob},
+					{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 9, "digest": topBlob},
+				},
+			}))
+		})
+
+		It("asks the registry for a schema2 manifest", func() {
+			_, err := conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			var accept string
+			for _, req := range registry.Requests() {
+				if req.URL.Path == "/v2/some/repo/manifests/some-tag" {
+					accept = req.Header.Get("Accept")
+				}
+			}
+
+			Expect(accept).To(ContainSubstring(distclient.MediaTypeManifestV2))
+		})
+
+		It("returns the layers bottom to top with their blob sums", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers).To(HaveLen(2))
+			Expect(manifest.Layers[0].BlobSum).To(Equal(bottomBlob))
+			Expect(manifest.Layers[1].BlobSum).To(Equal(topBlob))
+		})
+
+		It("chains the layer IDs", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers[0].StrongID).To(BeEquivalentTo("sha256:aaaa"))
+			Expect(manifest.Layers[0].ParentStrongID).To(BeEquivalentTo(""))
+			Expect(manifest.Layers[1].ParentStrongID).To(Equal(manifest.Layers[0].StrongID))
+			Expect(manifest.Layers[1].StrongID).NotTo(BeEquivalentTo("sha256:bbbb"))
+		})
+
+		It("records the size of each layer", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers[0].Image.Size).To(BeEquivalentTo(12))
+			Expect(manifest.Layers[1].Image.Size).To(BeEquivalentTo(9))
+		})
+
+		It("attaches the image config to the top layer", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers[0].Image.Config).To(BeNil())
+			Expect(manifest.Layers[1].Image.Config.Env).To(Equal([]string{"PATH=/bin", "FOO=bar"}))
+			Expect(manifest.Layers[1].Image.Config.Volumes).To(HaveKey("/data"))
+		})
+
+		It("attaches the healthcheck to the top layer", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers[0].Healthcheck).To(BeNil())
+			Expect(manifest.Layers[1].Healthcheck).To(Equal(&distclient.Healthcheck{
+				Test:     []string{"CMD", "true"},
+				Interval: 30 * time.Second,
+				Retries:  3,
+			}))
+		})
+
+		Context("when the number of diff_ids does not match the number of layers", func() {
+			BeforeEach(func() {
+				configBytes = mustMarshal(map[string]interface{}{
+					"rootfs": map[string]interface{}{
+						"type":     "layers",
+						"diff_ids": []string{"sha256:aaaa"},
+					},
+				})
+			})
+
+			It("returns an error", func() {
+				_, err := conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("OCI manifests and indexes", func() {
+		var (
+			amdBlob, armBlob     digest.Digest
+			amdConfig, armConfig digest.Digest
+			indexPlatforms       []distclient.Platform
+		)
+
+		ociManifest := func(config, layer digest.Digest) []byte {
+			return mustMarshal(map[string]interface{}{
+				"schemaVersion": 2,
+				"config": map[string]interface{}{
+					"mediaType": distclient.MediaTypeOCIConfig,
+					"digest":    config,
+				},
+				"layers": []map[string]interface{}{
+					{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "size": 3, "digest": layer},
+				},
+			})
+		}
+
+		ociConfig := func(env, diffID string) []byte {
+			return mustMarshal(map[string]interface{}{
+				"config": map[string]interface{}{"Env": []string{env}},
+				"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}},
+			})
+		}
+
+		BeforeEach(func() {
+			amdBlob = registry.AddBlob([]byte("amd64-layer"))
+			armBlob = registry.AddBlob([]byte("arm64-layer"))
+			amdConfig = registry.AddBlob(ociConfig("ARCH=amd64", "sha256:aaaa"))
+			armConfig = registry.AddBlob(ociConfig("ARCH=arm64", "sha256:bbbb"))
+
+			indexPlatforms = []distclient.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			}
+		})
+
+		JustBeforeEach(func() {
+			amdManifest := ociManifest(amdConfig, amdBlob)
+			armManifest := ociManifest(armConfig, armBlob)
+			registry.AddManifest(sha256Digest(amdManifest).String(), distclient.MediaTypeOCIManifest, amdManifest)
+			registry.AddManifest(sha256Digest(armManifest).String(), distclient.MediaTypeOCIManifest, armManifest)
+
+			registry.AddManifest("single", distclient.MediaTypeOCIManifest, amdManifest)
+			registry.AddManifest("multi", distclient.MediaTypeOCIIndex, mustMarshal(map[string]interface{}{
+				"schemaVersion": 2,
+				"manifests": []map[string]interface{}{
+					{"mediaType": distclient.MediaTypeOCIManifest, "digest": sha256Digest(amdManifest), "platform": indexPlatforms[0]},
+					{"mediaType": distclient.MediaTypeOCIManifest, "digest": sha256Digest(armManifest), "platform": indexPlatforms[1]},
+				},
+			}))
+		})
+
+		It("can read an OCI image manifest", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "single", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers).To(HaveLen(1))
+			Expect(manifest.Layers[0].BlobSum).To(Equal(amdBlob))
+			Expect(manifest.Layers[0].Image.Config.Env).To(Equal([]string{"ARCH=amd64"}))
+		})
+
+		It("selects the manifest matching the requested platform from an index", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "multi", distclient.Platform{OS: "linux", Architecture: "arm64"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers).To(HaveLen(1))
+			Expect(manifest.Layers[0].BlobSum).To(Equal(armBlob))
+			Expect(manifest.Layers[0].Image.Config.Env).To(Equal([]string{"ARCH=arm64"}))
+		})
+
+		Context("when no manifest in the index matches the platform", func() {
+			It("returns an error", func() {
+				_, err := conn.GetManifest(context.Background(), logger, "multi", distclient.Platform{OS: "windows", Architecture: "amd64"})
+				Expect(err).To(MatchError(ContainSubstring("windows/amd64")))
+			})
+		})
+
+		Context("when the variant does not match", func() {
+			It("returns an error", func() {
+				_, err := conn.GetManifest(context.Background(), logger, "multi", distclient.Platform{OS: "linux", Architecture: "arm64", Variant: "v7"})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("schema1 manifests", func() {
+		var blob digest.Digest
+
+		BeforeEach(func() {
+			blob = registry.AddBlob([]byte("only-layer"))
+
+			registry.AddManifest("old-tag", distclient.MediaTypeSignedManifestV1, mustMarshal(map[string]interface{}{
+				"schemaVersion": 1,
+				"name":          "some/repo",
+				"tag":           "old-tag",
+				"fsLayers": []map[string]interface{}{
+					{"blobSum": blob},
+				},
+				"history": []map[string]interface{}{
+					{"v1Compatibility": `{"id":"abc","config":{"Env":["a=b"]},"Size":4}`},
+				},
+			}))
+		})
+
+		It("falls back to the v1 compatibility history", func() {
+			manifest, err := conn.GetManifest(context.Background(), logger, "old-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(manifest.Layers).To(HaveLen(1))
+			Expect(manifest.Layers[0].BlobSum).To(Equal(blob))
+			Expect(manifest.Layers[0].Image.Config.Env).To(Equal([]string{"a=b"}))
+		})
+	})
+
+	Describe("fetching by digest", func() {
+		var (
+			blob         digest.Digest
+			manifestBody []byte
+		)
+
+		BeforeEach(func() {
+			blob = registry.AddBlob([]byte("pinned-layer"))
+			manifestBody = mustMarshal(map[string]interface{}{
+				"schemaVersion": 1,
+				"fsLayers":      []map[string]interface{}{{"blobSum": blob}},
+				"history":       []map[string]interface{}{{"v1Compatibility": `{"id":"abc"}`}},
+			})
+		})
+
+		It("fetches the manifest with that digest", func() {
+			d := sha256Digest(manifestBody)
+			registry.AddManifest(d.String(), distclient.MediaTypeSignedManifestV1, manifestBody)
+
+			manifest, err := conn.GetManifest(context.Background(), logger, d.String(), distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Layers[0].BlobSum).To(Equal(blob))
+		})
+
+		Context("when the manifest is a signed schema1 manifest", func() {
+			var signed *manifest.SignedManifest
+
+			BeforeEach(func() {
+				key, err := libtrust.GenerateECP256PrivateKey()
+				Expect(err).NotTo(HaveOccurred())
+
+				signed, err = manifest.Sign(&manifest.Manifest{
+					Versioned: manifest.Versioned{SchemaVersion: 1},
+					Name:      "some/repo",
+					Tag:       "signed",
+					FSLayers:  []manifest.FSLayer{{BlobSum: blob}},
+					History:   []manifest.History{{V1Compatibility: `{"id":"abc"}`}},
+				}, key)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("verifies the digest of the payload without the signatures", func() {
+				payload, err := signed.Payload()
+				Expect(err).NotTo(HaveOccurred())
+
+				d := sha256Digest(payload)
+				registry.AddManifest(d.String(), distclient.MediaTypeSignedManifestV1, signed.Raw)
+
+				m, err := conn.GetManifest(context.Background(), logger, d.String(), distclient.DefaultPlatform())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(m.Layers[0].BlobSum).To(Equal(blob))
+			})
+
+			It("does not accept the digest of the signed body", func() {
+				d := sha256Digest(signed.Raw)
+				registry.AddManifest(d.String(), distclient.MediaTypeSignedManifestV1, signed.Raw)
+
+				_, err := conn.GetManifest(context.Background(), logger, d.String(), distclient.DefaultPlatform())
+				Expect(err).To(Equal(distclient.ErrDigestMismatch))
+			})
+		})
+
+		Context("when the registry serves a manifest which does not match the digest", func() {
+			It("returns an error", func() {
+				d := sha256Digest([]byte("something-else"))
+				registry.AddManifest(d.String(), distclient.MediaTypeSignedManifestV1, manifestBody)
+
+				_, err := conn.GetManifest(context.Background(), logger, d.String(), distclient.DefaultPlatform())
+				Expect(err).To(Equal(distclient.ErrDigestMismatch))
+			})
+		})
+	})
+
+	Context("when the manifest does not exist", func() {
+		It("returns an error", func() {
+			_, err := conn.GetManifest(context.Background(), logger, "missing", distclient.DefaultPlatform())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("can read a blob", func() {
+		d := registry.AddBlob([]byte("some-blob"))
+
+		r, err := conn.GetBlobReader(context.Background(), logger, d)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(r)).To(Equal([]byte("some-blob")))
+	})
+})
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	Expect(err).NotTo(HaveOccurred())
+	return b
+}
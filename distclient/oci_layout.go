@@ -0,0 +1,178 @@
+package distclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// refNameAnnotation tags the images of an OCI image layout's index.json.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// layoutConn is a Conn which reads an OCI image layout directory rather than
+// a registry. Refs are the ref.name annotations of index.json or digests.
+type layoutConn struct {
+	dir string
+}
+
+// OpenLayout returns a Conn for the OCI image layout in dir.
+func OpenLayout(dir string) (Conn, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		return nil, fmt.Errorf("distclient: read oci-layout: %s", err)
+	}
+
+	var layout struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+
+	if err := json.Unmarshal(b, &layout); err != nil || layout.ImageLayoutVersion == "" {
+		return nil, fmt.Errorf("distclient: %s is not an OCI image layout", dir)
+	}
+
+	return &layoutConn{dir: dir}, nil
+}
+
+func (l *layoutConn) GetManifest(ctx context.Context, logger lager.Logger, ref string, platform Platform) (*Manifest, error) {
+	desc, err := l.resolve(ref)
+	if err != nil {
+		logger.Error("failed-to-resolve-ref", err, lager.Data{"ref": ref})
+		return nil, err
+	}
+
+	body, mediaType, err := l.readManifest(desc)
+	if err != nil {
+		logger.Error("failed-to-read-manifest", err, lager.Data{"digest": desc.Digest})
+		return nil, err
+	}
+
+	if isIndex(mediaType) {
+		if desc, err = selectManifest(body, platform); err != nil {
+			logger.Error("failed-to-select-platform-manifest", err, lager.Data{"platform": platform.String()})
+			return nil, err
+		}
+
+		if body, mediaType, err = l.readManifest(desc); err != nil {
+			logger.Error("failed-to-read-platform-manifest", err, lager.Data{"digest": desc.Digest})
+			return nil, err
+		}
+	}
+
+	if mediaType != MediaTypeOCIManifest && mediaType != MediaTypeManifestV2 {
+		return nil, fmt.Errorf("distclient: unsupported manifest type %s in image layout", mediaType)
+	}
+
+	var m schema2Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+
+	config, err := l.readBlob(m.Config.Digest)
+	if err != nil {
+		logger.Error("failed-to-read-config", err, lager.Data{"digest": m.Config.Digest})
+		return nil, err
+	}
+
+	layers, err := schema2Layers(m, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manifest{Layers: layers}, nil
+}
+
+func (l *layoutConn) GetBlobReader(ctx context.Context, logger lager.Logger, d digest.Digest) (io.Reader, error) {
+	path, err := l.blobPath(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (l *layoutConn) StatBlob(ctx context.Context, logger lager.Logger, d digest.Digest) error {
+	path, err := l.blobPath(d)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path)
+	return err
+}
+
+// resolve finds the descriptor of ref in index.json. A digest need not be
+// listed in the index, and an empty ref means the only image in the layout
+// or, if there are several, the one tagged latest.
+func (l *layoutConn) resolve(ref string) (Descriptor, error) {
+	if d, err := digest.ParseDigest(ref); err == nil {
+		return Descriptor{Digest: d}, nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("distclient: read index.json: %s", err)
+	}
+
+	var index imageIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return Descriptor{}, fmt.Errorf("distclient: parse index.json: %s", err)
+	}
+
+	if ref == "" {
+		if len(index.Manifests) == 1 {
+			return index.Manifests[0].Descriptor, nil
+		}
+
+		ref = "latest"
+	}
+
+	for _, m := range index.Manifests {
+		if m.Annotations[refNameAnnotation] == ref {
+			return m.Descriptor, nil
+		}
+	}
+
+	return Descriptor{}, fmt.Errorf("distclient: no image tagged %s in %s", ref, l.dir)
+}
+
+func (l *layoutConn) readManifest(desc Descriptor) ([]byte, string, error) {
+	body, err := l.readBlob(desc.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, manifestMediaType(desc.MediaType, body), nil
+}
+
+// readBlob reads a whole blob, failing if it does not match its digest.
+func (l *layoutConn) readBlob(d digest.Digest) ([]byte, error) {
+	path, err := l.blobPath(d)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("distclient: open blob: %s", err)
+	}
+	defer f.Close()
+
+	return readVerified(f, d)
+}
+
+func (l *layoutConn) blobPath(d digest.Digest) (string, error) {
+	// digests come from files in the layout, so check them before they are
+	// turned in to paths
+	if err := d.Validate(); err != nil {
+		return "", fmt.Errorf("distclient: invalid digest %s: %s", d, err)
+	}
+
+	return filepath.Join(l.dir, "blobs", string(d.Algorithm()), d.Hex()), nil
+}
@@ -0,0 +1,84 @@
+package distclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform identifies the os and architecture an image in a multi-arch image
+// index was built for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// DefaultPlatform is the platform of the host.
+func DefaultPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// ParsePlatform parses platforms of the form os/arch[/variant], e.g.
+// linux/arm64/v8.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// Matches returns true if other satisfies p. An empty variant in p matches any
+// variant.
+func (p Platform) Matches(other Platform) bool {
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+
+	return p.Variant == "" || p.Variant == other.Variant
+}
+
+type indexEntry struct {
+	Descriptor
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type imageIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []indexEntry `json:"manifests"`
+}
+
+// selectManifest picks the manifest for the given platform out of an OCI image
+// index or docker manifest list.
+func selectManifest(body []byte, platform Platform) (Descriptor, error) {
+	var index imageIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return Descriptor{}, err
+	}
+
+	for _, m := range index.Manifests {
+		if m.Platform != nil && platform.Matches(*m.Platform) {
+			return m.Descriptor, nil
+		}
+	}
+
+	return Descriptor{}, fmt.Errorf("no manifest found for platform %s", platform)
+}
@@ -0,0 +1,50 @@
+package distclient_test
+
+import (
+	"runtime"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Platform", func() {
+	It("defaults to the platform of the host", func() {
+		Expect(distclient.DefaultPlatform()).To(Equal(distclient.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}))
+	})
+
+	Describe("ParsePlatform", func() {
+		It("parses os/arch", func() {
+			Expect(distclient.ParsePlatform("linux/amd64")).To(Equal(distclient.Platform{OS: "linux", Architecture: "amd64"}))
+		})
+
+		It("parses os/arch/variant", func() {
+			Expect(distclient.ParsePlatform("linux/arm64/v8")).To(Equal(distclient.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}))
+		})
+
+		It("rejects malformed platforms", func() {
+			_, err := distclient.ParsePlatform("linux")
+			Expect(err).To(HaveOccurred())
+
+			_, err = distclient.ParsePlatform("linux/arm/v7/extra")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Matches", func() {
+		It("matches any variant when none is requested", func() {
+			p := distclient.Platform{OS: "linux", Architecture: "arm64"}
+			Expect(p.Matches(distclient.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})).To(BeTrue())
+		})
+
+		It("requires the variant to match when one is requested", func() {
+			p := distclient.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+			Expect(p.Matches(distclient.Platform{OS: "linux", Architecture: "arm", Variant: "v6"})).To(BeFalse())
+		})
+
+		It("does not match a different architecture", func() {
+			p := distclient.Platform{OS: "linux", Architecture: "amd64"}
+			Expect(p.Matches(distclient.Platform{OS: "linux", Architecture: "arm64"})).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,307 @@
+package distclient
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/transport"
+	"golang.org/x/net/context"
+)
+
+// pingCacheTTL is how long the challenges returned by pinging a registry are
+// trusted before it is pinged again.
+const pingCacheTTL = 10 * time.Minute
+
+// authorizerTTL is how long an authorizer, and so its bearer token, is kept
+// for a repository and credentials which are not dialed again, and
+// maxAuthorizers bounds how many are kept per host.
+const (
+	authorizerTTL  = time.Hour
+	maxAuthorizers = 64
+)
+
+// DialStats counts how much of the work of connecting to a registry a dialer
+// has been able to skip by reusing the state of earlier dials.
+type DialStats struct {
+	Dials int64
+
+	TransportsCreated int64
+	TransportsReused  int64
+
+	Pings       int64
+	PingsCached int64
+
+	// AuthorizersReused counts dials for a repository and set of credentials
+	// seen before, which reuse any bearer token that has not yet expired.
+	AuthorizersReused int64
+}
+
+// hostTransport is the state a dialer keeps for each registry host: a
+// keep-alive transport whose connections are shared by every dial to the
+// host, the result of the last ping, and an authorizer per repository and
+// credentials so that bearer tokens are cached until they expire.
+type hostTransport struct {
+	base *http.Transport
+
+	mu          sync.Mutex
+	endpoint    string
+	challenges  auth.ChallengeManager
+	pingedAt    time.Time
+	pinging     *pingCall
+	authorizers map[authKey]*cachedAuthorizer
+}
+
+// pingCall is a ping in flight, which every dial to the host waits for
+// rather than pinging the registry itself.
+type pingCall struct {
+	done     chan struct{}
+	endpoint string
+	err      error
+}
+
+// authKey identifies the authorizer of a repository and credentials, by a
+// hash of the credentials so that they are not kept in the clear.
+type authKey struct {
+	repo  string
+	creds [sha256.Size]byte
+}
+
+type cachedAuthorizer struct {
+	authorizer transport.RequestModifier
+	usedAt     time.Time
+}
+
+// hostTransport returns the transport for host, creating it the first time
+// the host is dialed. The TLS configuration is loaded from the certs
+// directory at that point and kept for the life of the dialer.
+func (d *dialer) hostTransport(logger lager.Logger, host string) (*hostTransport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stats.Dials++
+	if ht, ok := d.hosts[host]; ok {
+		d.stats.TransportsReused++
+		return ht, nil
+	}
+
+	tlsConfig, err := registryTLSConfig(d.CertsDir, host, d.InsecureRegistryList.AllowInsecure(host))
+	if err != nil {
+		logger.Error("failed-to-load-registry-certificates", err)
+		return nil, err
+	}
+
+	ht := &hostTransport{
+		base: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+				DualStack: true,
+			}).Dial,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	if d.hosts == nil {
+		d.hosts = make(map[string]*hostTransport)
+	}
+
+	d.hosts[host] = ht
+	d.stats.TransportsCreated++
+	return ht, nil
+}
+
+func (d *dialer) record(fn func(*DialStats)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fn(&d.stats)
+}
+
+// Stats returns the counters of the dialer so far.
+func (d *dialer) Stats() DialStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.stats
+}
+
+// ping finds the endpoint of the registry and the auth challenges it issues,
+// unless it has done so within pingCacheTTL. It reports whether the cached
+// result was used. Concurrent dials share a single ping, which carries on
+// for the others when a dial's context is done.
+func (h *hostTransport) ping(ctx context.Context, logger lager.Logger, host string, allowInsecure bool) (string, bool, error) {
+	h.mu.Lock()
+	if h.endpoint != "" && time.Since(h.pingedAt) < pingCacheTTL {
+		h.mu.Unlock()
+		return h.endpoint, true, nil
+	}
+
+	call := h.pinging
+	if call == nil {
+		call = &pingCall{done: make(chan struct{})}
+		h.pinging = call
+
+		go h.doPing(call, logger, host, allowInsecure)
+	}
+	h.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.endpoint, false, call.err
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	}
+}
+
+func (h *hostTransport) doPing(call *pingCall, logger lager.Logger, host string, allowInsecure bool) {
+	defer close(call.done)
+
+	endpoint, challenges, err := h.pingEndpoint(logger, host, allowInsecure)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.pinging = nil
+	if err != nil {
+		call.err = err
+		return
+	}
+
+	// authorizers refer to the challenges they were built with, so are
+	// rebuilt along with them
+	h.endpoint = endpoint
+	h.challenges = challenges
+	h.pingedAt = time.Now()
+	h.authorizers = make(map[authKey]*cachedAuthorizer)
+
+	call.endpoint = endpoint
+}
+
+// pingEndpoint pings the registry over https, or http if that fails and the
+// registry is allowed to be insecure. The ping client's timeout bounds it.
+func (h *hostTransport) pingEndpoint(logger lager.Logger, host string, allowInsecure bool) (string, auth.ChallengeManager, error) {
+	ctx := context.Background()
+
+	pingClient := &http.Client{
+		Transport: transport.NewTransport(h.base),
+		Timeout:   15 * time.Second,
+	}
+
+	scheme := "https://"
+	resp, err := pingRegistry(ctx, pingClient, scheme+host)
+	if err != nil {
+		logger.Error("failed-to-ping-registry", err)
+
+		if !allowInsecure {
+			return "", nil, err
+		}
+
+		scheme = "http://"
+		resp, err = pingRegistry(ctx, pingClient, scheme+host)
+		if err != nil {
+			logger.Error("failed-to-ping-registry-over-http", err)
+			return "", nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	challenges := auth.NewSimpleChallengeManager()
+	if err := challenges.AddResponse(resp); err != nil {
+		logger.Error("failed-to-add-response-to-challenge-manager", err)
+		return "", nil, err
+	}
+
+	return scheme + host, challenges, nil
+}
+
+func pingRegistry(ctx context.Context, client *http.Client, endpoint string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", endpoint+"/v2", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = ctx.Done()
+
+	return client.Do(req)
+}
+
+// authorizer returns the authorizer for requests to repo with creds, and
+// whether it was reused from an earlier dial. It must be called after ping.
+func (h *hostTransport) authorizer(repo string, creds Credentials) (transport.RequestModifier, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := authKey{
+		repo:  repo,
+		creds: sha256.Sum256([]byte(creds.Username + "\x00" + creds.Password + "\x00" + creds.IdentityToken)),
+	}
+
+	if cached, ok := h.authorizers[key]; ok {
+		cached.usedAt = time.Now()
+		return cached.authorizer, true
+	}
+
+	h.evictAuthorizers()
+
+	authTransport := tokenTransport{transport.NewTransport(h.base)}
+
+	var tokenHandler auth.AuthenticationHandler = auth.NewTokenHandler(authTransport, creds, repo, "pull")
+	if creds.IdentityToken != "" {
+		tokenHandler = &identityTokenHandler{
+			transport:     authTransport,
+			identityToken: creds.IdentityToken,
+			scope:         fmt.Sprintf("repository:%s:pull", repo),
+		}
+	}
+
+	authorizer := auth.NewAuthorizer(h.challenges, tokenHandler, auth.NewBasicHandler(creds))
+	h.authorizers[key] = &cachedAuthorizer{authorizer: authorizer, usedAt: time.Now()}
+
+	return authorizer, false
+}
+
+// evictAuthorizers drops the authorizers which have not been used within
+// authorizerTTL, and then the least recently used until there is room for
+// another. It must be called with h.mu held.
+func (h *hostTransport) evictAuthorizers() {
+	for key, cached := range h.authorizers {
+		if time.Since(cached.usedAt) > authorizerTTL {
+			delete(h.authorizers, key)
+		}
+	}
+
+	for len(h.authorizers) >= maxAuthorizers {
+		var oldest authKey
+		var oldestUsedAt time.Time
+		for key, cached := range h.authorizers {
+			if oldestUsedAt.IsZero() || cached.usedAt.Before(oldestUsedAt) {
+				oldest, oldestUsedAt = key, cached.usedAt
+			}
+		}
+
+		delete(h.authorizers, oldest)
+	}
+}
+
+// tokenTransport fails requests which the token server refuses with a
+// StatusError, so that a failed token exchange is classified like any other
+// registry response rather than as a transient error.
+type tokenTransport struct {
+	http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+
+	resp.Body.Close()
+	return nil, newStatusError(resp, "token from "+req.URL.Host)
+}
@@ -0,0 +1,187 @@
+package distclient_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+type statsDialer interface {
+	Dial(ctx context.Context, logger lager.Logger, host, repo string, creds distclient.Credentials) (distclient.Conn, error)
+	Stats() distclient.DialStats
+}
+
+var _ = Describe("Reusing connections between dials", func() {
+	var (
+		logger   *lagertest.TestLogger
+		registry *fakeRegistry
+	)
+
+	requestsTo := func(path string) (n int) {
+		for _, req := range registry.Requests() {
+			if req.URL.Path == path {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		registry = newFakeRegistry()
+		registry.AddManifest("some-tag", distclient.MediaTypeManifestV1, mustMarshal(map[string]interface{}{
+			"schemaVersion": 1,
+			"fsLayers":      []map[string]interface{}{{"blobSum": registry.AddBlob([]byte("layer"))}},
+			"history":       []map[string]interface{}{{"v1Compatibility": `{"id":"abc"}`}},
+		}))
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	It("only pings the registry once", func() {
+		d := distclient.NewDialer([]string{registry.Host()})
+
+		for i := 0; i < 3; i++ {
+			_, err := d.Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(requestsTo("/v2")).To(Equal(1))
+		Expect(d.Stats()).To(Equal(distclient.DialStats{
+			Dials:             3,
+			TransportsCreated: 1,
+			TransportsReused:  2,
+			Pings:             1,
+			PingsCached:       2,
+			AuthorizersReused: 2,
+		}))
+	})
+
+	It("does not share state between dialers", func() {
+		for i := 0; i < 2; i++ {
+			_, err := distclient.NewDialer([]string{registry.Host()}).Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(requestsTo("/v2")).To(Equal(2))
+	})
+
+	Context("when a ping is slow", func() {
+		var release func()
+
+		BeforeEach(func() {
+			release = registry.HoldPings()
+		})
+
+		AfterEach(func() {
+			release()
+		})
+
+		It("shares the ping between concurrent dials", func() {
+			d := distclient.NewDialer([]string{registry.Host()})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					_, err := d.Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+					Expect(err).NotTo(HaveOccurred())
+				}()
+			}
+
+			Eventually(func() int { return requestsTo("/v2") }).Should(Equal(1))
+			Consistently(func() int { return requestsTo("/v2") }, "100ms").Should(Equal(1))
+
+			release()
+			wg.Wait()
+
+			Expect(requestsTo("/v2")).To(Equal(1))
+			release = func() {}
+		})
+
+		It("returns when the dial's context is done", func() {
+			d := distclient.NewDialer([]string{registry.Host()})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := d.Dial(ctx, logger, registry.Host(), "some/repo", distclient.Credentials{})
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+			release()
+			release = func() {}
+
+			_, err = d.Dial(context.Background(), logger, registry.Host(), "some/repo", distclient.Credentials{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requestsTo("/v2")).To(Equal(1))
+		})
+	})
+
+	It("evicts the least recently used authorizer once there are too many", func() {
+		d := distclient.NewDialer([]string{registry.Host()})
+
+		for i := 0; i <= 64; i++ {
+			_, err := d.Dial(context.Background(), logger, registry.Host(), fmt.Sprintf("some/repo-%d", i), distclient.Credentials{})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		_, err := d.Dial(context.Background(), logger, registry.Host(), "some/repo-0", distclient.Credentials{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Stats().AuthorizersReused).To(BeZero())
+
+		_, err = d.Dial(context.Background(), logger, registry.Host(), "some/repo-64", distclient.Credentials{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Stats().AuthorizersReused).To(BeEquivalentTo(1))
+	})
+
+	Context("when the registry issues bearer tokens", func() {
+		BeforeEach(func() {
+			registry.RequireBearerAuth("some-user", "some-password")
+		})
+
+		fetch := func(d statsDialer, repo string, creds distclient.Credentials) {
+			conn, err := d.Dial(context.Background(), logger, registry.Host(), repo, creds)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = conn.GetManifest(context.Background(), logger, "some-tag", distclient.DefaultPlatform())
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		It("reuses the token for later dials with the same repository and credentials", func() {
+			d := distclient.NewDialer([]string{registry.Host()})
+			creds := distclient.Credentials{Username: "some-user", Password: "some-password"}
+
+			fetch(d, "some/repo", creds)
+			fetch(d, "some/repo", creds)
+
+			Expect(requestsTo("/token")).To(Equal(1))
+			Expect(d.Stats().AuthorizersReused).To(BeEquivalentTo(1))
+		})
+
+		It("fetches a new token for a different repository", func() {
+			d := distclient.NewDialer([]string{registry.Host()})
+			creds := distclient.Credentials{Username: "some-user", Password: "some-password"}
+
+			fetch(d, "some/repo", creds)
+			fetch(d, "some/other-repo", creds)
+
+			Expect(requestsTo("/token")).To(Equal(2))
+			Expect(d.Stats().AuthorizersReused).To(BeZero())
+		})
+	})
+})
@@ -1,14 +1,17 @@
 package layercake
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"fmt"
 
+	"code.cloudfoundry.org/garden-shed/pkg/atomicfile"
 	"github.com/cloudfoundry/gunk/command_runner"
 	"github.com/docker/docker/image"
 )
@@ -17,12 +20,20 @@ const (
 	metadataDirName    string = "garden-info"
 	parentChildDirName string = "parent-child"
 	childParentDirName string = "child-parent"
+	linksFileName      string = "links.json"
 )
 
+// AufsCake copies namespaced layers from their parents rather than layering
+// them, and records which layer each was copied from in
+// <GraphRoot>/garden-info/links.json, so that parents are not garbage
+// collected while they have namespaced children. The file is only ever
+// replaced by a rename, so a crash leaves either the old or the new links.
 type AufsCake struct {
 	Cake
 	Runner    command_runner.CommandRunner
 	GraphRoot string
+
+	mu sync.Mutex
 }
 
 func (a *AufsCake) Create(childID, parentID ID, id string) error {
@@ -30,9 +41,17 @@ func (a *AufsCake) Create(childID, parentID ID, id string) error {
 		return a.Cake.Create(childID, parentID, id)
 	}
 
-	if isAlreadyNamespaced, err := a.hasInfo(a.childParentDir(), childID); err != nil {
+	// the links are held from checking that the child does not exist until
+	// it is linked, so that concurrent creates of it cannot both copy it
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	links, err := a.readLinks()
+	if err != nil {
 		return err
-	} else if isAlreadyNamespaced {
+	}
+
+	if _, isAlreadyNamespaced := links[childID.GraphID()]; isAlreadyNamespaced {
 		return fmt.Errorf("%s already exists", childID.GraphID())
 	}
 
@@ -40,8 +59,7 @@ func (a *AufsCake) Create(childID, parentID ID, id string) error {
 		return err
 	}
 
-	_, err := a.Cake.Get(childID)
-	if err != nil {
+	if _, err := a.Cake.Get(childID); err != nil {
 		return err
 	}
 
@@ -61,15 +79,8 @@ func (a *AufsCake) Create(childID, parentID ID, id string) error {
 		return err
 	}
 
-	if err = a.addInfo(a.parentChildDir(), parentID.GraphID(), childID.GraphID()); err != nil {
-		return err
-	}
-
-	if err = a.addInfo(a.childParentDir(), childID.GraphID(), parentID.GraphID()); err != nil {
-		return err
-	}
-
-	return nil
+	links[childID.GraphID()] = parentID.GraphID()
+	return a.writeLinks(links)
 }
 
 func (a *AufsCake) IsLeaf(id ID) (bool, error) {
@@ -79,7 +90,7 @@ func (a *AufsCake) IsLeaf(id ID) (bool, error) {
 		return false, nil
 	}
 
-	isParent, err := a.hasInfo(a.parentChildDir(), id)
+	isParent, err := a.hasChildren(id)
 	if err != nil {
 		return false, err
 	}
@@ -96,7 +107,7 @@ func (a *AufsCake) GetAllLeaves() ([]ID, error) {
 	}
 
 	for _, dockerLeaf := range dockerLeaves {
-		isParent, err := a.hasInfo(a.parentChildDir(), dockerLeaf)
+		isParent, err := a.hasChildren(dockerLeaf)
 		if err != nil {
 			return []ID{}, err
 		}
@@ -116,12 +127,12 @@ func (a *AufsCake) Get(id ID) (*image.Image, error) {
 	}
 
 	if img.Parent == "" {
-		parentData, err := a.readInfo(a.childParentDir(), id)
+		parent, _, err := a.parentOf(id)
 		if err != nil {
 			return nil, err
 		}
 
-		img.Parent = strings.TrimSpace(parentData)
+		img.Parent = parent
 	}
 	return img, nil
 }
@@ -131,97 +142,187 @@ func (a *AufsCake) Remove(id ID) error {
 		return err
 	}
 
-	parentData, err := a.readInfo(a.childParentDir(), id)
+	return a.removeLink(id.GraphID())
+}
+
+func (a *AufsCake) parentOf(id ID) (string, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	links, err := a.readLinks()
 	if err != nil {
-		return err
+		return "", false, err
+	}
+
+	parent, ok := links[id.GraphID()]
+	return parent, ok, nil
+}
+
+func (a *AufsCake) hasChildren(id ID) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	links, err := a.readLinks()
+	if err != nil {
+		return false, err
 	}
 
-	parentGraphID := strings.TrimSpace(string(parentData))
-	if err := os.Remove(filepath.Join(a.childParentDir(), id.GraphID())); err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	for _, parent := range links {
+		if parent == id.GraphID() {
+			return true, nil
 		}
-		return fmt.Errorf("layercake: Remove failed to remove file %s", err)
 	}
 
-	if err := a.removeInfo(a.parentChildDir(), parentGraphID, id.GraphID()); err != nil {
+	return false, nil
+}
+
+func (a *AufsCake) removeLink(child string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	links, err := a.readLinks()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	if _, ok := links[child]; !ok {
+		return nil
+	}
+
+	delete(links, child)
+	return a.writeLinks(links)
 }
 
-func (a *AufsCake) readInfo(path string, id ID) (string, error) {
-	parentData, err := ioutil.ReadFile(filepath.Join(a.childParentDir(), id.GraphID()))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil
-		}
-		return "", err
+// readLinks returns the parent of each namespaced layer, keyed by the graph
+// ID of the layer. Links are migrated from the parent-child and child-parent
+// files of earlier versions if they have not been yet.
+func (a *AufsCake) readLinks() (map[string]string, error) {
+	return a.loadLinks(true)
+}
+
+func (a *AufsCake) loadLinks(migrate bool) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(a.linksPath())
+	if os.IsNotExist(err) && migrate {
+		return a.migrateLinks()
+	} else if os.IsNotExist(err) {
+		links, _, err := a.readOldLinks()
+		return links, err
+	} else if err != nil {
+		return nil, fmt.Errorf("layercake: read links: %s", err)
+	}
+
+	links := make(map[string]string)
+	if err := json.Unmarshal(contents, &links); err != nil {
+		return nil, fmt.Errorf("layercake: read links: %s", err)
 	}
-	return string(parentData), nil
+
+	return links, nil
 }
 
-func (a *AufsCake) removeInfo(path string, file string, content string) error {
-	filePath := filepath.Join(path, file)
-	fileData, err := ioutil.ReadFile(filePath)
+func (a *AufsCake) writeLinks(links map[string]string) error {
+	contents, err := json.Marshal(links)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
 		return err
 	}
 
-	graphIDs := strings.Split(string(fileData), "\n")
-	finalGraphIDs := []string{}
-	for _, ID := range graphIDs {
-		if ID != content && ID != "" {
-			finalGraphIDs = append(finalGraphIDs, ID)
-		}
+	if err := os.MkdirAll(filepath.Dir(a.linksPath()), 0755); err != nil {
+		return fmt.Errorf("layercake: write links: %s", err)
 	}
 
-	if err := os.RemoveAll(filePath); err != nil {
-		return err
+	if err := atomicfile.WriteFile(a.linksPath(), contents, 0644); err != nil {
+		return fmt.Errorf("layercake: write links: %s", err)
 	}
 
-	for _, ID := range finalGraphIDs {
-		if err = a.addInfo(path, file, ID); err != nil {
-			return err
-		}
-	}
 	return nil
 }
 
-func (a *AufsCake) hasInfo(path string, id ID) (bool, error) {
-	if _, err := os.Stat(filepath.Join(path, id.GraphID())); err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, err
+// migrateLinks reads the links from the parent-child and child-parent files,
+// writes them to the links file, and only then removes the old files, so an
+// interrupted migration is run again. The old files were rewritten in place,
+// so a link found in either of them is kept; keeping a stale link only stops
+// a parent from being garbage collected.
+func (a *AufsCake) migrateLinks() (map[string]string, error) {
+	links, found, err := a.readOldLinks()
+	if err != nil || !found {
+		return links, err
+	}
+
+	if err := a.writeLinks(links); err != nil {
+		return nil, err
 	}
-	return true, nil
+
+	if err := os.RemoveAll(a.childParentDir()); err != nil {
+		return nil, fmt.Errorf("layercake: migrate links: %s", err)
+	}
+
+	if err := os.RemoveAll(a.parentChildDir()); err != nil {
+		return nil, fmt.Errorf("layercake: migrate links: %s", err)
+	}
+
+	return links, nil
 }
 
-func (a *AufsCake) addInfo(path string, file string, content string) error {
+// readOldLinks reads the links from the parent-child and child-parent files,
+// returning whether there were any such files.
+func (a *AufsCake) readOldLinks() (map[string]string, bool, error) {
+	links := make(map[string]string)
 
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return err
+	childParents, err := readLinkFiles(a.childParentDir())
+	if err != nil {
+		return nil, false, fmt.Errorf("layercake: migrate links: %s", err)
+	}
+
+	for child, parents := range childParents {
+		if len(parents) > 0 {
+			links[child] = parents[0]
+		}
 	}
 
-	handle, err := os.OpenFile(
-		filepath.Join(path, file),
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
-		0755)
+	parentChildren, err := readLinkFiles(a.parentChildDir())
 	if err != nil {
-		return err
+		return nil, false, fmt.Errorf("layercake: migrate links: %s", err)
 	}
-	defer handle.Close()
 
-	if _, err := fmt.Fprintln(handle, content); err != nil {
-		return err
+	for parent, children := range parentChildren {
+		for _, child := range children {
+			if _, ok := links[child]; !ok {
+				links[child] = parent
+			}
+		}
 	}
 
-	return nil
+	return links, childParents != nil || parentChildren != nil, nil
+}
+
+// readLinkFiles returns the graph IDs listed in each file of dir, keyed by the
+// file name, or nil if dir does not exist.
+func readLinkFiles(dir string) (map[string][]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]string)
+	for _, entry := range entries {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(contents), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				files[entry.Name()] = append(files[entry.Name()], line)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+func (a *AufsCake) linksPath() string {
+	return filepath.Join(a.GraphRoot, metadataDirName, linksFileName)
 }
 
 func (a *AufsCake) parentChildDir() string {
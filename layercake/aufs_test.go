@@ -1,6 +1,7 @@
 package layercake_test
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -31,12 +32,28 @@ var _ = Describe("Aufs", func() {
 		otherNamespacedChildID layercake.ID
 		runner                 command_runner.CommandRunner
 		baseDirectory          string
+		linksPath              string
 	)
 
+	readLinks := func() map[string]string {
+		contents, err := ioutil.ReadFile(linksPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		links := make(map[string]string)
+		Expect(json.Unmarshal(contents, &links)).To(Succeed())
+		return links
+	}
+
+	corruptLinks := func() {
+		Expect(os.MkdirAll(filepath.Dir(linksPath), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(linksPath, []byte("{"), 0644)).To(Succeed())
+	}
+
 	BeforeEach(func() {
 		var err error
 		baseDirectory, err = ioutil.TempDir("", "aufsTestGraphRoot")
 		Expect(err).NotTo(HaveOccurred())
+		linksPath = filepath.Join(baseDirectory, "garden-info", "links.json")
 
 		cake = new(fake_cake.FakeCake)
 		runner = linux_command_runner.New()
@@ -337,11 +354,10 @@ var _ = Describe("Aufs", func() {
 						Expect(cake.UnmountArgsForCall(0)).To(Equal(parentID))
 					})
 
-					It("should not create the garden-info metadata directories", func() {
+					It("should not create the garden-info metadata", func() {
 						Expect(aufsCake.Create(namespacedChildID, parentID, "")).To(Equal(testError))
 						Expect(filepath.Join(baseDirectory, "garden-info")).NotTo(BeADirectory())
-						Expect(filepath.Join(baseDirectory, "garden-info", "parent-child")).NotTo(BeADirectory())
-						Expect(filepath.Join(baseDirectory, "garden-info", "child-parent")).NotTo(BeADirectory())
+						Expect(linksPath).NotTo(BeAnExistingFile())
 					})
 				})
 			})
@@ -353,22 +369,34 @@ var _ = Describe("Aufs", func() {
 						Expect(aufsCake.Create(namespacedChildID, parentID, "")).To(MatchError(fmt.Sprintf("%s already exists", namespacedChildID.GraphID())))
 					})
 
-					It("does not add duplicated records in child-parent file", func() {
-						childParentInfo := filepath.Join(baseDirectory, "garden-info", "child-parent", namespacedChildID.GraphID())
+					It("keeps a single link from the namespaced layer to its parent", func() {
 						Expect(aufsCake.Create(namespacedChildID, parentID, "")).To(HaveOccurred())
 
-						childParentInfoData, err := ioutil.ReadFile(childParentInfo)
-						Expect(err).NotTo(HaveOccurred())
-						Expect(string(childParentInfoData)).To(Equal(parentID.GraphID() + "\n"))
+						Expect(readLinks()).To(Equal(map[string]string{
+							namespacedChildID.GraphID(): parentID.GraphID(),
+						}))
 					})
+				})
 
-					It("does not duplicate the namespaced child id in parent-child file", func() {
-						parentChildInfo := filepath.Join(baseDirectory, "garden-info", "parent-child", parentID.GraphID())
-						Expect(parentChildInfo).To(BeAnExistingFile())
+				Context("when the namespaced layer is created concurrently", func() {
+					It("only creates it once", func() {
+						errs := make(chan error, 2)
+						for i := 0; i < 2; i++ {
+							go func() {
+								errs <- aufsCake.Create(namespacedChildID, parentID, "")
+							}()
+						}
 
-						parentChildInfoData, err := ioutil.ReadFile(parentChildInfo)
-						Expect(err).NotTo(HaveOccurred())
-						Expect(string(parentChildInfoData)).To(Equal(namespacedChildID.GraphID() + "\n"))
+						var failed int
+						for i := 0; i < 2; i++ {
+							if err := <-errs; err != nil {
+								Expect(err).To(MatchError(fmt.Sprintf("%s already exists", namespacedChildID.GraphID())))
+								failed++
+							}
+						}
+
+						Expect(failed).To(Equal(1))
+						Expect(cake.CreateCallCount()).To(Equal(1))
 					})
 				})
 
@@ -520,13 +548,13 @@ var _ = Describe("Aufs", func() {
 				Expect(os.RemoveAll(namespacedChildDir)).To(Succeed())
 			})
 
-			Context("when the image ID is an invalid file", func() {
+			Context("when the links are corrupt", func() {
 				JustBeforeEach(func() {
 					cake.GetReturns(&image.Image{}, nil)
 				})
 
 				It("returns the error", func() {
-					childID.GraphIDReturns("\x00")
+					corruptLinks()
 
 					img, err := aufsCake.Get(childID)
 					Expect(img).To(BeNil())
@@ -687,36 +715,19 @@ var _ = Describe("Aufs", func() {
 					Expect(isLeaf).To(BeTrue())
 				})
 
-				It("should remove the parent child relationship", func() {
+				It("should remove the link to the parent", func() {
 					Expect(aufsCake.Remove(namespacedChildID)).To(Succeed())
 
-					parentChildInfo := filepath.Join(baseDirectory, "garden-info", "parent-child", parentID.GraphID())
-					Expect(parentChildInfo).NotTo(BeAnExistingFile())
-				})
-
-				It("should remove the child parent relationship", func() {
-					Expect(aufsCake.Remove(namespacedChildID)).To(Succeed())
-
-					childParentInfo := filepath.Join(baseDirectory, "garden-info", "child-parent", namespacedChildID.GraphID())
-					Expect(childParentInfo).NotTo(BeAnExistingFile())
+					Expect(readLinks()).To(BeEmpty())
 				})
 			})
 
 			Context("when cake remove fails", func() {
-				It("should not remove the child-parent relationship file", func() {
+				It("should not remove the link to the parent", func() {
 					cake.RemoveReturns(testError)
 					Expect(aufsCake.Remove(namespacedChildID)).To(Equal(testError))
 
-					childParentInfo := filepath.Join(baseDirectory, "garden-info", "child-parent", namespacedChildID.GraphID())
-					Expect(childParentInfo).To(BeAnExistingFile())
-				})
-
-				It("should not remove the parent-child relationship file", func() {
-					cake.RemoveReturns(testError)
-					Expect(aufsCake.Remove(namespacedChildID)).To(Equal(testError))
-
-					parentChildInfo := filepath.Join(baseDirectory, "garden-info", "parent-child", parentID.GraphID())
-					Expect(parentChildInfo).To(BeAnExistingFile())
+					Expect(readLinks()).To(HaveKeyWithValue(namespacedChildID.GraphID(), parentID.GraphID()))
 				})
 			})
 
@@ -733,9 +744,9 @@ var _ = Describe("Aufs", func() {
 			})
 		})
 
-		Context("when layer id is not valid file name", func() {
+		Context("when the links are corrupt", func() {
 			It("should return the error", func() {
-				childID.GraphIDReturns("\x00")
+				corruptLinks()
 				cake.IsLeafReturns(true, nil)
 
 				isLeaf, err := aufsCake.IsLeaf(childID)
@@ -930,9 +941,9 @@ var _ = Describe("Aufs", func() {
 				})
 			})
 
-			Context("when layer id is not valid file name", func() {
+			Context("when the links are corrupt", func() {
 				It("should return the error", func() {
-					cake.GetAllLeavesReturns([]layercake.ID{layercake.DockerImageID("\x00")}, nil)
+					corruptLinks()
 					cake.IsLeafReturns(true, nil)
 
 					_, err := aufsCake.GetAllLeaves()
@@ -942,4 +953,119 @@ var _ = Describe("Aufs", func() {
 		})
 	})
 
+	Describe("links", func() {
+		writeOldLinks := func(dir, name, contents string) {
+			Expect(os.MkdirAll(filepath.Join(baseDirectory, "garden-info", dir), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(baseDirectory, "garden-info", dir, name), []byte(contents), 0755)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			cake.IsLeafReturns(true, nil)
+			cake.GetReturns(&image.Image{}, nil)
+		})
+
+		Context("when a crash left a partly written links file", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Dir(linksPath), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(linksPath, []byte(`{"ns-child":"graph-id"}`), 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(filepath.Dir(linksPath), ".links.json123"), []byte(`{"ns-chi`), 0644)).To(Succeed())
+			})
+
+			It("keeps the links from before the crash", func() {
+				isLeaf, err := aufsCake.IsLeaf(parentID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(isLeaf).To(BeFalse())
+			})
+
+			It("can still change the links", func() {
+				Expect(aufsCake.Remove(layercake.DockerImageID("ns-child"))).To(Succeed())
+
+				isLeaf, err := aufsCake.IsLeaf(parentID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(isLeaf).To(BeTrue())
+			})
+		})
+
+		Describe("migrating the links of earlier versions", func() {
+			BeforeEach(func() {
+				writeOldLinks("child-parent", "ns-child", "graph-id\n")
+				writeOldLinks("child-parent", "other-ns-child", "graph-id\n")
+				writeOldLinks("parent-child", "graph-id", "ns-child\nother-ns-child\n")
+			})
+
+			It("keeps the parents from being leaves", func() {
+				isLeaf, err := aufsCake.IsLeaf(parentID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(isLeaf).To(BeFalse())
+			})
+
+			It("returns the parents of the namespaced layers", func() {
+				img, err := aufsCake.Get(layercake.DockerImageID("ns-child"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(img.Parent).To(Equal("graph-id"))
+			})
+
+			It("writes the links file and then removes the old files", func() {
+				_, err := aufsCake.IsLeaf(parentID)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(readLinks()).To(Equal(map[string]string{
+					"ns-child":       "graph-id",
+					"other-ns-child": "graph-id",
+				}))
+				Expect(filepath.Join(baseDirectory, "garden-info", "child-parent")).NotTo(BeADirectory())
+				Expect(filepath.Join(baseDirectory, "garden-info", "parent-child")).NotTo(BeADirectory())
+			})
+
+			Context("when a crash interrupted rewriting a parent-child file", func() {
+				BeforeEach(func() {
+					Expect(os.Remove(filepath.Join(baseDirectory, "garden-info", "parent-child", "graph-id"))).To(Succeed())
+				})
+
+				It("recovers the links from the child-parent files", func() {
+					isLeaf, err := aufsCake.IsLeaf(parentID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(isLeaf).To(BeFalse())
+				})
+			})
+
+			Context("when a crash interrupted removing a child-parent file", func() {
+				BeforeEach(func() {
+					Expect(os.Remove(filepath.Join(baseDirectory, "garden-info", "child-parent", "other-ns-child"))).To(Succeed())
+				})
+
+				It("keeps the link from the parent-child file", func() {
+					Expect(aufsCake.Remove(layercake.DockerImageID("ns-child"))).To(Succeed())
+
+					isLeaf, err := aufsCake.IsLeaf(parentID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(isLeaf).To(BeFalse())
+				})
+			})
+
+			Context("when a crash interrupted the migration after writing the links file", func() {
+				BeforeEach(func() {
+					Expect(ioutil.WriteFile(linksPath, []byte(`{"ns-child":"graph-id"}`), 0644)).To(Succeed())
+				})
+
+				It("does not migrate the old files again", func() {
+					Expect(aufsCake.Remove(layercake.DockerImageID("ns-child"))).To(Succeed())
+
+					isLeaf, err := aufsCake.IsLeaf(parentID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(isLeaf).To(BeTrue())
+				})
+			})
+
+			Context("when there is nothing to migrate", func() {
+				It("does not write a links file", func() {
+					Expect(os.RemoveAll(filepath.Join(baseDirectory, "garden-info"))).To(Succeed())
+
+					_, err := aufsCake.IsLeaf(parentID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(linksPath).NotTo(BeAnExistingFile())
+				})
+			})
+		})
+	})
 })
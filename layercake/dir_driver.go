@@ -0,0 +1,298 @@
+package layercake
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// Sharing is how a layer of a DirDriver shares the files of its parent.
+type Sharing int
+
+const (
+	// CopyFiles gives each layer its own copy of every file.
+	CopyFiles Sharing = iota
+
+	// ReflinkFiles clones files on filesystems which support it, such as
+	// btrfs and xfs, and copies them elsewhere.
+	ReflinkFiles
+
+	// HardlinkFiles links the files of the parent into the layer. Files
+	// replaced by a layer's diff are unlinked first, but writing to a file
+	// in place, or chowning it, would change it in the parent too, so the
+	// layers of containers are given copies instead.
+	HardlinkFiles
+)
+
+// DirDriver is a Driver which keeps each layer as a complete directory,
+// starting as a copy of its parent, so it needs no mounts or privileges.
+type DirDriver struct {
+	Root    string
+	Sharing Sharing
+}
+
+// NewDirCake returns a Store under root which keeps its layers in a
+// DirDriver.
+func NewDirCake(root string, sharing Sharing) *Store {
+	return &Store{
+		Root:   root,
+		Driver: &DirDriver{Root: filepath.Join(root, "dir"), Sharing: sharing},
+	}
+}
+
+func (d *DirDriver) String() string {
+	return "dir"
+}
+
+func (d *DirDriver) Create(id, parent string) error {
+	return d.create(id, parent, d.Sharing)
+}
+
+// CreateWritable creates the layer of a container, which never shares the
+// files of its parent by hardlinks, as writing to them would change the
+// parent.
+func (d *DirDriver) CreateWritable(id, parent string) error {
+	sharing := d.Sharing
+	if sharing == HardlinkFiles {
+		sharing = CopyFiles
+	}
+
+	return d.create(id, parent, sharing)
+}
+
+func (d *DirDriver) create(id, parent string, sharing Sharing) error {
+	if err := os.MkdirAll(d.Root, 0700); err != nil {
+		return err
+	}
+
+	if parent == "" {
+		return os.Mkdir(d.dir(id), 0755)
+	}
+
+	// copy into a temporary directory, so that an interrupted copy is never
+	// taken for the layer
+	tmp, err := ioutil.TempDir(d.Root, "."+id)
+	if err != nil {
+		return err
+	}
+	defer removeAll(tmp)
+
+	if err := copyTree(d.dir(parent), tmp, sharing); err != nil {
+		return fmt.Errorf("copy parent %s: %s", parent, err)
+	}
+
+	return os.Rename(tmp, d.dir(id))
+}
+
+func (d *DirDriver) Remove(id string) error {
+	return removeAll(d.dir(id))
+}
+
+func (d *DirDriver) Get(id, mountLabel string) (string, error) {
+	if _, err := os.Stat(d.dir(id)); err != nil {
+		return "", err
+	}
+
+	return d.dir(id), nil
+}
+
+func (d *DirDriver) Put(id string) error {
+	return nil
+}
+
+func (d *DirDriver) Exists(id string) bool {
+	_, err := os.Stat(d.dir(id))
+	return err == nil
+}
+
+// ApplyDiff extracts the diff over the copy of the parent in the layer,
+// removing whited out files.
+func (d *DirDriver) ApplyDiff(id, parent string, diff archive.ArchiveReader) (int64, error) {
+	return applyLayer(d.dir(id), diff, dirWhiteouts{})
+}
+
+func (d *DirDriver) dir(id string) string {
+	return filepath.Join(d.Root, id)
+}
+
+type dirWhiteouts struct{}
+
+func (dirWhiteouts) whiteout(dir, name string) error {
+	return removeAll(filepath.Join(dir, name))
+}
+
+func (dirWhiteouts) opaque(dir string, extracted func(string) bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if extracted(path) {
+			continue
+		}
+
+		if err := removeAll(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyTree copies the contents of src into the existing directory dst,
+// keeping modes, ownership and xattrs (when permitted), modification times
+// and hardlinks between files.
+func copyTree(src, dst string, sharing Sharing) error {
+	var dirs []string
+	dirInfos := make(map[string]os.FileInfo)
+	linked := make(map[fileID]string)
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if rel != "." {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+
+			uid, gid := fileOwner(info)
+			dirs = append(dirs, rel)
+			dirInfos[rel] = info
+			if err := unprivileged(os.Lchown(target, uid, gid)); err != nil {
+				return err
+			}
+
+			return copyXattrs(path, target)
+
+		case mode.IsRegular():
+			if sharing == HardlinkFiles {
+				return os.Link(path, target)
+			}
+
+			// files linked together in src are linked together in dst
+			id, ok := hardlinkID(info)
+			if first, seen := linked[id]; ok && seen {
+				return os.Link(first, target)
+			} else if ok {
+				linked[id] = target
+			}
+
+			if err := copyFile(path, target, sharing == ReflinkFiles); err != nil {
+				return err
+			}
+
+			if err := copyMetadata(target, info); err != nil {
+				return err
+			}
+
+			return copyXattrs(path, target)
+
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+
+			uid, gid := fileOwner(info)
+			return unprivileged(os.Lchown(target, uid, gid))
+
+		case mode&os.ModeSocket != 0:
+			return nil
+
+		default:
+			if err := unprivileged(copySpecial(target, info)); err != nil {
+				return err
+			}
+
+			if _, err := os.Lstat(target); os.IsNotExist(err) {
+				return nil
+			}
+		}
+
+		return copyMetadata(target, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directory modes and times are set last, deepest first, as copying
+	// their contents needs write permission and changes their times
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dst, dirs[i])
+		info := dirInfos[dirs[i]]
+
+		if err := os.Chmod(target, info.Mode()); err != nil {
+			return err
+		}
+
+		if err := os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileID identifies a file which has several hardlinks.
+type fileID struct {
+	dev, ino uint64
+}
+
+func copyMetadata(target string, info os.FileInfo) error {
+	uid, gid := fileOwner(info)
+	if err := unprivileged(os.Lchown(target, uid, gid)); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(target, info.Mode()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+func copyFile(src, dst string, tryReflink bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if tryReflink && reflink(out, in) == nil {
+		return nil
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
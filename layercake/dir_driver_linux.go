@@ -0,0 +1,72 @@
+package layercake
+
+import (
+	"os"
+	"syscall"
+
+	"code.cloudfoundry.org/garden-shed/pkg/xattr"
+)
+
+// FICLONE from linux/fs.h
+const ficlone = 0x40049409
+
+func reflink(dst, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func fileOwner(info os.FileInfo) (int, int) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return os.Getuid(), os.Getgid()
+	}
+
+	return int(stat.Uid), int(stat.Gid)
+}
+
+func copySpecial(path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return syscall.EINVAL
+	}
+
+	return syscall.Mknod(path, stat.Mode, int(stat.Rdev))
+}
+
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// copyXattrs copies the xattrs of src, such as file capabilities, to dst.
+// Those which need privileges are skipped when not running as root.
+func copyXattrs(src, dst string) error {
+	names, err := xattr.List(src)
+	if err == syscall.ENOTSUP {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		value, err := xattr.Get(src, name)
+		if err != nil {
+			return unprivileged(err)
+		}
+
+		if err := syscall.Setxattr(dst, name, value, 0); err != nil && err != syscall.ENOTSUP {
+			if err := unprivileged(err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package layercake_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"github.com/docker/docker/image"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DirDriver xattrs", func() {
+	var (
+		root string
+		cake *layercake.Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "dircakeroot")
+		Expect(err).NotTo(HaveOccurred())
+
+		// tmpfs supports trusted xattrs wherever the tests run
+		Expect(syscall.Mount("tmpfs", root, "tmpfs", 0, "")).To(Succeed())
+
+		cake = layercake.NewDirCake(root, layercake.CopyFiles)
+	})
+
+	AfterEach(func() {
+		Expect(syscall.Unmount(root, 0)).To(Succeed())
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("copies the xattrs of the parent's files and directories into the child", func() {
+		Expect(cake.Register(&image.Image{ID: "parent"}, layerTar(
+			tarEntry{name: "bin/", dir: true, xattrs: map[string]string{"trusted.dir": "d"}},
+			tarEntry{name: "bin/tool", contents: "t", xattrs: map[string]string{"trusted.cap": "c"}},
+		))).To(Succeed())
+		Expect(cake.Register(&image.Image{ID: "child", Parent: "parent"}, nil)).To(Succeed())
+
+		childPath, err := cake.Path(layercake.DockerImageID("child"))
+		Expect(err).NotTo(HaveOccurred())
+
+		value := make([]byte, 16)
+		n, err := syscall.Getxattr(filepath.Join(childPath, "bin", "tool"), "trusted.cap", value)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(value[:n])).To(Equal("c"))
+
+		n, err = syscall.Getxattr(filepath.Join(childPath, "bin"), "trusted.dir", value)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(value[:n])).To(Equal("d"))
+	})
+})
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package layercake
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(dst, src *os.File) error {
+	return errors.New("reflinks are only supported on linux")
+}
+
+func fileOwner(info os.FileInfo) (int, int) {
+	return os.Getuid(), os.Getgid()
+}
+
+func copySpecial(path string, info os.FileInfo) error {
+	return errors.New("special files can only be copied on linux")
+}
+
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func copyXattrs(src, dst string) error {
+	return nil
+}
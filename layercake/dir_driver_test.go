@@ -0,0 +1,323 @@
+package layercake_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"github.com/docker/docker/image"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DirDriver", func() {
+	var (
+		root    string
+		sharing layercake.Sharing
+		cake    *layercake.Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "dircakeroot")
+		Expect(err).NotTo(HaveOccurred())
+
+		sharing = layercake.CopyFiles
+	})
+
+	JustBeforeEach(func() {
+		cake = layercake.NewDirCake(root, sharing)
+
+		Expect(cake.Register(&image.Image{ID: "parent"}, layerTar(
+			tarEntry{name: "etc/", dir: true},
+			tarEntry{name: "etc/removed", contents: "a"},
+			tarEntry{name: "etc/kept", contents: "b"},
+			tarEntry{name: "opaque/", dir: true},
+			tarEntry{name: "opaque/hidden", contents: "c"},
+		))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	pathOf := func(id string, elem ...string) string {
+		p, err := cake.Path(layercake.DockerImageID(id))
+		Expect(err).NotTo(HaveOccurred())
+		return filepath.Join(append([]string{p}, elem...)...)
+	}
+
+	It("is called dir", func() {
+		Expect(cake.DriverName()).To(Equal("dir"))
+	})
+
+	It("extracts the layer into a directory", func() {
+		Expect(ioutil.ReadFile(pathOf("parent", "etc", "kept"))).To(Equal([]byte("b")))
+	})
+
+	It("records the size of the layer", func() {
+		img, err := cake.Get(layercake.DockerImageID("parent"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Size).To(BeEquivalentTo(3))
+	})
+
+	Context("when the layer is gzipped, as registry blobs are", func() {
+		It("decompresses it", func() {
+			Expect(cake.Register(&image.Image{ID: "gzipped"}, gzipped(layerTar(
+				tarEntry{name: "file", contents: "zipped"},
+			)))).To(Succeed())
+
+			Expect(ioutil.ReadFile(pathOf("gzipped", "file"))).To(Equal([]byte("zipped")))
+		})
+	})
+
+	Context("with a child layer", func() {
+		JustBeforeEach(func() {
+			Expect(cake.Register(&image.Image{ID: "child", Parent: "parent"}, layerTar(
+				tarEntry{name: "etc/", dir: true},
+				tarEntry{name: "etc/.wh.removed"},
+				tarEntry{name: "etc/added", contents: "d"},
+				tarEntry{name: "opaque/", dir: true},
+				tarEntry{name: "opaque/.wh..wh..opq"},
+				tarEntry{name: "opaque/added", contents: "e"},
+				tarEntry{name: ".wh..wh.plnk/", dir: true},
+			))).To(Succeed())
+		})
+
+		It("inherits the files of the parent", func() {
+			Expect(ioutil.ReadFile(pathOf("child", "etc", "kept"))).To(Equal([]byte("b")))
+			Expect(ioutil.ReadFile(pathOf("child", "etc", "added"))).To(Equal([]byte("d")))
+		})
+
+		It("removes whited out files without changing the parent", func() {
+			Expect(pathOf("child", "etc", "removed")).NotTo(BeAnExistingFile())
+			Expect(pathOf("parent", "etc", "removed")).To(BeAnExistingFile())
+		})
+
+		It("hides the parent's contents of opaque directories", func() {
+			Expect(pathOf("child", "opaque", "hidden")).NotTo(BeAnExistingFile())
+			Expect(pathOf("child", "opaque", "added")).To(BeAnExistingFile())
+			Expect(pathOf("parent", "opaque", "hidden")).To(BeAnExistingFile())
+		})
+
+		It("does not extract aufs metadata", func() {
+			Expect(pathOf("child", ".wh..wh.plnk")).NotTo(BeADirectory())
+		})
+
+		It("does not change the parent when files are written", func() {
+			Expect(ioutil.WriteFile(pathOf("child", "etc", "kept"), []byte("changed"), 0644)).To(Succeed())
+			Expect(ioutil.ReadFile(pathOf("parent", "etc", "kept"))).To(Equal([]byte("b")))
+		})
+
+		It("leaves no temporary directories behind", func() {
+			entries, err := ioutil.ReadDir(filepath.Join(root, "dir"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			Expect(names).To(ConsistOf("parent", "child"))
+		})
+
+		It("can remove the child without changing the parent", func() {
+			Expect(cake.Remove(layercake.DockerImageID("child"))).To(Succeed())
+
+			Expect(filepath.Join(root, "dir", "child")).NotTo(BeADirectory())
+			Expect(pathOf("parent", "etc", "kept")).To(BeAnExistingFile())
+		})
+
+		Context("when files are shared by hardlinks", func() {
+			BeforeEach(func() {
+				sharing = layercake.HardlinkFiles
+			})
+
+			It("links the parent's files into the child", func() {
+				parentInfo, err := os.Stat(pathOf("parent", "etc", "kept"))
+				Expect(err).NotTo(HaveOccurred())
+				childInfo, err := os.Stat(pathOf("child", "etc", "kept"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(os.SameFile(parentInfo, childInfo)).To(BeTrue())
+			})
+
+			It("does not change the parent when the diff replaces a file", func() {
+				Expect(cake.Register(&image.Image{ID: "grandchild", Parent: "child"}, layerTar(
+					tarEntry{name: "etc/kept", contents: "replaced"},
+				))).To(Succeed())
+
+				Expect(ioutil.ReadFile(pathOf("grandchild", "etc", "kept"))).To(Equal([]byte("replaced")))
+				Expect(ioutil.ReadFile(pathOf("parent", "etc", "kept"))).To(Equal([]byte("b")))
+			})
+
+			Context("when the child is a container's layer", func() {
+				JustBeforeEach(func() {
+					Expect(cake.Create(layercake.DockerImageID("container"), layercake.DockerImageID("child"), "some-container")).To(Succeed())
+				})
+
+				It("gives it its own copies of the files", func() {
+					Expect(ioutil.WriteFile(pathOf("container", "etc", "kept"), []byte("changed"), 0644)).To(Succeed())
+
+					Expect(ioutil.ReadFile(pathOf("container", "etc", "kept"))).To(Equal([]byte("changed")))
+					Expect(ioutil.ReadFile(pathOf("child", "etc", "kept"))).To(Equal([]byte("b")))
+					Expect(ioutil.ReadFile(pathOf("parent", "etc", "kept"))).To(Equal([]byte("b")))
+				})
+			})
+		})
+
+		Context("when files are shared by reflinks", func() {
+			BeforeEach(func() {
+				sharing = layercake.ReflinkFiles
+			})
+
+			It("gives the child its own files, copying them if the filesystem cannot clone", func() {
+				parentInfo, err := os.Stat(pathOf("parent", "etc", "kept"))
+				Expect(err).NotTo(HaveOccurred())
+				childInfo, err := os.Stat(pathOf("child", "etc", "kept"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(os.SameFile(parentInfo, childInfo)).To(BeFalse())
+				Expect(ioutil.ReadFile(pathOf("child", "etc", "kept"))).To(Equal([]byte("b")))
+			})
+		})
+	})
+
+	Context("when a parent layer has an absolute symlink", func() {
+		var outside string
+
+		BeforeEach(func() {
+			var err error
+			outside, err = ioutil.TempDir("", "outside")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(outside)).To(Succeed())
+		})
+
+		JustBeforeEach(func() {
+			Expect(cake.Register(&image.Image{ID: "symlinked", Parent: "parent"}, layerTar(
+				tarEntry{name: "lib64", symlink: outside},
+			))).To(Succeed())
+
+			Expect(cake.Register(&image.Image{ID: "child", Parent: "symlinked"}, layerTar(
+				tarEntry{name: "lib64/file", contents: "f"},
+			))).To(Succeed())
+		})
+
+		It("extracts the child's files within the layer", func() {
+			Expect(filepath.Join(outside, "file")).NotTo(BeAnExistingFile())
+			Expect(ioutil.ReadFile(pathOf("child", outside, "file"))).To(Equal([]byte("f")))
+		})
+	})
+
+	Context("when a layer has hardlinked files", func() {
+		JustBeforeEach(func() {
+			Expect(cake.Register(&image.Image{ID: "linked", Parent: "parent"}, layerTar(
+				tarEntry{name: "bin/", dir: true},
+				tarEntry{name: "bin/tool", contents: "t"},
+				tarEntry{name: "bin/alias", hardlink: "bin/tool"},
+			))).To(Succeed())
+
+			Expect(cake.Register(&image.Image{ID: "child", Parent: "linked"}, nil)).To(Succeed())
+		})
+
+		It("keeps them linked together in the child's own copy", func() {
+			tool, err := os.Stat(pathOf("child", "bin", "tool"))
+			Expect(err).NotTo(HaveOccurred())
+			alias, err := os.Stat(pathOf("child", "bin", "alias"))
+			Expect(err).NotTo(HaveOccurred())
+			parentTool, err := os.Stat(pathOf("linked", "bin", "tool"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(os.SameFile(tool, alias)).To(BeTrue())
+			Expect(os.SameFile(tool, parentTool)).To(BeFalse())
+		})
+	})
+
+	Context("when a layer has a read-only directory", func() {
+		JustBeforeEach(func() {
+			Expect(cake.Register(&image.Image{ID: "read-only", Parent: "parent"}, layerTar(
+				tarEntry{name: "ro/", dir: true, mode: 0555},
+				tarEntry{name: "ro/file", contents: "f"},
+			))).To(Succeed())
+
+			Expect(cake.Register(&image.Image{ID: "child", Parent: "read-only"}, layerTar(
+				tarEntry{name: "ro/added", contents: "g"},
+			))).To(Succeed())
+		})
+
+		It("keeps its mode in the child and can still extract into it", func() {
+			info, err := os.Stat(pathOf("child", "ro"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0555)))
+
+			Expect(pathOf("child", "ro", "file")).To(BeAnExistingFile())
+			Expect(pathOf("child", "ro", "added")).To(BeAnExistingFile())
+		})
+
+		It("can remove the layers", func() {
+			Expect(cake.Remove(layercake.DockerImageID("child"))).To(Succeed())
+			Expect(cake.Remove(layercake.DockerImageID("read-only"))).To(Succeed())
+		})
+	})
+})
+
+type tarEntry struct {
+	name     string
+	contents string
+	dir      bool
+	mode     int64
+	symlink  string
+	hardlink string
+	xattrs   map[string]string
+}
+
+func layerTar(entries ...tarEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.contents)), Xattrs: entry.xattrs}
+		if entry.dir {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+
+		if entry.symlink != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.symlink
+		}
+
+		if entry.hardlink != "" {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = entry.hardlink
+		}
+
+		if entry.mode != 0 {
+			hdr.Mode = entry.mode
+		}
+
+		Expect(tw.WriteHeader(hdr)).To(Succeed())
+		_, err := tw.Write([]byte(entry.contents))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	Expect(tw.Close()).To(Succeed())
+	return buf
+}
+
+func gzipped(layer *bytes.Buffer) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+
+	_, err := gz.Write(layer.Bytes())
+	Expect(err).NotTo(HaveOccurred())
+	Expect(gz.Close()).To(Succeed())
+
+	return buf
+}
@@ -105,8 +105,16 @@ type DockerImageID string
 type LocalImageID struct {
 	Path         string
 	ModifiedTime time.Time
+
+	// Size is set for rootfs tarballs, so that a tarball replaced within the
+	// resolution of its modification time still gets a new ID
+	Size int64
 }
 
+// ContentImageID identifies a local rootfs by a digest of its whole tree, so
+// that it is only re-imported when its contents change.
+type ContentImageID string
+
 type NamespacedLayerID struct {
 	LayerID  ID
 	CacheKey string
@@ -125,9 +133,19 @@ func (d DockerImageID) GraphID() string {
 }
 
 func (c LocalImageID) GraphID() string {
+	if c.Size != 0 {
+		return shaID(fmt.Sprintf("%s-%d-%d", c.Path, c.ModifiedTime, c.Size))
+	}
+
+	// directories keep the IDs they have always had, so that their layers
+	// are still found after an upgrade
 	return shaID(fmt.Sprintf("%s-%d", c.Path, c.ModifiedTime))
 }
 
+func (c ContentImageID) GraphID() string {
+	return shaID("content:" + string(c))
+}
+
 func (n NamespacedLayerID) GraphID() string {
 	return shaID(n.LayerID.GraphID() + "@" + n.CacheKey)
 }
@@ -351,11 +351,11 @@ var _ = Describe("Docker", func() {
 	})
 })
 
-func createContainerLayer(cake *layercake.Docker, id, parent layercake.ID, containerId string) {
+func createContainerLayer(cake layercake.Cake, id, parent layercake.ID, containerId string) {
 	Expect(cake.Create(id, parent, containerId)).To(Succeed())
 }
 
-func registerImageLayer(cake *layercake.Docker, img *image.Image) {
+func registerImageLayer(cake layercake.Cake, img *image.Image) {
 	tmp, err := ioutil.TempDir("", "my-img")
 	Expect(err).NotTo(HaveOccurred())
 	defer os.RemoveAll(tmp)
@@ -0,0 +1,330 @@
+// This file was generated by counterfeiter
+package fake_driver
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"github.com/docker/docker/pkg/archive"
+)
+
+type FakeDriver struct {
+	StringStub        func() string
+	stringMutex       sync.RWMutex
+	stringArgsForCall []struct{}
+	stringReturns     struct {
+		result1 string
+	}
+	CreateStub        func(id string, parent string) error
+	createMutex       sync.RWMutex
+	createArgsForCall []struct {
+		id     string
+		parent string
+	}
+	createReturns struct {
+		result1 error
+	}
+	RemoveStub        func(id string) error
+	removeMutex       sync.RWMutex
+	removeArgsForCall []struct {
+		id string
+	}
+	removeReturns struct {
+		result1 error
+	}
+	GetStub        func(id string, mountLabel string) (string, error)
+	getMutex       sync.RWMutex
+	getArgsForCall []struct {
+		id         string
+		mountLabel string
+	}
+	getReturns struct {
+		result1 string
+		result2 error
+	}
+	PutStub        func(id string) error
+	putMutex       sync.RWMutex
+	putArgsForCall []struct {
+		id string
+	}
+	putReturns struct {
+		result1 error
+	}
+	ExistsStub        func(id string) bool
+	existsMutex       sync.RWMutex
+	existsArgsForCall []struct {
+		id string
+	}
+	existsReturns struct {
+		result1 bool
+	}
+	ApplyDiffStub        func(id string, parent string, diff archive.ArchiveReader) (int64, error)
+	applyDiffMutex       sync.RWMutex
+	applyDiffArgsForCall []struct {
+		id     string
+		parent string
+		diff   archive.ArchiveReader
+	}
+	applyDiffReturns struct {
+		result1 int64
+		result2 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeDriver) String() string {
+	fake.stringMutex.Lock()
+	fake.stringArgsForCall = append(fake.stringArgsForCall, struct{}{})
+	fake.recordInvocation("String", []interface{}{})
+	fake.stringMutex.Unlock()
+	if fake.StringStub != nil {
+		return fake.StringStub()
+	}
+	return fake.stringReturns.result1
+}
+
+func (fake *FakeDriver) StringCallCount() int {
+	fake.stringMutex.RLock()
+	defer fake.stringMutex.RUnlock()
+	return len(fake.stringArgsForCall)
+}
+
+func (fake *FakeDriver) StringReturns(result1 string) {
+	fake.StringStub = nil
+	fake.stringReturns = struct {
+		result1 string
+	}{result1}
+}
+
+func (fake *FakeDriver) Create(id string, parent string) error {
+	fake.createMutex.Lock()
+	fake.createArgsForCall = append(fake.createArgsForCall, struct {
+		id     string
+		parent string
+	}{id, parent})
+	fake.recordInvocation("Create", []interface{}{id, parent})
+	fake.createMutex.Unlock()
+	if fake.CreateStub != nil {
+		return fake.CreateStub(id, parent)
+	}
+	return fake.createReturns.result1
+}
+
+func (fake *FakeDriver) CreateCallCount() int {
+	fake.createMutex.RLock()
+	defer fake.createMutex.RUnlock()
+	return len(fake.createArgsForCall)
+}
+
+func (fake *FakeDriver) CreateArgsForCall(i int) (string, string) {
+	fake.createMutex.RLock()
+	defer fake.createMutex.RUnlock()
+	return fake.createArgsForCall[i].id, fake.createArgsForCall[i].parent
+}
+
+func (fake *FakeDriver) CreateReturns(result1 error) {
+	fake.CreateStub = nil
+	fake.createReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeDriver) Remove(id string) error {
+	fake.removeMutex.Lock()
+	fake.removeArgsForCall = append(fake.removeArgsForCall, struct {
+		id string
+	}{id})
+	fake.recordInvocation("Remove", []interface{}{id})
+	fake.removeMutex.Unlock()
+	if fake.RemoveStub != nil {
+		return fake.RemoveStub(id)
+	}
+	return fake.removeReturns.result1
+}
+
+func (fake *FakeDriver) RemoveCallCount() int {
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	return len(fake.removeArgsForCall)
+}
+
+func (fake *FakeDriver) RemoveArgsForCall(i int) string {
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	return fake.removeArgsForCall[i].id
+}
+
+func (fake *FakeDriver) RemoveReturns(result1 error) {
+	fake.RemoveStub = nil
+	fake.removeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeDriver) Get(id string, mountLabel string) (string, error) {
+	fake.getMutex.Lock()
+	fake.getArgsForCall = append(fake.getArgsForCall, struct {
+		id         string
+		mountLabel string
+	}{id, mountLabel})
+	fake.recordInvocation("Get", []interface{}{id, mountLabel})
+	fake.getMutex.Unlock()
+	if fake.GetStub != nil {
+		return fake.GetStub(id, mountLabel)
+	}
+	return fake.getReturns.result1, fake.getReturns.result2
+}
+
+func (fake *FakeDriver) GetCallCount() int {
+	fake.getMutex.RLock()
+	defer fake.getMutex.RUnlock()
+	return len(fake.getArgsForCall)
+}
+
+func (fake *FakeDriver) GetArgsForCall(i int) (string, string) {
+	fake.getMutex.RLock()
+	defer fake.getMutex.RUnlock()
+	return fake.getArgsForCall[i].id, fake.getArgsForCall[i].mountLabel
+}
+
+func (fake *FakeDriver) GetReturns(result1 string, result2 error) {
+	fake.GetStub = nil
+	fake.getReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeDriver) Put(id string) error {
+	fake.putMutex.Lock()
+	fake.putArgsForCall = append(fake.putArgsForCall, struct {
+		id string
+	}{id})
+	fake.recordInvocation("Put", []interface{}{id})
+	fake.putMutex.Unlock()
+	if fake.PutStub != nil {
+		return fake.PutStub(id)
+	}
+	return fake.putReturns.result1
+}
+
+func (fake *FakeDriver) PutCallCount() int {
+	fake.putMutex.RLock()
+	defer fake.putMutex.RUnlock()
+	return len(fake.putArgsForCall)
+}
+
+func (fake *FakeDriver) PutArgsForCall(i int) string {
+	fake.putMutex.RLock()
+	defer fake.putMutex.RUnlock()
+	return fake.putArgsForCall[i].id
+}
+
+func (fake *FakeDriver) PutReturns(result1 error) {
+	fake.PutStub = nil
+	fake.putReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeDriver) Exists(id string) bool {
+	fake.existsMutex.Lock()
+	fake.existsArgsForCall = append(fake.existsArgsForCall, struct {
+		id string
+	}{id})
+	fake.recordInvocation("Exists", []interface{}{id})
+	fake.existsMutex.Unlock()
+	if fake.ExistsStub != nil {
+		return fake.ExistsStub(id)
+	}
+	return fake.existsReturns.result1
+}
+
+func (fake *FakeDriver) ExistsCallCount() int {
+	fake.existsMutex.RLock()
+	defer fake.existsMutex.RUnlock()
+	return len(fake.existsArgsForCall)
+}
+
+func (fake *FakeDriver) ExistsArgsForCall(i int) string {
+	fake.existsMutex.RLock()
+	defer fake.existsMutex.RUnlock()
+	return fake.existsArgsForCall[i].id
+}
+
+func (fake *FakeDriver) ExistsReturns(result1 bool) {
+	fake.ExistsStub = nil
+	fake.existsReturns = struct {
+		result1 bool
+	}{result1}
+}
+
+func (fake *FakeDriver) ApplyDiff(id string, parent string, diff archive.ArchiveReader) (int64, error) {
+	fake.applyDiffMutex.Lock()
+	fake.applyDiffArgsForCall = append(fake.applyDiffArgsForCall, struct {
+		id     string
+		parent string
+		diff   archive.ArchiveReader
+	}{id, parent, diff})
+	fake.recordInvocation("ApplyDiff", []interface{}{id, parent, diff})
+	fake.applyDiffMutex.Unlock()
+	if fake.ApplyDiffStub != nil {
+		return fake.ApplyDiffStub(id, parent, diff)
+	}
+	return fake.applyDiffReturns.result1, fake.applyDiffReturns.result2
+}
+
+func (fake *FakeDriver) ApplyDiffCallCount() int {
+	fake.applyDiffMutex.RLock()
+	defer fake.applyDiffMutex.RUnlock()
+	return len(fake.applyDiffArgsForCall)
+}
+
+func (fake *FakeDriver) ApplyDiffArgsForCall(i int) (string, string, archive.ArchiveReader) {
+	fake.applyDiffMutex.RLock()
+	defer fake.applyDiffMutex.RUnlock()
+	return fake.applyDiffArgsForCall[i].id, fake.applyDiffArgsForCall[i].parent, fake.applyDiffArgsForCall[i].diff
+}
+
+func (fake *FakeDriver) ApplyDiffReturns(result1 int64, result2 error) {
+	fake.ApplyDiffStub = nil
+	fake.applyDiffReturns = struct {
+		result1 int64
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeDriver) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.stringMutex.RLock()
+	defer fake.stringMutex.RUnlock()
+	fake.createMutex.RLock()
+	defer fake.createMutex.RUnlock()
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	fake.getMutex.RLock()
+	defer fake.getMutex.RUnlock()
+	fake.putMutex.RLock()
+	defer fake.putMutex.RUnlock()
+	fake.existsMutex.RLock()
+	defer fake.existsMutex.RUnlock()
+	fake.applyDiffMutex.RLock()
+	defer fake.applyDiffMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeDriver) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ layercake.Driver = new(FakeDriver)
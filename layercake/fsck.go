@@ -0,0 +1,482 @@
+package layercake
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/image"
+)
+
+type ProblemCategory string
+
+const (
+	// OrphanedLayer is an entry in a driver directory for a layer which is
+	// not in the cake, such as one left by an interrupted create or remove.
+	OrphanedLayer ProblemCategory = "orphaned-layer"
+
+	// MissingParent is a layer whose parent is not in the cake. It is never
+	// repaired, as the layer may need the files of its parent.
+	MissingParent ProblemCategory = "missing-parent"
+
+	// DanglingLink is a garden-info link from a namespaced layer to the
+	// layer it was copied from, where either is not in the cake, or an
+	// overlay short link to the directory of a layer which is not.
+	DanglingLink ProblemCategory = "dangling-link"
+
+	// UnreadableMetadata is a layer whose metadata is there but cannot be
+	// read, so the cake leaves it out. It is never repaired, and its
+	// directories are not treated as orphaned, as the layer may be needed.
+	UnreadableMetadata ProblemCategory = "unreadable-metadata"
+
+	// LeftoverMount is a mount of a layer which is not in the cake.
+	LeftoverMount ProblemCategory = "leftover-mount"
+
+	// MissingLink is an overlay layer without the short link its mounts
+	// refer to it by, as left by a crash between the layer being moved into
+	// place and being linked. It is repaired by linking it again.
+	MissingLink ProblemCategory = "missing-link"
+
+	// LeftoverTempDir is an entry in the overlay tmp directory, left by an
+	// interrupted register.
+	LeftoverTempDir ProblemCategory = "leftover-temp-dir"
+)
+
+// defaultLayerDirs are the directories, relative to the graph root, whose
+// entries are named after the graph IDs of the layers of each driver. The
+// layers directory is where a Store or an Overlay keeps its layers.
+var defaultLayerDirs = map[string][]string{
+	"aufs":    {"aufs/diff", "aufs/layers", "aufs/mnt", storeLayersDir},
+	"overlay": {"overlay", storeLayersDir},
+	"vfs":     {"vfs/dir", storeLayersDir},
+	"btrfs":   {"btrfs/subvolumes", storeLayersDir},
+	"dir":     {"dir", storeLayersDir},
+}
+
+type FsckOptions struct {
+	// GraphRoot is the directory holding the layer directories of the
+	// driver and the garden-info metadata.
+	GraphRoot string
+
+	// LayerDirs are the directories, relative to GraphRoot, whose entries
+	// are named after graph IDs. They default to those of the cake's driver.
+	LayerDirs []string
+
+	// Repair unmounts leftover mounts, removes orphaned layer directories,
+	// dangling links and leftover temporary directories, and recreates
+	// missing links.
+	Repair bool
+}
+
+type Problem struct {
+	Category    ProblemCategory `json:"category"`
+	ID          string          `json:"id,omitempty"`
+	Path        string          `json:"path,omitempty"`
+	Detail      string          `json:"detail"`
+	Repaired    bool            `json:"repaired"`
+	RepairError string          `json:"repair_error,omitempty"`
+}
+
+type FsckReport struct {
+	Layers   int       `json:"layers"`
+	Problems []Problem `json:"problems"`
+}
+
+// Count returns the number of problems in category.
+func (r *FsckReport) Count(category ProblemCategory) int {
+	count := 0
+	for _, problem := range r.Problems {
+		if problem.Category == category {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Unrepaired returns the problems which were not repaired.
+func (r *FsckReport) Unrepaired() []Problem {
+	var problems []Problem
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+func (r *FsckReport) add(problem Problem, repair func() error) bool {
+	if repair != nil {
+		if err := repair(); err != nil {
+			problem.RepairError = err.Error()
+		} else {
+			problem.Repaired = true
+		}
+	}
+
+	r.Problems = append(r.Problems, problem)
+	return problem.Repaired
+}
+
+// Fsck checks the layers of cake against the layer directories, mounts,
+// overlay short links and temporary directories under opts.GraphRoot, and the
+// garden-info links of an AufsCake. The cake should not be changed while it runs, for example by
+// running it before the cake is used or while holding the lock that garbage
+// collection takes.
+func Fsck(cake Cake, opts FsckOptions) (*FsckReport, error) {
+	if opts.GraphRoot == "" {
+		return nil, errors.New("layercake: fsck: empty graph root")
+	}
+
+	// mount points are absolute paths without symlinks
+	graphRoot, err := filepath.Abs(opts.GraphRoot)
+	if err != nil {
+		return nil, fmt.Errorf("layercake: fsck: %s", err)
+	}
+
+	if resolved, err := filepath.EvalSymlinks(graphRoot); err == nil {
+		graphRoot = resolved
+	}
+
+	layers := make(map[string]string)
+	for _, img := range cake.All() {
+		layers[img.ID] = img.Parent
+	}
+
+	layerDirs := opts.LayerDirs
+	if layerDirs == nil {
+		layerDirs = defaultLayerDirs[cake.DriverName()]
+	}
+
+	report := &FsckReport{Layers: len(layers)}
+
+	for _, dir := range layerDirs {
+		if dir != storeLayersDir {
+			continue
+		}
+
+		// from here on, layers whose metadata cannot be read are treated as
+		// existing, so nothing they may need is removed
+		if err := checkMetadata(report, layers, filepath.Join(graphRoot, dir)); err != nil {
+			return nil, fmt.Errorf("layercake: fsck: %s", err)
+		}
+	}
+
+	mounted, err := checkMounts(report, layers, graphRoot, layerDirs, opts.Repair)
+	if err != nil {
+		return nil, fmt.Errorf("layercake: fsck: %s", err)
+	}
+
+	for _, dir := range layerDirs {
+		if err := checkLayerDir(report, layers, filepath.Join(graphRoot, dir), mounted, opts.Repair); err != nil {
+			return nil, fmt.Errorf("layercake: fsck: %s", err)
+		}
+	}
+
+	for _, id := range sortedKeys(layers) {
+		if parent := layers[id]; parent != "" {
+			if _, ok := layers[parent]; !ok {
+				report.add(Problem{Category: MissingParent, ID: id, Detail: fmt.Sprintf("parent %s does not exist", parent)}, nil)
+			}
+		}
+	}
+
+	if cake.DriverName() == "overlay" {
+		if err := checkShortLinks(report, layers, graphRoot, opts.Repair); err != nil {
+			return nil, fmt.Errorf("layercake: fsck: %s", err)
+		}
+
+		if err := checkTempDirs(report, filepath.Join(graphRoot, overlayTmpDir), mounted, opts.Repair); err != nil {
+			return nil, fmt.Errorf("layercake: fsck: %s", err)
+		}
+	}
+
+	if aufs, ok := cake.(*AufsCake); ok {
+		if err := checkLinks(report, layers, aufs, opts.Repair); err != nil {
+			return nil, fmt.Errorf("layercake: fsck: %s", err)
+		}
+	}
+
+	return report, nil
+}
+
+// checkMetadata reports the entries of dir which are not layers in the cake
+// but have metadata, which must be that of layers the cake could not read.
+// They are added to layers.
+func checkMetadata(report *FsckReport, layers map[string]string, dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, ok := layers[entry.Name()]; ok {
+			continue
+		}
+
+		// a Store keeps the image in json, an Overlay in image.json
+		for _, name := range []string{"json", "image.json"} {
+			path := filepath.Join(dir, entry.Name(), name)
+			if _, err := os.Lstat(path); err != nil {
+				continue
+			}
+
+			detail := "layer is not in the cake"
+			if err := readImage(path); err != nil {
+				detail = err.Error()
+			}
+
+			report.add(Problem{Category: UnreadableMetadata, ID: entry.Name(), Path: path, Detail: detail}, nil)
+			layers[entry.Name()] = ""
+			break
+		}
+	}
+
+	return nil
+}
+
+func readImage(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var img image.Image
+	return json.Unmarshal(contents, &img)
+}
+
+// checkMounts reports mounts of layers which are not in the cake, returning
+// the mount points which remain.
+func checkMounts(report *FsckReport, layers map[string]string, graphRoot string, layerDirs []string, repair bool) ([]string, error) {
+	mountPoints, err := mountsUnder(graphRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var mounted []string
+	for _, mountPoint := range mountPoints {
+		id, ok := layerOf(mountPoint, graphRoot, layerDirs)
+		if _, exists := layers[id]; !ok || exists {
+			mounted = append(mounted, mountPoint)
+			continue
+		}
+
+		var fix func() error
+		if repair {
+			fix = func() error { return unmount(mountPoint) }
+		}
+
+		if !report.add(Problem{Category: LeftoverMount, ID: id, Path: mountPoint, Detail: "layer does not exist"}, fix) {
+			mounted = append(mounted, mountPoint)
+		}
+	}
+
+	return mounted, nil
+}
+
+func checkLayerDir(report *FsckReport, layers map[string]string, dir string, mounted []string, repair bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, ok := layers[entry.Name()]; ok {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		var fix func() error
+		if repair {
+			fix = func() error {
+				for _, mountPoint := range mounted {
+					if within(mountPoint, path) {
+						return fmt.Errorf("%s is mounted", mountPoint)
+					}
+				}
+
+				return removeAll(path)
+			}
+		}
+
+		report.add(Problem{Category: OrphanedLayer, ID: entry.Name(), Path: path, Detail: "layer does not exist"}, fix)
+	}
+
+	return nil
+}
+
+// checkShortLinks reports the overlay short links which do not lead to the
+// directory of a layer in the cake, and the layers whose short link is
+// missing.
+func checkShortLinks(report *FsckReport, layers map[string]string, graphRoot string, repair bool) error {
+	dir := filepath.Join(graphRoot, overlayLinksDir)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		// links are relative, ../layers/<graph id>/diff
+		target, err := os.Readlink(path)
+		if err != nil {
+			target = ""
+		}
+
+		id := filepath.Base(filepath.Dir(target))
+
+		var detail string
+		if _, ok := layers[id]; !ok || target == "" {
+			detail = "layer does not exist"
+		} else if _, err := os.Stat(path); err != nil {
+			detail = fmt.Sprintf("target of layer %s does not exist", id)
+		} else {
+			continue
+		}
+
+		var fix func() error
+		if repair {
+			fix = func() error { return os.Remove(path) }
+		}
+
+		report.add(Problem{Category: DanglingLink, ID: id, Path: path, Detail: detail}, fix)
+	}
+
+	for _, id := range sortedKeys(layers) {
+		// the name of the link is kept in the layer, layers without one are
+		// not overlay layers
+		link, err := ioutil.ReadFile(filepath.Join(graphRoot, overlayLayersDir, id, "link"))
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(dir, string(link))
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+
+		var fix func() error
+		if repair {
+			fix = func() error {
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					return err
+				}
+
+				return os.Symlink(filepath.Join("..", overlayLayersDir, id, "diff"), path)
+			}
+		}
+
+		report.add(Problem{Category: MissingLink, ID: id, Path: path, Detail: "layer has no short link"}, fix)
+	}
+
+	return nil
+}
+
+// checkTempDirs reports the entries of the overlay tmp directory, which only
+// holds layers while they are registered.
+func checkTempDirs(report *FsckReport, dir string, mounted []string, repair bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		var fix func() error
+		if repair {
+			fix = func() error {
+				for _, mountPoint := range mounted {
+					if within(mountPoint, path) {
+						return fmt.Errorf("%s is mounted", mountPoint)
+					}
+				}
+
+				return removeAll(path)
+			}
+		}
+
+		report.add(Problem{Category: LeftoverTempDir, Path: path, Detail: "left by an interrupted register"}, fix)
+	}
+
+	return nil
+}
+
+// checkLinks reports links whose layers are not in the cake. Links are kept
+// from child to parent only, so there are no reverse links to rebuild, but
+// repairing migrates the parent-child and child-parent files of earlier
+// versions.
+func checkLinks(report *FsckReport, layers map[string]string, links *AufsCake, repair bool) error {
+	links.mu.Lock()
+	childParents, err := links.loadLinks(repair)
+	links.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range sortedKeys(childParents) {
+		parent := childParents[child]
+
+		var detail string
+		if _, ok := layers[child]; !ok {
+			detail = "layer does not exist"
+		} else if _, ok := layers[parent]; !ok {
+			detail = fmt.Sprintf("parent %s does not exist", parent)
+		} else {
+			continue
+		}
+
+		var fix func() error
+		if repair {
+			fix = func() error { return links.removeLink(child) }
+		}
+
+		report.add(Problem{Category: DanglingLink, ID: child, Path: links.linksPath(), Detail: detail}, fix)
+	}
+
+	return nil
+}
+
+// layerOf returns the graph ID of the layer whose directory holds path.
+func layerOf(path, graphRoot string, layerDirs []string) (string, bool) {
+	for _, dir := range layerDirs {
+		rel, err := filepath.Rel(filepath.Join(graphRoot, dir), path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		return strings.Split(rel, string(filepath.Separator))[0], true
+	}
+
+	return "", false
+}
+
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
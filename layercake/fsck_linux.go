@@ -0,0 +1,64 @@
+package layercake
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// mountsUnder returns the mount points below root, deepest first, so that
+// they can be unmounted in order.
+func mountsUnder(root string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mountPoints []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mountPoint := unescapeMountPoint(fields[4])
+		if mountPoint != root && within(mountPoint, root) {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(mountPoints)))
+	return mountPoints, nil
+}
+
+// unescapeMountPoint undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in mountinfo.
+func unescapeMountPoint(s string) string {
+	var unescaped []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				unescaped = append(unescaped, byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		unescaped = append(unescaped, s[i])
+	}
+
+	return string(unescaped)
+}
+
+func unmount(path string) error {
+	return syscall.Unmount(path, 0)
+}
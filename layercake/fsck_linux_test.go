@@ -0,0 +1,82 @@
+package layercake_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/layercake/fake_cake"
+	"github.com/docker/docker/image"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fsck of mounts", func() {
+	var (
+		root string
+		cake *fake_cake.FakeCake
+	)
+
+	mount := func(id string) string {
+		mountPoint := filepath.Join(root, "aufs", "mnt", id)
+		Expect(os.MkdirAll(mountPoint, 0755)).To(Succeed())
+		Expect(syscall.Mount("tmpfs", mountPoint, "tmpfs", 0, "")).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(mountPoint, "file"), []byte("contents"), 0644)).To(Succeed())
+		return mountPoint
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "fsckroot")
+		Expect(err).NotTo(HaveOccurred())
+
+		root, err = filepath.EvalSymlinks(root)
+		Expect(err).NotTo(HaveOccurred())
+
+		cake = new(fake_cake.FakeCake)
+		cake.DriverNameReturns("aufs")
+		cake.AllReturns([]*image.Image{{ID: "mounted"}})
+	})
+
+	AfterEach(func() {
+		syscall.Unmount(filepath.Join(root, "aufs", "mnt", "mounted"), 0)
+		syscall.Unmount(filepath.Join(root, "aufs", "mnt", "gone"), 0)
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	Context("when a layer which does not exist is mounted", func() {
+		var mountPoint string
+
+		BeforeEach(func() {
+			mount("mounted")
+			mountPoint = mount("gone")
+		})
+
+		It("reports the mount and the orphaned directory", func() {
+			report, err := layercake.Fsck(cake, layercake.FsckOptions{GraphRoot: root})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(report.Problems).To(Equal([]layercake.Problem{
+				{Category: layercake.LeftoverMount, ID: "gone", Path: mountPoint, Detail: "layer does not exist"},
+				{Category: layercake.OrphanedLayer, ID: "gone", Path: mountPoint, Detail: "layer does not exist"},
+			}))
+		})
+
+		It("unmounts it before removing the directory when repairing", func() {
+			report, err := layercake.Fsck(cake, layercake.FsckOptions{GraphRoot: root, Repair: true})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(report.Unrepaired()).To(BeEmpty())
+			Expect(mountPoint).NotTo(BeADirectory())
+		})
+
+		It("leaves the mounts of layers which exist", func() {
+			_, err := layercake.Fsck(cake, layercake.FsckOptions{GraphRoot: root, Repair: true})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(root, "aufs", "mnt", "mounted", "file")).To(BeAnExistingFile())
+		})
+	})
+})
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package layercake
+
+import "errors"
+
+func mountsUnder(root string) ([]string, error) {
+	return nil, nil
+}
+
+func unmount(path string) error {
+	return errors.New("unmounting is only supported on linux")
+}
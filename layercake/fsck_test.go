@@ -0,0 +1,390 @@
+package layercake_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/layercake/fake_cake"
+	"github.com/docker/docker/image"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fsck", func() {
+	var (
+		root   string
+		cake   *fake_cake.FakeCake
+		repair bool
+		report *layercake.FsckReport
+	)
+
+	mkdir := func(elem ...string) {
+		Expect(os.MkdirAll(filepath.Join(append([]string{root}, elem...)...), 0755)).To(Succeed())
+	}
+
+	writeLinks := func(contents string) {
+		mkdir("garden-info")
+		Expect(ioutil.WriteFile(filepath.Join(root, "garden-info", "links.json"), []byte(contents), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "fsckroot")
+		Expect(err).NotTo(HaveOccurred())
+
+		root, err = filepath.EvalSymlinks(root)
+		Expect(err).NotTo(HaveOccurred())
+
+		repair = false
+
+		cake = new(fake_cake.FakeCake)
+		cake.DriverNameReturns("aufs")
+		cake.AllReturns([]*image.Image{
+			{ID: "base"},
+			{ID: "child", Parent: "base"},
+			{ID: "namespaced"},
+		})
+
+		for _, dir := range []string{"diff", "mnt"} {
+			mkdir("aufs", dir, "base")
+			mkdir("aufs", dir, "child")
+			mkdir("aufs", dir, "namespaced")
+		}
+
+		writeLinks(`{"namespaced":"base"}`)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		report, err = layercake.Fsck(&layercake.AufsCake{Cake: cake, GraphRoot: root}, layercake.FsckOptions{GraphRoot: root, Repair: repair})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports no problems for a consistent graph", func() {
+		Expect(report.Layers).To(Equal(3))
+		Expect(report.Problems).To(BeEmpty())
+	})
+
+	It("requires a graph root", func() {
+		_, err := layercake.Fsck(cake, layercake.FsckOptions{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("when a driver directory has no layer", func() {
+		BeforeEach(func() {
+			mkdir("aufs", "diff", "orphan")
+			mkdir("aufs", "mnt", "orphan")
+		})
+
+		It("reports each directory as orphaned", func() {
+			Expect(report.Count(layercake.OrphanedLayer)).To(Equal(2))
+			Expect(report.Problems[0]).To(Equal(layercake.Problem{
+				Category: layercake.OrphanedLayer,
+				ID:       "orphan",
+				Path:     filepath.Join(root, "aufs", "diff", "orphan"),
+				Detail:   "layer does not exist",
+			}))
+		})
+
+		It("does not remove them", func() {
+			Expect(filepath.Join(root, "aufs", "diff", "orphan")).To(BeADirectory())
+		})
+
+		Context("when repairing", func() {
+			BeforeEach(func() {
+				repair = true
+			})
+
+			It("removes them", func() {
+				Expect(report.Unrepaired()).To(BeEmpty())
+				Expect(filepath.Join(root, "aufs", "diff", "orphan")).NotTo(BeADirectory())
+				Expect(filepath.Join(root, "aufs", "mnt", "orphan")).NotTo(BeADirectory())
+			})
+
+			It("keeps the directories of layers", func() {
+				Expect(filepath.Join(root, "aufs", "diff", "base")).To(BeADirectory())
+			})
+		})
+	})
+
+	Context("when the layer directories are given", func() {
+		BeforeEach(func() {
+			mkdir("elsewhere", "orphan")
+			mkdir("aufs", "diff", "orphan")
+		})
+
+		It("checks those directories instead", func() {
+			report, err := layercake.Fsck(cake, layercake.FsckOptions{GraphRoot: root, LayerDirs: []string{"elsewhere"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(report.Problems).To(HaveLen(1))
+			Expect(report.Problems[0].Path).To(Equal(filepath.Join(root, "elsewhere", "orphan")))
+		})
+	})
+
+	Context("when a layer's parent is missing", func() {
+		BeforeEach(func() {
+			cake.AllReturns([]*image.Image{
+				{ID: "child", Parent: "base"},
+			})
+			Expect(os.RemoveAll(filepath.Join(root, "aufs"))).To(Succeed())
+			writeLinks(`{}`)
+
+			repair = true
+		})
+
+		It("reports it without repairing it", func() {
+			Expect(report.Problems).To(Equal([]layercake.Problem{{
+				Category: layercake.MissingParent,
+				ID:       "child",
+				Detail:   "parent base does not exist",
+			}}))
+			Expect(report.Unrepaired()).To(HaveLen(1))
+		})
+	})
+
+	Context("when a link's layer or parent is missing", func() {
+		BeforeEach(func() {
+			writeLinks(`{"namespaced":"base","deleted":"base","orphaned":"gone"}`)
+			cake.AllReturns([]*image.Image{
+				{ID: "base"},
+				{ID: "child", Parent: "base"},
+				{ID: "namespaced"},
+				{ID: "orphaned"},
+			})
+			mkdir("aufs", "diff", "orphaned")
+			mkdir("aufs", "mnt", "orphaned")
+		})
+
+		It("reports the dangling links", func() {
+			Expect(report.Count(layercake.DanglingLink)).To(Equal(2))
+			Expect(report.Problems[0].ID).To(Equal("deleted"))
+			Expect(report.Problems[0].Detail).To(Equal("layer does not exist"))
+			Expect(report.Problems[1].ID).To(Equal("orphaned"))
+			Expect(report.Problems[1].Detail).To(Equal("parent gone does not exist"))
+		})
+
+		Context("when repairing", func() {
+			BeforeEach(func() {
+				repair = true
+			})
+
+			It("removes the dangling links and keeps the others", func() {
+				Expect(report.Unrepaired()).To(BeEmpty())
+
+				contents, err := ioutil.ReadFile(filepath.Join(root, "garden-info", "links.json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				var links map[string]string
+				Expect(json.Unmarshal(contents, &links)).To(Succeed())
+				Expect(links).To(Equal(map[string]string{"namespaced": "base"}))
+			})
+		})
+	})
+
+	Context("when the cake is not an AufsCake", func() {
+		BeforeEach(func() {
+			writeLinks(`{"deleted":"base"}`)
+		})
+
+		It("does not check the garden-info links", func() {
+			report, err := layercake.Fsck(cake, layercake.FsckOptions{GraphRoot: root})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(report.Problems).To(BeEmpty())
+		})
+	})
+
+	Context("when the links are in the files of an earlier version", func() {
+		BeforeEach(func() {
+			Expect(os.Remove(filepath.Join(root, "garden-info", "links.json"))).To(Succeed())
+			mkdir("garden-info", "child-parent")
+			Expect(ioutil.WriteFile(filepath.Join(root, "garden-info", "child-parent", "deleted"), []byte("base\n"), 0755)).To(Succeed())
+		})
+
+		It("reports the dangling links without migrating them", func() {
+			Expect(report.Count(layercake.DanglingLink)).To(Equal(1))
+			Expect(filepath.Join(root, "garden-info", "child-parent", "deleted")).To(BeAnExistingFile())
+			Expect(filepath.Join(root, "garden-info", "links.json")).NotTo(BeAnExistingFile())
+		})
+
+		Context("when repairing", func() {
+			BeforeEach(func() {
+				repair = true
+			})
+
+			It("migrates the links and removes the dangling ones", func() {
+				Expect(report.Unrepaired()).To(BeEmpty())
+				Expect(filepath.Join(root, "garden-info", "child-parent")).NotTo(BeADirectory())
+				Expect(ioutil.ReadFile(filepath.Join(root, "garden-info", "links.json"))).To(MatchJSON(`{}`))
+			})
+		})
+	})
+
+	Context("when a layer's metadata cannot be read", func() {
+		BeforeEach(func() {
+			mkdir("layers", "base")
+			Expect(ioutil.WriteFile(filepath.Join(root, "layers", "base", "json"), []byte(`{"id":"base"}`), 0644)).To(Succeed())
+
+			mkdir("layers", "corrupt")
+			Expect(ioutil.WriteFile(filepath.Join(root, "layers", "corrupt", "json"), []byte("{not json"), 0644)).To(Succeed())
+			mkdir("aufs", "diff", "corrupt")
+			mkdir("aufs", "diff", "corrupt-child")
+
+			cake.AllReturns([]*image.Image{
+				{ID: "base"},
+				{ID: "child", Parent: "base"},
+				{ID: "namespaced"},
+				{ID: "corrupt-child", Parent: "corrupt"},
+			})
+
+			repair = true
+		})
+
+		It("reports it as unreadable without repairing it", func() {
+			Expect(report.Problems).To(HaveLen(1))
+			Expect(report.Problems[0].Category).To(Equal(layercake.UnreadableMetadata))
+			Expect(report.Problems[0].ID).To(Equal("corrupt"))
+			Expect(report.Problems[0].Path).To(Equal(filepath.Join(root, "layers", "corrupt", "json")))
+			Expect(report.Unrepaired()).To(HaveLen(1))
+		})
+
+		It("does not remove its directories", func() {
+			Expect(filepath.Join(root, "layers", "corrupt", "json")).To(BeAnExistingFile())
+			Expect(filepath.Join(root, "aufs", "diff", "corrupt")).To(BeADirectory())
+		})
+	})
+
+	Context("when the cake is an overlay", func() {
+		link := func(name, target string) {
+			mkdir("l")
+			Expect(os.Symlink(target, filepath.Join(root, "l", name))).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			cake.DriverNameReturns("overlay")
+			Expect(os.RemoveAll(filepath.Join(root, "aufs"))).To(Succeed())
+			Expect(os.RemoveAll(filepath.Join(root, "garden-info"))).To(Succeed())
+
+			for _, id := range []string{"base", "child", "namespaced"} {
+				mkdir("layers", id, "diff")
+				Expect(ioutil.WriteFile(filepath.Join(root, "layers", id, "image.json"), []byte(`{"id":"`+id+`"}`), 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(root, "layers", id, "link"), []byte(strings.ToUpper(id)), 0644)).To(Succeed())
+				link(strings.ToUpper(id), filepath.Join("..", "layers", id, "diff"))
+			}
+		})
+
+		It("reports no problems for a consistent graph", func() {
+			Expect(report.Problems).To(BeEmpty())
+		})
+
+		Context("when a register was interrupted", func() {
+			BeforeEach(func() {
+				mkdir("tmp", "registering", "diff")
+			})
+
+			It("reports its temporary directory", func() {
+				Expect(report.Problems).To(Equal([]layercake.Problem{
+					{Category: layercake.LeftoverTempDir, Path: filepath.Join(root, "tmp", "registering"), Detail: "left by an interrupted register"},
+				}))
+			})
+
+			Context("when repairing", func() {
+				BeforeEach(func() {
+					repair = true
+				})
+
+				It("removes it", func() {
+					Expect(report.Unrepaired()).To(BeEmpty())
+					Expect(filepath.Join(root, "tmp", "registering")).NotTo(BeADirectory())
+				})
+			})
+		})
+
+		Context("when a layer's short link is missing", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(filepath.Join(root, "l", "CHILD"))).To(Succeed())
+			})
+
+			It("reports the layer", func() {
+				Expect(report.Problems).To(Equal([]layercake.Problem{
+					{Category: layercake.MissingLink, ID: "child", Path: filepath.Join(root, "l", "CHILD"), Detail: "layer has no short link"},
+				}))
+			})
+
+			Context("when repairing", func() {
+				BeforeEach(func() {
+					repair = true
+				})
+
+				It("links the layer again", func() {
+					Expect(report.Unrepaired()).To(BeEmpty())
+
+					target, err := os.Readlink(filepath.Join(root, "l", "CHILD"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(target).To(Equal(filepath.Join("..", "layers", "child", "diff")))
+					Expect(filepath.Join(root, "l", "CHILD")).To(BeADirectory())
+				})
+			})
+		})
+
+		Context("when a short link's layer is missing", func() {
+			BeforeEach(func() {
+				link("GONE", filepath.Join("..", "layers", "gone", "diff"))
+				link("NODIFF", filepath.Join("..", "layers", "child", "missing"))
+			})
+
+			It("reports the dangling links", func() {
+				Expect(report.Problems).To(Equal([]layercake.Problem{
+					{Category: layercake.DanglingLink, ID: "gone", Path: filepath.Join(root, "l", "GONE"), Detail: "layer does not exist"},
+					{Category: layercake.DanglingLink, ID: "child", Path: filepath.Join(root, "l", "NODIFF"), Detail: "target of layer child does not exist"},
+				}))
+			})
+
+			Context("when repairing", func() {
+				BeforeEach(func() {
+					repair = true
+				})
+
+				It("removes the dangling links and keeps the others", func() {
+					Expect(report.Unrepaired()).To(BeEmpty())
+
+					entries, err := ioutil.ReadDir(filepath.Join(root, "l"))
+					Expect(err).NotTo(HaveOccurred())
+
+					var names []string
+					for _, entry := range entries {
+						names = append(names, entry.Name())
+					}
+					Expect(names).To(ConsistOf("BASE", "CHILD", "NAMESPACED"))
+				})
+			})
+		})
+	})
+
+	It("can be logged as JSON", func() {
+		mkdir("aufs", "diff", "orphan")
+
+		report, err := layercake.Fsck(cake, layercake.FsckOptions{GraphRoot: root})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(json.Marshal(report)).To(MatchJSON(`{
+			"layers": 3,
+			"problems": [{
+				"category": "orphaned-layer",
+				"id": "orphan",
+				"path": "` + filepath.Join(root, "aufs", "diff", "orphan") + `",
+				"detail": "layer does not exist",
+				"repaired": false
+			}]
+		}`))
+	})
+})
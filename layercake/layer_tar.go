@@ -0,0 +1,300 @@
+package layercake
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/symlink"
+)
+
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutMetaPrefix = ".wh..wh."
+	opaqueWhiteout     = ".wh..wh..opq"
+)
+
+// whiteouts is how the aufs whiteouts in a layer tar are applied to the
+// directory it is extracted into.
+type whiteouts interface {
+	// whiteout removes name from dir
+	whiteout(dir, name string) error
+
+	// opaque hides the contents of dir from lower layers, apart from those
+	// for which extracted is true, which came from the layer itself
+	opaque(dir string, extracted func(path string) bool) error
+}
+
+// applyLayer extracts the layer tar, which may be compressed as registry
+// blobs are, into dest, returning the total size of the regular files
+// extracted. Ownership, device nodes and xattrs which need privileges are
+// skipped when not running as root.
+//
+// The directory of each entry is resolved within dest, following symlinks
+// as if dest were the root, so that neither a malicious layer nor an
+// absolute symlink in a parent layer (such as lib64 -> /lib) can lead
+// outside of it.
+func applyLayer(dest string, layer io.Reader, wh whiteouts) (int64, error) {
+	var size int64
+	var dirs []extractedDir
+	extracted := make(map[string]bool)
+	restore := make(map[string]os.FileMode)
+
+	stream, err := archive.DecompressStream(layer)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+
+		dir, err := resolveInScope(dest, filepath.Dir(name))
+		if err != nil {
+			return 0, fmt.Errorf("extract %s: %s", name, err)
+		}
+
+		base := filepath.Base(name)
+		path := filepath.Join(dir, base)
+
+		if err := makeWritable(dir, restore); err != nil {
+			return 0, err
+		}
+
+		if base == opaqueWhiteout {
+			if err := wh.opaque(dir, func(path string) bool { return extracted[path] }); err != nil {
+				return 0, fmt.Errorf("mark %s opaque: %s", name, err)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(base, whiteoutMetaPrefix) || strings.Contains(name, "/"+whiteoutMetaPrefix) {
+			// aufs bookkeeping, such as .wh..wh.plnk
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, err
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if err := wh.whiteout(dir, strings.TrimPrefix(base, whiteoutPrefix)); err != nil {
+				return 0, fmt.Errorf("whiteout %s: %s", name, err)
+			}
+			continue
+		}
+
+		if info, err := os.Lstat(path); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := removeAll(path); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := createFromHeader(dest, path, hdr, tr)
+		if err != nil {
+			return 0, fmt.Errorf("extract %s: %s", name, err)
+		}
+		size += n
+		extracted[path] = true
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, extractedDir{path: path, hdr: hdr})
+		}
+	}
+
+	for dir, mode := range restore {
+		if err := chmodDir(dir, mode); err != nil {
+			return 0, err
+		}
+	}
+
+	// directory modes and times are set last, as creating their contents
+	// can need write permission and changes their times
+	for _, dir := range dirs {
+		if err := chmodDir(dir.path, dir.hdr.FileInfo().Mode()); err != nil {
+			return 0, err
+		}
+
+		if err := os.Chtimes(dir.path, accessTime(dir.hdr), dir.hdr.ModTime); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+type extractedDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// resolveInScope returns the path of name within dest, with any symlinks
+// along it resolved as if dest were the root.
+func resolveInScope(dest, name string) (string, error) {
+	return symlink.FollowSymlinkInScope(filepath.Join(dest, filepath.Clean("/"+name)), dest)
+}
+
+// chmodDir changes the mode of dir, unless a later entry of the layer has
+// replaced it with something else, such as a symlink which must not be
+// followed.
+func chmodDir(dir string, mode os.FileMode) error {
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return os.Chmod(dir, mode)
+}
+
+func createFromHeader(dest, path string, hdr *tar.Header, contents io.Reader) (int64, error) {
+	var size int64
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+			return 0, err
+		}
+
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return 0, err
+		}
+
+		size, err = io.Copy(f, contents)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return 0, err
+		}
+
+		return 0, unprivileged(os.Lchown(path, hdr.Uid, hdr.Gid))
+
+	case tar.TypeLink:
+		linkname := filepath.Clean("/" + hdr.Linkname)
+		linkDir, err := resolveInScope(dest, filepath.Dir(linkname))
+		if err != nil {
+			return 0, err
+		}
+
+		// link(2) does not follow a final symlink, so the target is within
+		// dest. The link shares the target's ownership and mode, which are
+		// not changed, as the target may be a symlink.
+		return 0, os.Link(filepath.Join(linkDir, filepath.Base(linkname)), path)
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := unprivileged(mknod(path, hdr)); err != nil {
+			return 0, err
+		}
+
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return 0, nil
+		}
+
+	case tar.TypeXGlobalHeader:
+		return 0, nil
+
+	default:
+		return 0, fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+
+	if err := unprivileged(os.Lchown(path, hdr.Uid, hdr.Gid)); err != nil {
+		return 0, err
+	}
+
+	for key, value := range hdr.Xattrs {
+		if err := unprivileged(setXattr(path, key, value)); err != nil {
+			return 0, err
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return 0, nil
+	}
+
+	if err := os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+		return 0, err
+	}
+
+	if err := os.Chtimes(path, accessTime(hdr), hdr.ModTime); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// makeWritable lets an unprivileged process change the contents of an
+// existing read-only directory, recording its mode in restore.
+func makeWritable(dir string, restore map[string]os.FileMode) error {
+	dir = filepath.Clean(dir)
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	if _, ok := restore[dir]; ok {
+		return nil
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil || !info.IsDir() || info.Mode().Perm()&0200 != 0 {
+		return nil
+	}
+
+	restore[dir] = info.Mode()
+	return os.Chmod(dir, info.Mode()|0200)
+}
+
+// removeAll is os.RemoveAll, which also removes read-only directories when
+// not running as root.
+func removeAll(path string) error {
+	if os.Geteuid() != 0 {
+		filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() && info.Mode().Perm()&0200 == 0 {
+				os.Chmod(path, info.Mode()|0200)
+			}
+			return nil
+		})
+	}
+
+	return os.RemoveAll(path)
+}
+
+// unprivileged ignores permission errors when not running as root, since
+// ownership and device nodes then cannot be preserved.
+func unprivileged(err error) error {
+	if err != nil && os.Geteuid() != 0 && os.IsPermission(err) {
+		return nil
+	}
+
+	return err
+}
+
+func accessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+
+	return hdr.AccessTime
+}
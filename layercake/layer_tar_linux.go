@@ -0,0 +1,28 @@
+package layercake
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+func mknod(path string, hdr *tar.Header) error {
+	mode := uint32(hdr.FileInfo().Mode().Perm())
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+
+	return syscall.Mknod(path, mode, int(mkdev(hdr.Devmajor, hdr.Devminor)))
+}
+
+func setXattr(path, key, value string) error {
+	return syscall.Setxattr(path, key, []byte(value), 0)
+}
+
+func mkdev(major, minor int64) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package layercake
+
+import (
+	"archive/tar"
+	"errors"
+)
+
+func mknod(path string, hdr *tar.Header) error {
+	return errors.New("device nodes can only be extracted on linux")
+}
+
+func setXattr(path, key, value string) error {
+	return nil
+}
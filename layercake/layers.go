@@ -0,0 +1,55 @@
+package layercake
+
+import (
+	"io/ioutil"
+
+	"github.com/docker/docker/image"
+)
+
+// readLayers gets the layers named by the entries of dir, skipping any which
+// cannot be got.
+func readLayers(dir string, get func(ID) (*image.Image, error)) (layers []*image.Image) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	for _, entry := range entries {
+		img, err := get(DockerImageID(entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		layers = append(layers, img)
+	}
+
+	return layers
+}
+
+// isLeaf is whether none of layers is a child of id.
+func isLeaf(layers []*image.Image, id ID) bool {
+	for _, img := range layers {
+		if img.Parent == id.GraphID() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// leaves returns the layers which are not the parent of another.
+func leaves(layers []*image.Image) []ID {
+	parents := make(map[string]bool)
+	for _, img := range layers {
+		parents[img.Parent] = true
+	}
+
+	var ids []ID
+	for _, img := range layers {
+		if !parents[img.ID] {
+			ids = append(ids, DockerImageID(img.ID))
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,274 @@
+package layercake
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+)
+
+const (
+	overlayLayersDir = "layers"
+	overlayLinksDir  = "l"
+	overlayTmpDir    = "tmp"
+)
+
+// Overlay is a Cake which keeps each layer as a directory of its own changes
+// and mounts a layer's chain of parents as the lowerdirs of an overlay
+// filesystem. Layers without a parent are used directly, without a mount.
+//
+// Under Root, each layer lives in layers/<graph id>:
+//
+//	image.json   the image of the layer
+//	diff/        the files of the layer, the upperdir of its mount
+//	work/        the overlay workdir
+//	merged/      where the layer is mounted
+//	link         the name of the short link to diff/ in l/
+//	lower        the short links of its parents, nearest first
+//
+// The short links keep the mount options of deep chains within a page.
+type Overlay struct {
+	Root string
+
+	mu sync.Mutex
+}
+
+func (o *Overlay) DriverName() string {
+	return "overlay"
+}
+
+func (o *Overlay) Create(layerID, parentID ID, containerID string) error {
+	return o.Register(
+		&image.Image{
+			ID:        layerID.GraphID(),
+			Parent:    parentID.GraphID(),
+			Container: containerID,
+		}, nil)
+}
+
+// Register creates the layer of img from the changes in layer, which may be
+// nil for an empty layer. Whiteouts and opaque directories in the aufs format
+// used by docker's layer tars are converted to their overlay equivalents.
+func (o *Overlay) Register(img *image.Image, layer archive.ArchiveReader) error {
+	if img.ID == "" {
+		return errors.New("layercake: register overlay layer: empty ID")
+	}
+
+	if _, err := os.Stat(o.layerDir(img.ID)); err == nil {
+		return fmt.Errorf("layercake: register overlay layer: %s already exists", img.ID)
+	}
+
+	var lower []string
+	if img.Parent != "" {
+		parentLink, err := o.readLink(img.Parent)
+		if err != nil {
+			return fmt.Errorf("layercake: register overlay layer: parent %s: %s", img.Parent, err)
+		}
+
+		parentLower, err := o.readLower(img.Parent)
+		if err != nil {
+			return fmt.Errorf("layercake: register overlay layer: parent %s: %s", img.Parent, err)
+		}
+
+		lower = append([]string{parentLink}, parentLower...)
+	}
+
+	if err := os.MkdirAll(filepath.Join(o.Root, overlayTmpDir), 0700); err != nil {
+		return fmt.Errorf("layercake: register overlay layer: %s", err)
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Join(o.Root, overlayTmpDir), img.ID)
+	if err != nil {
+		return fmt.Errorf("layercake: register overlay layer: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, dir := range []string{"diff", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(tmp, dir), 0755); err != nil {
+			return fmt.Errorf("layercake: register overlay layer: %s", err)
+		}
+	}
+
+	if layer != nil {
+		size, err := applyOverlayLayer(filepath.Join(tmp, "diff"), layer)
+		if err != nil {
+			return fmt.Errorf("layercake: register overlay layer: apply %s: %s", img.ID, err)
+		}
+
+		img.Size = size
+	}
+
+	link := shortLink(img.ID)
+	files := map[string][]byte{
+		"link":  []byte(link),
+		"lower": []byte(strings.Join(lower, ":")),
+	}
+
+	if files["image.json"], err = json.Marshal(img); err != nil {
+		return fmt.Errorf("layercake: register overlay layer: %s", err)
+	}
+
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), contents, 0600); err != nil {
+			return fmt.Errorf("layercake: register overlay layer: %s", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(o.Root, overlayLayersDir), 0700); err != nil {
+		return fmt.Errorf("layercake: register overlay layer: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(o.Root, overlayLinksDir), 0700); err != nil {
+		return fmt.Errorf("layercake: register overlay layer: %s", err)
+	}
+
+	if err := os.Rename(tmp, o.layerDir(img.ID)); err != nil {
+		return fmt.Errorf("layercake: register overlay layer: %s", err)
+	}
+
+	linkTarget := filepath.Join("..", overlayLayersDir, img.ID, "diff")
+	if err := os.Symlink(linkTarget, filepath.Join(o.Root, overlayLinksDir, link)); err != nil {
+		os.RemoveAll(o.layerDir(img.ID))
+		return fmt.Errorf("layercake: register overlay layer: %s", err)
+	}
+
+	return nil
+}
+
+func (o *Overlay) Get(id ID) (*image.Image, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(o.layerDir(id.GraphID()), "image.json"))
+	if err != nil {
+		return nil, fmt.Errorf("layercake: get overlay layer %s: %s", id.GraphID(), err)
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(contents, &img); err != nil {
+		return nil, fmt.Errorf("layercake: get overlay layer %s: %s", id.GraphID(), err)
+	}
+
+	return &img, nil
+}
+
+func (o *Overlay) Unmount(id ID) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.unmount(id.GraphID())
+}
+
+func (o *Overlay) Remove(id ID) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.unmount(id.GraphID()); err != nil {
+		return err
+	}
+
+	if link, err := o.readLink(id.GraphID()); err == nil {
+		os.Remove(filepath.Join(o.Root, overlayLinksDir, link))
+	}
+
+	return os.RemoveAll(o.layerDir(id.GraphID()))
+}
+
+// Path returns the root of the layer, mounting it over its parents if it has
+// any and is not already mounted.
+func (o *Overlay) Path(id ID) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	dir := o.layerDir(id.GraphID())
+	lower, err := o.readLower(id.GraphID())
+	if err != nil {
+		return "", fmt.Errorf("layercake: overlay path %s: %s", id.GraphID(), err)
+	}
+
+	if len(lower) == 0 {
+		return filepath.Join(dir, "diff"), nil
+	}
+
+	merged := filepath.Join(dir, "merged")
+	if mounted, err := isMountPoint(merged); err != nil {
+		return "", fmt.Errorf("layercake: overlay path %s: %s", id.GraphID(), err)
+	} else if mounted {
+		return merged, nil
+	}
+
+	var lowerDirs []string
+	for _, link := range lower {
+		lowerDirs = append(lowerDirs, filepath.Join(o.Root, overlayLinksDir, link))
+	}
+
+	if err := mountOverlay(lowerDirs, filepath.Join(dir, "diff"), filepath.Join(dir, "work"), merged); err != nil {
+		return "", fmt.Errorf("layercake: overlay path %s: %s", id.GraphID(), err)
+	}
+
+	return merged, nil
+}
+
+func (o *Overlay) QuotaedPath(id ID, quota int64) (string, error) {
+	return "", errors.New("quotas are not supported for this driver")
+}
+
+func (o *Overlay) IsLeaf(id ID) (bool, error) {
+	return isLeaf(o.All(), id), nil
+}
+
+func (o *Overlay) GetAllLeaves() ([]ID, error) {
+	return leaves(o.All()), nil
+}
+
+func (o *Overlay) All() []*image.Image {
+	return readLayers(filepath.Join(o.Root, overlayLayersDir), o.Get)
+}
+
+func (o *Overlay) unmount(graphID string) error {
+	merged := filepath.Join(o.layerDir(graphID), "merged")
+	if mounted, err := isMountPoint(merged); err != nil || !mounted {
+		return nil
+	}
+
+	if err := unmountOverlay(merged); err != nil {
+		return fmt.Errorf("layercake: unmount overlay layer %s: %s", graphID, err)
+	}
+
+	return nil
+}
+
+func (o *Overlay) layerDir(graphID string) string {
+	return filepath.Join(o.Root, overlayLayersDir, graphID)
+}
+
+func (o *Overlay) readLink(graphID string) (string, error) {
+	link, err := ioutil.ReadFile(filepath.Join(o.layerDir(graphID), "link"))
+	if err != nil {
+		return "", err
+	}
+
+	return string(link), nil
+}
+
+func (o *Overlay) readLower(graphID string) ([]string, error) {
+	lower, err := ioutil.ReadFile(filepath.Join(o.layerDir(graphID), "lower"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lower) == 0 {
+		return nil, nil
+	}
+
+	return strings.Split(string(lower), ":"), nil
+}
+
+func shortLink(graphID string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(graphID)))[:26]
+}
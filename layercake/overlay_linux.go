@@ -0,0 +1,59 @@
+package layercake
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func mountOverlay(lower []string, upper, work, target string) error {
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lower, ":"), upper, work)
+	if len(options) >= syscall.Getpagesize() {
+		return fmt.Errorf("overlay mount options for %d layers are too long", len(lower))
+	}
+
+	return syscall.Mount("overlay", target, "overlay", 0, options)
+}
+
+func unmountOverlay(target string) error {
+	return syscall.Unmount(target, 0)
+}
+
+func isMountPoint(path string) (bool, error) {
+	var stat, parentStat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return false, err
+	}
+
+	if err := syscall.Stat(filepath.Dir(path), &parentStat); err != nil {
+		return false, err
+	}
+
+	return stat.Dev != parentStat.Dev, nil
+}
+
+// applyOverlayLayer extracts the layer tar into dest, which only holds the
+// changes of the layer, turning aufs whiteouts into overlay whiteouts (0/0
+// character devices) and opaque markers into the trusted.overlay.opaque
+// xattr.
+func applyOverlayLayer(dest string, layer io.Reader) (int64, error) {
+	return applyLayer(dest, layer, overlayWhiteouts{})
+}
+
+type overlayWhiteouts struct{}
+
+func (overlayWhiteouts) whiteout(dir, name string) error {
+	path := filepath.Join(dir, name)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	return syscall.Mknod(path, syscall.S_IFCHR, 0)
+}
+
+func (overlayWhiteouts) opaque(dir string, _ func(string) bool) error {
+	return syscall.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0)
+}
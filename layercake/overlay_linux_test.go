@@ -0,0 +1,483 @@
+package layercake_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"github.com/docker/docker/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Overlay", func() {
+	var (
+		root string
+		cake *layercake.Overlay
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		root, err = ioutil.TempDir("", "cakeroot")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(syscall.Mount("tmpfs", root, "tmpfs", 0, "")).To(Succeed())
+
+		cake = &layercake.Overlay{Root: root}
+	})
+
+	AfterEach(func() {
+		for _, img := range cake.All() {
+			Expect(cake.Unmount(layercake.DockerImageID(img.ID))).To(Succeed())
+		}
+
+		Expect(syscall.Unmount(root, 0)).To(Succeed())
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("is called overlay", func() {
+		Expect(cake.DriverName()).To(Equal("overlay"))
+	})
+
+	Describe("Register", func() {
+		Context("after registering a layer", func() {
+			var id layercake.ID
+			var parent layercake.ID
+
+			BeforeEach(func() {
+				id = layercake.ContainerID("")
+				parent = layercake.ContainerID("")
+			})
+
+			ItCanReadWriteTheLayer := func() {
+				It("can read and write files", func() {
+					p, err := cake.Path(id)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ioutil.WriteFile(path.Join(p, "foo"), []byte("hi"), 0700)).To(Succeed())
+
+					p, err = cake.Path(id)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(path.Join(p, "foo")).To(BeAnExistingFile())
+				})
+
+				It("can get back the image", func() {
+					img, err := cake.Get(id)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(img.ID).To(Equal(id.GraphID()))
+					Expect(img.Parent).To(Equal(parent.GraphID()))
+				})
+			}
+
+			Context("when the new layer is a docker image", func() {
+				JustBeforeEach(func() {
+					id = layercake.DockerImageID("70d8f0edf5c9008eb61c7c52c458e7e0a831649dbb238b93dde0854faae314a8")
+					registerImageLayer(cake, &image.Image{
+						ID:     id.GraphID(),
+						Parent: parent.GraphID(),
+					})
+				})
+
+				Context("without a parent", func() {
+					ItCanReadWriteTheLayer()
+
+					It("can read the files in the image", func() {
+						p, err := cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(path.Join(p, id.GraphID())).To(BeAnExistingFile())
+					})
+
+					It("records the size of the layer", func() {
+						img, err := cake.Get(id)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(img.Size).To(BeEquivalentTo(len("Hello")))
+					})
+
+					It("can be deleted", func() {
+						Expect(cake.Remove(id)).To(Succeed())
+
+						filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+							Expect(path).To(BeADirectory())
+							return nil
+						})
+					})
+				})
+
+				Context("with a parent", func() {
+					BeforeEach(func() {
+						parent = layercake.DockerImageID("07d8fe0df5c9008eb16c7c52c548e7e0a831649dbb238b93dde0854faae3148a")
+						registerImageLayer(cake, &image.Image{
+							ID:     parent.GraphID(),
+							Parent: "",
+						})
+					})
+
+					ItCanReadWriteTheLayer()
+
+					It("inherits files from the parent layer", func() {
+						p, err := cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(path.Join(p, parent.GraphID())).To(BeAnExistingFile())
+					})
+
+					It("can read the files in the image", func() {
+						p, err := cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(path.Join(p, id.GraphID())).To(BeAnExistingFile())
+					})
+
+					It("does not change the parent layer when files are written", func() {
+						p, err := cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(ioutil.WriteFile(path.Join(p, parent.GraphID()), []byte("changed"), 0700)).To(Succeed())
+
+						parentPath, err := cake.Path(parent)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(ioutil.ReadFile(path.Join(parentPath, parent.GraphID()))).To(Equal([]byte("Hello")))
+					})
+
+					It("can be unmounted and mounted again", func() {
+						p, err := cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(ioutil.WriteFile(path.Join(p, "foo"), []byte("hi"), 0700)).To(Succeed())
+
+						Expect(cake.Unmount(id)).To(Succeed())
+						Expect(path.Join(p, "foo")).NotTo(BeAnExistingFile())
+
+						p, err = cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(path.Join(p, "foo")).To(BeAnExistingFile())
+					})
+				})
+			})
+
+			Context("when the new layer is a container", func() {
+				Context("with a parent", func() {
+					BeforeEach(func() {
+						parent = layercake.DockerImageID("70d8f0edf5c9008eb61c7c52c458e7e0a831649dbb238b93dde0854faae314a8")
+						registerImageLayer(cake, &image.Image{
+							ID:     parent.GraphID(),
+							Parent: "",
+						})
+
+						id = layercake.ContainerID("abc")
+						createContainerLayer(cake, id, parent, "potato")
+					})
+
+					ItCanReadWriteTheLayer()
+
+					It("inherits files from the parent layer", func() {
+						p, err := cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(path.Join(p, parent.GraphID())).To(BeAnExistingFile())
+					})
+
+					It("saves the container ID in the graph", func() {
+						p, err := cake.Get(id)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(p.Container).To(Equal("potato"))
+					})
+
+					It("unmounts the layer when it is removed", func() {
+						p, err := cake.Path(id)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(cake.Remove(id)).To(Succeed())
+						Expect(p).NotTo(BeADirectory())
+
+						_, err = cake.Get(id)
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+
+			Context("when the layer already exists", func() {
+				It("returns an error", func() {
+					id := layercake.DockerImageID("some-layer")
+					registerImageLayer(cake, &image.Image{ID: id.GraphID()})
+
+					Expect(cake.Register(&image.Image{ID: id.GraphID()}, nil)).NotTo(Succeed())
+				})
+			})
+
+			Context("when the parent does not exist", func() {
+				It("returns an error", func() {
+					Expect(cake.Create(layercake.ContainerID("abc"), layercake.DockerImageID("missing"), "")).NotTo(Succeed())
+				})
+			})
+		})
+
+		Context("when the layer is gzipped, as registry blobs are", func() {
+			It("decompresses it", func() {
+				id := layercake.DockerImageID("gzipped")
+				Expect(cake.Register(&image.Image{ID: id.GraphID()}, gzipped(layerTar(
+					tarEntry{name: "file", contents: "zipped"},
+				)))).To(Succeed())
+
+				p, err := cake.Path(id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadFile(path.Join(p, "file"))).To(Equal([]byte("zipped")))
+			})
+		})
+
+		Context("when the layer has symlinks which point outside of it", func() {
+			var (
+				outside string
+				id      layercake.ID
+			)
+
+			BeforeEach(func() {
+				var err error
+				outside, err = ioutil.TempDir("", "outside")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(path.Join(outside, "secret"), []byte("host"), 0644)).To(Succeed())
+
+				id = layercake.DockerImageID("breakout")
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(outside)).To(Succeed())
+			})
+
+			It("extracts files through absolute symlinks within the layer", func() {
+				Expect(cake.Register(&image.Image{ID: id.GraphID()}, layerTar(
+					tarEntry{name: "x", symlink: outside},
+					tarEntry{name: "x/secret", contents: "overwritten"},
+				))).To(Succeed())
+
+				Expect(ioutil.ReadFile(path.Join(outside, "secret"))).To(Equal([]byte("host")))
+
+				p, err := cake.Path(id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadFile(path.Join(p, outside, "secret"))).To(Equal([]byte("overwritten")))
+			})
+
+			It("extracts files through relative symlinks within the layer", func() {
+				Expect(cake.Register(&image.Image{ID: id.GraphID()}, layerTar(
+					tarEntry{name: "x", symlink: "../../../../../../../../.." + outside},
+					tarEntry{name: "x/secret", contents: "overwritten"},
+				))).To(Succeed())
+
+				Expect(ioutil.ReadFile(path.Join(outside, "secret"))).To(Equal([]byte("host")))
+			})
+
+			It("does not whiteout files through symlinks", func() {
+				Expect(cake.Register(&image.Image{ID: id.GraphID()}, layerTar(
+					tarEntry{name: "x", symlink: outside},
+					tarEntry{name: "x/.wh.secret"},
+				))).To(Succeed())
+
+				Expect(path.Join(outside, "secret")).To(BeAnExistingFile())
+			})
+
+			It("does not hardlink files through symlinks", func() {
+				Expect(cake.Register(&image.Image{ID: id.GraphID()}, layerTar(
+					tarEntry{name: "x", symlink: outside},
+					tarEntry{name: "linked", hardlink: "x/secret"},
+				))).NotTo(Succeed())
+
+				info, err := os.Stat(path.Join(outside, "secret"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Sys().(*syscall.Stat_t).Nlink).To(BeEquivalentTo(1))
+			})
+
+			It("does not hardlink files outside of the layer", func() {
+				Expect(cake.Register(&image.Image{ID: id.GraphID()}, layerTar(
+					tarEntry{name: "linked", hardlink: "../../../../../../../../.." + outside + "/secret"},
+				))).NotTo(Succeed())
+
+				info, err := os.Stat(path.Join(outside, "secret"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Sys().(*syscall.Stat_t).Nlink).To(BeEquivalentTo(1))
+			})
+		})
+
+		Context("when the layer has whiteouts", func() {
+			var id layercake.ID
+
+			BeforeEach(func() {
+				parent := layercake.DockerImageID("parent")
+				Expect(cake.Register(&image.Image{ID: parent.GraphID()}, layerTar(
+					tarEntry{name: "etc/", dir: true},
+					tarEntry{name: "etc/removed", contents: "a"},
+					tarEntry{name: "etc/kept", contents: "b"},
+					tarEntry{name: "opaque/", dir: true},
+					tarEntry{name: "opaque/hidden", contents: "c"},
+				))).To(Succeed())
+
+				id = layercake.DockerImageID("child")
+				Expect(cake.Register(&image.Image{ID: id.GraphID(), Parent: parent.GraphID()}, layerTar(
+					tarEntry{name: "etc/.wh.removed"},
+					tarEntry{name: "opaque/", dir: true},
+					tarEntry{name: "opaque/.wh..wh..opq"},
+					tarEntry{name: "opaque/added", contents: "d"},
+					tarEntry{name: ".wh..wh.plnk/", dir: true},
+				))).To(Succeed())
+			})
+
+			It("removes whited out files of the parent", func() {
+				p, err := cake.Path(id)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(path.Join(p, "etc", "removed")).NotTo(BeAnExistingFile())
+				Expect(path.Join(p, "etc", "kept")).To(BeAnExistingFile())
+			})
+
+			It("hides the parent's contents of opaque directories", func() {
+				p, err := cake.Path(id)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(path.Join(p, "opaque", "hidden")).NotTo(BeAnExistingFile())
+				Expect(path.Join(p, "opaque", "added")).To(BeAnExistingFile())
+			})
+
+			It("does not extract aufs metadata", func() {
+				p, err := cake.Path(id)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(path.Join(p, ".wh..wh.plnk")).NotTo(BeADirectory())
+			})
+		})
+	})
+
+	Describe("namespacing a layer", func() {
+		var (
+			parent       layercake.ID
+			namespacedID layercake.ID
+		)
+
+		BeforeEach(func() {
+			parent = layercake.DockerImageID("70d8f0edf5c9008eb61c7c52c458e7e0a831649dbb238b93dde0854faae314a8")
+			registerImageLayer(cake, &image.Image{ID: parent.GraphID()})
+
+			namespacedID = layercake.NamespacedID(parent, "some-cache-key")
+			Expect(cake.Create(namespacedID, parent, "")).To(Succeed())
+
+			p, err := cake.Path(namespacedID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Lchown(path.Join(p, parent.GraphID()), 1000, 1000)).To(Succeed())
+			Expect(cake.Unmount(namespacedID)).To(Succeed())
+		})
+
+		It("gives containers on the namespaced layer the translated files", func() {
+			id := layercake.ContainerID("abc")
+			createContainerLayer(cake, id, namespacedID, "")
+
+			p, err := cake.Path(id)
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := os.Stat(path.Join(p, parent.GraphID()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Sys().(*syscall.Stat_t).Uid).To(BeEquivalentTo(1000))
+		})
+
+		It("leaves the files of the parent layer as they were", func() {
+			p, err := cake.Path(parent)
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := os.Stat(path.Join(p, parent.GraphID()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Sys().(*syscall.Stat_t).Uid).To(BeEquivalentTo(os.Getuid()))
+		})
+
+		It("records the parent of the namespaced layer", func() {
+			img, err := cake.Get(namespacedID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.Parent).To(Equal(parent.GraphID()))
+
+			Expect(cake.IsLeaf(parent)).To(BeFalse())
+		})
+	})
+
+	Describe("All", func() {
+		BeforeEach(func() {
+			createContainerLayer(cake, layercake.ContainerID("def"), layercake.DockerImageID(""), "")
+			createContainerLayer(cake, layercake.ContainerID("abc"), layercake.ContainerID("def"), "")
+			createContainerLayer(cake, layercake.ContainerID("child2"), layercake.ContainerID("def"), "")
+		})
+
+		It("returns all the layers in the graph", func() {
+			Expect(cake.All()).To(HaveLen(3))
+
+			var ids []string
+			for _, layer := range cake.All() {
+				ids = append(ids, layer.ID)
+			}
+
+			Expect(ids).To(ContainElement(layercake.ContainerID("def").GraphID()))
+			Expect(ids).To(ContainElement(layercake.ContainerID("abc").GraphID()))
+			Expect(ids).To(ContainElement(layercake.ContainerID("child2").GraphID()))
+		})
+	})
+
+	Describe("IsLeaf", func() {
+		BeforeEach(func() {
+			createContainerLayer(cake, layercake.ContainerID("def"), layercake.DockerImageID(""), "")
+			createContainerLayer(cake, layercake.ContainerID("abc"), layercake.ContainerID("def"), "")
+			createContainerLayer(cake, layercake.ContainerID("child2"), layercake.ContainerID("def"), "")
+		})
+
+		Context("when an image has no children", func() {
+			It("is a leaf", func() {
+				Expect(cake.IsLeaf(layercake.ContainerID("abc"))).To(Equal(true))
+			})
+		})
+
+		Context("when an image has children", func() {
+			It("is not a leaf", func() {
+				Expect(cake.IsLeaf(layercake.ContainerID("def"))).To(Equal(false))
+			})
+		})
+
+		Context("when an image's final child is removed", func() {
+			It("is becomes a leaf", func() {
+				Expect(cake.IsLeaf(layercake.ContainerID("def"))).To(Equal(false))
+
+				Expect(cake.Remove(layercake.ContainerID("abc"))).To(Succeed())
+				Expect(cake.IsLeaf(layercake.ContainerID("def"))).To(Equal(false))
+
+				Expect(cake.Remove(layercake.ContainerID("child2"))).To(Succeed())
+				Expect(cake.IsLeaf(layercake.ContainerID("def"))).To(Equal(true))
+			})
+		})
+	})
+
+	Describe("GetAllLeaves", func() {
+		BeforeEach(func() {
+			createContainerLayer(cake, layercake.ContainerID("def"), layercake.DockerImageID(""), "")
+			createContainerLayer(cake, layercake.ContainerID("abc"), layercake.ContainerID("def"), "")
+			createContainerLayer(cake, layercake.ContainerID("child2"), layercake.ContainerID("def"), "")
+		})
+
+		It("should return all the leaves", func() {
+			leaves, err := cake.GetAllLeaves()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(leaves).To(HaveLen(2))
+			Expect(leaves).To(ContainElement(layercake.DockerImageID(layercake.ContainerID("abc").GraphID())))
+			Expect(leaves).To(ContainElement(layercake.DockerImageID(layercake.ContainerID("child2").GraphID())))
+		})
+	})
+
+	Describe("QuotaedPath", func() {
+		It("should return an error", func() {
+			id := layercake.ContainerID("aubergine-layer")
+
+			registerImageLayer(cake, &image.Image{
+				ID: id.GraphID(),
+			})
+
+			_, err := cake.QuotaedPath(id, 10*1024*1024)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package layercake
+
+import (
+	"errors"
+	"io"
+)
+
+var errOverlayNotSupported = errors.New("overlay is only supported on linux")
+
+func mountOverlay(lower []string, upper, work, target string) error {
+	return errOverlayNotSupported
+}
+
+func unmountOverlay(target string) error {
+	return errOverlayNotSupported
+}
+
+func isMountPoint(path string) (bool, error) {
+	return false, nil
+}
+
+func applyOverlayLayer(dest string, layer io.Reader) (int64, error) {
+	return 0, errOverlayNotSupported
+}
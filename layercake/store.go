@@ -0,0 +1,306 @@
+package layercake
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/garden-shed/pkg/atomicfile"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+)
+
+const storeLayersDir = "layers"
+
+// Driver keeps the filesystems of layers. It is the part of docker's
+// graphdriver.Driver which a Store uses, so any graphdriver can be used.
+//
+//go:generate counterfeiter -o fake_driver/fake_driver.go . Driver
+type Driver interface {
+	String() string
+	Create(id, parent string) error
+	Remove(id string) error
+	Get(id, mountLabel string) (string, error)
+	Put(id string) error
+	Exists(id string) bool
+	ApplyDiff(id, parent string, diff archive.ArchiveReader) (int64, error)
+}
+
+type quotaedGetter interface {
+	GetQuotaed(id, mountlabel string, quota int64) (string, error)
+}
+
+// writableCreator is implemented by drivers which create the layers of
+// containers, which are written to, differently from image layers.
+type writableCreator interface {
+	CreateWritable(id, parent string) error
+}
+
+// Store is a Cake which keeps the metadata of its layers itself, and their
+// filesystems in a Driver. The image of each layer, including its parent,
+// size and container, is kept as JSON in <Root>/layers/<graph id>/json, which
+// is written once the layer is in the driver, so a layer with metadata always
+// has a filesystem.
+type Store struct {
+	Root   string
+	Driver Driver
+
+	mu      sync.Mutex
+	idLocks map[string]*idLock
+}
+
+// idLock serializes the registers and removes of a layer. It is forgotten
+// once nothing holds or waits for it, so the locks do not outlive the layers.
+type idLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (s *Store) DriverName() string {
+	return s.Driver.String()
+}
+
+func (s *Store) Create(layerID, parentID ID, containerID string) error {
+	return s.Register(
+		&image.Image{
+			ID:        layerID.GraphID(),
+			Parent:    parentID.GraphID(),
+			Container: containerID,
+		}, nil)
+}
+
+func (s *Store) Register(img *image.Image, layer archive.ArchiveReader) error {
+	if img.ID == "" {
+		return errors.New("layercake: register layer: empty ID")
+	}
+
+	// a concurrent register of the same ID must not be taken for a partial
+	// layer and removed while it is being applied
+	unlock := s.lock(img.ID)
+	defer unlock()
+
+	if _, err := os.Stat(s.imagePath(img.ID)); err == nil {
+		return fmt.Errorf("layercake: register layer: %s already exists", img.ID)
+	}
+
+	if img.Parent != "" {
+		if _, err := os.Stat(s.imagePath(img.Parent)); err != nil {
+			return fmt.Errorf("layercake: register layer: parent %s does not exist", img.Parent)
+		}
+	}
+
+	// a previous attempt may have been interrupted before writing metadata
+	if s.Driver.Exists(img.ID) {
+		if err := s.Driver.Remove(img.ID); err != nil {
+			return fmt.Errorf("layercake: register layer: remove partial layer %s: %s", img.ID, err)
+		}
+	}
+
+	if err := s.create(img); err != nil {
+		return fmt.Errorf("layercake: register layer: create %s: %s", img.ID, err)
+	}
+
+	if layer != nil {
+		size, err := s.Driver.ApplyDiff(img.ID, img.Parent, layer)
+		if err != nil {
+			s.Driver.Remove(img.ID)
+			return fmt.Errorf("layercake: register layer: apply %s: %s", img.ID, err)
+		}
+
+		img.Size = size
+	}
+
+	if err := s.writeImage(img); err != nil {
+		s.Driver.Remove(img.ID)
+		return fmt.Errorf("layercake: register layer: %s", err)
+	}
+
+	return nil
+}
+
+func (s *Store) create(img *image.Image) error {
+	if driver, ok := s.Driver.(writableCreator); ok && img.Container != "" {
+		return driver.CreateWritable(img.ID, img.Parent)
+	}
+
+	return s.Driver.Create(img.ID, img.Parent)
+}
+
+func (s *Store) Get(id ID) (*image.Image, error) {
+	contents, err := ioutil.ReadFile(s.imagePath(id.GraphID()))
+	if err != nil {
+		return nil, fmt.Errorf("layercake: get layer %s: %s", id.GraphID(), err)
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(contents, &img); err != nil {
+		return nil, fmt.Errorf("layercake: get layer %s: %s", id.GraphID(), err)
+	}
+
+	return &img, nil
+}
+
+func (s *Store) Unmount(id ID) error {
+	return s.Driver.Put(id.GraphID())
+}
+
+// Remove deletes the metadata of the layer before its filesystem, so that an
+// interrupted remove leaves at worst a filesystem without metadata, which the
+// next Register of the layer replaces.
+func (s *Store) Remove(id ID) error {
+	unlock := s.lock(id.GraphID())
+	defer unlock()
+
+	if err := s.Driver.Put(id.GraphID()); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(filepath.Join(s.Root, storeLayersDir, id.GraphID())); err != nil {
+		return fmt.Errorf("layercake: remove layer %s: %s", id.GraphID(), err)
+	}
+
+	return s.Driver.Remove(id.GraphID())
+}
+
+func (s *Store) Path(id ID) (string, error) {
+	return s.Driver.Get(id.GraphID(), "")
+}
+
+func (s *Store) QuotaedPath(id ID, quota int64) (string, error) {
+	driver, ok := s.Driver.(quotaedGetter)
+	if !ok {
+		return "", errors.New("quotas are not supported for this driver")
+	}
+
+	return driver.GetQuotaed(id.GraphID(), "", quota)
+}
+
+func (s *Store) IsLeaf(id ID) (bool, error) {
+	return isLeaf(s.All(), id), nil
+}
+
+func (s *Store) GetAllLeaves() ([]ID, error) {
+	return leaves(s.All()), nil
+}
+
+func (s *Store) All() []*image.Image {
+	return readLayers(filepath.Join(s.Root, storeLayersDir), s.Get)
+}
+
+// MigrateDockerGraph imports the images of the docker graph in graphRoot,
+// whose layers are already in the store's driver, so that they are used in
+// place. Images which are already in the store, or whose layers the driver
+// does not have, are skipped, so an interrupted migration can be run again.
+// It returns the number of images imported.
+func (s *Store) MigrateDockerGraph(graphRoot string) (int, error) {
+	entries, err := ioutil.ReadDir(graphRoot)
+	if err != nil {
+		return 0, fmt.Errorf("layercake: migrate docker graph: %s", err)
+	}
+
+	migrated := 0
+	for _, entry := range entries {
+		id := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(id, "_") || id == storeLayersDir {
+			continue
+		}
+
+		if _, err := os.Stat(s.imagePath(id)); err == nil {
+			continue
+		}
+
+		if !s.Driver.Exists(id) {
+			continue
+		}
+
+		img, err := readDockerGraphImage(filepath.Join(graphRoot, id))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return migrated, fmt.Errorf("layercake: migrate docker graph: image %s: %s", id, err)
+		}
+
+		if img.ID != id {
+			return migrated, fmt.Errorf("layercake: migrate docker graph: image %s has ID %s", id, img.ID)
+		}
+
+		if err := s.writeImage(img); err != nil {
+			return migrated, fmt.Errorf("layercake: migrate docker graph: %s", err)
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+func readDockerGraphImage(dir string) (*image.Image, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(contents, &img); err != nil {
+		return nil, err
+	}
+
+	// the graph keeps sizes apart from the image JSON
+	if size, err := ioutil.ReadFile(filepath.Join(dir, "layersize")); err == nil {
+		if img.Size, err = strconv.ParseInt(strings.TrimSpace(string(size)), 10, 64); err != nil {
+			return nil, fmt.Errorf("parse layersize: %s", err)
+		}
+	}
+
+	return &img, nil
+}
+
+func (s *Store) writeImage(img *image.Image) error {
+	contents, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.imagePath(img.ID)), 0700); err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(s.imagePath(img.ID), contents, 0600)
+}
+
+func (s *Store) lock(graphID string) func() {
+	s.mu.Lock()
+	if s.idLocks == nil {
+		s.idLocks = make(map[string]*idLock)
+	}
+
+	lock, ok := s.idLocks[graphID]
+	if !ok {
+		lock = new(idLock)
+		s.idLocks[graphID] = lock
+	}
+	lock.refs++
+	s.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if lock.refs--; lock.refs == 0 {
+			delete(s.idLocks, graphID)
+		}
+	}
+}
+
+func (s *Store) imagePath(graphID string) string {
+	return filepath.Join(s.Root, storeLayersDir, graphID, "json")
+}
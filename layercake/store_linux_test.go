@@ -0,0 +1,81 @@
+package layercake_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/graph"
+	"github.com/docker/docker/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store migrating a docker graph", func() {
+	var (
+		root   string
+		driver graphdriver.Driver
+		parent layercake.ID
+		child  layercake.ID
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		root, err = ioutil.TempDir("", "cakeroot")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(syscall.Mount("tmpfs", root, "tmpfs", 0, "")).To(Succeed())
+		driver, err = graphdriver.GetDriver("vfs", root, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		g, err := graph.NewGraph(root, driver)
+		Expect(err).NotTo(HaveOccurred())
+
+		docker := &layercake.Docker{Graph: g, Driver: driver}
+
+		parent = layercake.DockerImageID("07d8fe0df5c9008eb16c7c52c548e7e0a831649dbb238b93dde0854faae3148a")
+		registerImageLayer(docker, &image.Image{ID: parent.GraphID()})
+
+		child = layercake.ContainerID("abc")
+		createContainerLayer(docker, child, parent, "potato")
+	})
+
+	AfterEach(func() {
+		Expect(syscall.Unmount(root, 0)).To(Succeed())
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("uses the layers of the graph in place", func() {
+		store := &layercake.Store{Root: root, Driver: driver}
+		Expect(store.MigrateDockerGraph(root)).To(Equal(2))
+
+		img, err := store.Get(child)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Parent).To(Equal(parent.GraphID()))
+		Expect(img.Container).To(Equal("potato"))
+
+		p, err := store.Path(child)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path.Join(p, parent.GraphID())).To(BeAnExistingFile())
+
+		Expect(store.IsLeaf(parent)).To(BeFalse())
+	})
+
+	It("can register layers on top of migrated layers", func() {
+		store := &layercake.Store{Root: root, Driver: driver}
+		_, err := store.MigrateDockerGraph(root)
+		Expect(err).NotTo(HaveOccurred())
+
+		id := layercake.ContainerID("def")
+		Expect(store.Create(id, child, "")).To(Succeed())
+
+		p, err := store.Path(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path.Join(p, parent.GraphID())).To(BeAnExistingFile())
+	})
+})
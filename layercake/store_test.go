@@ -0,0 +1,343 @@
+package layercake_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/layercake/fake_driver"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		root   string
+		driver *fake_driver.FakeDriver
+		store  *layercake.Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "storeroot")
+		Expect(err).NotTo(HaveOccurred())
+
+		driver = new(fake_driver.FakeDriver)
+		driver.StringReturns("some-driver")
+		driver.ApplyDiffReturns(42, nil)
+
+		store = &layercake.Store{Root: root, Driver: driver}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("is named after its driver", func() {
+		Expect(store.DriverName()).To(Equal("some-driver"))
+	})
+
+	Describe("Register", func() {
+		var layer archive.ArchiveReader
+
+		BeforeEach(func() {
+			layer = bytes.NewBufferString("some-tar")
+		})
+
+		It("creates the layer in the driver and applies the diff to it", func() {
+			Expect(store.Register(&image.Image{ID: "some-id"}, layer)).To(Succeed())
+
+			Expect(driver.CreateCallCount()).To(Equal(1))
+			id, parent := driver.CreateArgsForCall(0)
+			Expect(id).To(Equal("some-id"))
+			Expect(parent).To(BeEmpty())
+
+			Expect(driver.ApplyDiffCallCount()).To(Equal(1))
+			id, _, diff := driver.ApplyDiffArgsForCall(0)
+			Expect(id).To(Equal("some-id"))
+			Expect(diff).To(Equal(layer))
+		})
+
+		It("records the image with the size of the diff", func() {
+			Expect(store.Register(&image.Image{ID: "parent-id"}, nil)).To(Succeed())
+			Expect(store.Register(&image.Image{ID: "some-id", Parent: "parent-id", Container: "potato"}, layer)).To(Succeed())
+
+			img, err := store.Get(layercake.DockerImageID("some-id"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.ID).To(Equal("some-id"))
+			Expect(img.Parent).To(Equal("parent-id"))
+			Expect(img.Container).To(Equal("potato"))
+			Expect(img.Size).To(BeEquivalentTo(42))
+		})
+
+		It("does not apply a diff for an empty layer", func() {
+			Expect(store.Create(layercake.ContainerID("abc"), layercake.DockerImageID(""), "")).To(Succeed())
+			Expect(driver.ApplyDiffCallCount()).To(Equal(0))
+		})
+
+		Context("when the layer already exists", func() {
+			It("returns an error without touching the driver", func() {
+				Expect(store.Register(&image.Image{ID: "some-id"}, nil)).To(Succeed())
+
+				Expect(store.Register(&image.Image{ID: "some-id"}, nil)).To(MatchError(ContainSubstring("already exists")))
+				Expect(driver.CreateCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the parent does not exist", func() {
+			It("returns an error", func() {
+				Expect(store.Register(&image.Image{ID: "some-id", Parent: "missing"}, nil)).To(MatchError(ContainSubstring("parent missing does not exist")))
+				Expect(driver.CreateCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the driver has a layer left from an interrupted register", func() {
+			It("replaces it", func() {
+				driver.ExistsReturns(true)
+				Expect(store.Register(&image.Image{ID: "some-id"}, layer)).To(Succeed())
+
+				Expect(driver.RemoveCallCount()).To(Equal(1))
+				Expect(driver.RemoveArgsForCall(0)).To(Equal("some-id"))
+				Expect(driver.CreateCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the same layer is registered concurrently", func() {
+			It("waits for the first register rather than removing its layer", func() {
+				applying := make(chan struct{})
+				release := make(chan struct{})
+
+				driver.ExistsStub = func(string) bool {
+					return driver.CreateCallCount() > 0
+				}
+				driver.ApplyDiffStub = func(string, string, archive.ArchiveReader) (int64, error) {
+					close(applying)
+					<-release
+					return 42, nil
+				}
+
+				errs := make(chan error, 2)
+				register := func() {
+					defer GinkgoRecover()
+					errs <- store.Register(&image.Image{ID: "some-id"}, layer)
+				}
+
+				go register()
+				Eventually(applying).Should(BeClosed())
+
+				go register()
+				Consistently(errs).ShouldNot(Receive())
+
+				close(release)
+				Eventually(errs).Should(Receive(BeNil()))
+				Eventually(errs).Should(Receive(MatchError(ContainSubstring("already exists"))))
+
+				Expect(driver.CreateCallCount()).To(Equal(1))
+				Expect(driver.RemoveCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when applying the diff fails", func() {
+			BeforeEach(func() {
+				driver.ApplyDiffReturns(0, errors.New("boom"))
+			})
+
+			It("removes the layer from the driver and records nothing", func() {
+				Expect(store.Register(&image.Image{ID: "some-id"}, layer)).To(MatchError(ContainSubstring("boom")))
+
+				Expect(driver.RemoveCallCount()).To(Equal(1))
+				_, err := store.Get(layercake.DockerImageID("some-id"))
+				Expect(err).To(HaveOccurred())
+				Expect(store.All()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Path", func() {
+		It("gets the layer from the driver", func() {
+			driver.GetReturns("/some/path", nil)
+
+			Expect(store.Path(layercake.DockerImageID("some-id"))).To(Equal("/some/path"))
+			id, _ := driver.GetArgsForCall(0)
+			Expect(id).To(Equal("some-id"))
+		})
+	})
+
+	Describe("Unmount", func() {
+		It("puts the layer back to the driver", func() {
+			Expect(store.Unmount(layercake.DockerImageID("some-id"))).To(Succeed())
+			Expect(driver.PutArgsForCall(0)).To(Equal("some-id"))
+		})
+	})
+
+	Describe("Remove", func() {
+		BeforeEach(func() {
+			Expect(store.Register(&image.Image{ID: "some-id"}, nil)).To(Succeed())
+		})
+
+		It("removes the layer from the driver and forgets it", func() {
+			Expect(store.Remove(layercake.DockerImageID("some-id"))).To(Succeed())
+
+			Expect(driver.PutArgsForCall(0)).To(Equal("some-id"))
+			Expect(driver.RemoveArgsForCall(0)).To(Equal("some-id"))
+
+			_, err := store.Get(layercake.DockerImageID("some-id"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("when the driver fails to release the layer", func() {
+			It("keeps the layer", func() {
+				driver.PutReturns(errors.New("busy"))
+
+				Expect(store.Remove(layercake.DockerImageID("some-id"))).To(MatchError("busy"))
+				Expect(store.Get(layercake.DockerImageID("some-id"))).NotTo(BeNil())
+			})
+		})
+	})
+
+	Describe("QuotaedPath", func() {
+		It("returns an error when the driver does not support quotas", func() {
+			_, err := store.QuotaedPath(layercake.DockerImageID("some-id"), 10)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("gets a quotaed path from a driver which supports quotas", func() {
+			store.Driver = &quotaedDriver{FakeDriver: driver}
+
+			Expect(store.QuotaedPath(layercake.DockerImageID("some-id"), 10)).To(Equal("/quotaed/some-id/10"))
+		})
+	})
+
+	Describe("All, IsLeaf and GetAllLeaves", func() {
+		BeforeEach(func() {
+			Expect(store.Create(layercake.ContainerID("def"), layercake.DockerImageID(""), "")).To(Succeed())
+			Expect(store.Create(layercake.ContainerID("abc"), layercake.ContainerID("def"), "")).To(Succeed())
+			Expect(store.Create(layercake.ContainerID("child2"), layercake.ContainerID("def"), "")).To(Succeed())
+		})
+
+		It("returns all the layers", func() {
+			var ids []string
+			for _, layer := range store.All() {
+				ids = append(ids, layer.ID)
+			}
+
+			Expect(ids).To(ConsistOf(
+				layercake.ContainerID("def").GraphID(),
+				layercake.ContainerID("abc").GraphID(),
+				layercake.ContainerID("child2").GraphID(),
+			))
+		})
+
+		It("knows which layers are leaves", func() {
+			Expect(store.IsLeaf(layercake.ContainerID("abc"))).To(BeTrue())
+			Expect(store.IsLeaf(layercake.ContainerID("def"))).To(BeFalse())
+
+			Expect(store.GetAllLeaves()).To(ConsistOf(
+				layercake.DockerImageID(layercake.ContainerID("abc").GraphID()),
+				layercake.DockerImageID(layercake.ContainerID("child2").GraphID()),
+			))
+		})
+
+		It("makes a parent a leaf once its children are removed", func() {
+			Expect(store.Remove(layercake.ContainerID("abc"))).To(Succeed())
+			Expect(store.IsLeaf(layercake.ContainerID("def"))).To(BeFalse())
+
+			Expect(store.Remove(layercake.ContainerID("child2"))).To(Succeed())
+			Expect(store.IsLeaf(layercake.ContainerID("def"))).To(BeTrue())
+		})
+	})
+
+	Describe("MigrateDockerGraph", func() {
+		var graphRoot string
+
+		writeGraphImage := func(id, parent, size string) {
+			dir := filepath.Join(graphRoot, id)
+			Expect(os.MkdirAll(dir, 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "json"), []byte(`{"id":"`+id+`","parent":"`+parent+`","container":"c-`+id+`"}`), 0600)).To(Succeed())
+			if size != "" {
+				Expect(ioutil.WriteFile(filepath.Join(dir, "layersize"), []byte(size), 0600)).To(Succeed())
+			}
+		}
+
+		BeforeEach(func() {
+			var err error
+			graphRoot, err = ioutil.TempDir("", "graphroot")
+			Expect(err).NotTo(HaveOccurred())
+
+			writeGraphImage("base", "", "12")
+			writeGraphImage("child", "base", "34")
+			writeGraphImage("no-layer", "", "56")
+			Expect(os.MkdirAll(filepath.Join(graphRoot, "_tmp", "partial"), 0700)).To(Succeed())
+
+			driver.ExistsStub = func(id string) bool {
+				return id != "no-layer"
+			}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(graphRoot)).To(Succeed())
+		})
+
+		It("imports the images whose layers the driver has", func() {
+			Expect(store.MigrateDockerGraph(graphRoot)).To(Equal(2))
+
+			base, err := store.Get(layercake.DockerImageID("base"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(base.Size).To(BeEquivalentTo(12))
+			Expect(base.Container).To(Equal("c-base"))
+
+			child, err := store.Get(layercake.DockerImageID("child"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(child.Parent).To(Equal("base"))
+			Expect(child.Size).To(BeEquivalentTo(34))
+
+			_, err = store.Get(layercake.DockerImageID("no-layer"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("does not touch the layers in the driver", func() {
+			_, err := store.MigrateDockerGraph(graphRoot)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(driver.CreateCallCount()).To(Equal(0))
+			Expect(driver.ApplyDiffCallCount()).To(Equal(0))
+			Expect(driver.RemoveCallCount()).To(Equal(0))
+		})
+
+		It("can be run again", func() {
+			Expect(store.MigrateDockerGraph(graphRoot)).To(Equal(2))
+			Expect(store.MigrateDockerGraph(graphRoot)).To(Equal(0))
+			Expect(store.All()).To(HaveLen(2))
+		})
+
+		It("can migrate a graph in the root of the store", func() {
+			store.Root = graphRoot
+
+			Expect(store.MigrateDockerGraph(graphRoot)).To(Equal(2))
+			Expect(store.MigrateDockerGraph(graphRoot)).To(Equal(0))
+		})
+
+		Context("when an image's JSON is corrupt", func() {
+			It("returns an error", func() {
+				Expect(ioutil.WriteFile(filepath.Join(graphRoot, "child", "json"), []byte("{"), 0600)).To(Succeed())
+
+				_, err := store.MigrateDockerGraph(graphRoot)
+				Expect(err).To(MatchError(ContainSubstring("image child")))
+			})
+		})
+	})
+})
+
+type quotaedDriver struct {
+	*fake_driver.FakeDriver
+}
+
+func (q *quotaedDriver) GetQuotaed(id, mountlabel string, quota int64) (string, error) {
+	return filepath.Join("/quotaed", id, fmt.Sprintf("%d", quota)), nil
+}
@@ -0,0 +1,58 @@
+package atomicfile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/garden-shed/pkg/atomicfile"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WriteFile", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "atomicfile")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("writes the file with the given permissions", func() {
+		path := filepath.Join(dir, "file")
+		Expect(atomicfile.WriteFile(path, []byte("contents"), 0640)).To(Succeed())
+
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("contents")))
+		info, err := os.Stat(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+	})
+
+	It("replaces an existing file", func() {
+		path := filepath.Join(dir, "file")
+		Expect(ioutil.WriteFile(path, []byte("old"), 0600)).To(Succeed())
+
+		Expect(atomicfile.WriteFile(path, []byte("new"), 0600)).To(Succeed())
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("new")))
+	})
+
+	It("leaves no temporary files behind", func() {
+		Expect(atomicfile.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0600)).To(Succeed())
+
+		entries, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	Context("when the directory does not exist", func() {
+		It("returns an error", func() {
+			Expect(atomicfile.WriteFile(filepath.Join(dir, "missing", "file"), nil, 0600)).NotTo(Succeed())
+		})
+	})
+})
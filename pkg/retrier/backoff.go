@@ -0,0 +1,108 @@
+package retrier
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+	"golang.org/x/net/context"
+)
+
+// Backoff retries a callback with exponentially growing delays between
+// attempts. Each delay is reduced by a random fraction of up to Jitter of
+// itself, so that many clients which failed together do not all retry
+// together.
+type Backoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Jitter       float64
+	Clock        clock.Clock
+
+	// MaxWait caps how long a classifier can ask Retry to wait, so that a
+	// server asking for a long Retry-After cannot hold it up indefinitely.
+	// Zero leaves the wait uncapped.
+	MaxWait time.Duration
+}
+
+// Classifier decides whether an error is worth retrying, and the least time
+// to wait before doing so.
+type Classifier func(err error) (retry bool, wait time.Duration)
+
+// Retry calls callback, numbering attempts from 1, until it succeeds, the
+// attempts run out, classify says the error is not worth retrying or ctx is
+// done. A nil classify retries every error.
+func (b Backoff) Retry(ctx context.Context, attempts int, classify Classifier, callback func(attempt int) error) error {
+	clk := b.Clock
+	if clk == nil {
+		clk = clock.NewClock()
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = callback(attempt); err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		retry, wait := true, time.Duration(0)
+		if classify != nil {
+			retry, wait = classify(err)
+		}
+
+		if !retry {
+			return err
+		}
+
+		if b.MaxWait > 0 && wait > b.MaxWait {
+			wait = b.MaxWait
+		}
+
+		delay := b.Delay(attempt)
+		if wait > delay {
+			delay = wait
+		}
+
+		if delay <= 0 {
+			continue
+		}
+
+		timer := clk.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// Delay returns how long to wait after the given failed attempt.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.InitialDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+
+		if b.MaxDelay > 0 && delay >= b.MaxDelay {
+			break
+		}
+	}
+
+	if b.MaxDelay > 0 && delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	if b.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * b.Jitter * float64(delay))
+	}
+
+	return delay
+}
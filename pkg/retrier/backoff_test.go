@@ -0,0 +1,151 @@
+package retrier_test
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/pkg/retrier"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backoff", func() {
+	var (
+		fakeClk  *fakeclock.FakeClock
+		backoff  retrier.Backoff
+		attempts []int
+		callback func(int) error
+	)
+
+	BeforeEach(func() {
+		fakeClk = fakeclock.NewFakeClock(time.Now())
+		backoff = retrier.Backoff{
+			InitialDelay: time.Second,
+			MaxDelay:     10 * time.Second,
+			Clock:        fakeClk,
+		}
+
+		attempts = nil
+		callback = func(attempt int) error {
+			attempts = append(attempts, attempt)
+			return errors.New("banana")
+		}
+	})
+
+	Describe("Delay", func() {
+		It("doubles with each attempt, up to the maximum", func() {
+			Expect(backoff.Delay(1)).To(Equal(time.Second))
+			Expect(backoff.Delay(2)).To(Equal(2 * time.Second))
+			Expect(backoff.Delay(3)).To(Equal(4 * time.Second))
+			Expect(backoff.Delay(4)).To(Equal(8 * time.Second))
+			Expect(backoff.Delay(5)).To(Equal(10 * time.Second))
+			Expect(backoff.Delay(50)).To(Equal(10 * time.Second))
+		})
+
+		It("takes off up to the jitter fraction of the delay", func() {
+			backoff.Jitter = 0.5
+
+			for i := 0; i < 100; i++ {
+				Expect(backoff.Delay(2)).To(BeNumerically(">", time.Second))
+				Expect(backoff.Delay(2)).To(BeNumerically("<=", 2*time.Second))
+			}
+		})
+	})
+
+	Describe("Retry", func() {
+		It("stops as soon as the callback succeeds", func() {
+			backoff.InitialDelay = 0
+			callback = func(attempt int) error {
+				attempts = append(attempts, attempt)
+				if attempt == 2 {
+					return nil
+				}
+
+				return errors.New("banana")
+			}
+
+			Expect(backoff.Retry(context.Background(), 5, nil, callback)).To(Succeed())
+			Expect(attempts).To(Equal([]int{1, 2}))
+		})
+
+		It("returns the last error once the attempts run out", func() {
+			backoff.InitialDelay = 0
+
+			Expect(backoff.Retry(context.Background(), 3, nil, callback)).To(MatchError("banana"))
+			Expect(attempts).To(Equal([]int{1, 2, 3}))
+		})
+
+		It("does not retry errors the classifier rejects", func() {
+			classify := func(error) (bool, time.Duration) { return false, 0 }
+
+			Expect(backoff.Retry(context.Background(), 3, classify, callback)).To(MatchError("banana"))
+			Expect(attempts).To(Equal([]int{1}))
+		})
+
+		It("waits between attempts", func() {
+			errs := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				errs <- backoff.Retry(context.Background(), 2, nil, callback)
+			}()
+
+			fakeClk.WaitForWatcherAndIncrement(999 * time.Millisecond)
+			Consistently(errs).ShouldNot(Receive())
+
+			fakeClk.Increment(time.Millisecond)
+			Eventually(errs).Should(Receive(MatchError("banana")))
+		})
+
+		It("waits at least as long as the classifier asks", func() {
+			classify := func(error) (bool, time.Duration) { return true, time.Minute }
+
+			errs := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				errs <- backoff.Retry(context.Background(), 2, classify, callback)
+			}()
+
+			fakeClk.WaitForWatcherAndIncrement(30 * time.Second)
+			Consistently(errs).ShouldNot(Receive())
+
+			fakeClk.Increment(30 * time.Second)
+			Eventually(errs).Should(Receive(MatchError("banana")))
+		})
+
+		It("waits no longer than the maximum wait, however long the classifier asks", func() {
+			classify := func(error) (bool, time.Duration) { return true, time.Hour }
+			backoff.MaxWait = time.Minute
+
+			errs := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				errs <- backoff.Retry(context.Background(), 2, classify, callback)
+			}()
+
+			fakeClk.WaitForWatcherAndIncrement(59 * time.Second)
+			Consistently(errs).ShouldNot(Receive())
+
+			fakeClk.Increment(time.Second)
+			Eventually(errs).Should(Receive(MatchError("banana")))
+		})
+
+		It("stops waiting when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+
+			errs := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				errs <- backoff.Retry(ctx, 2, nil, callback)
+			}()
+
+			Eventually(fakeClk.WatcherCount).Should(Equal(1))
+			cancel()
+
+			Eventually(errs).Should(Receive(Equal(context.Canceled)))
+			Expect(attempts).To(Equal([]int{1}))
+		})
+	})
+})
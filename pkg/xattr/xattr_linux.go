@@ -0,0 +1,44 @@
+package xattr
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// List returns the names of the extended attributes of path. The error is
+// syscall.ENOTSUP when its filesystem does not support them.
+func List(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+
+	return names, nil
+}
+
+// Get returns the value of the extended attribute name of path.
+func Get(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(path, name, value); err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
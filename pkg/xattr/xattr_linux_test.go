@@ -0,0 +1,64 @@
+package xattr_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/garden-shed/pkg/xattr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Xattrs", func() {
+	var (
+		tmpDir string
+		path   string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "xattr")
+		Expect(err).NotTo(HaveOccurred())
+
+		path = filepath.Join(tmpDir, "file")
+		Expect(ioutil.WriteFile(path, []byte("contents"), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	setXattr := func(name, value string) {
+		err := syscall.Setxattr(path, name, []byte(value), 0)
+		if err == syscall.ENOTSUP {
+			Skip("the temp dir does not support user xattrs")
+		}
+
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("lists and gets the xattrs of a file", func() {
+		setXattr("user.a", "value-a")
+		setXattr("user.b", "value-b")
+
+		names, err := xattr.List(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("user.a", "user.b"))
+
+		Expect(xattr.Get(path, "user.a")).To(Equal([]byte("value-a")))
+		Expect(xattr.Get(path, "user.b")).To(Equal([]byte("value-b")))
+	})
+
+	It("gets an empty value", func() {
+		setXattr("user.empty", "")
+
+		Expect(xattr.Get(path, "user.empty")).To(BeEmpty())
+	})
+
+	It("returns an error for a missing xattr", func() {
+		_, err := xattr.Get(path, "user.missing")
+		Expect(err).To(HaveOccurred())
+	})
+})
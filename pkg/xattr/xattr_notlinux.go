@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package xattr
+
+import "errors"
+
+var errNotSupported = errors.New("xattrs are only supported on linux")
+
+func List(path string) ([]string, error) {
+	return nil, errNotSupported
+}
+
+func Get(path, name string) ([]byte, error) {
+	return nil, errNotSupported
+}
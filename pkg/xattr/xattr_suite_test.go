@@ -0,0 +1,13 @@
+package xattr_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestXattr(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Xattr Suite")
+}
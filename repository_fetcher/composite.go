@@ -5,8 +5,10 @@ import (
 	"net/url"
 
 	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
 	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
 )
 
 type CompositeFetcher struct {
@@ -15,22 +17,52 @@ type CompositeFetcher struct {
 
 	// fetchers used for docker:// urls, depending on the version
 	RemoteFetcher RepositoryFetcher
+
+	// fetcher used for oci: urls, which are not supported if it is nil
+	OCIFetcher RepositoryFetcher
+
+	// fetcher used for docker-archive: urls, which are not supported if it
+	// is nil
+	DockerArchiveFetcher RepositoryFetcher
 }
 
-func (f *CompositeFetcher) Fetch(log lager.Logger, repoURL *url.URL, diskQuota int64) (*Image, error) {
-	if repoURL.Scheme == "" {
-		return f.LocalFetcher.Fetch(log, repoURL, diskQuota)
+func (f *CompositeFetcher) Fetch(ctx context.Context, log lager.Logger, repoURL *url.URL, creds distclient.Credentials, diskQuota int64) (*Image, error) {
+	fetcher, err := f.fetcherFor(repoURL)
+	if err != nil {
+		return nil, err
 	}
 
-	return f.RemoteFetcher.Fetch(log, repoURL, diskQuota)
+	return fetcher.Fetch(ctx, log, repoURL, creds, diskQuota)
 }
 
 func (f *CompositeFetcher) FetchID(log lager.Logger, repoURL *url.URL) (layercake.ID, error) {
-	if repoURL.Scheme == "" {
-		return f.LocalFetcher.FetchID(log, repoURL)
+	fetcher, err := f.fetcherFor(repoURL)
+	if err != nil {
+		return nil, err
 	}
 
-	return f.RemoteFetcher.FetchID(log, repoURL)
+	return fetcher.FetchID(log, repoURL)
+}
+
+func (f *CompositeFetcher) fetcherFor(repoURL *url.URL) (RepositoryFetcher, error) {
+	switch repoURL.Scheme {
+	case "":
+		return f.LocalFetcher, nil
+	case "oci":
+		if f.OCIFetcher == nil {
+			return nil, fmt.Errorf("repository_fetcher: oci image layouts are not supported")
+		}
+
+		return f.OCIFetcher, nil
+	case "docker-archive":
+		if f.DockerArchiveFetcher == nil {
+			return nil, fmt.Errorf("repository_fetcher: docker archives are not supported")
+		}
+
+		return f.DockerArchiveFetcher, nil
+	default:
+		return f.RemoteFetcher, nil
+	}
 }
 
 type dockerImage struct {
@@ -38,12 +70,12 @@ type dockerImage struct {
 }
 
 func (d dockerImage) Env() []string {
-	var envs []string
+	var envs [][]string
 	for _, l := range d.layers {
-		envs = append(envs, l.env...)
+		envs = append(envs, l.env)
 	}
 
-	return envs
+	return MergeEnv(envs...).Strings()
 }
 
 func (d dockerImage) Vols() []string {
@@ -3,9 +3,11 @@ package repository_fetcher_test
 import (
 	"net/url"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
 	. "code.cloudfoundry.org/garden-shed/repository_fetcher"
 	fakes "code.cloudfoundry.org/garden-shed/repository_fetcher/repository_fetcherfakes"
 	"code.cloudfoundry.org/lager/lagertest"
+	"golang.org/x/net/context"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -13,26 +15,32 @@ import (
 
 var _ = Describe("CompositeFetcher", func() {
 	var (
-		logger            *lagertest.TestLogger
-		fakeLocalFetcher  *fakes.FakeRepositoryFetcher
-		fakeRemoteFetcher *fakes.FakeRepositoryFetcher
-		factory           *CompositeFetcher
+		logger             *lagertest.TestLogger
+		fakeLocalFetcher   *fakes.FakeRepositoryFetcher
+		fakeRemoteFetcher  *fakes.FakeRepositoryFetcher
+		fakeOCIFetcher     *fakes.FakeRepositoryFetcher
+		fakeArchiveFetcher *fakes.FakeRepositoryFetcher
+		factory            *CompositeFetcher
 	)
 
 	BeforeEach(func() {
 		logger = lagertest.NewTestLogger("test")
 		fakeLocalFetcher = new(fakes.FakeRepositoryFetcher)
 		fakeRemoteFetcher = new(fakes.FakeRepositoryFetcher)
+		fakeOCIFetcher = new(fakes.FakeRepositoryFetcher)
+		fakeArchiveFetcher = new(fakes.FakeRepositoryFetcher)
 
 		factory = &CompositeFetcher{
-			LocalFetcher:  fakeLocalFetcher,
-			RemoteFetcher: fakeRemoteFetcher,
+			LocalFetcher:         fakeLocalFetcher,
+			RemoteFetcher:        fakeRemoteFetcher,
+			OCIFetcher:           fakeOCIFetcher,
+			DockerArchiveFetcher: fakeArchiveFetcher,
 		}
 	})
 
 	Context("when the URL does not contain a scheme", func() {
 		It("delegates .Fetch to the local fetcher", func() {
-			factory.Fetch(logger, &url.URL{Path: "cake"}, 24)
+			factory.Fetch(context.Background(), logger, &url.URL{Path: "cake"}, distclient.Credentials{}, 24)
 			Expect(fakeLocalFetcher.FetchCallCount()).To(Equal(1))
 			Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(0))
 		})
@@ -46,7 +54,7 @@ var _ = Describe("CompositeFetcher", func() {
 
 	Context("when the scheme is docker://", func() {
 		It("delegates .Fetch to the remote fetcher", func() {
-			factory.Fetch(logger, &url.URL{Scheme: "docker", Path: "cake"}, 24)
+			factory.Fetch(context.Background(), logger, &url.URL{Scheme: "docker", Path: "cake"}, distclient.Credentials{}, 24)
 			Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(1))
 			Expect(fakeLocalFetcher.FetchCallCount()).To(Equal(0))
 		})
@@ -57,4 +65,42 @@ var _ = Describe("CompositeFetcher", func() {
 			Expect(fakeLocalFetcher.FetchIDCallCount()).To(Equal(0))
 		})
 	})
+
+	Context("when the scheme is oci:", func() {
+		It("delegates .Fetch to the oci fetcher", func() {
+			factory.Fetch(context.Background(), logger, &url.URL{Scheme: "oci", Path: "/some/layout"}, distclient.Credentials{}, 24)
+			Expect(fakeOCIFetcher.FetchCallCount()).To(Equal(1))
+			Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(0))
+		})
+
+		It("delegates .FetchID to the oci fetcher", func() {
+			factory.FetchID(logger, &url.URL{Scheme: "oci", Path: "/some/layout"})
+			Expect(fakeOCIFetcher.FetchIDCallCount()).To(Equal(1))
+			Expect(fakeRemoteFetcher.FetchIDCallCount()).To(Equal(0))
+		})
+
+		Context("when there is no oci fetcher", func() {
+			It("returns an error", func() {
+				factory.OCIFetcher = nil
+
+				_, err := factory.Fetch(context.Background(), logger, &url.URL{Scheme: "oci", Path: "/some/layout"}, distclient.Credentials{}, 24)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when the scheme is docker-archive:", func() {
+		It("delegates .Fetch to the docker archive fetcher", func() {
+			factory.Fetch(context.Background(), logger, &url.URL{Scheme: "docker-archive", Path: "/some/image.tar"}, distclient.Credentials{}, 24)
+			Expect(fakeArchiveFetcher.FetchCallCount()).To(Equal(1))
+			Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(0))
+		})
+
+		It("delegates .FetchID to the docker archive fetcher", func() {
+			factory.FetchID(logger, &url.URL{Scheme: "docker-archive", Path: "/some/image.tar"})
+			Expect(fakeArchiveFetcher.FetchIDCallCount()).To(Equal(1))
+			Expect(fakeRemoteFetcher.FetchIDCallCount()).To(Equal(0))
+		})
+	})
 })
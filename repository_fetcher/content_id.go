@@ -0,0 +1,273 @@
+package repository_fetcher
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/pkg/atomicfile"
+)
+
+// ContentHashIDProvider is a ContainerIDProvider which identifies a local
+// rootfs by a Merkle digest of its whole tree: the names, modes, ownership,
+// extended attributes and contents of every file in it. Unlike
+// LayerIDProvider an edit anywhere in the tree gives a new ID, while touching
+// the rootfs does not.
+//
+// The digests of files are remembered in a sidecar index for each rootfs in
+// IndexDir, keyed on their size, modification and change times and inode, so
+// that only files which have changed are read again, including after a
+// restart. With no IndexDir they are only remembered in memory. Each rootfs
+// is walked under its own lock, so different rootfses are hashed at once.
+//
+// If the tree cannot be read the ID falls back to that of LayerIDProvider.
+type ContentHashIDProvider struct {
+	IndexDir string
+
+	mu      sync.Mutex
+	indexes map[string]*hashIndex
+}
+
+type fileStat struct {
+	uid, gid uint32
+	inode    uint64
+	rdev     uint64
+	ctime    int64
+}
+
+// hashIndex holds the digests of the regular files in a rootfs, by path
+// relative to its root.
+type hashIndex struct {
+	Files map[string]indexedFile `json:"files"`
+
+	mu     sync.Mutex
+	loaded bool
+	seen   map[string]bool
+	dirty  bool
+}
+
+type indexedFile struct {
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"mtime"`
+	ChangeTime int64  `json:"ctime"`
+	Inode      uint64 `json:"inode"`
+	Digest     string `json:"digest"`
+}
+
+func (p *ContentHashIDProvider) ProvideID(path string) layercake.ID {
+	resolved, err := resolve(path)
+	if err != nil {
+		return LayerIDProvider{}.ProvideID(path)
+	}
+
+	index := p.index(resolved)
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if !index.loaded {
+		p.load(resolved, index)
+	}
+
+	digest, err := index.digest(resolved)
+	if err != nil {
+		return LayerIDProvider{}.ProvideID(path)
+	}
+
+	if index.dirty {
+		// a failure to save only costs rehashing next time
+		if err := p.save(resolved, index); err == nil {
+			index.dirty = false
+		}
+	}
+
+	return layercake.ContentImageID(digest)
+}
+
+func (p *ContentHashIDProvider) index(path string) *hashIndex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index, ok := p.indexes[path]; ok {
+		return index
+	}
+
+	if p.indexes == nil {
+		p.indexes = make(map[string]*hashIndex)
+	}
+
+	index := &hashIndex{Files: make(map[string]indexedFile)}
+	p.indexes[path] = index
+	return index
+}
+
+// load reads the saved index of path, it must be called with index.mu held.
+func (p *ContentHashIDProvider) load(path string, index *hashIndex) {
+	index.loaded = true
+	if p.IndexDir == "" {
+		return
+	}
+
+	if b, err := ioutil.ReadFile(p.indexPath(path)); err == nil {
+		// a corrupt index is as good as none
+		if json.Unmarshal(b, index) != nil || index.Files == nil {
+			index.Files = make(map[string]indexedFile)
+		}
+	}
+}
+
+func (p *ContentHashIDProvider) save(path string, index *hashIndex) error {
+	if p.IndexDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(p.IndexDir, 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(p.indexPath(path), b, 0600)
+}
+
+func (p *ContentHashIDProvider) indexPath(path string) string {
+	return filepath.Join(p.IndexDir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(path))))
+}
+
+// digest walks the tree at root, forgetting files which have gone away.
+func (index *hashIndex) digest(root string) (string, error) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return "", err
+	}
+
+	index.seen = make(map[string]bool)
+	digest, err := index.node(root, ".", info)
+	if err != nil {
+		return "", err
+	}
+
+	for rel := range index.Files {
+		if !index.seen[rel] {
+			delete(index.Files, rel)
+			index.dirty = true
+		}
+	}
+
+	return digest, nil
+}
+
+// node digests a file from its metadata, extended attributes and contents.
+// The name is left out, and instead covered by the digest of the directory
+// containing it, so that the root of the tree can live anywhere.
+func (index *hashIndex) node(path, rel string, info os.FileInfo) (string, error) {
+	stat := statOf(info)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %d\n", uint32(info.Mode()), stat.uid, stat.gid)
+
+	if info.Mode().IsRegular() || info.Mode().IsDir() {
+		xattrs, err := xattrsOf(path)
+		if err != nil {
+			return "", err
+		}
+
+		for _, name := range sortedNames(xattrs) {
+			fmt.Fprintf(h, "xattr %s\x00%x\n", name, xattrs[name])
+		}
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		digest, err := index.file(path, rel, info, stat)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s\n", digest)
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s\n", target)
+	case mode.IsDir():
+		children, err := ioutil.ReadDir(path)
+		if err != nil {
+			return "", err
+		}
+
+		for _, child := range children {
+			digest, err := index.node(filepath.Join(path, child.Name()), filepath.Join(rel, child.Name()), child)
+			if err != nil {
+				return "", err
+			}
+
+			fmt.Fprintf(h, "%s\x00%s\n", child.Name(), digest)
+		}
+	case mode&os.ModeDevice != 0:
+		fmt.Fprintf(h, "%d\n", stat.rdev)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// file returns the digest of the contents of a regular file, only reading it
+// when it is not in the index or has changed since it was indexed.
+func (index *hashIndex) file(path, rel string, info os.FileInfo, stat fileStat) (string, error) {
+	index.seen[rel] = true
+
+	current := indexedFile{
+		Size:       info.Size(),
+		ModTime:    info.ModTime().UnixNano(),
+		ChangeTime: stat.ctime,
+		Inode:      stat.inode,
+	}
+
+	if indexed, ok := index.Files[rel]; ok {
+		digest := indexed.Digest
+		indexed.Digest = ""
+
+		if indexed == current {
+			return digest, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	current.Digest = fmt.Sprintf("%x", h.Sum(nil))
+	index.Files[rel] = current
+	index.dirty = true
+
+	return current.Digest, nil
+}
+
+func sortedNames(xattrs map[string][]byte) []string {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,47 @@
+package repository_fetcher
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/pkg/xattr"
+)
+
+func statOf(info os.FileInfo) fileStat {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat{}
+	}
+
+	return fileStat{
+		uid:   stat.Uid,
+		gid:   stat.Gid,
+		inode: uint64(stat.Ino),
+		rdev:  uint64(stat.Rdev),
+		ctime: time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec)).UnixNano(),
+	}
+}
+
+// xattrsOf returns the extended attributes of path which can be read, none
+// if the filesystem does not support them.
+func xattrsOf(path string) (map[string][]byte, error) {
+	names, err := xattr.List(path)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range names {
+		value, err := xattr.Get(path, name)
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[name] = value
+	}
+
+	return xattrs, nil
+}
@@ -0,0 +1,40 @@
+package repository_fetcher_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/garden-shed/repository_fetcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ContentHashIDProvider on linux", func() {
+	var rootfs string
+
+	BeforeEach(func() {
+		var err error
+		rootfs, err = ioutil.TempDir("", "content-id-rootfs")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("contents"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(rootfs)).To(Succeed())
+	})
+
+	It("returns a different ID when an extended attribute changes", func() {
+		if err := syscall.Setxattr(filepath.Join(rootfs, "file"), "user.some-attr", []byte("a"), 0); err != nil {
+			Skip("the temp dir does not support user xattrs: " + err.Error())
+		}
+
+		idp := &repository_fetcher.ContentHashIDProvider{}
+		id := idp.ProvideID(rootfs)
+
+		Expect(syscall.Setxattr(filepath.Join(rootfs, "file"), "user.some-attr", []byte("b"), 0)).To(Succeed())
+		Expect(idp.ProvideID(rootfs)).NotTo(Equal(id))
+	})
+})
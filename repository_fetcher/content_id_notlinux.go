@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package repository_fetcher
+
+import "os"
+
+func statOf(info os.FileInfo) fileStat {
+	return fileStat{}
+}
+
+func xattrsOf(path string) (map[string][]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+package repository_fetcher_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/repository_fetcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ContentHashIDProvider", func() {
+	var (
+		rootfs   string
+		indexDir string
+		idp      *repository_fetcher.ContentHashIDProvider
+	)
+
+	writeFile := func(rel, contents string) {
+		path := filepath.Join(rootfs, rel)
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		rootfs, err = ioutil.TempDir("", "content-id-rootfs")
+		Expect(err).NotTo(HaveOccurred())
+
+		indexDir, err = ioutil.TempDir("", "content-id-index")
+		Expect(err).NotTo(HaveOccurred())
+
+		writeFile("etc/hostname", "some-host")
+		writeFile("usr/lib/deep/down/libfoo.so", "some-library")
+		Expect(os.Symlink("/usr/lib/deep/down/libfoo.so", filepath.Join(rootfs, "usr", "lib", "libfoo.so"))).To(Succeed())
+
+		idp = &repository_fetcher.ContentHashIDProvider{IndexDir: indexDir}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(rootfs)).To(Succeed())
+		Expect(os.RemoveAll(indexDir)).To(Succeed())
+	})
+
+	It("returns a content ID", func() {
+		Expect(idp.ProvideID(rootfs)).To(BeAssignableToTypeOf(layercake.ContentImageID("")))
+	})
+
+	It("consistently returns the same ID when nothing has changed", func() {
+		id := idp.ProvideID(rootfs)
+		Expect(idp.ProvideID(rootfs)).To(Equal(id))
+	})
+
+	It("returns the same ID when the rootfs is touched", func() {
+		id := idp.ProvideID(rootfs)
+
+		later := time.Now().Add(time.Hour)
+		Expect(os.Chtimes(rootfs, later, later)).To(Succeed())
+		Expect(os.Chtimes(filepath.Join(rootfs, "etc", "hostname"), later, later)).To(Succeed())
+
+		Expect(idp.ProvideID(rootfs)).To(Equal(id))
+	})
+
+	It("returns a different ID when a file deep in the tree changes", func() {
+		id := idp.ProvideID(rootfs)
+		writeFile("usr/lib/deep/down/libfoo.so", "some-patched-library")
+
+		Expect(idp.ProvideID(rootfs)).NotTo(Equal(id))
+	})
+
+	It("returns a different ID when the mode of a file changes", func() {
+		id := idp.ProvideID(rootfs)
+		Expect(os.Chmod(filepath.Join(rootfs, "etc", "hostname"), 0600)).To(Succeed())
+
+		Expect(idp.ProvideID(rootfs)).NotTo(Equal(id))
+	})
+
+	It("returns a different ID when a file is renamed", func() {
+		id := idp.ProvideID(rootfs)
+		Expect(os.Rename(filepath.Join(rootfs, "etc", "hostname"), filepath.Join(rootfs, "etc", "hostname2"))).To(Succeed())
+
+		Expect(idp.ProvideID(rootfs)).NotTo(Equal(id))
+	})
+
+	It("returns a different ID when a symlink is repointed", func() {
+		id := idp.ProvideID(rootfs)
+
+		link := filepath.Join(rootfs, "usr", "lib", "libfoo.so")
+		Expect(os.Remove(link)).To(Succeed())
+		Expect(os.Symlink("/elsewhere", link)).To(Succeed())
+
+		Expect(idp.ProvideID(rootfs)).NotTo(Equal(id))
+	})
+
+	It("returns the same ID for an identical tree somewhere else", func() {
+		copied, err := ioutil.TempDir("", "content-id-copy")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(copied)
+
+		Expect(os.MkdirAll(filepath.Join(copied, "etc"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(copied, "usr", "lib", "deep", "down"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(copied, "etc", "hostname"), []byte("some-host"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(copied, "usr", "lib", "deep", "down", "libfoo.so"), []byte("some-library"), 0644)).To(Succeed())
+		Expect(os.Symlink("/usr/lib/deep/down/libfoo.so", filepath.Join(copied, "usr", "lib", "libfoo.so"))).To(Succeed())
+		Expect(os.Chmod(copied, 0700)).To(Succeed())
+		Expect(os.Chmod(rootfs, 0700)).To(Succeed())
+
+		Expect(idp.ProvideID(copied)).To(Equal(idp.ProvideID(rootfs)))
+	})
+
+	Describe("the sidecar index", func() {
+		var indexPath string
+
+		BeforeEach(func() {
+			idp.ProvideID(rootfs)
+
+			indexes, err := filepath.Glob(filepath.Join(indexDir, "*.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(indexes).To(HaveLen(1))
+			indexPath = indexes[0]
+		})
+
+		// rewrites the indexed digest of etc/hostname, so whether it is
+		// trusted shows up in the ID
+		tamperWithIndex := func() {
+			b, err := ioutil.ReadFile(indexPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			var index map[string]map[string]map[string]interface{}
+			Expect(json.Unmarshal(b, &index)).To(Succeed())
+			index["files"]["etc/hostname"]["digest"] = "not-the-real-digest"
+
+			b, err = json.Marshal(index)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(indexPath, b, 0600)).To(Succeed())
+		}
+
+		It("is used after a restart instead of rereading unchanged files", func() {
+			id := idp.ProvideID(rootfs)
+			tamperWithIndex()
+
+			restarted := &repository_fetcher.ContentHashIDProvider{IndexDir: indexDir}
+			Expect(restarted.ProvideID(rootfs)).NotTo(Equal(id))
+		})
+
+		It("is not trusted for files which have changed since", func() {
+			tamperWithIndex()
+			writeFile("etc/hostname", "some-other-host")
+
+			restarted := &repository_fetcher.ContentHashIDProvider{IndexDir: indexDir}
+			fresh := &repository_fetcher.ContentHashIDProvider{}
+			Expect(restarted.ProvideID(rootfs)).To(Equal(fresh.ProvideID(rootfs)))
+		})
+
+		It("is not trusted for files which have changed without changing their modification time", func() {
+			info, err := os.Stat(filepath.Join(rootfs, "etc", "hostname"))
+			Expect(err).NotTo(HaveOccurred())
+
+			tamperWithIndex()
+			writeFile("etc/hostname", "same-host")
+			Expect(os.Chtimes(filepath.Join(rootfs, "etc", "hostname"), info.ModTime(), info.ModTime())).To(Succeed())
+
+			restarted := &repository_fetcher.ContentHashIDProvider{IndexDir: indexDir}
+			fresh := &repository_fetcher.ContentHashIDProvider{}
+			Expect(restarted.ProvideID(rootfs)).To(Equal(fresh.ProvideID(rootfs)))
+		})
+
+		It("is ignored when it is corrupt", func() {
+			id := idp.ProvideID(rootfs)
+			Expect(ioutil.WriteFile(indexPath, []byte("{"), 0600)).To(Succeed())
+
+			restarted := &repository_fetcher.ContentHashIDProvider{IndexDir: indexDir}
+			Expect(restarted.ProvideID(rootfs)).To(Equal(id))
+		})
+	})
+
+	Context("when the rootfs does not exist", func() {
+		It("falls back to a path based ID", func() {
+			Expect(idp.ProvideID("/does/not/exist")).To(BeAssignableToTypeOf(layercake.LocalImageID{}))
+		})
+	})
+})
@@ -0,0 +1,128 @@
+package repository_fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
+)
+
+// DockerArchive fetches images from `docker save` tarballs, with urls such
+// as docker-archive:///path/to/image.tar:busybox:latest. The tag may be left
+// off when the archive holds a single image.
+//
+// Like OCILayout, layers are verified against their diff IDs and registered
+// in the cake individually, sharing cache hits with the same layers pulled
+// by Remote.
+type DockerArchive struct {
+	Cake     layercake.Cake
+	Verifier Verifier
+
+	// FetchLock should be shared with Remote when both use the same cake.
+	// One is created if it is nil.
+	FetchLock *FetchLock
+
+	mu sync.Mutex
+}
+
+func NewDockerArchive(cake layercake.Cake, verifier Verifier, fetchLock *FetchLock) *DockerArchive {
+	if fetchLock == nil {
+		fetchLock = NewFetchLock()
+	}
+
+	return &DockerArchive{
+		Cake:      cake,
+		Verifier:  verifier,
+		FetchLock: fetchLock,
+	}
+}
+
+func (a *DockerArchive) Fetch(ctx context.Context, log lager.Logger, u *url.URL, _ distclient.Credentials, diskQuota int64) (*Image, error) {
+	log = log.Session("docker-archive-fetch", lager.Data{"url": u})
+
+	log.Info("start")
+	defer log.Info("finished")
+
+	conn, manifest, err := a.manifest(ctx, log, u)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := &layerFetcher{
+		cake:                   a.Cake,
+		verifier:               a.Verifier,
+		maxConcurrentDownloads: DefaultMaxConcurrentDownloads,
+		fetchLock:              a.fetchLock(),
+	}
+
+	return fetcher.fetchImage(ctx, log, conn, manifest, diskQuota)
+}
+
+func (a *DockerArchive) fetchLock() *FetchLock {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.FetchLock == nil {
+		a.FetchLock = NewFetchLock()
+	}
+
+	return a.FetchLock
+}
+
+func (a *DockerArchive) FetchID(log lager.Logger, u *url.URL) (layercake.ID, error) {
+	log = log.Session("docker-archive-fetch-id", lager.Data{"url": u})
+
+	_, manifest, err := a.manifest(context.Background(), log, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return layercake.DockerImageID(hex(manifest.Layers[len(manifest.Layers)-1].StrongID)), nil
+}
+
+func (a *DockerArchive) manifest(ctx context.Context, log lager.Logger, u *url.URL) (distclient.Conn, *distclient.Manifest, error) {
+	archive, ref := parseArchiveReference(u.Path)
+	if archive == "" {
+		return nil, nil, errors.New("repository_fetcher: docker-archive url has no path to an archive")
+	}
+
+	conn, err := distclient.OpenDockerArchive(archive)
+	if err != nil {
+		log.Error("failed-to-open-archive", err)
+		return nil, nil, err
+	}
+
+	manifest, err := conn.GetManifest(ctx, log, ref, distclient.DefaultPlatform())
+	if err != nil {
+		return nil, nil, fmt.Errorf("repository_fetcher: get manifest from %s: %s", archive, err)
+	}
+
+	if len(manifest.Layers) == 0 {
+		return nil, nil, fmt.Errorf("repository_fetcher: image in %s has no layers", archive)
+	}
+
+	return conn, manifest, nil
+}
+
+// parseArchiveReference splits the path of a docker-archive url in to the
+// archive and the tag, if any, which follows it. Tags contain colons too, so
+// the archive is the shortest prefix which is an existing file.
+func parseArchiveReference(path string) (string, string) {
+	for i := range path {
+		if path[i] != ':' {
+			continue
+		}
+
+		if info, err := os.Stat(path[:i]); err == nil && !info.IsDir() {
+			return path[:i], path[i+1:]
+		}
+	}
+
+	return path, ""
+}
@@ -0,0 +1,293 @@
+package repository_fetcher_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/layercake/fake_cake"
+	"code.cloudfoundry.org/garden-shed/repository_fetcher"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+type archiveImage struct {
+	repoTags []string
+	env      []string
+	layers   []string
+
+	// gzipLayers saves the layer tars gzipped, as some tools do
+	gzipLayers bool
+}
+
+var _ = Describe("Fetching from a docker archive", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeCake    *fake_cake.FakeCake
+		tmpDir      string
+		archivePath string
+		fetcher     *repository_fetcher.DockerArchive
+
+		registered map[string]string
+	)
+
+	sha256Hex := func(b []byte) string {
+		return fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+
+	// writeArchive writes a tarball laid out like the output of `docker save`
+	writeArchive := func(images []archiveImage, repositories map[string]map[string]string) {
+		f, err := os.Create(archivePath)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		tw := tar.NewWriter(f)
+		defer tw.Close()
+
+		add := func(name string, b []byte) {
+			Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg})).To(Succeed())
+			_, err := tw.Write(b)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		var manifests []map[string]interface{}
+		for _, img := range images {
+			var diffIDs, layerPaths []string
+			for _, l := range img.layers {
+				diffID := sha256Hex([]byte(l))
+				layerPath := diffID + "/layer.tar"
+				if img.gzipLayers {
+					var buf bytes.Buffer
+					gz := gzip.NewWriter(&buf)
+					_, err := gz.Write([]byte(l))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(gz.Close()).To(Succeed())
+
+					add(layerPath, buf.Bytes())
+				} else {
+					add(layerPath, []byte(l))
+				}
+
+				diffIDs = append(diffIDs, "sha256:"+diffID)
+				layerPaths = append(layerPaths, layerPath)
+			}
+
+			config, err := json.Marshal(map[string]interface{}{
+				"config": map[string]interface{}{"Env": img.env},
+				"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			configPath := sha256Hex(config) + ".json"
+			add(configPath, config)
+
+			manifests = append(manifests, map[string]interface{}{
+				"Config":   configPath,
+				"RepoTags": img.repoTags,
+				"Layers":   layerPaths,
+			})
+		}
+
+		b, err := json.Marshal(manifests)
+		Expect(err).NotTo(HaveOccurred())
+		add("manifest.json", b)
+
+		if repositories != nil {
+			b, err := json.Marshal(repositories)
+			Expect(err).NotTo(HaveOccurred())
+			add("repositories", b)
+		}
+	}
+
+	archiveURL := func(ref string) *url.URL {
+		return &url.URL{Scheme: "docker-archive", Path: archivePath + ref}
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "docker-archive")
+		Expect(err).NotTo(HaveOccurred())
+		archivePath = filepath.Join(tmpDir, "image.tar")
+
+		registered = map[string]string{}
+		fakeCake = new(fake_cake.FakeCake)
+		fakeCake.GetReturns(nil, errors.New("no such layer"))
+		fakeCake.RegisterStub = func(img *image.Image, layer archive.ArchiveReader) error {
+			b, err := ioutil.ReadAll(layer)
+			Expect(err).NotTo(HaveOccurred())
+
+			registered[img.ID] = string(b)
+			return nil
+		}
+
+		fetcher = repository_fetcher.NewDockerArchive(fakeCake, repository_fetcher.TempFileVerifier{}, repository_fetcher.NewFetchLock())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	Context("when the archive holds a single image", func() {
+		BeforeEach(func() {
+			writeArchive([]archiveImage{
+				{repoTags: []string{"busybox:latest"}, env: []string{"A=1"}, layers: []string{"layer-1", "layer-2"}},
+			}, nil)
+		})
+
+		It("registers each layer tar in the cake, parent first", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCake.RegisterCallCount()).To(Equal(2))
+			first, _ := fakeCake.RegisterArgsForCall(0)
+			second, _ := fakeCake.RegisterArgsForCall(1)
+
+			Expect(registered[first.ID]).To(Equal("layer-1"))
+			Expect(registered[second.ID]).To(Equal("layer-2"))
+			Expect(first.Parent).To(BeEmpty())
+			Expect(second.Parent).To(Equal(first.ID))
+			Expect(second.Size).To(BeEquivalentTo(len("layer-2")))
+		})
+
+		It("gives the layers the chain IDs a registry pull of the image would", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			first := sha256Hex([]byte("layer-1"))
+			second := sha256Hex([]byte("layer-2"))
+			Expect(img.ImageID).To(Equal(sha256Hex([]byte("sha256:" + first + " sha256:" + second))))
+		})
+
+		It("returns the env of the image", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.Env).To(Equal([]string{"A=1"}))
+		})
+
+		It("fetches the image by its tag", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, archiveURL(":busybox:latest"), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = fetcher.Fetch(context.Background(), logger, archiveURL(":busybox"), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns the same ID from FetchID", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			id, err := fetcher.FetchID(logger, archiveURL(""))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal(layercake.DockerImageID(img.ImageID)))
+		})
+
+		It("does not register layers which are already in the cake", func() {
+			fakeCake.GetReturns(&image.Image{}, nil)
+
+			_, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeCake.RegisterCallCount()).To(Equal(0))
+		})
+
+		It("creates a fetch lock when it is not given one", func() {
+			for _, f := range []*repository_fetcher.DockerArchive{
+				repository_fetcher.NewDockerArchive(fakeCake, repository_fetcher.TempFileVerifier{}, nil),
+				&repository_fetcher.DockerArchive{Cake: fakeCake, Verifier: repository_fetcher.TempFileVerifier{}},
+			} {
+				_, err := f.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			Expect(fakeCake.RegisterCallCount()).To(Equal(4))
+		})
+	})
+
+	Context("when the archive holds gzipped layer tars", func() {
+		BeforeEach(func() {
+			writeArchive([]archiveImage{
+				{repoTags: []string{"busybox:latest"}, layers: []string{"layer-1", "layer-2"}, gzipLayers: true},
+			}, nil)
+		})
+
+		It("registers the decompressed layer tars", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCake.RegisterCallCount()).To(Equal(2))
+			first, _ := fakeCake.RegisterArgsForCall(0)
+			second, _ := fakeCake.RegisterArgsForCall(1)
+
+			Expect(registered[first.ID]).To(Equal("layer-1"))
+			Expect(registered[second.ID]).To(Equal("layer-2"))
+		})
+
+		It("gives the layers the same IDs as uncompressed ones", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			first := sha256Hex([]byte("layer-1"))
+			second := sha256Hex([]byte("layer-2"))
+			Expect(img.ImageID).To(Equal(sha256Hex([]byte("sha256:" + first + " sha256:" + second))))
+		})
+	})
+
+	Context("when the archive holds several images", func() {
+		BeforeEach(func() {
+			writeArchive([]archiveImage{
+				{repoTags: []string{"busybox:latest"}, env: []string{"BUSYBOX=1"}, layers: []string{"busybox-layer"}},
+				{repoTags: []string{"example.com/alpine:3"}, env: []string{"ALPINE=1"}, layers: []string{"alpine-layer"}},
+				{env: []string{"UNTAGGED=1"}, layers: []string{"untagged-layer"}},
+			}, map[string]map[string]string{
+				"untagged": {"v1": sha256Hex([]byte("untagged-layer"))},
+			})
+		})
+
+		It("fetches the image with the given tag", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, archiveURL(":example.com/alpine:3"), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.Env).To(Equal([]string{"ALPINE=1"}))
+		})
+
+		It("falls back to the repositories file", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, archiveURL(":untagged:v1"), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.Env).To(Equal([]string{"UNTAGGED=1"}))
+		})
+
+		It("requires a tag", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error for an unknown tag", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, archiveURL(":busybox:missing"), distclient.Credentials{}, 0)
+			Expect(err).To(MatchError(ContainSubstring("no image tagged busybox:missing")))
+		})
+	})
+
+	Context("when the archive has no manifest.json", func() {
+		It("returns an error", func() {
+			Expect(ioutil.WriteFile(archivePath, nil, 0644)).To(Succeed())
+
+			_, err := fetcher.Fetch(context.Background(), logger, archiveURL(""), distclient.Credentials{}, 0)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,77 @@
+package repository_fetcher
+
+import "strings"
+
+// Env is an ordered list of environment variables in which each name appears
+// once.
+type Env []EnvVar
+
+type EnvVar struct {
+	Name  string
+	Value string
+
+	// NoValue is set for an entry without an =, which is kept as it is
+	NoValue bool
+}
+
+// MergeEnv merges lists of NAME=VALUE environment variables. A variable which
+// is set again replaces the value of the earlier one, keeping its position,
+// the same way docker applies ENV.
+func MergeEnv(envs ...[]string) Env {
+	var merged Env
+	index := make(map[string]int)
+
+	for _, env := range envs {
+		for _, entry := range env {
+			v := parseEnvVar(entry)
+			if i, ok := index[v.Name]; ok {
+				merged[i] = v
+				continue
+			}
+
+			index[v.Name] = len(merged)
+			merged = append(merged, v)
+		}
+	}
+
+	return merged
+}
+
+func parseEnvVar(entry string) EnvVar {
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) == 1 {
+		return EnvVar{Name: parts[0], NoValue: true}
+	}
+
+	return EnvVar{Name: parts[0], Value: parts[1]}
+}
+
+func (e Env) Get(name string) (string, bool) {
+	for _, v := range e {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Strings returns the variables in NAME=VALUE form, or as just NAME if they
+// were given without an =.
+func (e Env) Strings() []string {
+	if e == nil {
+		return nil
+	}
+
+	strs := make([]string, 0, len(e))
+	for _, v := range e {
+		if v.NoValue {
+			strs = append(strs, v.Name)
+			continue
+		}
+
+		strs = append(strs, v.Name+"="+v.Value)
+	}
+
+	return strs
+}
@@ -0,0 +1,53 @@
+package repository_fetcher_test
+
+import (
+	"code.cloudfoundry.org/garden-shed/repository_fetcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MergeEnv", func() {
+	It("keeps the variables in the order they were first set", func() {
+		env := repository_fetcher.MergeEnv([]string{"A=1", "B=2"}, []string{"C=3"})
+		Expect(env).To(Equal(repository_fetcher.Env{
+			{Name: "A", Value: "1"},
+			{Name: "B", Value: "2"},
+			{Name: "C", Value: "3"},
+		}))
+	})
+
+	It("lets the last value of a variable win", func() {
+		env := repository_fetcher.MergeEnv([]string{"PATH=/bin", "A=1", "PATH=/sbin"}, []string{"A=2"})
+		Expect(env.Strings()).To(Equal([]string{"PATH=/sbin", "A=2"}))
+	})
+
+	It("splits on the first =", func() {
+		env := repository_fetcher.MergeEnv([]string{"OPTS=a=b"})
+		value, ok := env.Get("OPTS")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("a=b"))
+	})
+
+	It("keeps a variable without an = unchanged", func() {
+		env := repository_fetcher.MergeEnv([]string{"A=1", "EMPTY"})
+		Expect(env.Strings()).To(Equal([]string{"A=1", "EMPTY"}))
+
+		value, ok := env.Get("EMPTY")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(BeEmpty())
+	})
+
+	It("lets a later value replace a variable without an =", func() {
+		env := repository_fetcher.MergeEnv([]string{"EMPTY"}, []string{"EMPTY=set"})
+		Expect(env.Strings()).To(Equal([]string{"EMPTY=set"}))
+	})
+
+	It("reports variables which are not set", func() {
+		_, ok := repository_fetcher.MergeEnv([]string{"A=1"}).Get("B")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("returns no variables when there are none", func() {
+		Expect(repository_fetcher.MergeEnv().Strings()).To(BeNil())
+	})
+})
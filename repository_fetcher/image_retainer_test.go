@@ -2,18 +2,26 @@ package repository_fetcher_test
 
 import (
 	"errors"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"time"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/garden-shed/distclient/fake_distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/layercake/fake_cake"
 	"code.cloudfoundry.org/garden-shed/layercake/fake_retainer"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher/fake_container_id_provider"
 	fakes "code.cloudfoundry.org/garden-shed/repository_fetcher/repository_fetcherfakes"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/docker/docker/image"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
 )
 
 var _ = Describe("ImageRetainer", func() {
@@ -103,6 +111,71 @@ var _ = Describe("ImageRetainer", func() {
 		})
 	})
 
+	Context("when a docker image is pinned by digest", func() {
+		It("asks the fetcher for the ID of the digest reference", func() {
+			imageRetainer.Retain([]string{
+				"docker:///busybox@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			})
+
+			Expect(fakeRemoteImageIDProvider.FetchIDCallCount()).To(Equal(1))
+			_, u := fakeRemoteImageIDProvider.FetchIDArgsForCall(0)
+			Expect(u.Path).To(Equal("/busybox@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"))
+			Expect(fakeGraphRetainer.RetainCallCount()).To(Equal(2))
+		})
+	})
+
+	Context("when a docker image pinned by digest was fetched before a restart", func() {
+		const pinned = "docker:///busybox@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+		var (
+			digestIDsPath string
+			fakeCake      *fake_cake.FakeCake
+		)
+
+		newRemote := func(dialer repository_fetcher.Dialer) *repository_fetcher.Remote {
+			remote := repository_fetcher.NewRemote("registry-1.docker.io", fakeCake, dialer, new(fakes.FakeVerifier), 1)
+			remote.DigestIDsPath = digestIDsPath
+			return remote
+		}
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "digest-ids")
+			Expect(err).NotTo(HaveOccurred())
+			digestIDsPath = filepath.Join(dir, "digest-ids.json")
+
+			// every layer is already in the cake
+			fakeCake = new(fake_cake.FakeCake)
+			fakeCake.GetReturns(&image.Image{}, nil)
+
+			fakeConn := new(fake_distclient.FakeConn)
+			fakeConn.GetManifestReturns(&distclient.Manifest{
+				Layers: []distclient.Layer{{BlobSum: "some-blob", StrongID: "sha256:pinned-id"}},
+			}, nil)
+
+			fakeDialer := new(fakes.FakeDialer)
+			fakeDialer.DialReturns(fakeConn, nil)
+
+			_, err = newRemote(fakeDialer).Fetch(context.Background(), lagertest.NewTestLogger("test"), parseURL(pinned), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(filepath.Dir(digestIDsPath))).To(Succeed())
+		})
+
+		It("retains the image without asking the registry", func() {
+			restartedDialer := new(fakes.FakeDialer)
+			imageRetainer.DockerImageIDFetcher = newRemote(restartedDialer)
+
+			imageRetainer.Retain([]string{pinned})
+
+			Expect(restartedDialer.DialCallCount()).To(Equal(0))
+			Expect(fakeGraphRetainer.RetainCallCount()).To(Equal(2))
+			_, id := fakeGraphRetainer.RetainArgsForCall(0)
+			Expect(id).To(Equal(layercake.DockerImageID("pinned-id")))
+		})
+	})
+
 	Context("when multiple images are passed", func() {
 		It("retains all the images", func() {
 			imageRetainer.Retain([]string{
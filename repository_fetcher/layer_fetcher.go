@@ -0,0 +1,317 @@
+package repository_fetcher
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/docker/docker/image"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
+)
+
+// layerFetcher registers the layers of images in a cake, downloading those
+// which are not already there. It is shared by the fetchers of images from
+// registries and from disk, so that they share layers in the cake.
+type layerFetcher struct {
+	cake                   layercake.Cake
+	verifier               Verifier
+	maxConcurrentDownloads int
+	fetchLock              *FetchLock
+
+	// checkCached, if set, is asked whether a layer already in the cake may
+	// be handed out to the fetch, and registered is told of each layer the
+	// fetch registers
+	checkCached func(ctx context.Context, log lager.Logger, conn distclient.Conn, layer distclient.Layer) error
+	registered  func(log lager.Logger, layerID string)
+}
+
+// fetchImage registers the layers of manifest in the cake, fetching any
+// which are not already there from conn. The size of the image is that of
+// its layers once they are in the cake. The sizes in a schema2 manifest are
+// those of the compressed blobs, which are no bigger than the layers, so
+// checking them against diskQuota up front only turns away images which
+// certainly do not fit, and the quota is checked again once they are in.
+func (f *layerFetcher) fetchImage(ctx context.Context, log lager.Logger, conn distclient.Conn, manifest *distclient.Manifest, diskQuota int64) (*Image, error) {
+	manifestSize := int64(0)
+	for _, layer := range manifest.Layers {
+		manifestSize += layer.Image.Size
+	}
+
+	if diskQuota > 0 && manifestSize > diskQuota {
+		return nil, ErrQuotaExceeded
+	}
+
+	var vols []string
+	for _, layer := range manifest.Layers {
+		if layer.Image.Config != nil {
+			vols = append(vols, keys(layer.Image.Config.Volumes)...)
+		}
+	}
+
+	totalImageSize, err := f.fetchLayers(ctx, log, conn, manifest.Layers)
+	if err != nil {
+		return nil, err
+	}
+
+	if diskQuota > 0 && totalImageSize > diskQuota {
+		log.Info("layers-exceed-quota", lager.Data{"size": totalImageSize, "quota": diskQuota})
+		return nil, ErrQuotaExceeded
+	}
+
+	return &Image{
+		ImageID: hex(manifest.Layers[len(manifest.Layers)-1].StrongID),
+		Env:     imageEnv(manifest.Layers).Strings(),
+		Volumes: vols,
+		Size:    totalImageSize,
+		Config:  imageConfig(manifest.Layers),
+	}, nil
+}
+
+// layerFetch tracks a layer being fetched, done is closed once the layer is
+// in the cake or the fetch has failed.
+type layerFetch struct {
+	done chan struct{}
+	size int64
+	err  error
+}
+
+// fetchLayers downloads up to maxConcurrentDownloads layers at once, while
+// registering them in the cake strictly parent first. The FetchLock for each
+// layer, keyed by the ID it is registered under, is taken in layer order
+// before its download starts and is held until it is registered, so
+// concurrent fetches of images sharing layers only download and register
+// each layer once, even if their blobs differ, and can never wait on each
+// other in a cycle.
+// Download slots are handed out in layer order too, as a streamed blob keeps
+// its slot until it is registered, which waits for its parent.
+// The first layer to fail cancels the others, and all of them have finished
+// by the time it returns. Layers registered before then, or before ctx is
+// cancelled, are complete and stay in the cake.
+func (f *layerFetcher) fetchLayers(ctx context.Context, log lager.Logger, conn distclient.Conn, layers []distclient.Layer) (int64, error) {
+	limit := f.maxConcurrentDownloads
+	if limit <= 0 {
+		limit = 1
+	}
+
+	downloads := make(chan struct{}, limit)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		failOnce sync.Once
+		failure  error
+	)
+
+	var fetches []*layerFetch
+	var parent *layerFetch
+	for _, layer := range layers {
+		if parent != nil && parent.failed() {
+			break
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		f.fetchLock.Acquire(hex(layer.StrongID))
+
+		select {
+		case downloads <- struct{}{}:
+		case <-ctx.Done():
+			f.fetchLock.Release(hex(layer.StrongID))
+			continue
+		}
+
+		slot := &downloadSlot{downloads: downloads}
+		fetch := &layerFetch{done: make(chan struct{})}
+		go func(layer distclient.Layer, slot *downloadSlot, fetch, parent *layerFetch) {
+			defer close(fetch.done)
+			defer f.fetchLock.Release(hex(layer.StrongID))
+			defer slot.release()
+
+			fetch.size, fetch.err = f.fetchLayer(ctx, log, conn, layer, slot, parent)
+			if fetch.err != nil {
+				failOnce.Do(func() {
+					failure = fetch.err
+					cancel()
+				})
+			}
+		}(layer, slot, fetch, parent)
+
+		fetches = append(fetches, fetch)
+		parent = fetch
+	}
+
+	var size int64
+	for _, fetch := range fetches {
+		<-fetch.done
+		size += fetch.size
+	}
+
+	// the other layers fail with the cancellation, so return the error
+	// which caused it
+	if failure != nil {
+		return 0, failure
+	}
+
+	return size, ctx.Err()
+}
+
+func (f *layerFetch) failed() bool {
+	select {
+	case <-f.done:
+		return f.err != nil
+	default:
+		return false
+	}
+}
+
+func (f *layerFetcher) fetchLayer(ctx context.Context, log lager.Logger, conn distclient.Conn, layer distclient.Layer, slot *downloadSlot, parent *layerFetch) (int64, error) {
+	log = log.Session("fetch-layer", lager.Data{"blobsum": layer.BlobSum, "id": layer.StrongID, "parent": layer.ParentStrongID})
+
+	log.Info("start")
+	defer log.Info("fetched")
+
+	cached, err := f.cake.Get(layercake.DockerImageID(hex(layer.StrongID)))
+	if err == nil {
+		if f.checkCached != nil {
+			if err := f.checkCached(ctx, log, conn, layer); err != nil {
+				return 0, err
+			}
+		}
+
+		log.Info("got-cache")
+		return cached.Size, nil
+	}
+
+	if parent != nil && parent.failed() {
+		return 0, parent.err
+	}
+
+	verifiedBlob, err := f.download(ctx, log, conn, layer, slot)
+	if err != nil {
+		return 0, err
+	}
+
+	if parent != nil {
+		log.Debug("waiting-for-parent")
+		select {
+		case <-parent.done:
+		case <-ctx.Done():
+			verifiedBlob.Close()
+			return 0, ctx.Err()
+		}
+
+		if parent.err != nil {
+			verifiedBlob.Close()
+			return 0, parent.err
+		}
+	}
+
+	// the cake replaces the size from the manifest with the size of the
+	// layer as extracted
+	img := &image.Image{
+		ID:     hex(layer.StrongID),
+		Parent: hex(layer.ParentStrongID),
+		Size:   layer.Image.Size,
+	}
+
+	log.Debug("registering")
+	if err := f.cake.Register(img, verifiedBlob); err != nil {
+		verifiedBlob.Close()
+
+		if ctx.Err() != nil {
+			// the blob stopped part way through, don't leave half a layer behind
+			log.Info("cancelled-while-registering")
+			if removeErr := f.cake.Remove(layercake.DockerImageID(hex(layer.StrongID))); removeErr != nil {
+				log.Error("failed-to-remove-partial-layer", removeErr)
+			}
+
+			return 0, ctx.Err()
+		}
+
+		return 0, err
+	}
+
+	// a streaming verifier only knows whether the blob matched once it has
+	// been read to the end, and the layer's tar stream may end before the blob
+	_, err = io.Copy(ioutil.Discard, verifiedBlob)
+	if closeErr := verifiedBlob.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		log.Error("failed-to-verify-registered-layer", err)
+		if removeErr := f.cake.Remove(layercake.DockerImageID(hex(layer.StrongID))); removeErr != nil {
+			log.Error("failed-to-remove-unverified-layer", removeErr)
+		}
+
+		return 0, err
+	}
+
+	if f.registered != nil {
+		f.registered(log, img.ID)
+	}
+
+	return img.Size, nil
+}
+
+func (f *layerFetcher) download(ctx context.Context, log lager.Logger, conn distclient.Conn, layer distclient.Layer, slot *downloadSlot) (io.ReadCloser, error) {
+	blob, err := conn.GetBlobReader(ctx, log, layer.BlobSum)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &slotReader{Reader: blob, slot: slot}
+
+	log.Debug("verifying")
+	verifiedBlob, err := f.verifier.Verify(source, layer.BlobSum)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	log.Debug("verified")
+	return verifiedBlob, nil
+}
+
+// downloadSlot is one of the maxConcurrentDownloads of a fetch.
+type downloadSlot struct {
+	downloads chan struct{}
+	once      sync.Once
+}
+
+func (s *downloadSlot) release() {
+	s.once.Do(func() { <-s.downloads })
+}
+
+// slotReader releases the download slot of a blob once the blob has been
+// read to the end or closed.
+type slotReader struct {
+	io.Reader
+	slot *downloadSlot
+}
+
+func (s *slotReader) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if err != nil {
+		s.slot.release()
+	}
+
+	return n, err
+}
+
+func (s *slotReader) Close() error {
+	s.slot.release()
+
+	if closer, ok := s.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
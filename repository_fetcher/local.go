@@ -3,15 +3,18 @@ package repository_fetcher
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"sync"
 	"time"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
 	"code.cloudfoundry.org/lager"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/pkg/archive"
+	"golang.org/x/net/context"
 )
 
 //go:generate counterfeiter -o fake_container_id_provider/FakeContainerIDProvider.go . ContainerIDProvider
@@ -24,10 +27,15 @@ type Local struct {
 	DefaultRootFSPath string
 	IDProvider        ContainerIDProvider
 
-	mu sync.RWMutex
+	// FetchLock makes concurrent imports of the same rootfs wait for the
+	// first, while different rootfses import concurrently. It is taken on
+	// the path of the rootfs and then on its ID. One is created if it is nil.
+	FetchLock *FetchLock
+
+	mu sync.Mutex
 }
 
-func (l *Local) Fetch(log lager.Logger, repoURL *url.URL, _ int64) (*Image, error) {
+func (l *Local) Fetch(ctx context.Context, log lager.Logger, repoURL *url.URL, _ distclient.Credentials, _ int64) (*Image, error) {
 	log = log.Session("local-fetch", lager.Data{"path": repoURL})
 
 	log.Info("start")
@@ -42,6 +50,10 @@ func (l *Local) Fetch(log lager.Logger, repoURL *url.URL, _ int64) (*Image, erro
 		return nil, errors.New("RootFSPath: is a required parameter, since no default rootfs was provided to the server.")
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	id, err := l.fetch(log, path)
 	return &Image{
 		ImageID: id,
@@ -58,22 +70,37 @@ func (l *Local) fetch(log lager.Logger, path string) (string, error) {
 		return "", err
 	}
 
+	// the ID is worked out under the lock of the path, as working it out may
+	// mean walking the whole rootfs, which concurrent fetches of the same
+	// rootfs should wait for rather than repeat
+	lock := l.fetchLock()
+	lock.Acquire(path)
+	defer lock.Release(path)
+
 	id := l.IDProvider.ProvideID(path)
 
-	// synchronize all downloads, we could optimize by only mutexing around each
-	// particular rootfs path, but in practice importing local rootfses is decently fast,
-	// and concurrently importing local rootfses is rare.
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	lock.Acquire(id.GraphID())
+	defer lock.Release(id.GraphID())
 
 	if _, err := l.Cake.Get(id); err == nil {
 		log.Info("using-cache", lager.Data{"graphID": id.GraphID()})
 		return id.GraphID(), nil // use cache
 	}
 
-	tar, err := archive.Tar(path, archive.Uncompressed)
+	info, err := os.Stat(path)
 	if err != nil {
-		return "", fmt.Errorf("repository_fetcher: fetch local rootfs: untar rootfs: %v", err)
+		return "", fmt.Errorf("repository_fetcher: fetch local rootfs: %v", err)
+	}
+
+	var tar io.ReadCloser
+	if info.Mode().IsRegular() {
+		if tar, err = openTarball(path); err != nil {
+			return "", fmt.Errorf("repository_fetcher: fetch local rootfs: open tarball: %v", err)
+		}
+	} else {
+		if tar, err = archive.Tar(path, archive.Uncompressed); err != nil {
+			return "", fmt.Errorf("repository_fetcher: fetch local rootfs: untar rootfs: %v", err)
+		}
 	}
 	defer tar.Close()
 
@@ -85,6 +112,17 @@ func (l *Local) fetch(log lager.Logger, path string) (string, error) {
 	return id.GraphID(), nil
 }
 
+func (l *Local) fetchLock() *FetchLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.FetchLock == nil {
+		l.FetchLock = NewFetchLock()
+	}
+
+	return l.FetchLock
+}
+
 func resolve(path string) (string, error) {
 	fileInfo, err := os.Lstat(path)
 	if err != nil {
@@ -119,8 +157,14 @@ func (LayerIDProvider) ProvideID(path string) layercake.ID {
 		}
 	}
 
-	return layercake.LocalImageID{
+	id := layercake.LocalImageID{
 		Path:         path,
 		ModifiedTime: info.ModTime(),
 	}
+
+	if info.Mode().IsRegular() {
+		id.Size = info.Size()
+	}
+
+	return id
 }
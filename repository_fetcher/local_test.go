@@ -3,23 +3,28 @@ package repository_fetcher_test
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
 	"code.cloudfoundry.org/garden-shed/layercake/fake_cake"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
+	"code.cloudfoundry.org/garden-shed/repository_fetcher/fake_container_id_provider"
 	"code.cloudfoundry.org/lager/lagertest"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/pkg/archive"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
+	"golang.org/x/net/context"
 )
 
 var _ = Describe("LayerIDProvider", func() {
@@ -70,6 +75,25 @@ var _ = Describe("LayerIDProvider", func() {
 		Expect(idp.ProvideID(path1)).NotTo(Equal(beforeID))
 	})
 
+	Context("when path is a tarball", func() {
+		var tarball string
+
+		BeforeEach(func() {
+			tarball = path.Join(path1, "rootfs.tar")
+			Expect(ioutil.WriteFile(tarball, []byte("some-tarball"), 0600)).To(Succeed())
+			Expect(os.Chtimes(tarball, accessTime, modifiedTime)).To(Succeed())
+		})
+
+		It("returns a different ID if the size changes, even when the modification time does not", func() {
+			beforeID := idp.ProvideID(tarball)
+
+			Expect(ioutil.WriteFile(tarball, []byte("some-bigger-tarball"), 0600)).To(Succeed())
+			Expect(os.Chtimes(tarball, accessTime, modifiedTime)).To(Succeed())
+
+			Expect(idp.ProvideID(tarball).GraphID()).NotTo(Equal(beforeID.GraphID()))
+		})
+	})
+
 	Context("when path is a symlink", func() {
 		var symlinkPath string
 
@@ -140,7 +164,7 @@ var _ = Describe("Local", func() {
 		})
 
 		It("returns the image id", func() {
-			response, err := fetcher.Fetch(fakeLogger, &url.URL{Path: rootFSPath}, 0)
+			response, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: rootFSPath}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(response.ImageID).To(HaveSuffix("foo_bar_baz"))
 		})
@@ -159,7 +183,7 @@ var _ = Describe("Local", func() {
 				It("should use the default", func() {
 					fakeCake.GetReturns(&image.Image{}, nil)
 
-					response, err := fetcher.Fetch(fakeLogger, &url.URL{Path: ""}, 0)
+					response, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: ""}, distclient.Credentials{}, 0)
 					Expect(err).NotTo(HaveOccurred())
 					Expect(response.ImageID).To(HaveSuffix("the_default_path"))
 				})
@@ -167,14 +191,14 @@ var _ = Describe("Local", func() {
 
 			Context("and a default was not specified", func() {
 				It("should throw an appropriate error", func() {
-					_, err := fetcher.Fetch(fakeLogger, &url.URL{Path: ""}, 0)
+					_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: ""}, distclient.Credentials{}, 0)
 					Expect(err).To(MatchError("RootFSPath: is a required parameter, since no default rootfs was provided to the server."))
 				})
 			})
 		})
 
 		It("provides import time profile info", func() {
-			_, err := fetcher.Fetch(fakeLogger, &url.URL{Path: rootFSPath}, 0)
+			_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: rootFSPath}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 
 			By("logging with timestamps")
@@ -183,7 +207,7 @@ var _ = Describe("Local", func() {
 		})
 
 		It("logs that it is using the cache", func() {
-			_, err := fetcher.Fetch(fakeLogger, &url.URL{Path: rootFSPath}, 0)
+			_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: rootFSPath}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(fakeLogger).To(gbytes.Say("local-fetch.using-cache"))
@@ -214,7 +238,7 @@ var _ = Describe("Local", func() {
 			err := os.MkdirAll(dirPath, 0700)
 			Expect(err).NotTo(HaveOccurred())
 
-			_, err = fetcher.Fetch(fakeLogger, &url.URL{Path: dirPath}, 0)
+			_, err = fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: dirPath}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(registeredImage).NotTo(BeNil())
@@ -239,7 +263,7 @@ var _ = Describe("Local", func() {
 			Expect(os.MkdirAll(path.Join(tmp, "a", "test"), 0700)).To(Succeed())
 			Expect(ioutil.WriteFile(path.Join(tmp, "a", "test", "file"), []byte(""), 0700)).To(Succeed())
 
-			_, err = fetcher.Fetch(fakeLogger, &url.URL{Path: tmp}, 0)
+			_, err = fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tmp}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 		})
 
@@ -248,7 +272,7 @@ var _ = Describe("Local", func() {
 			err := os.MkdirAll(dirPath, 0700)
 			Expect(err).NotTo(HaveOccurred())
 
-			response, err := fetcher.Fetch(fakeLogger, &url.URL{Path: dirPath}, 0)
+			response, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: dirPath}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(response.ImageID).To(HaveSuffix("foo_bar_baz"))
 		})
@@ -280,19 +304,235 @@ var _ = Describe("Local", func() {
 				Expect(os.MkdirAll(path.Join(tmp, "a", "test"), 0700)).To(Succeed())
 				Expect(ioutil.WriteFile(path.Join(tmp, "a", "test", "file"), []byte(""), 0700)).To(Succeed())
 
-				_, err = fetcher.Fetch(fakeLogger, &url.URL{Path: symlinkDir}, 0)
+				_, err = fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: symlinkDir}, distclient.Credentials{}, 0)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when importing several rootfses at once", func() {
+			var (
+				stackA, stackB string
+				releaseA       chan struct{}
+
+				mu         sync.Mutex
+				registered map[string]bool
+			)
+
+			BeforeEach(func() {
+				stackA = path.Join(tmpDir, "stack-a")
+				stackB = path.Join(tmpDir, "stack-b")
+				Expect(os.MkdirAll(stackA, 0700)).To(Succeed())
+				Expect(os.MkdirAll(stackB, 0700)).To(Succeed())
+
+				releaseA = make(chan struct{})
+				registered = map[string]bool{}
+
+				fakeCake.GetStub = func(id layercake.ID) (*image.Image, error) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					if registered[id.GraphID()] {
+						return &image.Image{}, nil
+					}
+
+					return nil, errors.New("no image")
+				}
+
+				fakeCake.RegisterStub = func(img *image.Image, layer archive.ArchiveReader) error {
+					if strings.HasSuffix(img.ID, "stack-a") {
+						<-releaseA
+					}
+
+					mu.Lock()
+					defer mu.Unlock()
+					registered[img.ID] = true
+					return nil
+				}
+			})
+
+			fetchInBackground := func(rootfs string) chan error {
+				errs := make(chan error, 1)
+				go func() {
+					defer GinkgoRecover()
+					_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: rootfs}, distclient.Credentials{}, 0)
+					errs <- err
+				}()
+
+				return errs
+			}
+
+			It("does not make different rootfses wait for each other", func() {
+				fetchingA := fetchInBackground(stackA)
+				Eventually(fakeCake.RegisterCallCount).Should(Equal(1))
+
+				Eventually(fetchInBackground(stackB)).Should(Receive(BeNil()))
+				Consistently(fetchingA).ShouldNot(Receive())
+
+				close(releaseA)
+				Eventually(fetchingA).Should(Receive(BeNil()))
+			})
+
+			It("only imports the same rootfs once", func() {
+				first := fetchInBackground(stackA)
+				Eventually(fakeCake.RegisterCallCount).Should(Equal(1))
+
+				second := fetchInBackground(stackA)
+				Consistently(second).ShouldNot(Receive())
+
+				close(releaseA)
+				Eventually(first).Should(Receive(BeNil()))
+				Eventually(second).Should(Receive(BeNil()))
+				Expect(fakeCake.RegisterCallCount()).To(Equal(1))
+			})
+
+			Context("while the ID of a rootfs is being worked out", func() {
+				var (
+					fakeIDProvider *fake_container_id_provider.FakeContainerIDProvider
+					releaseID      chan struct{}
+				)
+
+				JustBeforeEach(func() {
+					close(releaseA)
+					releaseID = make(chan struct{})
+
+					fakeIDProvider = new(fake_container_id_provider.FakeContainerIDProvider)
+					fakeIDProvider.ProvideIDStub = func(path string) layercake.ID {
+						if path == stackA {
+							<-releaseID
+						}
+
+						return UnderscoreIDer{}.ProvideID(path)
+					}
+					fetcher.IDProvider = fakeIDProvider
+				})
+
+				It("does not make different rootfses wait", func() {
+					fetchingA := fetchInBackground(stackA)
+					Eventually(fakeIDProvider.ProvideIDCallCount).Should(Equal(1))
+
+					Eventually(fetchInBackground(stackB)).Should(Receive(BeNil()))
+
+					close(releaseID)
+					Eventually(fetchingA).Should(Receive(BeNil()))
+				})
+
+				It("makes fetches of the same rootfs wait for it rather than work it out again", func() {
+					first := fetchInBackground(stackA)
+					Eventually(fakeIDProvider.ProvideIDCallCount).Should(Equal(1))
+
+					second := fetchInBackground(stackA)
+					Consistently(fakeIDProvider.ProvideIDCallCount).Should(Equal(1))
+
+					close(releaseID)
+					Eventually(first).Should(Receive(BeNil()))
+					Eventually(second).Should(Receive(BeNil()))
+					Expect(fakeCake.RegisterCallCount()).To(Equal(1))
+				})
+			})
+		})
+
+		Context("when the path is a tarball", func() {
+			var (
+				rootfsDir   string
+				tarballPath string
+				untarred    string
+			)
+
+			writeTarball := func(compression archive.Compression) {
+				tar, err := archive.Tar(rootfsDir, compression)
 				Expect(err).NotTo(HaveOccurred())
+				defer tar.Close()
+
+				f, err := os.Create(tarballPath)
+				Expect(err).NotTo(HaveOccurred())
+				defer f.Close()
+
+				_, err = io.Copy(f, tar)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			BeforeEach(func() {
+				rootfsDir = path.Join(tmpDir, "rootfs")
+				Expect(os.MkdirAll(path.Join(rootfsDir, "a", "test"), 0700)).To(Succeed())
+				Expect(ioutil.WriteFile(path.Join(rootfsDir, "a", "test", "file"), []byte("stack"), 0700)).To(Succeed())
+
+				tarballPath = path.Join(tmpDir, "rootfs.tar")
+				untarred = path.Join(tmpDir, "untarred")
+
+				fakeCake.RegisterStub = func(image *image.Image, layer archive.ArchiveReader) error {
+					return archive.Untar(layer, untarred, nil)
+				}
+			})
+
+			It("registers the contents of an uncompressed tarball", func() {
+				writeTarball(archive.Uncompressed)
+
+				_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tarballPath}, distclient.Credentials{}, 0)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadFile(path.Join(untarred, "a", "test", "file"))).To(Equal([]byte("stack")))
+			})
+
+			It("decompresses a gzipped tarball", func() {
+				tarballPath = path.Join(tmpDir, "rootfs.tgz")
+				writeTarball(archive.Gzip)
+
+				_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tarballPath}, distclient.Credentials{}, 0)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadFile(path.Join(untarred, "a", "test", "file"))).To(Equal([]byte("stack")))
+			})
+
+			It("decompresses a zstd tarball", func() {
+				if _, err := exec.LookPath("zstd"); err != nil {
+					Skip("zstd is not installed")
+				}
+
+				writeTarball(archive.Uncompressed)
+				Expect(exec.Command("zstd", "-q", tarballPath, "-o", tarballPath+".zst").Run()).To(Succeed())
+
+				_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tarballPath + ".zst"}, distclient.Credentials{}, 0)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadFile(path.Join(untarred, "a", "test", "file"))).To(Equal([]byte("stack")))
+			})
+
+			Context("when the zstd command is not installed", func() {
+				var oldPath string
+
+				BeforeEach(func() {
+					oldPath = os.Getenv("PATH")
+					Expect(os.Setenv("PATH", tmpDir)).To(Succeed())
+				})
+
+				AfterEach(func() {
+					Expect(os.Setenv("PATH", oldPath)).To(Succeed())
+				})
+
+				It("says so for a zstd tarball", func() {
+					Expect(ioutil.WriteFile(tarballPath, []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}, 0600)).To(Succeed())
+
+					_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tarballPath}, distclient.Credentials{}, 0)
+					Expect(err).To(MatchError(ContainSubstring(repository_fetcher.ErrZstdNotFound.Error())))
+					Expect(fakeCake.RegisterCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the tarball is corrupt", func() {
+				It("returns an error", func() {
+					Expect(ioutil.WriteFile(tarballPath, append([]byte{0x1f, 0x8b}, []byte("not really gzip")...), 0600)).To(Succeed())
+
+					_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tarballPath}, distclient.Credentials{}, 0)
+					Expect(err).To(HaveOccurred())
+				})
 			})
 		})
 
 		Context("when the path does not exist", func() {
 			It("returns an error", func() {
-				_, err := fetcher.Fetch(fakeLogger, &url.URL{Path: "does-not-exist"}, 0)
+				_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: "does-not-exist"}, distclient.Credentials{}, 0)
 				Expect(err).To(HaveOccurred())
 			})
 
 			It("doesn't try to register anything in the graph", func() {
-				fetcher.Fetch(fakeLogger, &url.URL{Path: "does-not-exist"}, 0)
+				fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: "does-not-exist"}, distclient.Credentials{}, 0)
 				Expect(fakeCake.RegisterCallCount()).To(Equal(0))
 			})
 		})
@@ -305,13 +545,13 @@ var _ = Describe("Local", func() {
 			})
 
 			It("returns a wrapped error", func() {
-				_, err := fetcher.Fetch(fakeLogger, &url.URL{Path: tmpDir}, 0)
+				_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tmpDir}, distclient.Credentials{}, 0)
 				Expect(err).To(MatchError("repository_fetcher: fetch local rootfs: register rootfs: sold out"))
 			})
 		})
 
 		It("provides import time profile info", func() {
-			_, err := fetcher.Fetch(fakeLogger, &url.URL{Path: tmpDir}, 0)
+			_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tmpDir}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 
 			By("logging with timestamps")
@@ -320,7 +560,7 @@ var _ = Describe("Local", func() {
 		})
 
 		It("does not log that it is using cache", func() {
-			_, err := fetcher.Fetch(fakeLogger, &url.URL{Path: tmpDir}, 0)
+			_, err := fetcher.Fetch(context.Background(), fakeLogger, &url.URL{Path: tmpDir}, distclient.Credentials{}, 0)
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(fakeLogger).NotTo(gbytes.Say("local-fetch.using-cache"))
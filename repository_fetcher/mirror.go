@@ -0,0 +1,117 @@
+package repository_fetcher
+
+import (
+	"io"
+	"sync"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/lager"
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// mirroredConn is a distclient.Conn which tries each of a registry's mirrors
+// in order before falling back to the registry itself. Connections are dialed
+// lazily, the first time an endpoint is needed.
+//
+// Only the upstream registry is sent the credentials of the fetch, mirrors
+// are dialed with whatever credentials the dialer finds for them itself.
+type mirroredConn struct {
+	dialer    Dialer
+	repo      string
+	creds     distclient.Credentials
+	upstream  string
+	endpoints []string
+
+	mu    sync.Mutex
+	conns map[string]dialResult
+}
+
+type dialResult struct {
+	conn distclient.Conn
+	err  error
+}
+
+func newMirroredConn(dialer Dialer, upstream string, mirrors []string, repo string, creds distclient.Credentials) *mirroredConn {
+	return &mirroredConn{
+		dialer:    dialer,
+		repo:      repo,
+		creds:     creds,
+		upstream:  upstream,
+		endpoints: append(append([]string{}, mirrors...), upstream),
+		conns:     make(map[string]dialResult),
+	}
+}
+
+func (m *mirroredConn) GetManifest(ctx context.Context, log lager.Logger, ref string, platform distclient.Platform) (*distclient.Manifest, error) {
+	var manifest *distclient.Manifest
+	err := m.try(ctx, log, "manifest", func(conn distclient.Conn) (err error) {
+		manifest, err = conn.GetManifest(ctx, log, ref, platform)
+		return err
+	})
+
+	return manifest, err
+}
+
+func (m *mirroredConn) GetBlobReader(ctx context.Context, log lager.Logger, d digest.Digest) (io.Reader, error) {
+	var blob io.Reader
+	err := m.try(ctx, log, "blob", func(conn distclient.Conn) (err error) {
+		blob, err = conn.GetBlobReader(ctx, log, d)
+		return err
+	})
+
+	return blob, err
+}
+
+func (m *mirroredConn) StatBlob(ctx context.Context, log lager.Logger, d digest.Digest) error {
+	return m.try(ctx, log, "stat", func(conn distclient.Conn) error {
+		return conn.StatBlob(ctx, log, d)
+	})
+}
+
+// try calls fn with the connection to each endpoint in turn until one
+// succeeds, returning the error from the last endpoint if none do.
+func (m *mirroredConn) try(ctx context.Context, log lager.Logger, what string, fn func(distclient.Conn) error) error {
+	var err error
+	for _, endpoint := range m.endpoints {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var conn distclient.Conn
+		if conn, err = m.conn(ctx, log, endpoint); err != nil {
+			log.Error("failed-to-dial-endpoint", err, lager.Data{"endpoint": endpoint, "for": what})
+			continue
+		}
+
+		if err = fn(conn); err != nil {
+			log.Error("endpoint-failed", err, lager.Data{"endpoint": endpoint, "for": what})
+			continue
+		}
+
+		log.Info("served", lager.Data{"endpoint": endpoint, "for": what, "mirror": endpoint != m.upstream})
+		return nil
+	}
+
+	return err
+}
+
+func (m *mirroredConn) conn(ctx context.Context, log lager.Logger, endpoint string) (distclient.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// failed dials are remembered too, so that an unreachable mirror is
+	// only waited on once per fetch rather than once per layer
+	if result, ok := m.conns[endpoint]; ok {
+		return result.conn, result.err
+	}
+
+	creds := distclient.Credentials{}
+	if endpoint == m.upstream {
+		creds = m.creds
+	}
+
+	conn, err := m.dialer.Dial(ctx, log, endpoint, m.repo, creds)
+	m.conns[endpoint] = dialResult{conn: conn, err: err}
+	return conn, err
+}
@@ -0,0 +1,129 @@
+package repository_fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
+)
+
+// OCILayout fetches images from OCI image layout directories on disk, with
+// urls such as oci:///path/to/layout:tag or oci:///path/to/layout@sha256:...
+// With no tag or digest the only image in the layout is used, or if there
+// are several the one tagged latest.
+//
+// Blobs are verified and layers are registered in the cake individually,
+// exactly as Remote does for images from a registry, so an image staged on
+// disk shares its layers with the same image pulled from a registry.
+type OCILayout struct {
+	Cake     layercake.Cake
+	Verifier Verifier
+	Platform distclient.Platform
+
+	// FetchLock should be shared with Remote when both use the same cake.
+	// One is created if it is nil.
+	FetchLock *FetchLock
+
+	mu sync.Mutex
+}
+
+func NewOCILayout(cake layercake.Cake, verifier Verifier, fetchLock *FetchLock) *OCILayout {
+	if fetchLock == nil {
+		fetchLock = NewFetchLock()
+	}
+
+	return &OCILayout{
+		Cake:      cake,
+		Verifier:  verifier,
+		Platform:  distclient.DefaultPlatform(),
+		FetchLock: fetchLock,
+	}
+}
+
+func (o *OCILayout) Fetch(ctx context.Context, log lager.Logger, u *url.URL, _ distclient.Credentials, diskQuota int64) (*Image, error) {
+	log = log.Session("oci-fetch", lager.Data{"url": u})
+
+	log.Info("start")
+	defer log.Info("finished")
+
+	conn, manifest, err := o.manifest(ctx, log, u)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := &layerFetcher{
+		cake:                   o.Cake,
+		verifier:               o.Verifier,
+		maxConcurrentDownloads: DefaultMaxConcurrentDownloads,
+		fetchLock:              o.fetchLock(),
+	}
+
+	return fetcher.fetchImage(ctx, log, conn, manifest, diskQuota)
+}
+
+func (o *OCILayout) fetchLock() *FetchLock {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.FetchLock == nil {
+		o.FetchLock = NewFetchLock()
+	}
+
+	return o.FetchLock
+}
+
+func (o *OCILayout) FetchID(log lager.Logger, u *url.URL) (layercake.ID, error) {
+	log = log.Session("oci-fetch-id", lager.Data{"url": u})
+
+	_, manifest, err := o.manifest(context.Background(), log, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return layercake.DockerImageID(hex(manifest.Layers[len(manifest.Layers)-1].StrongID)), nil
+}
+
+func (o *OCILayout) manifest(ctx context.Context, log lager.Logger, u *url.URL) (distclient.Conn, *distclient.Manifest, error) {
+	dir, ref := parseLayoutReference(u)
+	if dir == "" {
+		return nil, nil, errors.New("repository_fetcher: oci url has no path to an image layout")
+	}
+
+	conn, err := distclient.OpenLayout(dir)
+	if err != nil {
+		log.Error("failed-to-open-layout", err)
+		return nil, nil, err
+	}
+
+	manifest, err := conn.GetManifest(ctx, log, ref, o.Platform)
+	if err != nil {
+		return nil, nil, fmt.Errorf("repository_fetcher: get manifest from %s: %s", dir, err)
+	}
+
+	if len(manifest.Layers) == 0 {
+		return nil, nil, fmt.Errorf("repository_fetcher: image in %s has no layers", dir)
+	}
+
+	return conn, manifest, nil
+}
+
+// parseLayoutReference splits the path of an oci url in to the layout
+// directory and the tag or digest, if any, which follows it.
+func parseLayoutReference(u *url.URL) (string, string) {
+	path := u.Path
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+		return path[:i], path[i+1:]
+	}
+
+	return path, ""
+}
@@ -0,0 +1,265 @@
+package repository_fetcher_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+
+	"code.cloudfoundry.org/garden-shed/distclient"
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/layercake/fake_cake"
+	"code.cloudfoundry.org/garden-shed/repository_fetcher"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/docker/distribution/digest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Fetching from an OCI image layout", func() {
+	var (
+		logger    *lagertest.TestLogger
+		fakeCake  *fake_cake.FakeCake
+		layoutDir string
+		fetcher   *repository_fetcher.OCILayout
+
+		mu         sync.Mutex
+		registered map[string]string
+	)
+
+	writeBlob := func(b []byte) digest.Digest {
+		d := digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256(b)))
+		Expect(ioutil.WriteFile(filepath.Join(layoutDir, "blobs", "sha256", d.Hex()), b, 0644)).To(Succeed())
+		return d
+	}
+
+	writeJSONBlob := func(v interface{}) digest.Digest {
+		b, err := json.Marshal(v)
+		Expect(err).NotTo(HaveOccurred())
+		return writeBlob(b)
+	}
+
+	// writeImage writes an image with a layer for each of contents to the
+	// layout, returning the digest of its manifest
+	writeImage := func(env []string, contents ...string) digest.Digest {
+		var layers []map[string]interface{}
+		var diffIDs []digest.Digest
+		for _, c := range contents {
+			d := writeBlob([]byte(c))
+			layers = append(layers, map[string]interface{}{
+				"mediaType": "application/vnd.oci.image.layer.v1.tar",
+				"digest":    d,
+				"size":      len(c),
+			})
+			diffIDs = append(diffIDs, d)
+		}
+
+		config := writeJSONBlob(map[string]interface{}{
+			"config": map[string]interface{}{
+				"Env":        env,
+				"Volumes":    map[string]struct{}{"/data": {}},
+				"Cmd":        []string{"/bin/app"},
+				"WorkingDir": "/srv",
+			},
+			"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		})
+
+		return writeJSONBlob(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     distclient.MediaTypeOCIManifest,
+			"config":        map[string]interface{}{"mediaType": distclient.MediaTypeOCIConfig, "digest": config},
+			"layers":        layers,
+		})
+	}
+
+	writeIndex := func(tags map[string]digest.Digest) {
+		var manifests []map[string]interface{}
+		for tag, d := range tags {
+			manifests = append(manifests, map[string]interface{}{
+				"mediaType":   distclient.MediaTypeOCIManifest,
+				"digest":      d,
+				"annotations": map[string]string{"org.opencontainers.image.ref.name": tag},
+			})
+		}
+
+		b, err := json.Marshal(map[string]interface{}{"schemaVersion": 2, "manifests": manifests})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(layoutDir, "index.json"), b, 0644)).To(Succeed())
+	}
+
+	layoutURL := func(ref string) *url.URL {
+		return &url.URL{Scheme: "oci", Path: layoutDir + ref}
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+
+		var err error
+		layoutDir, err = ioutil.TempDir("", "oci-layout")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.MkdirAll(filepath.Join(layoutDir, "blobs", "sha256"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(layoutDir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)).To(Succeed())
+
+		registered = map[string]string{}
+		fakeCake = new(fake_cake.FakeCake)
+		fakeCake.GetReturns(nil, errors.New("no such layer"))
+		fakeCake.RegisterStub = func(img *image.Image, layer archive.ArchiveReader) error {
+			b, err := ioutil.ReadAll(layer)
+			Expect(err).NotTo(HaveOccurred())
+
+			mu.Lock()
+			defer mu.Unlock()
+			registered[img.ID] = string(b)
+			return nil
+		}
+
+		fetcher = repository_fetcher.NewOCILayout(fakeCake, repository_fetcher.TempFileVerifier{}, repository_fetcher.NewFetchLock())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(layoutDir)).To(Succeed())
+	})
+
+	Context("when the layout holds a single image", func() {
+		BeforeEach(func() {
+			writeIndex(map[string]digest.Digest{"v1": writeImage([]string{"A=1"}, "layer-1", "layer-2")})
+		})
+
+		It("registers each layer in the cake", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCake.RegisterCallCount()).To(Equal(2))
+			Expect(registered).To(HaveLen(2))
+
+			var contents []string
+			for _, c := range registered {
+				contents = append(contents, c)
+			}
+			Expect(contents).To(ConsistOf("layer-1", "layer-2"))
+		})
+
+		It("registers the layers parent first", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			first, _ := fakeCake.RegisterArgsForCall(0)
+			second, _ := fakeCake.RegisterArgsForCall(1)
+			Expect(first.Parent).To(BeEmpty())
+			Expect(second.Parent).To(Equal(first.ID))
+		})
+
+		It("returns the config of the image, with the top layer as its ID", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			top, _ := fakeCake.RegisterArgsForCall(1)
+			Expect(img.ImageID).To(Equal(top.ID))
+			Expect(img.Env).To(Equal([]string{"A=1"}))
+			Expect(img.Volumes).To(Equal([]string{"/data"}))
+			Expect(img.Config.Cmd).To(Equal([]string{"/bin/app"}))
+			Expect(img.Config.WorkingDir).To(Equal("/srv"))
+		})
+
+		It("returns the same ID from FetchID", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			id, err := fetcher.FetchID(logger, layoutURL(""))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal(layercake.DockerImageID(img.ImageID)))
+		})
+
+		It("creates a fetch lock when it is not given one", func() {
+			fetcher = repository_fetcher.NewOCILayout(fakeCake, repository_fetcher.TempFileVerifier{}, nil)
+
+			_, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeCake.RegisterCallCount()).To(Equal(2))
+		})
+
+		It("creates a fetch lock when constructed without one", func() {
+			fetcher = &repository_fetcher.OCILayout{Cake: fakeCake, Verifier: repository_fetcher.TempFileVerifier{}, Platform: distclient.DefaultPlatform()}
+
+			_, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeCake.RegisterCallCount()).To(Equal(2))
+		})
+
+		It("does not register layers which are already in the cake", func() {
+			fakeCake.GetReturns(&image.Image{}, nil)
+
+			_, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeCake.RegisterCallCount()).To(Equal(0))
+		})
+
+		Context("when a layer does not match its digest", func() {
+			BeforeEach(func() {
+				d := digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("layer-2"))))
+				Expect(ioutil.WriteFile(filepath.Join(layoutDir, "blobs", "sha256", d.Hex()), []byte("tampered"), 0644)).To(Succeed())
+			})
+
+			It("returns an error and does not register it", func() {
+				_, err := fetcher.Fetch(context.Background(), logger, layoutURL(":v1"), distclient.Credentials{}, 0)
+				Expect(err).To(HaveOccurred())
+
+				for _, contents := range registered {
+					Expect(contents).NotTo(Equal("tampered"))
+				}
+			})
+		})
+	})
+
+	Context("when the layout holds several images", func() {
+		var latest, other digest.Digest
+
+		BeforeEach(func() {
+			latest = writeImage([]string{"LATEST=1"}, "latest-layer")
+			other = writeImage([]string{"OTHER=1"}, "other-layer")
+			writeIndex(map[string]digest.Digest{"latest": latest, "other": other})
+		})
+
+		It("uses the latest tag when none is given", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.Env).To(Equal([]string{"LATEST=1"}))
+		})
+
+		It("fetches the image with the given tag", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, layoutURL(":other"), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.Env).To(Equal([]string{"OTHER=1"}))
+		})
+
+		It("fetches the image with the given digest", func() {
+			img, err := fetcher.Fetch(context.Background(), logger, layoutURL("@"+other.String()), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.Env).To(Equal([]string{"OTHER=1"}))
+		})
+
+		It("returns an error for an unknown tag", func() {
+			_, err := fetcher.Fetch(context.Background(), logger, layoutURL(":missing"), distclient.Credentials{}, 0)
+			Expect(err).To(MatchError(ContainSubstring("no image tagged missing")))
+		})
+	})
+
+	Context("when the directory is not an image layout", func() {
+		It("returns an error", func() {
+			Expect(os.Remove(filepath.Join(layoutDir, "oci-layout"))).To(Succeed())
+
+			_, err := fetcher.Fetch(context.Background(), logger, layoutURL(""), distclient.Credentials{}, 0)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -1,170 +1,496 @@
 package repository_fetcher
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
-
-	"github.com/docker/docker/image"
+	"sync"
 
 	"github.com/docker/distribution/digest"
 
 	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/pkg/atomicfile"
 	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
 )
 
+// DefaultMaxConcurrentDownloads is the number of layers of a single image
+// which are downloaded at once when no limit is given.
+const DefaultMaxConcurrentDownloads = 3
+
 type Remote struct {
 	DefaultHost string
 	Dial        Dialer
 	Cake        layercake.Cake
 	Verifier    Verifier
 
+	// MaxConcurrentDownloads bounds how many layers of an image are
+	// downloaded and verified at once, a layer counting until its blob has
+	// been read to the end or closed. Layers are always registered in the
+	// cake parent first.
+	MaxConcurrentDownloads int
+
+	// Mirrors maps a registry host to mirrors of it, which are tried in order
+	// before the registry itself for both manifests and blobs.
+	Mirrors map[string][]string
+
+	// Platform is used to pick an image out of multi-arch image indexes,
+	// it defaults to the os and architecture of the host. A fetch can ask
+	// for another with a platform query in its URL, e.g.
+	// docker:///busybox?platform=linux/arm64#latest.
+	Platform distclient.Platform
+
 	FetchLock *FetchLock
+
+	// DigestIDsPath is a file, such as one under the graph root, in which the
+	// image IDs of digest references are kept so that they are still known
+	// after a restart. With no path they are only remembered in memory.
+	DigestIDsPath string
+
+	// LayerSourcesPath is a file in which the repositories each layer was
+	// fetched from are kept. A layer already in the cake is handed out to an
+	// anonymous fetch from one of those repositories as it is, but otherwise
+	// only once the registry says the fetch can see its blob. With no path
+	// they are only remembered in memory.
+	LayerSourcesPath string
+
+	// digestIDs remembers the image ID of digest references, which can never
+	// change, so that FetchID does not need to ask the registry again
+	digestIDsMu sync.Mutex
+	digestIDs   map[string]string
+
+	layerSourcesMu sync.Mutex
+	layerSources   map[string][]string
+}
+
+// layerSource is where the layers of a fetch come from, a repository and
+// whether the fetch has credentials for it.
+type layerSource struct {
+	repo          string
+	authenticated bool
 }
 
-func NewRemote(defaultHost string, cake layercake.Cake, dialer Dialer, verifier Verifier) *Remote {
+func NewRemote(defaultHost string, cake layercake.Cake, dialer Dialer, verifier Verifier, maxConcurrentDownloads int) *Remote {
+	if maxConcurrentDownloads <= 0 {
+		maxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+
 	return &Remote{
-		DefaultHost: defaultHost,
-		Dial:        dialer,
-		Cake:        cake,
-		Verifier:    verifier,
-		FetchLock:   NewFetchLock(),
+		DefaultHost:            defaultHost,
+		Dial:                   dialer,
+		Cake:                   cake,
+		Verifier:               verifier,
+		MaxConcurrentDownloads: maxConcurrentDownloads,
+		Platform:               distclient.DefaultPlatform(),
+		FetchLock:              NewFetchLock(),
 	}
 }
 
-func (r *Remote) Fetch(log lager.Logger, u *url.URL, diskQuota int64) (*Image, error) {
-	log = log.Session("fetch", lager.Data{"url": u})
+func (r *Remote) Fetch(ctx context.Context, log lager.Logger, u *url.URL, creds distclient.Credentials, diskQuota int64) (*Image, error) {
+	log = log.Session("fetch", lager.Data{"url": u, "authenticated": !creds.Empty()})
 
 	log.Info("start")
 	defer log.Info("finished")
 
-	conn, manifest, err := r.manifest(log, u)
+	ref, err := r.parseReference(u)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, manifest, err := r.manifest(ctx, log, ref, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	src := layerSource{repo: ref.host + "/" + ref.repo, authenticated: !creds.Empty()}
+	img, err := r.layerFetcher(src).fetchImage(ctx, log, conn, manifest, diskQuota)
 	if err != nil {
 		return nil, err
 	}
 
-	totalImageSize := int64(0)
-	for _, layer := range manifest.Layers {
-		totalImageSize += layer.Image.Size
+	if ref.digest != "" {
+		r.rememberDigestID(log, ref, img.ImageID)
+	}
+
+	return img, nil
+}
+
+// layerFetcher fetches layers from the repository of src, remembering which
+// repositories each layer came from.
+func (r *Remote) layerFetcher(src layerSource) *layerFetcher {
+	return &layerFetcher{
+		cake:                   r.Cake,
+		verifier:               r.Verifier,
+		maxConcurrentDownloads: r.MaxConcurrentDownloads,
+		fetchLock:              r.FetchLock,
+
+		checkCached: func(ctx context.Context, log lager.Logger, conn distclient.Conn, layer distclient.Layer) error {
+			// the cached layer may have been fetched with someone else's
+			// credentials or from another repository, so unless neither can
+			// be the case make sure this fetch can see the blob before handing
+			// it out
+			if !src.authenticated && r.fetchedFrom(src, hex(layer.StrongID)) {
+				return nil
+			}
+
+			if err := conn.StatBlob(ctx, log, layer.BlobSum); err != nil {
+				log.Error("cached-layer-not-accessible", err)
+				return distclient.WrapError(err, "layer %s is not accessible", layer.BlobSum)
+			}
+
+			r.rememberLayerSource(log, src, hex(layer.StrongID))
+			return nil
+		},
+
+		registered: func(log lager.Logger, layerID string) {
+			r.rememberLayerSource(log, src, layerID)
+		},
 	}
+}
 
-	if diskQuota > 0 && totalImageSize > diskQuota {
-		return nil, ErrQuotaExceeded
+// imageEnv is the environment of the top-most layer which has a config. Each
+// config holds the whole environment of the image as of that layer, so
+// earlier layers are not merged in.
+func imageEnv(layers []distclient.Layer) Env {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if config := layers[i].Image.Config; config != nil {
+			return MergeEnv(config.Env)
+		}
 	}
 
-	var env []string
-	var vols []string
-	for _, layer := range manifest.Layers {
-		if layer.Image.Config != nil {
-			env = append(env, layer.Image.Config.Env...)
-			vols = append(vols, keys(layer.Image.Config.Volumes)...)
+	return nil
+}
+
+// imageConfig takes the run config from the top-most layer which has one,
+// since each config is the full config of the image as of that layer.
+func imageConfig(layers []distclient.Layer) ImageConfig {
+	for i := len(layers) - 1; i >= 0; i-- {
+		config := layers[i].Image.Config
+		if config == nil {
+			continue
 		}
 
-		if err := r.fetchLayer(log, conn, layer); err != nil {
-			return nil, err
+		var ports []string
+		for port := range config.ExposedPorts {
+			ports = append(ports, string(port))
+		}
+		sort.Strings(ports)
+
+		return ImageConfig{
+			Entrypoint:   config.Entrypoint.Slice(),
+			Cmd:          config.Cmd.Slice(),
+			User:         config.User,
+			WorkingDir:   config.WorkingDir,
+			ExposedPorts: ports,
+			StopSignal:   config.StopSignal,
+			Healthcheck:  layers[i].Healthcheck,
+			Labels:       config.Labels,
 		}
 	}
 
-	return &Image{
-		ImageID: hex(manifest.Layers[len(manifest.Layers)-1].StrongID),
-		Env:     env,
-		Volumes: vols,
-		Size:    totalImageSize,
-	}, nil
+	return ImageConfig{}
 }
 
 func (r *Remote) FetchID(log lager.Logger, u *url.URL) (layercake.ID, error) {
-	_, manifest, err := r.manifest(log.Session("fetch-id"), u)
+	log = log.Session("fetch-id")
+
+	ref, err := r.parseReference(u)
 	if err != nil {
 		return nil, err
 	}
 
-	return layercake.DockerImageID(hex(manifest.Layers[len(manifest.Layers)-1].StrongID)), nil
+	if id, ok := r.cachedDigestID(ref); ok {
+		log.Debug("got-cached-digest", lager.Data{"digest": ref.digest})
+		return id, nil
+	}
+
+	_, manifest, err := r.manifest(context.Background(), log, ref, distclient.Credentials{})
+	if err != nil {
+		return nil, err
+	}
+
+	imageID := hex(manifest.Layers[len(manifest.Layers)-1].StrongID)
+	if ref.digest != "" {
+		r.rememberDigestID(log, ref, imageID)
+	}
+
+	return layercake.DockerImageID(imageID), nil
 }
 
-func (r *Remote) manifest(log lager.Logger, u *url.URL) (distclient.Conn, *distclient.Manifest, error) {
-	log = log.Session("get-manifest", lager.Data{"url": u})
+// reference identifies an image in a registry, by either a tag or a
+// manifest digest, and the platform to pick if it is an image index.
+type reference struct {
+	host     string
+	repo     string
+	tag      string
+	digest   digest.Digest
+	platform *distclient.Platform
+}
 
-	log.Debug("started")
-	defer log.Debug("got")
+func (ref reference) String() string {
+	var s string
+	if ref.digest != "" {
+		s = fmt.Sprintf("%s/%s@%s", ref.host, ref.repo, ref.digest)
+	} else {
+		s = fmt.Sprintf("%s/%s:%s", ref.host, ref.repo, ref.tag)
+	}
+
+	if ref.platform != nil {
+		s += " for " + ref.platform.String()
+	}
+
+	return s
+}
 
-	host := u.Host
-	if host == "" {
-		host = r.DefaultHost
+// parseReference accepts the tag or digest in the fragment
+// (docker:///busybox#sha256:...) or a digest appended to the path
+// (docker:///busybox@sha256:...), and a platform in the query.
+func (r *Remote) parseReference(u *url.URL) (reference, error) {
+	ref := reference{host: u.Host}
+	if ref.host == "" {
+		ref.host = r.DefaultHost
 	}
 
-	isDockerHub := host == "registry-1.docker.io"
-	path := u.Path[1:] // strip off initial '/'
+	if p := u.Query().Get("platform"); p != "" {
+		platform, err := distclient.ParsePlatform(p)
+		if err != nil {
+			return reference{}, fmt.Errorf("invalid platform in %s: %s", u, err)
+		}
+
+		ref.platform = &platform
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(path, "@"); i >= 0 {
+		d, err := digest.ParseDigest(path[i+1:])
+		if err != nil {
+			return reference{}, fmt.Errorf("invalid digest in %s: %s", u, err)
+		}
+
+		if u.Fragment != "" {
+			return reference{}, fmt.Errorf("%s has both a digest and a tag", u)
+		}
+
+		path, ref.digest = path[:i], d
+	} else if d, err := digest.ParseDigest(u.Fragment); err == nil {
+		// tags cannot contain a ':', so anything that parses is a digest
+		ref.digest = d
+	} else {
+		ref.tag = u.Fragment
+	}
+
+	if ref.digest == "" && ref.tag == "" {
+		ref.tag = "latest"
+	}
+
+	isDockerHub := ref.host == "registry-1.docker.io"
 	isOfficialImage := strings.Index(path, "/") < 0
 	if isDockerHub && isOfficialImage {
 		// The Docker Hub keeps manifests of official images under library/
 		path = "library/" + path
 	}
 
-	tag := u.Fragment
-	if tag == "" {
-		tag = "latest"
+	ref.repo = path
+	return ref, nil
+}
+
+func (r *Remote) manifest(ctx context.Context, log lager.Logger, ref reference, creds distclient.Credentials) (distclient.Conn, *distclient.Manifest, error) {
+	log = log.Session("get-manifest", lager.Data{"ref": ref.String()})
+
+	log.Debug("started")
+	defer log.Debug("got")
+
+	var conn distclient.Conn
+	if mirrors := r.Mirrors[ref.host]; len(mirrors) > 0 {
+		conn = newMirroredConn(r.Dial, ref.host, mirrors, ref.repo, creds)
+	} else {
+		var err error
+		if conn, err = r.Dial.Dial(ctx, log, ref.host, ref.repo, creds); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	manifestRef := ref.tag
+	if ref.digest != "" {
+		manifestRef = ref.digest.String()
 	}
 
-	conn, err := r.Dial.Dial(log, host, path)
+	manifest, err := conn.GetManifest(ctx, log, manifestRef, r.platform(ref))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, distclient.WrapError(err, "get manifest for %s", ref)
 	}
 
-	manifest, err := conn.GetManifest(log, tag)
-	if err != nil {
-		return nil, nil, fmt.Errorf("get manifest for tag %s on repo %s: %s", u.Fragment, u, err)
+	if len(manifest.Layers) == 0 {
+		return nil, nil, fmt.Errorf("repository_fetcher: image %s has no layers", ref)
 	}
 
 	return conn, manifest, err
 }
 
-func (r *Remote) fetchLayer(log lager.Logger, conn distclient.Conn, layer distclient.Layer) error {
-	log = log.Session("fetch-layer", lager.Data{"blobsum": layer.BlobSum, "id": layer.StrongID, "parent": layer.ParentStrongID})
+// platform is the platform to pick out of an image index for ref.
+func (r *Remote) platform(ref reference) distclient.Platform {
+	if ref.platform != nil {
+		return *ref.platform
+	}
 
-	log.Info("start")
-	defer log.Info("fetched")
+	if r.Platform == (distclient.Platform{}) {
+		return distclient.DefaultPlatform()
+	}
+
+	return r.Platform
+}
 
-	r.FetchLock.Acquire(layer.BlobSum.String())
-	defer r.FetchLock.Release(layer.BlobSum.String())
+// digestIDKey is the key of the image ID of a digest reference, which may be
+// an image index, so depends on the platform picked out of it.
+func (r *Remote) digestIDKey(ref reference) string {
+	return fmt.Sprintf("%s/%s@%s for %s", ref.host, ref.repo, ref.digest, r.platform(ref))
+}
 
-	_, err := r.Cake.Get(layercake.DockerImageID(hex(layer.StrongID)))
-	if err == nil {
-		log.Info("got-cache")
-		return nil
+// cachedDigestID returns the image ID a digest reference was previously
+// resolved to, as long as the image is still in the cake.
+func (r *Remote) cachedDigestID(ref reference) (layercake.ID, bool) {
+	if ref.digest == "" {
+		return nil, false
 	}
 
-	blob, err := conn.GetBlobReader(log, layer.BlobSum)
-	if err != nil {
-		return err
+	r.digestIDsMu.Lock()
+	imageID, ok := r.loadDigestIDs()[r.digestIDKey(ref)]
+	r.digestIDsMu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	id := layercake.DockerImageID(imageID)
+	if _, err := r.Cake.Get(id); err != nil {
+		return nil, false
 	}
 
-	log.Debug("verifying")
-	verifiedBlob, err := r.Verifier.Verify(blob, layer.BlobSum)
+	return id, true
+}
+
+func (r *Remote) rememberDigestID(log lager.Logger, ref reference, imageID string) {
+	r.digestIDsMu.Lock()
+	defer r.digestIDsMu.Unlock()
+
+	key := r.digestIDKey(ref)
+
+	digestIDs := r.loadDigestIDs()
+	if digestIDs[key] == imageID {
+		return
+	}
+
+	digestIDs[key] = imageID
+
+	// a failure to save only costs asking the registry again after a restart
+	if err := saveJSON(r.DigestIDsPath, digestIDs); err != nil {
+		log.Error("failed-to-save-digest-ids", err)
+	}
+}
+
+// loadDigestIDs reads DigestIDsPath the first time it is called. It must be
+// called with digestIDsMu held.
+func (r *Remote) loadDigestIDs() map[string]string {
+	if r.digestIDs == nil {
+		loadJSON(r.DigestIDsPath, &r.digestIDs)
+	}
+
+	if r.digestIDs == nil {
+		r.digestIDs = make(map[string]string)
+	}
+
+	return r.digestIDs
+}
+
+// fetchedFrom is whether the layer was fetched from the repository of src.
+func (r *Remote) fetchedFrom(src layerSource, layerID string) bool {
+	r.layerSourcesMu.Lock()
+	defer r.layerSourcesMu.Unlock()
+
+	for _, repo := range r.loadLayerSources()[layerID] {
+		if repo == src.repo {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Remote) rememberLayerSource(log lager.Logger, src layerSource, layerID string) {
+	r.layerSourcesMu.Lock()
+	defer r.layerSourcesMu.Unlock()
+
+	layerSources := r.loadLayerSources()
+	for _, repo := range layerSources[layerID] {
+		if repo == src.repo {
+			return
+		}
+	}
+
+	layerSources[layerID] = append(layerSources[layerID], src.repo)
+
+	// a failure to save only costs asking the registry again after a restart
+	if err := saveJSON(r.LayerSourcesPath, layerSources); err != nil {
+		log.Error("failed-to-save-layer-sources", err)
+	}
+}
+
+// loadLayerSources reads LayerSourcesPath the first time it is called. It
+// must be called with layerSourcesMu held.
+func (r *Remote) loadLayerSources() map[string][]string {
+	if r.layerSources == nil {
+		loadJSON(r.LayerSourcesPath, &r.layerSources)
+	}
+
+	if r.layerSources == nil {
+		r.layerSources = make(map[string][]string)
+	}
+
+	return r.layerSources
+}
+
+// loadJSON reads path in to v, if there is a path. A missing or corrupt file
+// leaves v as it is.
+func loadJSON(path string, v interface{}) {
+	if path == "" {
+		return
+	}
+
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return
 	}
 
-	log.Debug("verified")
-	defer verifiedBlob.Close()
+	json.Unmarshal(b, v)
+}
 
-	log.Debug("registering")
-	err = r.Cake.Register(&image.Image{
-		ID:     hex(layer.StrongID),
-		Parent: hex(layer.ParentStrongID),
-		Size:   layer.Image.Size,
-	}, verifiedBlob)
+// saveJSON atomically replaces path with v, if there is a path.
+func saveJSON(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return atomicfile.WriteFile(path, b, 0600)
 }
 
 //go:generate counterfeiter . Dialer
 type Dialer interface {
-	Dial(logger lager.Logger, host, repo string) (distclient.Conn, error)
+	Dial(ctx context.Context, logger lager.Logger, host, repo string, creds distclient.Credentials) (distclient.Conn, error)
 }
 
 func keys(m map[string]struct{}) (r []string) {
@@ -6,10 +6,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/nat"
+	"github.com/docker/docker/pkg/stringutils"
 	"github.com/docker/docker/runconfig"
 
 	"code.cloudfoundry.org/garden-shed/distclient"
@@ -23,6 +27,8 @@ import (
 	"github.com/docker/distribution/digest"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"golang.org/x/net/context"
 )
 
 var _ = Describe("Fetching from a Remote repo", func() {
@@ -63,7 +69,7 @@ var _ = Describe("Fetching from a Remote repo", func() {
 						ParentStrongID: "sha256:abc-parent-id",
 						Image: image.Image{
 							Config: &runconfig.Config{
-								Env:     []string{"a", "b"},
+								Env:     []string{"A=1", "B=2"},
 								Volumes: map[string]struct{}{"vol1": struct{}{}},
 							},
 							Size: 1,
@@ -78,11 +84,22 @@ var _ = Describe("Fetching from a Remote repo", func() {
 						StrongID: "sha256:klm-id",
 						Image: image.Image{
 							Config: &runconfig.Config{
-								Env:     []string{"d", "e", "f"},
-								Volumes: map[string]struct{}{"vol2": struct{}{}},
+								Env:          []string{"D=4", "E=5", "F=6"},
+								Volumes:      map[string]struct{}{"vol2": struct{}{}},
+								Entrypoint:   stringutils.NewStrSlice("/entrypoint.sh"),
+								Cmd:          stringutils.NewStrSlice("serve", "--port", "8080"),
+								User:         "app",
+								WorkingDir:   "/app",
+								ExposedPorts: map[nat.Port]struct{}{"8080/tcp": struct{}{}, "53/udp": struct{}{}},
+								StopSignal:   "SIGQUIT",
+								Labels:       map[string]string{"maintainer": "someone"},
 							},
 							Size: 2,
 						},
+						Healthcheck: &distclient.Healthcheck{
+							Test:    []string{"CMD", "true"},
+							Retries: 3,
+						},
 					},
 				},
 			},
@@ -107,16 +124,16 @@ var _ = Describe("Fetching from a Remote repo", func() {
 		}
 
 		fakeConn = new(fake_distclient.FakeConn)
-		fakeConn.GetManifestStub = func(_ lager.Logger, tag string) (*distclient.Manifest, error) {
+		fakeConn.GetManifestStub = func(_ context.Context, _ lager.Logger, tag string, _ distclient.Platform) (*distclient.Manifest, error) {
 			return manifests[tag], nil
 		}
 
-		fakeConn.GetBlobReaderStub = func(_ lager.Logger, digest digest.Digest) (io.Reader, error) {
+		fakeConn.GetBlobReaderStub = func(_ context.Context, _ lager.Logger, digest digest.Digest) (io.Reader, error) {
 			return bytes.NewReader([]byte(blobs[digest])), nil
 		}
 
 		fakeDialer = new(fakes.FakeDialer)
-		fakeDialer.DialStub = func(_ lager.Logger, host, repo string) (distclient.Conn, error) {
+		fakeDialer.DialStub = func(_ context.Context, _ lager.Logger, host, repo string, _ distclient.Credentials) (distclient.Conn, error) {
 			return fakeConn, nil
 		}
 
@@ -134,35 +151,35 @@ var _ = Describe("Fetching from a Remote repo", func() {
 			return &verified{Reader: r}, nil
 		}
 
-		remote = repository_fetcher.NewRemote(defaultDockerRegistryHost, fakeCake, fakeDialer, fakeVerifier)
+		remote = repository_fetcher.NewRemote(defaultDockerRegistryHost, fakeCake, fakeDialer, fakeVerifier, 2)
 	})
 
 	Context("when the URL has a host", func() {
 		It("dials that host", func() {
-			_, err := remote.Fetch(logger, parseURL("docker://some-host/some/repo#some-tag"), 1234)
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker://some-host/some/repo#some-tag"), distclient.Credentials{}, 1234)
 			Expect(err).NotTo(HaveOccurred())
 
-			_, host, _ := fakeDialer.DialArgsForCall(0)
+			_, _, host, _, _ := fakeDialer.DialArgsForCall(0)
 			Expect(host).To(Equal("some-host"))
 		})
 	})
 
 	Context("when the host is empty", func() {
 		It("uses the default host", func() {
-			_, err := remote.Fetch(logger, parseURL("docker:///some/repo#some-tag"), 1234)
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///some/repo#some-tag"), distclient.Credentials{}, 1234)
 			Expect(err).NotTo(HaveOccurred())
 
-			_, host, _ := fakeDialer.DialArgsForCall(0)
+			_, _, host, _, _ := fakeDialer.DialArgsForCall(0)
 			Expect(host).To(Equal(defaultDockerRegistryHost))
 		})
 	})
 
 	Context("when the path contains a slash", func() {
 		It("uses the path explicitly", func() {
-			_, err := remote.Fetch(logger, parseURL("docker://some-host/some/repo#some-tag"), 1234)
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker://some-host/some/repo#some-tag"), distclient.Credentials{}, 1234)
 			Expect(err).NotTo(HaveOccurred())
 
-			_, _, repo := fakeDialer.DialArgsForCall(0)
+			_, _, _, repo, _ := fakeDialer.DialArgsForCall(0)
 			Expect(repo).To(Equal("some/repo"))
 		})
 	})
@@ -171,10 +188,10 @@ var _ = Describe("Fetching from a Remote repo", func() {
 		Context("and the default registry is being used", func() {
 			Context("and the default is DockerHub", func() {
 				It("prepends the implied 'library/' to the path", func() {
-					_, err := remote.Fetch(logger, parseURL("docker://registry-1.docker.io/somerepo#some-tag"), 1234)
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker://registry-1.docker.io/somerepo#some-tag"), distclient.Credentials{}, 1234)
 					Expect(err).NotTo(HaveOccurred())
 
-					_, _, repo := fakeDialer.DialArgsForCall(0)
+					_, _, _, repo, _ := fakeDialer.DialArgsForCall(0)
 					Expect(repo).To(Equal("library/somerepo"))
 				})
 			})
@@ -185,10 +202,10 @@ var _ = Describe("Fetching from a Remote repo", func() {
 				})
 
 				It("does not prepend 'library/' to the path", func() {
-					_, err := remote.Fetch(logger, parseURL("docker://some-host/somerepo#some-tag"), 1234)
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker://some-host/somerepo#some-tag"), distclient.Credentials{}, 1234)
 					Expect(err).NotTo(HaveOccurred())
 
-					_, _, repo := fakeDialer.DialArgsForCall(0)
+					_, _, _, repo, _ := fakeDialer.DialArgsForCall(0)
 					Expect(repo).To(Equal("somerepo"))
 				})
 			})
@@ -196,10 +213,10 @@ var _ = Describe("Fetching from a Remote repo", func() {
 
 		Context("and a custom registry is being used", func() {
 			It("does not prepend 'library/' to the path", func() {
-				_, err := remote.Fetch(logger, parseURL("docker://some-host/somerepo#some-tag"), 1234)
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker://some-host/somerepo#some-tag"), distclient.Credentials{}, 1234)
 				Expect(err).NotTo(HaveOccurred())
 
-				_, _, repo := fakeDialer.DialArgsForCall(0)
+				_, _, _, repo, _ := fakeDialer.DialArgsForCall(0)
 				Expect(repo).To(Equal("somerepo"))
 			})
 		})
@@ -207,7 +224,7 @@ var _ = Describe("Fetching from a Remote repo", func() {
 
 	Context("when the cake does not contain any of the layers", func() {
 		JustBeforeEach(func() {
-			_, err := remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 			Expect(err).NotTo(HaveOccurred())
 		})
 
@@ -237,24 +254,367 @@ var _ = Describe("Fetching from a Remote repo", func() {
 		})
 
 		It("avoids registering it again", func() {
-			_, err := remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(fakeCake.RegisterCallCount()).To(Equal(2))
 		})
+
+		It("checks the repository can serve the cached layer", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeConn.StatBlobCallCount()).To(Equal(1))
+			_, _, d := fakeConn.StatBlobArgsForCall(0)
+			Expect(d).To(BeEquivalentTo("ghj-klm"))
+		})
+
+		Context("and the repository cannot serve the cached layer", func() {
+			JustBeforeEach(func() {
+				fakeConn.StatBlobReturns(errors.New("unauthorized"))
+			})
+
+			It("returns an error", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).To(MatchError(ContainSubstring("unauthorized")))
+			})
+
+			It("does not hand out the cached layer", func() {
+				img, _ := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(img).To(BeNil())
+			})
+		})
+	})
+
+	Context("when the graph contains layers fetched from the same repository", func() {
+		JustBeforeEach(func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			existingLayers["abc-id"] = true
+			existingLayers["ghj-id"] = true
+			existingLayers["klm-id"] = true
+		})
+
+		It("hands them out to an anonymous fetch without asking the registry", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeConn.StatBlobCallCount()).To(Equal(0))
+		})
+
+		It("checks the registry can serve them to a fetch with credentials", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{Username: "u", Password: "p"}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeConn.StatBlobCallCount()).To(Equal(3))
+		})
+
+		It("checks the registry can serve them to a fetch from another repository", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///bar#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeConn.StatBlobCallCount()).To(Equal(3))
+
+			_, err = remote.Fetch(context.Background(), logger, parseURL("docker:///bar#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeConn.StatBlobCallCount()).To(Equal(3))
+		})
+
+		Context("when the layer sources are kept in a file", func() {
+			var layerSourcesPath string
+
+			BeforeEach(func() {
+				dir, err := ioutil.TempDir("", "layer-sources")
+				Expect(err).NotTo(HaveOccurred())
+				layerSourcesPath = filepath.Join(dir, "layer-sources.json")
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(filepath.Dir(layerSourcesPath))).To(Succeed())
+			})
+
+			JustBeforeEach(func() {
+				remote.LayerSourcesPath = layerSourcesPath
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///baz#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("remembers them after a restart", func() {
+				restarted := repository_fetcher.NewRemote(defaultDockerRegistryHost, fakeCake, fakeDialer, fakeVerifier, 2)
+				restarted.LayerSourcesPath = layerSourcesPath
+
+				statsBefore := fakeConn.StatBlobCallCount()
+				_, err := restarted.Fetch(context.Background(), logger, parseURL("docker:///baz#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeConn.StatBlobCallCount()).To(Equal(statsBefore))
+			})
+		})
+	})
+
+	Describe("credentials", func() {
+		var creds distclient.Credentials
+
+		JustBeforeEach(func() {
+			creds = distclient.Credentials{Username: "some-user", Password: "some-secret-password"}
+		})
+
+		It("dials with the given credentials", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), creds, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, _, _, dialedCreds := fakeDialer.DialArgsForCall(0)
+			Expect(dialedCreds).To(Equal(creds))
+		})
+
+		It("does not log the credentials", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), creds, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger).NotTo(gbytes.Say("some-secret-password"))
+		})
+
+		It("fetches IDs anonymously", func() {
+			_, err := remote.FetchID(logger, parseURL("docker:///foo#some-tag"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, _, _, dialedCreds := fakeDialer.DialArgsForCall(0)
+			Expect(dialedCreds.Empty()).To(BeTrue())
+		})
 	})
 
 	Context("when the url doesnot contain a fragment", func() {
 		It("uses 'latest' as the tag", func() {
-			_, err := remote.Fetch(logger, parseURL("docker:///foo"), 67)
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo"), distclient.Credentials{}, 67)
 			Expect(err).NotTo(HaveOccurred())
 
-			_, tag := fakeConn.GetManifestArgsForCall(0)
+			_, _, tag, _ := fakeConn.GetManifestArgsForCall(0)
 			Expect(tag).To(Equal("latest"))
 		})
 	})
 
+	Describe("digest references", func() {
+		const pinnedDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+		JustBeforeEach(func() {
+			manifests[pinnedDigest] = manifests["some-tag"]
+		})
+
+		It("fetches the manifest by digest when the digest follows an @ in the path", func() {
+			img, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo@"+pinnedDigest), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(img.ImageID).To(Equal("klm-id"))
+
+			_, _, _, repo, _ := fakeDialer.DialArgsForCall(0)
+			Expect(repo).To(Equal("library/foo"))
+
+			_, _, ref, _ := fakeConn.GetManifestArgsForCall(0)
+			Expect(ref).To(Equal(pinnedDigest))
+		})
+
+		It("fetches the manifest by digest when the digest is the fragment", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#"+pinnedDigest), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, ref, _ := fakeConn.GetManifestArgsForCall(0)
+			Expect(ref).To(Equal(pinnedDigest))
+		})
+
+		Context("when the digest is invalid", func() {
+			It("returns an error without dialing", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo@sha256:not-hex"), distclient.Credentials{}, 67)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeDialer.DialCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when both a digest and a tag are given", func() {
+			It("returns an error", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo@"+pinnedDigest+"#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("FetchID", func() {
+			It("resolves the digest through the registry the first time", func() {
+				id, err := remote.FetchID(logger, parseURL("docker:///foo@"+pinnedDigest))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(id).To(Equal(layercake.DockerImageID("klm-id")))
+				Expect(fakeDialer.DialCallCount()).To(Equal(1))
+			})
+
+			Context("when the image has already been fetched", func() {
+				JustBeforeEach(func() {
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo@"+pinnedDigest), distclient.Credentials{}, 67)
+					Expect(err).NotTo(HaveOccurred())
+					existingLayers["klm-id"] = true
+				})
+
+				It("does not go back to the registry", func() {
+					id, err := remote.FetchID(logger, parseURL("docker:///foo#"+pinnedDigest))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(id).To(Equal(layercake.DockerImageID("klm-id")))
+					Expect(fakeDialer.DialCallCount()).To(Equal(1))
+				})
+
+				Context("but the image has since been removed from the cake", func() {
+					It("resolves the digest again", func() {
+						delete(existingLayers, "klm-id")
+
+						_, err := remote.FetchID(logger, parseURL("docker:///foo@"+pinnedDigest))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeDialer.DialCallCount()).To(Equal(2))
+					})
+				})
+			})
+
+			Context("when the digest IDs are kept in a file", func() {
+				var digestIDsPath string
+
+				BeforeEach(func() {
+					dir, err := ioutil.TempDir("", "digest-ids")
+					Expect(err).NotTo(HaveOccurred())
+					digestIDsPath = filepath.Join(dir, "digest-ids.json")
+				})
+
+				AfterEach(func() {
+					Expect(os.RemoveAll(filepath.Dir(digestIDsPath))).To(Succeed())
+				})
+
+				JustBeforeEach(func() {
+					remote.DigestIDsPath = digestIDsPath
+
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo@"+pinnedDigest), distclient.Credentials{}, 67)
+					Expect(err).NotTo(HaveOccurred())
+					existingLayers["klm-id"] = true
+				})
+
+				It("does not go back to the registry after a restart", func() {
+					restartedDialer := new(fakes.FakeDialer)
+					restarted := repository_fetcher.NewRemote(defaultDockerRegistryHost, fakeCake, restartedDialer, fakeVerifier, 2)
+					restarted.DigestIDsPath = digestIDsPath
+
+					id, err := restarted.FetchID(logger, parseURL("docker:///foo@"+pinnedDigest))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(id).To(Equal(layercake.DockerImageID("klm-id")))
+					Expect(restartedDialer.DialCallCount()).To(Equal(0))
+				})
+
+				It("does not reuse them for another platform after a restart", func() {
+					restarted := repository_fetcher.NewRemote(defaultDockerRegistryHost, fakeCake, fakeDialer, fakeVerifier, 2)
+					restarted.DigestIDsPath = digestIDsPath
+					restarted.Platform = distclient.Platform{OS: "linux", Architecture: "s390x"}
+
+					_, err := restarted.FetchID(logger, parseURL("docker:///foo@"+pinnedDigest))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeDialer.DialCallCount()).To(Equal(2))
+				})
+
+				Context("when the file is corrupt", func() {
+					It("resolves the digest through the registry", func() {
+						Expect(ioutil.WriteFile(digestIDsPath, []byte("{not json"), 0600)).To(Succeed())
+
+						restarted := repository_fetcher.NewRemote(defaultDockerRegistryHost, fakeCake, fakeDialer, fakeVerifier, 2)
+						restarted.DigestIDsPath = digestIDsPath
+
+						id, err := restarted.FetchID(logger, parseURL("docker:///foo@"+pinnedDigest))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(id).To(Equal(layercake.DockerImageID("klm-id")))
+						Expect(fakeDialer.DialCallCount()).To(Equal(2))
+					})
+				})
+			})
+
+			It("always resolves tags through the registry", func() {
+				existingLayers["klm-id"] = true
+
+				_, err := remote.FetchID(logger, parseURL("docker:///foo#some-tag"))
+				Expect(err).NotTo(HaveOccurred())
+				_, err = remote.FetchID(logger, parseURL("docker:///foo#some-tag"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeDialer.DialCallCount()).To(Equal(2))
+			})
+		})
+	})
+
+	Describe("platform selection", func() {
+		It("asks for the manifest of the host platform by default", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, _, platform := fakeConn.GetManifestArgsForCall(0)
+			Expect(platform).To(Equal(distclient.DefaultPlatform()))
+		})
+
+		Context("when the platform is overridden", func() {
+			JustBeforeEach(func() {
+				remote.Platform = distclient.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+			})
+
+			It("asks for the manifest of that platform", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, _, platform := fakeConn.GetManifestArgsForCall(0)
+				Expect(platform).To(Equal(distclient.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}))
+			})
+		})
+
+		Context("when the Remote was built without a platform", func() {
+			JustBeforeEach(func() {
+				remote.Platform = distclient.Platform{}
+			})
+
+			It("asks for the manifest of the host platform", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, _, platform := fakeConn.GetManifestArgsForCall(0)
+				Expect(platform).To(Equal(distclient.DefaultPlatform()))
+			})
+		})
+
+		Context("when the URL asks for a platform", func() {
+			It("asks for the manifest of that platform", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo?platform=linux/arm/v7#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, ref, platform := fakeConn.GetManifestArgsForCall(0)
+				Expect(ref).To(Equal("some-tag"))
+				Expect(platform).To(Equal(distclient.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+			})
+
+			It("uses it for FetchID too", func() {
+				_, err := remote.FetchID(logger, parseURL("docker:///foo?platform=linux/arm64#some-tag"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, _, platform := fakeConn.GetManifestArgsForCall(0)
+				Expect(platform).To(Equal(distclient.Platform{OS: "linux", Architecture: "arm64"}))
+			})
+
+			It("remembers the image IDs of digests separately for each platform", func() {
+				const pinnedDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+				manifests[pinnedDigest] = manifests["some-tag"]
+				existingLayers["klm-id"] = true
+
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo@"+pinnedDigest), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = remote.FetchID(logger, parseURL("docker:///foo@"+pinnedDigest+"?platform=linux/arm64"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeDialer.DialCallCount()).To(Equal(2))
+			})
+
+			Context("when the platform is invalid", func() {
+				It("returns an error without dialing", func() {
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo?platform=linux#some-tag"), distclient.Credentials{}, 67)
+					Expect(err).To(MatchError(ContainSubstring("invalid platform")))
+					Expect(fakeDialer.DialCallCount()).To(Equal(0))
+				})
+			})
+		})
+	})
+
 	It("returns an image with the ID of the top layer", func() {
-		img, _ := remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+		img, _ := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 		Expect(img.ImageID).To(Equal("klm-id"))
 	})
 
@@ -263,25 +623,101 @@ var _ = Describe("Fetching from a Remote repo", func() {
 		Expect(id).To(Equal(layercake.DockerImageID("klm-id")))
 	})
 
-	It("combines all the environment variable arrays together", func() {
-		img, _ := remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
-		Expect(img.Env).To(ConsistOf([]string{"a", "b", "d", "e", "f"}))
+	It("takes the environment from the top-most config", func() {
+		img, _ := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+		Expect(img.Env).To(Equal([]string{"D=4", "E=5", "F=6"}))
+	})
+
+	Context("when every layer repeats the whole environment, as in schema1 histories", func() {
+		JustBeforeEach(func() {
+			manifests["schema1"] = &distclient.Manifest{
+				Layers: []distclient.Layer{
+					{
+						BlobSum:  "abc-def",
+						StrongID: "sha256:abc-id",
+						Image: image.Image{
+							Config: &runconfig.Config{Env: []string{"PATH=/bin", "HOME=/root"}},
+						},
+					},
+					{
+						BlobSum:  "ghj-klm",
+						StrongID: "sha256:ghj-id",
+						Image: image.Image{
+							Config: &runconfig.Config{Env: []string{"PATH=/bin", "HOME=/root", "LANG=C"}},
+						},
+					},
+					{
+						BlobSum:  "klm-nop",
+						StrongID: "sha256:klm-id",
+						Image: image.Image{
+							Config: &runconfig.Config{Env: []string{"PATH=/bin", "HOME=/root", "LANG=C", "PATH=/usr/local/bin:/bin", "HOME=/home/app"}},
+						},
+					},
+				},
+			}
+		})
+
+		It("returns each variable once, with the last value set", func() {
+			img, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#schema1"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(img.Env).To(Equal([]string{"PATH=/usr/local/bin:/bin", "HOME=/home/app", "LANG=C"}))
+		})
+
+		It("exposes the environment by name", func() {
+			img, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#schema1"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			path, ok := img.Environment().Get("PATH")
+			Expect(ok).To(BeTrue())
+			Expect(path).To(Equal("/usr/local/bin:/bin"))
+		})
 	})
 
 	It("combines all the volumes together", func() {
-		img, _ := remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+		img, _ := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 		Expect(img.Volumes).To(ConsistOf([]string{"vol1", "vol2"}))
 	})
 
+	It("returns the run config of the top-most layer", func() {
+		img, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(img.Config).To(Equal(repository_fetcher.ImageConfig{
+			Entrypoint:   []string{"/entrypoint.sh"},
+			Cmd:          []string{"serve", "--port", "8080"},
+			User:         "app",
+			WorkingDir:   "/app",
+			ExposedPorts: []string{"53/udp", "8080/tcp"},
+			StopSignal:   "SIGQUIT",
+			Healthcheck: &distclient.Healthcheck{
+				Test:    []string{"CMD", "true"},
+				Retries: 3,
+			},
+			Labels: map[string]string{"maintainer": "someone"},
+		}))
+	})
+
+	It("returns an empty run config when no layer has a config", func() {
+		img, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#shared-layers"), distclient.Credentials{}, 67)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(img.Config).To(Equal(repository_fetcher.ImageConfig{}))
+	})
+
 	It("should verify the image against its digest", func() {
-		remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+		remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 		_, reader := fakeCake.RegisterArgsForCall(0)
 
 		Expect(reader).To(BeAssignableToTypeOf(&verified{}))
-		_, digest1 := fakeVerifier.VerifyArgsForCall(0)
-		_, digest2 := fakeVerifier.VerifyArgsForCall(1)
-		Expect(string(digest1)).To(Equal("abc-def"))
-		Expect(string(digest2)).To(Equal("ghj-klm"))
+
+		// layers are downloaded in parallel, so may be verified in any order
+		var digests []string
+		for i := 0; i < fakeVerifier.VerifyCallCount(); i++ {
+			_, d := fakeVerifier.VerifyArgsForCall(i)
+			digests = append(digests, string(d))
+		}
+		Expect(digests).To(ConsistOf("abc-def", "ghj-klm", "klm-nop"))
 	})
 
 	It("should close the verified image reader after using it", func() {
@@ -293,17 +729,47 @@ var _ = Describe("Fetching from a Remote repo", func() {
 			return nil
 		}
 
-		remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+		remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 		Expect(registeredBlob.closed).To(BeTrue())
 	})
 
+	Context("when the layer is found not to match its digest after it is registered", func() {
+		JustBeforeEach(func() {
+			fakeVerifier.VerifyStub = func(r io.Reader, d digest.Digest) (io.ReadCloser, error) {
+				if d == "ghj-klm" {
+					return &verified{Reader: r, closeErr: repository_fetcher.ErrDigestMismatch}, nil
+				}
+
+				return &verified{Reader: r}, nil
+			}
+		})
+
+		It("returns an error", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).To(Equal(repository_fetcher.ErrDigestMismatch))
+		})
+
+		It("removes the registered layer", func() {
+			remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+
+			Expect(fakeCake.RemoveCallCount()).To(Equal(1))
+			Expect(fakeCake.RemoveArgsForCall(0)).To(Equal(layercake.DockerImageID("ghj-id")))
+		})
+
+		It("does not register its children", func() {
+			remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+
+			Expect(fakeCake.RegisterCallCount()).To(Equal(2))
+		})
+	})
+
 	Context("when the layer does not match its digest", func() {
 		JustBeforeEach(func() {
 			fakeVerifier.VerifyReturns(nil, errors.New("boom"))
 		})
 
 		It("returns an error", func() {
-			_, err := remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 			Expect(err).To(MatchError("boom"))
 		})
 
@@ -312,6 +778,399 @@ var _ = Describe("Fetching from a Remote repo", func() {
 		})
 	})
 
+	Describe("mirrors", func() {
+		var (
+			mirrorConn   *fake_distclient.FakeConn
+			mirrorFails  bool
+			dialFailures map[string]error
+		)
+
+		JustBeforeEach(func() {
+			mirrorFails = false
+			dialFailures = map[string]error{}
+
+			mirrorConn = new(fake_distclient.FakeConn)
+			mirrorConn.GetManifestStub = func(_ context.Context, _ lager.Logger, ref string, _ distclient.Platform) (*distclient.Manifest, error) {
+				if mirrorFails {
+					return nil, errors.New("mirror-exploded")
+				}
+
+				return manifests[ref], nil
+			}
+			mirrorConn.GetBlobReaderStub = func(_ context.Context, _ lager.Logger, d digest.Digest) (io.Reader, error) {
+				if mirrorFails || d == "klm-nop" {
+					return nil, errors.New("mirror-does-not-have-blob")
+				}
+
+				return bytes.NewReader([]byte(blobs[d])), nil
+			}
+
+			fakeDialer.DialStub = func(_ context.Context, _ lager.Logger, host, repo string, _ distclient.Credentials) (distclient.Conn, error) {
+				if err, ok := dialFailures[host]; ok {
+					return nil, err
+				}
+
+				if host == "mirror.example.com" {
+					return mirrorConn, nil
+				}
+
+				return fakeConn, nil
+			}
+
+			remote.Mirrors = map[string][]string{
+				"registry-1.docker.io": {"unreachable-mirror.example.com", "mirror.example.com"},
+			}
+			dialFailures["unreachable-mirror.example.com"] = errors.New("connection-refused")
+		})
+
+		It("fetches the manifest from the first mirror which can serve it", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mirrorConn.GetManifestCallCount()).To(Equal(1))
+			Expect(fakeConn.GetManifestCallCount()).To(Equal(0))
+		})
+
+		It("dials each mirror at most once per fetch", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			var unreachableDials int
+			for i := 0; i < fakeDialer.DialCallCount(); i++ {
+				if _, _, host, _, _ := fakeDialer.DialArgsForCall(i); host == "unreachable-mirror.example.com" {
+					unreachableDials++
+				}
+			}
+			Expect(unreachableDials).To(Equal(1))
+		})
+
+		It("falls back to the upstream for blobs the mirrors do not have", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mirrorConn.GetBlobReaderCallCount()).To(Equal(3))
+			Expect(fakeConn.GetBlobReaderCallCount()).To(Equal(1))
+			_, _, d := fakeConn.GetBlobReaderArgsForCall(0)
+			Expect(d).To(BeEquivalentTo("klm-nop"))
+		})
+
+		It("registers the layers exactly as if they came from the upstream", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCake.RegisterCallCount()).To(Equal(3))
+			img, reader := fakeCake.RegisterArgsForCall(0)
+			Expect(img.ID).To(Equal("abc-id"))
+			Expect(ioutil.ReadAll(reader)).To(Equal([]byte("abc-def-contents")))
+		})
+
+		It("logs which endpoint served each blob", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger).To(gbytes.Say(`"endpoint":"mirror.example.com","for":"blob"`))
+			Expect(logger).To(gbytes.Say(`"endpoint":"registry-1.docker.io","for":"blob"`))
+		})
+
+		It("only sends the credentials to the upstream", func() {
+			creds := distclient.Credentials{Username: "user", Password: "pass"}
+			mirrorFails = true
+
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), creds, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < fakeDialer.DialCallCount(); i++ {
+				_, _, host, _, dialedCreds := fakeDialer.DialArgsForCall(i)
+				if host == "registry-1.docker.io" {
+					Expect(dialedCreds).To(Equal(creds))
+				} else {
+					Expect(dialedCreds.Empty()).To(BeTrue())
+				}
+			}
+		})
+
+		Context("when none of the mirrors can serve the manifest", func() {
+			It("falls back to the upstream", func() {
+				mirrorFails = true
+
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeConn.GetManifestCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the upstream fails too", func() {
+			It("returns the upstream's error", func() {
+				mirrorFails = true
+				dialFailures["registry-1.docker.io"] = errors.New("upstream-exploded")
+
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).To(MatchError(ContainSubstring("upstream-exploded")))
+			})
+		})
+
+		Context("when the registry has no mirrors", func() {
+			It("goes straight to the registry", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker://other-registry.example.com/foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeDialer.DialCallCount()).To(Equal(1))
+				_, _, host, _, _ := fakeDialer.DialArgsForCall(0)
+				Expect(host).To(Equal("other-registry.example.com"))
+			})
+		})
+	})
+
+	Describe("cancellation", func() {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		It("passes the context to the registry", func() {
+			_, err := remote.Fetch(ctx, logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+			Expect(err).NotTo(HaveOccurred())
+
+			dialCtx, _, _, _, _ := fakeDialer.DialArgsForCall(0)
+			Expect(dialCtx).To(Equal(ctx))
+
+			manifestCtx, _, _, _ := fakeConn.GetManifestArgsForCall(0)
+			Expect(manifestCtx).To(Equal(ctx))
+
+			blobCtx, _, _ := fakeConn.GetBlobReaderArgsForCall(0)
+			Expect(blobCtx).To(Equal(ctx))
+		})
+
+		Context("when the context is already cancelled", func() {
+			It("does not download any layers", func() {
+				cancel()
+
+				_, err := remote.Fetch(ctx, logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).To(Equal(context.Canceled))
+				Expect(fakeConn.GetBlobReaderCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the context is cancelled while a layer is being registered", func() {
+			JustBeforeEach(func() {
+				fakeCake.RegisterStub = func(img *image.Image, _ archive.ArchiveReader) error {
+					if img.ID == "ghj-id" {
+						cancel()
+						return errors.New("read: request canceled")
+					}
+
+					return nil
+				}
+			})
+
+			It("returns the cancellation error", func() {
+				_, err := remote.Fetch(ctx, logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+				Expect(err).To(Equal(context.Canceled))
+			})
+
+			It("removes the partially registered layer", func() {
+				remote.Fetch(ctx, logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+
+				Expect(fakeCake.RemoveCallCount()).To(Equal(1))
+				Expect(fakeCake.RemoveArgsForCall(0)).To(Equal(layercake.DockerImageID("ghj-id")))
+			})
+
+			It("keeps the layers which were completely registered", func() {
+				remote.Fetch(ctx, logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
+
+				Expect(fakeCake.RegisterCallCount()).To(Equal(2))
+				Expect(fakeCake.RemoveCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("parallel layer downloads", func() {
+		var (
+			mu             sync.Mutex
+			inFlight       int
+			maxInFlight    int
+			releaseBlobs   chan struct{}
+			registeredIDs  []string
+			manyLayerImage *distclient.Manifest
+		)
+
+		JustBeforeEach(func() {
+			inFlight, maxInFlight = 0, 0
+			registeredIDs = nil
+			releaseBlobs = make(chan struct{})
+
+			manyLayerImage = &distclient.Manifest{}
+			parent := digest.Digest("")
+			for _, name := range []string{"l1", "l2", "l3", "l4", "l5"} {
+				id := digest.Digest("sha256:" + name + "-id")
+				manyLayerImage.Layers = append(manyLayerImage.Layers, distclient.Layer{
+					BlobSum:        digest.Digest(name),
+					StrongID:       id,
+					ParentStrongID: parent,
+				})
+				parent = id
+			}
+			manifests["many-layers"] = manyLayerImage
+
+			fakeConn.GetBlobReaderStub = func(_ context.Context, _ lager.Logger, d digest.Digest) (io.Reader, error) {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				<-releaseBlobs
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+
+				return bytes.NewReader([]byte(d)), nil
+			}
+
+			fakeCake.RegisterStub = func(img *image.Image, _ archive.ArchiveReader) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				registeredIDs = append(registeredIDs, img.ID)
+				return nil
+			}
+		})
+
+		It("downloads up to the configured number of layers at once", func() {
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#many-layers"), distclient.Credentials{}, 0)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			Eventually(func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return inFlight
+			}).Should(Equal(2))
+			Consistently(func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return inFlight
+			}).Should(Equal(2))
+
+			close(releaseBlobs)
+			Eventually(done).Should(BeClosed())
+
+			Expect(maxInFlight).To(Equal(2))
+		})
+
+		It("keeps a layer's download slot until its blob has been read", func() {
+			close(releaseBlobs)
+
+			registering := make(chan struct{})
+			fakeCake.RegisterStub = func(img *image.Image, _ archive.ArchiveReader) error {
+				if img.ID == "l1-id" {
+					<-registering
+				}
+
+				return nil
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#many-layers"), distclient.Credentials{}, 0)
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			Eventually(fakeConn.GetBlobReaderCallCount).Should(Equal(2))
+			Consistently(fakeConn.GetBlobReaderCallCount).Should(Equal(2))
+
+			close(registering)
+			Eventually(done).Should(BeClosed())
+			Expect(fakeConn.GetBlobReaderCallCount()).To(Equal(5))
+		})
+
+		It("registers the layers parent first", func() {
+			close(releaseBlobs)
+
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#many-layers"), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(registeredIDs).To(Equal([]string{"l1-id", "l2-id", "l3-id", "l4-id", "l5-id"}))
+		})
+
+		Context("when a layer fails to download", func() {
+			JustBeforeEach(func() {
+				close(releaseBlobs)
+
+				fakeConn.GetBlobReaderStub = func(_ context.Context, _ lager.Logger, d digest.Digest) (io.Reader, error) {
+					if d == "l2" {
+						return nil, errors.New("l2-exploded")
+					}
+
+					return bytes.NewReader([]byte(d)), nil
+				}
+			})
+
+			It("returns the error", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#many-layers"), distclient.Credentials{}, 0)
+				Expect(err).To(MatchError("l2-exploded"))
+			})
+
+			It("does not register any of its children", func() {
+				remote.Fetch(context.Background(), logger, parseURL("docker:///foo#many-layers"), distclient.Credentials{}, 0)
+				Expect(registeredIDs).To(Equal([]string{"l1-id"}))
+			})
+		})
+
+		Context("when a layer fails while its parent is still downloading", func() {
+			var parentFinished chan struct{}
+
+			JustBeforeEach(func() {
+				close(releaseBlobs)
+				parentFinished = make(chan struct{})
+
+				fakeConn.GetBlobReaderStub = func(ctx context.Context, _ lager.Logger, d digest.Digest) (io.Reader, error) {
+					switch d {
+					case "l1":
+						<-ctx.Done()
+						close(parentFinished)
+						return nil, ctx.Err()
+					case "l2":
+						return nil, errors.New("l2-exploded")
+					}
+
+					return bytes.NewReader([]byte(d)), nil
+				}
+			})
+
+			It("cancels the parent and waits for it before returning the error", func() {
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#many-layers"), distclient.Credentials{}, 0)
+				Expect(err).To(MatchError("l2-exploded"))
+				Expect(parentFinished).To(BeClosed())
+			})
+		})
+
+		Context("when no limit is given", func() {
+			It("uses the default", func() {
+				r := repository_fetcher.NewRemote(defaultDockerRegistryHost, fakeCake, fakeDialer, fakeVerifier, 0)
+				Expect(r.MaxConcurrentDownloads).To(Equal(repository_fetcher.DefaultMaxConcurrentDownloads))
+			})
+		})
+	})
+
 	Describe("concurrently fetching", func() {
 		It("serializes calls to cake.get and getblobreader", func() {
 			for i := 1; i < 100; i++ {
@@ -323,7 +1182,7 @@ var _ = Describe("Fetching from a Remote repo", func() {
 					mu.RUnlock()
 
 					if had {
-						return nil, nil
+						return &image.Image{}, nil
 					}
 
 					return nil, errors.New("not found")
@@ -341,13 +1200,13 @@ var _ = Describe("Fetching from a Remote repo", func() {
 				wg.Add(2)
 				go func() {
 					defer wg.Done()
-					_, err := remote.Fetch(logger, parseURL("docker:///foo#some-tag"), 67)
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#some-tag"), distclient.Credentials{}, 67)
 					Expect(err).NotTo(HaveOccurred())
 				}()
 
 				go func() {
 					defer wg.Done()
-					_, err := remote.Fetch(logger, parseURL("docker:///foo#shared-layers"), 67)
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#shared-layers"), distclient.Credentials{}, 67)
 					Expect(err).NotTo(HaveOccurred())
 				}()
 
@@ -355,29 +1214,118 @@ var _ = Describe("Fetching from a Remote repo", func() {
 				Expect(fakeConn.GetBlobReaderCallCount()).To(Equal(4 * i))
 			}
 		})
+
+		It("only registers a layer once when images have different blobs for it", func() {
+			manifests["compressed-one-way"] = &distclient.Manifest{
+				Layers: []distclient.Layer{{BlobSum: "gzipped", StrongID: "sha256:same-id"}},
+			}
+			manifests["compressed-another-way"] = &distclient.Manifest{
+				Layers: []distclient.Layer{{BlobSum: "zstd", StrongID: "sha256:same-id"}},
+			}
+
+			registered := make(chan struct{})
+			fakeCake.GetStub = func(id layercake.ID) (*image.Image, error) {
+				select {
+				case <-registered:
+					return &image.Image{}, nil
+				default:
+					return nil, errors.New("not found")
+				}
+			}
+
+			releaseBlob := make(chan struct{})
+			fakeConn.GetBlobReaderStub = func(_ context.Context, _ lager.Logger, d digest.Digest) (io.Reader, error) {
+				<-releaseBlob
+				return bytes.NewReader([]byte(d)), nil
+			}
+
+			fakeCake.RegisterStub = func(img *image.Image, _ archive.ArchiveReader) error {
+				close(registered)
+				return nil
+			}
+
+			wg := new(sync.WaitGroup)
+			wg.Add(2)
+			for _, tag := range []string{"compressed-one-way", "compressed-another-way"} {
+				go func(tag string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///foo#"+tag), distclient.Credentials{}, 0)
+					Expect(err).NotTo(HaveOccurred())
+				}(tag)
+			}
+
+			Eventually(fakeConn.GetBlobReaderCallCount).Should(Equal(1))
+			Consistently(fakeConn.GetBlobReaderCallCount).Should(Equal(1))
+
+			close(releaseBlob)
+			wg.Wait()
+
+			Expect(fakeCake.RegisterCallCount()).To(Equal(1))
+		})
 	})
 
 	Context("when a disk quota is provided", func() {
 		Context("and the image is smaller than the quota", func() {
 			It("should succeed", func() {
-				_, err := remote.Fetch(logger, parseURL("docker:///banana#some-tag"), 3)
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///banana#some-tag"), distclient.Credentials{}, 3)
 				Expect(err).NotTo(HaveOccurred())
 			})
 		})
 
 		Context("and the image is bigger than the quota", func() {
 			It("should return an error", func() {
-				_, err := remote.Fetch(logger, parseURL("docker:///banana#some-tag"), 2)
+				_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///banana#some-tag"), distclient.Credentials{}, 2)
 				Expect(err).To(HaveOccurred())
 			})
 		})
 	})
 
 	It("returns the size of the image", func() {
-		image, err := remote.Fetch(logger, parseURL("docker:///banana#some-tag"), 3)
+		image, err := remote.Fetch(context.Background(), logger, parseURL("docker:///banana#some-tag"), distclient.Credentials{}, 3)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(image.Size).To(BeNumerically("==", 3))
 	})
+
+	Context("when the layers are bigger in the cake than in the manifest, as compressed schema2 layers are", func() {
+		JustBeforeEach(func() {
+			existingLayers["ghj-id"] = true
+
+			fakeCake.RegisterStub = func(img *image.Image, _ archive.ArchiveReader) error {
+				img.Size = 10
+				return nil
+			}
+		})
+
+		It("returns the size of the layers in the cake", func() {
+			image, err := remote.Fetch(context.Background(), logger, parseURL("docker:///banana#some-tag"), distclient.Credentials{}, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(image.Size).To(BeNumerically("==", 10+33+10))
+		})
+
+		It("fails when they do not fit in the quota after all", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///banana#some-tag"), distclient.Credentials{}, 50)
+			Expect(err).To(Equal(repository_fetcher.ErrQuotaExceeded))
+		})
+	})
+
+	Context("when the manifest has no layers", func() {
+		JustBeforeEach(func() {
+			manifests["empty"] = &distclient.Manifest{}
+		})
+
+		It("fails to fetch it", func() {
+			_, err := remote.Fetch(context.Background(), logger, parseURL("docker:///banana#empty"), distclient.Credentials{}, 0)
+			Expect(err).To(MatchError(ContainSubstring("has no layers")))
+			Expect(fakeConn.GetBlobReaderCallCount()).To(Equal(0))
+		})
+
+		It("fails to fetch its ID", func() {
+			_, err := remote.FetchID(logger, parseURL("docker:///banana#empty"))
+			Expect(err).To(MatchError(ContainSubstring("has no layers")))
+		})
+	})
 })
 
 func parseURL(u string) *url.URL {
@@ -389,10 +1337,11 @@ func parseURL(u string) *url.URL {
 
 type verified struct {
 	io.Reader
-	closed bool
+	closed   bool
+	closeErr error
 }
 
 func (v *verified) Close() error {
 	v.closed = true
-	return nil
+	return v.closeErr
 }
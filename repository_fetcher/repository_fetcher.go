@@ -5,10 +5,12 @@ import (
 	"io"
 	"net/url"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
 	"code.cloudfoundry.org/lager"
 	"github.com/docker/distribution"
 	"github.com/docker/docker/registry"
+	"golang.org/x/net/context"
 )
 
 //go:generate counterfeiter -o fake_lock/FakeLock.go . Lock
@@ -33,7 +35,7 @@ type RemoteFetcher interface {
 
 //go:generate counterfeiter . RepositoryFetcher
 type RepositoryFetcher interface {
-	Fetch(log lager.Logger, u *url.URL, diskQuota int64) (*Image, error)
+	Fetch(ctx context.Context, log lager.Logger, u *url.URL, creds distclient.Credentials, diskQuota int64) (*Image, error)
 	FetchID(log lager.Logger, u *url.URL) (layercake.ID, error)
 }
 
@@ -53,6 +55,25 @@ type Image struct {
 	Env     []string
 	Volumes []string
 	Size    int64
+	Config  ImageConfig
+}
+
+// Environment returns the environment of the image by name.
+func (i *Image) Environment() Env {
+	return MergeEnv(i.Env)
+}
+
+// ImageConfig is how an image asks to be run, taken from the top-most
+// config of the image.
+type ImageConfig struct {
+	Entrypoint   []string
+	Cmd          []string
+	User         string
+	WorkingDir   string
+	ExposedPorts []string
+	StopSignal   string
+	Healthcheck  *distclient.Healthcheck
+	Labels       map[string]string
 }
 
 var ErrInvalidDockerURL = errors.New("invalid docker url")
@@ -7,15 +7,18 @@ import (
 	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
 	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
 )
 
 type FakeDialer struct {
-	DialStub        func(logger lager.Logger, host, repo string) (distclient.Conn, error)
+	DialStub        func(ctx context.Context, logger lager.Logger, host string, repo string, creds distclient.Credentials) (distclient.Conn, error)
 	dialMutex       sync.RWMutex
 	dialArgsForCall []struct {
+		ctx    context.Context
 		logger lager.Logger
 		host   string
 		repo   string
+		creds  distclient.Credentials
 	}
 	dialReturns struct {
 		result1 distclient.Conn
@@ -25,17 +28,19 @@ type FakeDialer struct {
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeDialer) Dial(logger lager.Logger, host string, repo string) (distclient.Conn, error) {
+func (fake *FakeDialer) Dial(ctx context.Context, logger lager.Logger, host string, repo string, creds distclient.Credentials) (distclient.Conn, error) {
 	fake.dialMutex.Lock()
 	fake.dialArgsForCall = append(fake.dialArgsForCall, struct {
+		ctx    context.Context
 		logger lager.Logger
 		host   string
 		repo   string
-	}{logger, host, repo})
-	fake.recordInvocation("Dial", []interface{}{logger, host, repo})
+		creds  distclient.Credentials
+	}{ctx, logger, host, repo, creds})
+	fake.recordInvocation("Dial", []interface{}{ctx, logger, host, repo, creds})
 	fake.dialMutex.Unlock()
 	if fake.DialStub != nil {
-		return fake.DialStub(logger, host, repo)
+		return fake.DialStub(ctx, logger, host, repo, creds)
 	}
 	return fake.dialReturns.result1, fake.dialReturns.result2
 }
@@ -46,10 +51,10 @@ func (fake *FakeDialer) DialCallCount() int {
 	return len(fake.dialArgsForCall)
 }
 
-func (fake *FakeDialer) DialArgsForCall(i int) (lager.Logger, string, string) {
+func (fake *FakeDialer) DialArgsForCall(i int) (context.Context, lager.Logger, string, string, distclient.Credentials) {
 	fake.dialMutex.RLock()
 	defer fake.dialMutex.RUnlock()
-	return fake.dialArgsForCall[i].logger, fake.dialArgsForCall[i].host, fake.dialArgsForCall[i].repo
+	return fake.dialArgsForCall[i].ctx, fake.dialArgsForCall[i].logger, fake.dialArgsForCall[i].host, fake.dialArgsForCall[i].repo, fake.dialArgsForCall[i].creds
 }
 
 func (fake *FakeDialer) DialReturns(result1 distclient.Conn, result2 error) {
@@ -5,17 +5,21 @@ import (
 	"net/url"
 	"sync"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
 	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
 )
 
 type FakeRepositoryFetcher struct {
-	FetchStub        func(log lager.Logger, u *url.URL, diskQuota int64) (*repository_fetcher.Image, error)
+	FetchStub        func(ctx context.Context, log lager.Logger, u *url.URL, creds distclient.Credentials, diskQuota int64) (*repository_fetcher.Image, error)
 	fetchMutex       sync.RWMutex
 	fetchArgsForCall []struct {
+		ctx       context.Context
 		log       lager.Logger
 		u         *url.URL
+		creds     distclient.Credentials
 		diskQuota int64
 	}
 	fetchReturns struct {
@@ -36,17 +40,19 @@ type FakeRepositoryFetcher struct {
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeRepositoryFetcher) Fetch(log lager.Logger, u *url.URL, diskQuota int64) (*repository_fetcher.Image, error) {
+func (fake *FakeRepositoryFetcher) Fetch(ctx context.Context, log lager.Logger, u *url.URL, creds distclient.Credentials, diskQuota int64) (*repository_fetcher.Image, error) {
 	fake.fetchMutex.Lock()
 	fake.fetchArgsForCall = append(fake.fetchArgsForCall, struct {
+		ctx       context.Context
 		log       lager.Logger
 		u         *url.URL
+		creds     distclient.Credentials
 		diskQuota int64
-	}{log, u, diskQuota})
-	fake.recordInvocation("Fetch", []interface{}{log, u, diskQuota})
+	}{ctx, log, u, creds, diskQuota})
+	fake.recordInvocation("Fetch", []interface{}{ctx, log, u, creds, diskQuota})
 	fake.fetchMutex.Unlock()
 	if fake.FetchStub != nil {
-		return fake.FetchStub(log, u, diskQuota)
+		return fake.FetchStub(ctx, log, u, creds, diskQuota)
 	}
 	return fake.fetchReturns.result1, fake.fetchReturns.result2
 }
@@ -57,10 +63,10 @@ func (fake *FakeRepositoryFetcher) FetchCallCount() int {
 	return len(fake.fetchArgsForCall)
 }
 
-func (fake *FakeRepositoryFetcher) FetchArgsForCall(i int) (lager.Logger, *url.URL, int64) {
+func (fake *FakeRepositoryFetcher) FetchArgsForCall(i int) (context.Context, lager.Logger, *url.URL, distclient.Credentials, int64) {
 	fake.fetchMutex.RLock()
 	defer fake.fetchMutex.RUnlock()
-	return fake.fetchArgsForCall[i].log, fake.fetchArgsForCall[i].u, fake.fetchArgsForCall[i].diskQuota
+	return fake.fetchArgsForCall[i].ctx, fake.fetchArgsForCall[i].log, fake.fetchArgsForCall[i].u, fake.fetchArgsForCall[i].creds, fake.fetchArgsForCall[i].diskQuota
 }
 
 func (fake *FakeRepositoryFetcher) FetchReturns(result1 *repository_fetcher.Image, result2 error) {
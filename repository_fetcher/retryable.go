@@ -2,52 +2,99 @@ package repository_fetcher
 
 import (
 	"net/url"
+	"time"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/pkg/retrier"
 	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
 )
 
 const MAX_ATTEMPTS = 3
 
+// DefaultBackoff is used between attempts when a Retryable has no Backoff.
+var DefaultBackoff = retrier.Backoff{
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Jitter:       0.5,
+	MaxWait:      5 * time.Minute,
+}
+
 type Retryable struct {
 	RepositoryFetcher interface {
-		Fetch(lager.Logger, *url.URL, int64) (*Image, error)
+		Fetch(context.Context, lager.Logger, *url.URL, distclient.Credentials, int64) (*Image, error)
 		FetchID(lager.Logger, *url.URL) (layercake.ID, error)
 	}
+
+	// Attempts is how many times a fetch is tried before giving up,
+	// MAX_ATTEMPTS if zero.
+	Attempts int
+
+	// Backoff controls the delay between attempts, DefaultBackoff if nil.
+	Backoff *retrier.Backoff
 }
 
-func (retryable Retryable) Fetch(log lager.Logger, repoName *url.URL, diskQuota int64) (*Image, error) {
-	var err error
+func (retryable Retryable) Fetch(ctx context.Context, log lager.Logger, repoName *url.URL, creds distclient.Credentials, diskQuota int64) (*Image, error) {
 	var response *Image
-	for attempt := 1; attempt <= MAX_ATTEMPTS; attempt++ {
-		response, err = retryable.RepositoryFetcher.Fetch(log, repoName, diskQuota)
-		if err == nil {
-			break
-		}
+	err := retryable.retry(ctx, log, "failed-to-fetch", func() (err error) {
+		response, err = retryable.RepositoryFetcher.Fetch(ctx, log, repoName, creds, diskQuota)
+		return err
+	})
 
-		log.Error("failed-to-fetch", err, lager.Data{
-			"attempt": attempt,
-			"of":      MAX_ATTEMPTS,
-		})
+	if err != nil && ctx.Err() != nil {
+		log.Error("fetch-cancelled", err)
+		return nil, ctx.Err()
 	}
 
 	return response, err
 }
 
 func (retryable Retryable) FetchID(log lager.Logger, repoURL *url.URL) (layercake.ID, error) {
-	var err error
 	var response layercake.ID
-	for attempt := 1; attempt <= MAX_ATTEMPTS; attempt++ {
+	err := retryable.retry(context.Background(), log, "failed-to-fetch-ID", func() (err error) {
 		response, err = retryable.RepositoryFetcher.FetchID(log, repoURL)
-		if err == nil {
-			break
+		return err
+	})
+
+	return response, err
+}
+
+func (retryable Retryable) retry(ctx context.Context, log lager.Logger, failureMessage string, fn func() error) error {
+	attempts := retryable.Attempts
+	if attempts <= 0 {
+		attempts = MAX_ATTEMPTS
+	}
+
+	backoff := DefaultBackoff
+	if retryable.Backoff != nil {
+		backoff = *retryable.Backoff
+	}
+
+	return backoff.Retry(ctx, attempts, classify, func(attempt int) error {
+		err := fn()
+		if err != nil && ctx.Err() == nil {
+			log.Error(failureMessage, err, lager.Data{
+				"attempt": attempt,
+				"of":      attempts,
+				"class":   distclient.Classify(err).String(),
+			})
 		}
 
-		log.Error("failed-to-fetch-ID", err, lager.Data{
-			"attempt": attempt,
-			"of":      MAX_ATTEMPTS,
-		})
+		return err
+	})
+}
+
+// classify retries everything but errors which will certainly happen again,
+// waiting as long as a throttling registry asks.
+func classify(err error) (bool, time.Duration) {
+	if err == ErrQuotaExceeded {
+		return false, 0
 	}
 
-	return response, err
+	if distclient.Classify(err) == distclient.Permanent {
+		return false, 0
+	}
+
+	return true, distclient.RetryAfter(err)
 }
@@ -2,15 +2,21 @@ package repository_fetcher_test
 
 import (
 	"errors"
+	"net/http"
 	"net/url"
+	"time"
 
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/pkg/retrier"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
 	fakes "code.cloudfoundry.org/garden-shed/repository_fetcher/repository_fetcherfakes"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"golang.org/x/net/context"
 )
 
 var _ = Describe("Retryable", func() {
@@ -32,13 +38,14 @@ var _ = Describe("Retryable", func() {
 
 		retryable = repository_fetcher.Retryable{
 			RepositoryFetcher: fakeRemoteFetcher,
+			Backoff:           &retrier.Backoff{},
 		}
 	})
 
 	Describe("Fetch failures", func() {
 		Context("when fetching fails twice", func() {
 			BeforeEach(func() {
-				fakeRemoteFetcher.FetchStub = func(log lager.Logger, u *url.URL, diskQuota int64) (*repository_fetcher.Image, error) {
+				fakeRemoteFetcher.FetchStub = func(ctx context.Context, log lager.Logger, u *url.URL, creds distclient.Credentials, diskQuota int64) (*repository_fetcher.Image, error) {
 					if fakeRemoteFetcher.FetchCallCount() <= 2 {
 						return nil, errors.New("error-talking-to-remote-repo")
 					} else {
@@ -46,7 +53,7 @@ var _ = Describe("Retryable", func() {
 					}
 				}
 
-				_, err := retryable.Fetch(logger, repoURL, 0)
+				_, err := retryable.Fetch(context.Background(), logger, repoURL, distclient.Credentials{}, 0)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
@@ -59,12 +66,94 @@ var _ = Describe("Retryable", func() {
 			})
 		})
 
+		Context("when the context is cancelled", func() {
+			It("does not retry", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				fakeRemoteFetcher.FetchStub = func(context.Context, lager.Logger, *url.URL, distclient.Credentials, int64) (*repository_fetcher.Image, error) {
+					cancel()
+					return nil, errors.New("request-canceled")
+				}
+
+				_, err := retryable.Fetch(ctx, logger, repoURL, distclient.Credentials{}, 0)
+				Expect(err).To(Equal(context.Canceled))
+				Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the error is permanent", func() {
+			It("does not retry", func() {
+				fakeRemoteFetcher.FetchReturns(nil, &distclient.StatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"})
+
+				_, err := retryable.Fetch(context.Background(), logger, repoURL, distclient.Credentials{}, 0)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the image is too big for the quota", func() {
+			It("does not retry", func() {
+				fakeRemoteFetcher.FetchReturns(nil, repository_fetcher.ErrQuotaExceeded)
+
+				_, err := retryable.Fetch(context.Background(), logger, repoURL, distclient.Credentials{}, 0)
+				Expect(err).To(Equal(repository_fetcher.ErrQuotaExceeded))
+				Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the number of attempts is configured", func() {
+			It("tries that many times", func() {
+				retryable.Attempts = 5
+				fakeRemoteFetcher.FetchReturns(nil, errors.New("error-talking-to-remote-repo"))
+
+				_, err := retryable.Fetch(context.Background(), logger, repoURL, distclient.Credentials{}, 0)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(5))
+			})
+		})
+
+		Context("when the registry is throttling requests", func() {
+			var fakeClock *fakeclock.FakeClock
+
+			BeforeEach(func() {
+				fakeClock = fakeclock.NewFakeClock(time.Now())
+				retryable.Backoff = &retrier.Backoff{InitialDelay: time.Second, Clock: fakeClock}
+
+				fakeRemoteFetcher.FetchStub = func(context.Context, lager.Logger, *url.URL, distclient.Credentials, int64) (*repository_fetcher.Image, error) {
+					if fakeRemoteFetcher.FetchCallCount() == 1 {
+						return nil, &distclient.StatusError{
+							StatusCode: http.StatusTooManyRequests,
+							Status:     "429 Too Many Requests",
+							RetryAfter: time.Minute,
+						}
+					}
+
+					return &repository_fetcher.Image{}, nil
+				}
+			})
+
+			It("waits for as long as the registry asks before retrying", func() {
+				errs := make(chan error)
+				go func() {
+					defer GinkgoRecover()
+					_, err := retryable.Fetch(context.Background(), logger, repoURL, distclient.Credentials{}, 0)
+					errs <- err
+				}()
+
+				fakeClock.WaitForWatcherAndIncrement(59 * time.Second)
+				Consistently(fakeRemoteFetcher.FetchCallCount).Should(Equal(1))
+
+				fakeClock.Increment(time.Second)
+				Eventually(errs).Should(Receive(BeNil()))
+				Expect(fakeRemoteFetcher.FetchCallCount()).To(Equal(2))
+			})
+		})
+
 		Context("when fetching fails three times", func() {
 			BeforeEach(func() {
-				fakeRemoteFetcher.FetchStub = func(log lager.Logger, u *url.URL, diskQuota int64) (*repository_fetcher.Image, error) {
+				fakeRemoteFetcher.FetchStub = func(ctx context.Context, log lager.Logger, u *url.URL, creds distclient.Credentials, diskQuota int64) (*repository_fetcher.Image, error) {
 					return nil, errors.New("error-talking-to-remote-repo")
 				}
-				_, err := retryable.Fetch(logger, repoURL, 0)
+				_, err := retryable.Fetch(context.Background(), logger, repoURL, distclient.Credentials{}, 0)
 				Expect(err).To(HaveOccurred())
 			})
 
@@ -0,0 +1,92 @@
+package repository_fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// ErrZstdNotFound is returned for a zstd compressed rootfs tarball when the
+// zstd command is not in $PATH.
+var ErrZstdNotFound = errors.New("repository_fetcher: zstd compressed tarballs need the zstd command, which was not found in $PATH")
+
+// openTarball streams the uncompressed contents of a rootfs tarball. The
+// compression is detected from the contents rather than the extension:
+// gzip, bzip2 and xz are handled by archive.DecompressStream, and zstd, like
+// xz, by the command line tool, which must be installed to use them.
+func openTarball(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bufio.NewReader(f)
+	header, err := buf.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+
+	var stream io.ReadCloser
+	if bytes.Equal(header, zstdMagic) {
+		if _, err := exec.LookPath("zstd"); err != nil {
+			f.Close()
+			return nil, ErrZstdNotFound
+		}
+
+		stream = decompressZstd(buf)
+	} else if stream, err = archive.DecompressStream(buf); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &tarball{ReadCloser: stream, file: f}, nil
+}
+
+type tarball struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (t *tarball) Close() error {
+	err := t.ReadCloser.Close()
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func decompressZstd(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("zstd", "-d", "-c", "-q")
+	cmd.Stdin = r
+	cmd.Stdout = pw
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		pw.CloseWithError(fmt.Errorf("zstd: %s", err))
+		return pr
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			pw.CloseWithError(fmt.Errorf("zstd: %s: %s", err, stderr))
+			return
+		}
+
+		pw.Close()
+	}()
+
+	return pr
+}
@@ -9,6 +9,14 @@ import (
 	"github.com/docker/distribution/digest"
 )
 
+var ErrDigestMismatch = errors.New("digest verification failed")
+
+var ErrNotVerified = errors.New("blob was closed before it could be verified")
+
+// Verifier returns a reader for a blob which has been, or will be, checked
+// against its digest. If Close of the returned reader fails the data read
+// could not be verified, and anything created from it must be thrown away.
+//
 //go:generate counterfeiter . Verifier
 type Verifier interface {
 	Verify(io.Reader, digest.Digest) (io.ReadCloser, error)
@@ -22,31 +30,57 @@ var DefaultVerifier = VerifyFunc(Verify)
 // The caller is responsible for closing the returned reader, in order to
 // ensure the temporary file is deleted.
 func Verify(r io.Reader, d digest.Digest) (io.ReadCloser, error) {
+	return TempFileVerifier{}.Verify(r, d)
+}
+
+// TempFileVerifier verifies blobs by spilling them to a temporary file in
+// Dir, or the default temporary directory if Dir is empty. Placing Dir under
+// the graph root keeps the copy on the same filesystem as the layers.
+type TempFileVerifier struct {
+	Dir string
+}
+
+func (v TempFileVerifier) Verify(r io.Reader, d digest.Digest) (io.ReadCloser, error) {
 	w, err := digest.NewDigestVerifier(d)
 	if err != nil {
 		return nil, err
 	}
 
-	tmp, err := ioutil.TempFile("", "unverified-layer")
+	if v.Dir != "" {
+		if err := os.MkdirAll(v.Dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(v.Dir, "unverified-layer")
 	if err != nil {
 		return nil, err
 	}
 
+	verified := &deleteCloser{tmp}
+
 	_, err = io.Copy(io.MultiWriter(w, tmp), r)
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+
 	if err != nil {
+		verified.Close()
 		return nil, err
 	}
 
 	if !w.Verified() {
-		return nil, errors.New("digest verification failed")
+		verified.Close()
+		return nil, ErrDigestMismatch
 	}
 
 	_, err = tmp.Seek(0, 0)
 	if err != nil {
+		verified.Close()
 		return nil, err
 	}
 
-	return &deleteCloser{tmp}, nil
+	return verified, nil
 }
 
 type deleteCloser struct {
@@ -54,9 +88,66 @@ type deleteCloser struct {
 }
 
 func (dc *deleteCloser) Close() error {
+	dc.File.Close()
 	return os.Remove(dc.File.Name())
 }
 
+// StreamingVerifier hands out the blob without copying it anywhere, hashing
+// it as it is read. Reading to the end of a blob which does not match its
+// digest fails with ErrDigestMismatch. Close does not read the remainder, so
+// that an aborted download stops straight away; it returns ErrNotVerified
+// unless the blob was read to the end, and then ErrDigestMismatch if it did
+// not match.
+type StreamingVerifier struct{}
+
+func (StreamingVerifier) Verify(r io.Reader, d digest.Digest) (io.ReadCloser, error) {
+	w, err := digest.NewDigestVerifier(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamingReader{
+		source:   r,
+		tee:      io.TeeReader(r, w),
+		verifier: w,
+	}, nil
+}
+
+type streamingReader struct {
+	source   io.Reader
+	tee      io.Reader
+	verifier digest.Verifier
+	eof      bool
+}
+
+func (s *streamingReader) Read(p []byte) (int, error) {
+	n, err := s.tee.Read(p)
+	if err == io.EOF {
+		s.eof = true
+		if !s.verifier.Verified() {
+			return n, ErrDigestMismatch
+		}
+	}
+
+	return n, err
+}
+
+func (s *streamingReader) Close() error {
+	if closer, ok := s.source.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if !s.eof {
+		return ErrNotVerified
+	}
+
+	if !s.verifier.Verified() {
+		return ErrDigestMismatch
+	}
+
+	return nil
+}
+
 type VerifyFunc func(io.Reader, digest.Digest) (io.ReadCloser, error)
 
 func (fn VerifyFunc) Verify(r io.Reader, d digest.Digest) (io.ReadCloser, error) {
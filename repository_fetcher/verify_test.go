@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
 	"github.com/docker/distribution/digest"
@@ -38,3 +41,111 @@ var _ = Describe("Verifying a digest", func() {
 		})
 	})
 })
+
+var _ = Describe("TempFileVerifier", func() {
+	var (
+		spillDir string
+		verifier repository_fetcher.TempFileVerifier
+	)
+
+	BeforeEach(func() {
+		tmp, err := ioutil.TempDir("", "graph-root")
+		Expect(err).NotTo(HaveOccurred())
+
+		spillDir = filepath.Join(tmp, "tmp")
+		verifier = repository_fetcher.TempFileVerifier{Dir: spillDir}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(filepath.Dir(spillDir))).To(Succeed())
+	})
+
+	It("spills the blob in to the given directory", func() {
+		r, err := verifier.Verify(bytes.NewReader([]byte("matches")), shaThatDoesMatch)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ioutil.ReadDir(spillDir)).To(HaveLen(1))
+		Expect(ioutil.ReadAll(r)).To(Equal([]byte("matches")))
+	})
+
+	It("removes the spilled file when the reader is closed", func() {
+		r, err := verifier.Verify(bytes.NewReader([]byte("matches")), shaThatDoesMatch)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Close()).To(Succeed())
+
+		Expect(ioutil.ReadDir(spillDir)).To(BeEmpty())
+	})
+
+	Context("when the digest does not match", func() {
+		It("does not leave the spilled file behind", func() {
+			_, err := verifier.Verify(bytes.NewReader([]byte("does-not-match")), someShaThatDoesntMatch)
+			Expect(err).To(Equal(repository_fetcher.ErrDigestMismatch))
+
+			Expect(ioutil.ReadDir(spillDir)).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("StreamingVerifier", func() {
+	var verifier repository_fetcher.StreamingVerifier
+
+	Context("when the digest matches", func() {
+		It("allows reading the original data", func() {
+			r, err := verifier.Verify(bytes.NewReader([]byte("matches")), shaThatDoesMatch)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.ReadAll(r)).To(Equal([]byte("matches")))
+			Expect(r.Close()).To(Succeed())
+		})
+
+		It("cannot verify the blob when closed before reaching the end", func() {
+			r, err := verifier.Verify(bytes.NewReader([]byte("matches")), shaThatDoesMatch)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = io.ReadFull(r, make([]byte, 3))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Close()).To(Equal(repository_fetcher.ErrNotVerified))
+		})
+
+		It("closes the source without reading the remainder", func() {
+			source := &closeRecorder{Reader: bytes.NewReader([]byte("matches"))}
+			r, err := verifier.Verify(source, shaThatDoesMatch)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = io.ReadFull(r, make([]byte, 3))
+			Expect(err).NotTo(HaveOccurred())
+			r.Close()
+
+			Expect(source.closed).To(BeTrue())
+			Expect(source.Len()).To(Equal(4))
+		})
+	})
+
+	Context("when the digest does not match", func() {
+		It("fails the read at the end of the data", func() {
+			r, err := verifier.Verify(bytes.NewReader([]byte("does-not-match")), someShaThatDoesntMatch)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = ioutil.ReadAll(r)
+			Expect(err).To(Equal(repository_fetcher.ErrDigestMismatch))
+		})
+
+		It("fails the close once the data has been read to the end", func() {
+			r, err := verifier.Verify(bytes.NewReader([]byte("does-not-match")), someShaThatDoesntMatch)
+			Expect(err).NotTo(HaveOccurred())
+
+			ioutil.ReadAll(r)
+			Expect(r.Close()).To(Equal(repository_fetcher.ErrDigestMismatch))
+		})
+	})
+})
+
+type closeRecorder struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
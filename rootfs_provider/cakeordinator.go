@@ -1,14 +1,15 @@
 package rootfs_provider
 
 import (
-	"errors"
 	"net/url"
 	"sync"
 
 	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
 	"code.cloudfoundry.org/lager"
+	"golang.org/x/net/context"
 )
 
 //go:generate counterfeiter . LayerCreator
@@ -18,7 +19,7 @@ type LayerCreator interface {
 
 //go:generate counterfeiter . RepositoryFetcher
 type RepositoryFetcher interface {
-	Fetch(log lager.Logger, rootfs *url.URL, diskQuota int64) (*repository_fetcher.Image, error)
+	Fetch(ctx context.Context, log lager.Logger, rootfs *url.URL, creds distclient.Credentials, diskQuota int64) (*repository_fetcher.Image, error)
 }
 
 //go:generate counterfeiter . GCer
@@ -54,7 +55,11 @@ func NewCakeOrdinator(cake layercake.Cake, fetcher RepositoryFetcher, layerCreat
 	}
 }
 
-func (c *CakeOrdinator) Create(logger lager.Logger, id string, spec Spec) (string, []string, error) {
+// Create fetches the rootfs of spec and creates the container layer on top of
+// it, returning the path of the layer along with the environment and run
+// config of the image. Cancelling ctx abandons the fetch, and no container
+// layer is created.
+func (c *CakeOrdinator) Create(ctx context.Context, logger lager.Logger, id string, spec Spec) (string, []string, repository_fetcher.ImageConfig, error) {
 	logger = logger.Session("create", lager.Data{"id": id})
 	logger.Info("start")
 	c.mu.RLock()
@@ -64,21 +69,24 @@ func (c *CakeOrdinator) Create(logger lager.Logger, id string, spec Spec) (strin
 	}()
 	logger.Info("lock-acquired")
 
-	if spec.Username != "" || spec.Password != "" {
-		return "", nil, errors.New("private docker registries are not supported")
-	}
-
 	fetcherDiskQuota := spec.QuotaSize
 	if spec.QuotaScope == garden.DiskLimitScopeExclusive {
 		fetcherDiskQuota = 0
 	}
 
-	image, err := c.fetcher.Fetch(logger, spec.RootFS, fetcherDiskQuota)
+	creds := distclient.Credentials{Username: spec.Username, Password: spec.Password}
+	image, err := c.fetcher.Fetch(ctx, logger, spec.RootFS, creds, fetcherDiskQuota)
 	if err != nil {
-		return "", nil, err
+		return "", nil, repository_fetcher.ImageConfig{}, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		logger.Info("cancelled-after-fetch")
+		return "", nil, repository_fetcher.ImageConfig{}, err
 	}
 
-	return c.layerCreator.Create(logger, id, image, spec)
+	rootfsPath, env, err := c.layerCreator.Create(logger, id, image, spec)
+	return rootfsPath, env, image.Config, err
 }
 
 func (c *CakeOrdinator) Metrics(logger lager.Logger, id string, _ bool) (garden.ContainerDiskStat, error) {
@@ -5,6 +5,7 @@ import (
 	"net/url"
 
 	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/garden-shed/distclient"
 	"code.cloudfoundry.org/garden-shed/layercake"
 	"code.cloudfoundry.org/garden-shed/layercake/fake_cake"
 	"code.cloudfoundry.org/garden-shed/repository_fetcher"
@@ -12,9 +13,11 @@ import (
 	fakes "code.cloudfoundry.org/garden-shed/rootfs_provider/rootfs_providerfakes"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
+	"golang.org/x/net/context"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("The Cake Co-ordinator", func() {
@@ -33,6 +36,7 @@ var _ = Describe("The Cake Co-ordinator", func() {
 		logger = lagertest.NewTestLogger("test")
 
 		fakeFetcher = new(fakes.FakeRepositoryFetcher)
+		fakeFetcher.FetchReturns(&repository_fetcher.Image{}, nil)
 
 		fakeLayerCreator = new(fakes.FakeLayerCreator)
 		fakeCake = new(fake_cake.FakeCake)
@@ -53,7 +57,7 @@ var _ = Describe("The Cake Co-ordinator", func() {
 					Namespaced: true,
 					QuotaSize:  55,
 				}
-				rootfsPath, envs, err := cakeOrdinator.Create(logger, "container-id", spec)
+				rootfsPath, envs, _, err := cakeOrdinator.Create(context.Background(), logger, "container-id", spec)
 				Expect(rootfsPath).To(Equal("potato"))
 				Expect(envs).To(Equal([]string{"foo=bar"}))
 				Expect(err).To(MatchError("cake"))
@@ -64,12 +68,36 @@ var _ = Describe("The Cake Co-ordinator", func() {
 				Expect(parentImage).To(Equal(image))
 				Expect(layerCreatorSpec).To(Equal(spec))
 			})
+
+			It("returns the run config of the image", func() {
+				fakeFetcher.FetchReturns(&repository_fetcher.Image{
+					ImageID: "my cool image",
+					Config: repository_fetcher.ImageConfig{
+						Entrypoint: []string{"/bin/sh", "-c"},
+						Cmd:        []string{"echo hi"},
+						User:       "vcap",
+						WorkingDir: "/home/vcap",
+					},
+				}, nil)
+				fakeLayerCreator.CreateReturns("potato", []string{"foo=bar"}, nil)
+
+				_, _, config, err := cakeOrdinator.Create(context.Background(), logger, "container-id", rootfs_provider.Spec{
+					RootFS: &url.URL{Path: "parent"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config).To(Equal(repository_fetcher.ImageConfig{
+					Entrypoint: []string{"/bin/sh", "-c"},
+					Cmd:        []string{"echo hi"},
+					User:       "vcap",
+					WorkingDir: "/home/vcap",
+				}))
+			})
 		})
 
 		Context("when fetching fails", func() {
 			It("returns an error", func() {
 				fakeFetcher.FetchReturns(nil, errors.New("amadeus"))
-				_, _, err := cakeOrdinator.Create(logger, "", rootfs_provider.Spec{
+				_, _, _, err := cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
 					RootFS:     nil,
 					Namespaced: true,
 					QuotaSize:  12,
@@ -80,7 +108,7 @@ var _ = Describe("The Cake Co-ordinator", func() {
 
 		Context("when the quota scope is exclusive", func() {
 			It("disables quota for the fetcher", func() {
-				_, _, err := cakeOrdinator.Create(logger, "", rootfs_provider.Spec{
+				_, _, _, err := cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
 					RootFS:     &url.URL{},
 					Namespaced: false,
 					QuotaSize:  33,
@@ -88,14 +116,14 @@ var _ = Describe("The Cake Co-ordinator", func() {
 				})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(fakeFetcher.FetchCallCount()).To(Equal(1))
-				_, _, diskQuota := fakeFetcher.FetchArgsForCall(0)
+				_, _, _, _, diskQuota := fakeFetcher.FetchArgsForCall(0)
 				Expect(diskQuota).To(BeNumerically("==", 0))
 			})
 		})
 
 		Context("when the quota scope is total", func() {
 			It("passes down the same quota number to the fetcher", func() {
-				_, _, err := cakeOrdinator.Create(logger, "", rootfs_provider.Spec{
+				_, _, _, err := cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
 					RootFS:     &url.URL{},
 					Namespaced: false,
 					QuotaSize:  33,
@@ -103,18 +131,60 @@ var _ = Describe("The Cake Co-ordinator", func() {
 				})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(fakeFetcher.FetchCallCount()).To(Equal(1))
-				_, _, diskQuota := fakeFetcher.FetchArgsForCall(0)
+				_, _, _, _, diskQuota := fakeFetcher.FetchArgsForCall(0)
 				Expect(diskQuota).To(BeNumerically("==", 33))
 			})
 		})
 
 		Context("when username or password is passed", func() {
-			It("returns an error", func() {
-				_, _, err := cakeOrdinator.Create(logger, "", rootfs_provider.Spec{
+			It("passes the credentials to the fetcher", func() {
+				_, _, _, err := cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
+					RootFS:   &url.URL{Scheme: "docker", Path: "private/image"},
 					Username: "rootfsuser",
 					Password: "secretpasswrd",
 				})
-				Expect(err).To(MatchError("private docker registries are not supported"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeFetcher.FetchCallCount()).To(Equal(1))
+				_, _, _, creds, _ := fakeFetcher.FetchArgsForCall(0)
+				Expect(creds).To(Equal(distclient.Credentials{Username: "rootfsuser", Password: "secretpasswrd"}))
+			})
+
+			It("does not log the credentials", func() {
+				cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
+					RootFS:   &url.URL{Scheme: "docker", Path: "private/image"},
+					Username: "rootfsuser",
+					Password: "secretpasswrd",
+				})
+
+				Expect(logger).NotTo(gbytes.Say("secretpasswrd"))
+			})
+		})
+
+		Describe("cancellation", func() {
+			It("passes the context to the fetcher", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				_, _, _, err := cakeOrdinator.Create(ctx, logger, "", rootfs_provider.Spec{RootFS: &url.URL{}})
+				Expect(err).NotTo(HaveOccurred())
+
+				fetchCtx, _, _, _, _ := fakeFetcher.FetchArgsForCall(0)
+				Expect(fetchCtx).To(Equal(ctx))
+			})
+
+			Context("when the context is cancelled while fetching", func() {
+				It("does not create a container layer", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					fakeFetcher.FetchStub = func(context.Context, lager.Logger, *url.URL, distclient.Credentials, int64) (*repository_fetcher.Image, error) {
+						cancel()
+						return &repository_fetcher.Image{ImageID: "some-image"}, nil
+					}
+
+					_, _, _, err := cakeOrdinator.Create(ctx, logger, "", rootfs_provider.Spec{RootFS: &url.URL{}})
+					Expect(err).To(Equal(context.Canceled))
+					Expect(fakeLayerCreator.CreateCallCount()).To(Equal(0))
+				})
 			})
 		})
 
@@ -198,7 +268,7 @@ var _ = Describe("The Cake Co-ordinator", func() {
 			go cakeOrdinator.GC(logger)
 			<-gcStarted
 
-			go cakeOrdinator.Create(logger, "", rootfs_provider.Spec{
+			go cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
 				RootFS:     &url.URL{},
 				Namespaced: false,
 				QuotaSize:  33,
@@ -212,17 +282,17 @@ var _ = Describe("The Cake Co-ordinator", func() {
 
 	It("allows concurrent creation as long as deletion is not ongoing", func() {
 		fakeBlocks := make(chan struct{})
-		fakeFetcher.FetchStub = func(lager.Logger, *url.URL, int64) (*repository_fetcher.Image, error) {
+		fakeFetcher.FetchStub = func(context.Context, lager.Logger, *url.URL, distclient.Credentials, int64) (*repository_fetcher.Image, error) {
 			<-fakeBlocks
-			return nil, nil
+			return &repository_fetcher.Image{}, nil
 		}
 
-		go cakeOrdinator.Create(logger, "", rootfs_provider.Spec{
+		go cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
 			RootFS:     &url.URL{},
 			Namespaced: false,
 			QuotaSize:  33,
 		})
-		go cakeOrdinator.Create(logger, "", rootfs_provider.Spec{
+		go cakeOrdinator.Create(context.Background(), logger, "", rootfs_provider.Spec{
 			RootFS:     &url.URL{},
 			Namespaced: false,
 			QuotaSize:  33,
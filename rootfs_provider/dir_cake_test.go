@@ -0,0 +1,103 @@
+package rootfs_provider_test
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/garden-shed/layercake"
+	"code.cloudfoundry.org/garden-shed/layercake/cleaner"
+	"code.cloudfoundry.org/garden-shed/repository_fetcher"
+	"code.cloudfoundry.org/garden-shed/rootfs_provider"
+	fakes "code.cloudfoundry.org/garden-shed/rootfs_provider/rootfs_providerfakes"
+	"code.cloudfoundry.org/lager/lagertest"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("The Cake Co-ordinator with a directory cake", func() {
+	var (
+		root   string
+		rootfs string
+		logger *lagertest.TestLogger
+
+		cake          *layercake.Store
+		cakeOrdinator *rootfs_provider.CakeOrdinator
+	)
+
+	BeforeEach(func() {
+		var err error
+		logger = lagertest.NewTestLogger("test")
+
+		root, err = ioutil.TempDir("", "dircake")
+		Expect(err).NotTo(HaveOccurred())
+
+		rootfs, err = ioutil.TempDir("", "rootfs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(rootfs, "etc", "config"), []byte("potato"), 0644)).To(Succeed())
+
+		cake = layercake.NewDirCake(root, layercake.CopyFiles)
+		fetcher := &repository_fetcher.Local{
+			Cake:       cake,
+			IDProvider: repository_fetcher.LayerIDProvider{},
+		}
+
+		cakeOrdinator = rootfs_provider.NewCakeOrdinator(
+			cake,
+			fetcher,
+			rootfs_provider.NewLayerCreator(cake, rootfs_provider.SimpleVolumeCreator{}, nil),
+			new(fakes.FakeMetricser),
+			cleaner.NewOvenCleaner(cleaner.NewRetainer(), cleaner.NewThreshold(0)),
+		)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+		Expect(os.RemoveAll(rootfs)).To(Succeed())
+	})
+
+	create := func(id string) string {
+		path, _, _, err := cakeOrdinator.Create(context.Background(), logger, id, rootfs_provider.Spec{
+			RootFS: &url.URL{Path: rootfs},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return path
+	}
+
+	It("creates container layers with the files of the rootfs", func() {
+		path := create("container-1")
+		Expect(ioutil.ReadFile(filepath.Join(path, "etc", "config"))).To(Equal([]byte("potato")))
+	})
+
+	It("gives each container its own copy of the rootfs", func() {
+		path1 := create("container-1")
+		path2 := create("container-2")
+
+		Expect(ioutil.WriteFile(filepath.Join(path1, "etc", "config"), []byte("changed"), 0644)).To(Succeed())
+		Expect(ioutil.ReadFile(filepath.Join(path2, "etc", "config"))).To(Equal([]byte("potato")))
+	})
+
+	It("imports the rootfs once", func() {
+		create("container-1")
+		create("container-2")
+
+		Expect(cake.All()).To(HaveLen(3))
+	})
+
+	It("removes the rootfs layer on GC once its containers are destroyed", func() {
+		path := create("container-1")
+
+		Expect(cakeOrdinator.GC(logger)).To(Succeed())
+		Expect(cake.All()).To(HaveLen(2))
+
+		Expect(cakeOrdinator.Destroy(logger, "container-1")).To(Succeed())
+		Expect(path).NotTo(BeADirectory())
+
+		Expect(cakeOrdinator.GC(logger)).To(Succeed())
+		Expect(cake.All()).To(BeEmpty())
+	})
+})